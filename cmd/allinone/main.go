@@ -0,0 +1,76 @@
+//go:build dev
+
+// all-in-one 模式: 一个进程内运行signal、register和sfu,
+// 服务发现、RPC/广播和存储都使用进程内实现, 不需要etcd、nats和redis, 只用于开发和CI,
+// 需要带dev构建标签编译, 避免进程内的redis进入生产环境
+package main
+
+import (
+	"flag"
+	"fmt"
+	"goRTCServer/pkg/bus"
+	"goRTCServer/pkg/discovery"
+	regConf "goRTCServer/server/register/conf"
+	regSrc "goRTCServer/server/register/src"
+	sfuConf "goRTCServer/server/sfu/conf"
+	sfuSrc "goRTCServer/server/sfu/src"
+	signalConf "goRTCServer/server/signal/conf"
+	signalSrc "goRTCServer/server/signal/src"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func showHelp() {
+	fmt.Printf("Usage:%s {params}\n", os.Args[0])
+	fmt.Println("      -signal {signal config file}")
+	fmt.Println("      -register {register config file}")
+	fmt.Println("      -sfu {sfu config file}")
+	fmt.Println("      -h (show help info)")
+}
+
+func main() {
+	signalCfg := flag.String("signal", "cfg/signal.toml", "signal config file")
+	registerCfg := flag.String("register", "cfg/register.toml", "register config file")
+	sfuCfg := flag.String("sfu", "cfg/sfu.toml", "sfu config file")
+	help := flag.Bool("h", false, "help info")
+	flag.Parse()
+	if *help {
+		showHelp()
+		return
+	}
+	if !regConf.Load(*registerCfg) || !sfuConf.Load(*sfuCfg) || !signalConf.Load(*signalCfg) {
+		showHelp()
+		os.Exit(-1)
+	}
+
+	// 存储使用进程内的redis, 数据只在内存中, 进程退出后丢失
+	log.Printf("all-in-one mode is for development only, redis data is kept in memory and lost on exit")
+	store, err := miniredis.Run()
+	if err != nil {
+		log.Fatalf("start memory redis err, err is %v", err)
+	}
+	regConf.Redis.Addrs = []string{store.Addr()}
+	regConf.Redis.Pwd = ""
+	regConf.Redis.DB = 0
+
+	// 服务发现和RPC/广播使用进程内实现
+	memBus := bus.NewMemory()
+	registry := discovery.NewMemory()
+	regSrc.StartWith(memBus, registry.NewNode(regConf.Global.NodeDC, regConf.Global.NodeID, regConf.Global.Name))
+	sfuSrc.StartWith(memBus, registry.NewNode(sfuConf.Global.NodeDC, sfuConf.Global.NodeID, sfuConf.Global.Name))
+	signalSrc.StartWith(memBus, registry.NewNode(signalConf.Global.NodeDC, signalConf.Global.NodeID, signalConf.Global.Name), registry.NewWatcher())
+	log.Printf("all-in-one started, signal on %s:%s", signalConf.Signal.Host, signalConf.Signal.Port)
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	<-ch
+	signalSrc.Stop()
+	sfuSrc.Stop()
+	regSrc.Stop()
+	memBus.Shutdown()
+	store.Close()
+}
@@ -0,0 +1,306 @@
+// loadtest 压测工具: 建立N个信令连接加入M个房间, 每个房间前几个用户循环推送预编码的IVF/Ogg文件,
+// 其余用户按扇出配置订阅, 统计入会耗时、首帧耗时、丢包、抖动和各sfu节点的CPU, 结果以json输出
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	requestTimeout = 20 * time.Second
+	connectTimeout = 20 * time.Second
+	keepaliveCycle = 20 * time.Second
+)
+
+// Config 压测参数, 随结果一起输出
+type Config struct {
+	URL      string   `json:"url"`
+	Sessions int      `json:"sessions"`
+	Rooms    int      `json:"rooms"`
+	Pubs     int      `json:"pubs"`
+	Fanout   string   `json:"fanout"`
+	IVF      string   `json:"ivf"`
+	Ogg      string   `json:"ogg"`
+	Video    bool     `json:"video"`
+	Duration string   `json:"duration"`
+	Ramp     string   `json:"ramp"`
+	Settle   string   `json:"settle"`
+	SFU      []string `json:"sfu"`
+	Prefix   string   `json:"prefix"`
+}
+
+func showHelp() {
+	fmt.Printf("Usage:%s {params}\n", os.Args[0])
+	fmt.Println("      -url {signal websocket url}")
+	fmt.Println("      -sessions {websocket sessions}")
+	fmt.Println("      -rooms {rooms, sessions are spread over rooms}")
+	fmt.Println("      -pubs {publishers per room}")
+	fmt.Println("      -fanout {all or publishers subscribed by each subscriber}")
+	fmt.Println("      -ivf {vp8 ivf file, synthetic frames if empty}")
+	fmt.Println("      -ogg {opus ogg file, synthetic frames if empty}")
+	fmt.Println("      -video {publish video}")
+	fmt.Println("      -duration {media duration after subscribing}")
+	fmt.Println("      -ramp {interval between session starts}")
+	fmt.Println("      -settle {wait after publishing before subscribing}")
+	fmt.Println("      -sfu {sfu pprof addresses for /stats, comma separated}")
+	fmt.Println("      -out {json result file}")
+	fmt.Println("      -h (show help info)")
+}
+
+func main() {
+	url := flag.String("url", "ws://127.0.0.1:8443/ws", "signal websocket url")
+	sessions := flag.Int("sessions", 10, "websocket sessions")
+	rooms := flag.Int("rooms", 1, "rooms")
+	pubs := flag.Int("pubs", 1, "publishers per room")
+	fanout := flag.String("fanout", "all", "all or publishers subscribed by each subscriber")
+	ivf := flag.String("ivf", "", "vp8 ivf file")
+	ogg := flag.String("ogg", "", "opus ogg file")
+	video := flag.Bool("video", true, "publish video")
+	duration := flag.Duration("duration", 30*time.Second, "media duration after subscribing")
+	ramp := flag.Duration("ramp", 20*time.Millisecond, "interval between session starts")
+	settle := flag.Duration("settle", 3*time.Second, "wait after publishing before subscribing")
+	sfu := flag.String("sfu", "", "sfu pprof addresses, comma separated")
+	out := flag.String("out", "loadtest.json", "json result file")
+	prefix := flag.String("prefix", "lt"+strconv.FormatInt(time.Now().Unix(), 36), "uid and rid prefix")
+	help := flag.Bool("h", false, "help info")
+	flag.Parse()
+	if *help {
+		showHelp()
+		return
+	}
+	per, err := parseFanout(*fanout)
+	if *sessions <= 0 || *rooms <= 0 || *pubs < 0 || err != nil {
+		showHelp()
+		os.Exit(-1)
+	}
+
+	cfg := Config{
+		URL:      *url,
+		Sessions: *sessions,
+		Rooms:    *rooms,
+		Pubs:     *pubs,
+		Fanout:   *fanout,
+		IVF:      *ivf,
+		Ogg:      *ogg,
+		Video:    *video,
+		Duration: duration.String(),
+		Ramp:     ramp.String(),
+		Settle:   settle.String(),
+		Prefix:   *prefix,
+	}
+	for _, addr := range strings.Split(*sfu, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			cfg.SFU = append(cfg.SFU, addr)
+		}
+	}
+	audioFrames, err := loadOgg(*ogg)
+	if err != nil {
+		log.Fatalf("load ogg err, err is %v", err)
+	}
+	var videoFrames []frame
+	if *video {
+		if videoFrames, err = loadIVF(*ivf); err != nil {
+			log.Fatalf("load ivf err, err is %v", err)
+		}
+	}
+
+	r := run(cfg, per, audioFrames, videoFrames, *duration, *ramp, *settle)
+	r.print()
+	if err = r.write(*out); err != nil {
+		log.Fatalf("write result err, err is %v", err)
+	}
+	log.Printf("result written to %s", *out)
+}
+
+// parseFanout 解析扇出配置, all返回0
+func parseFanout(fanout string) (int, error) {
+	if fanout == "all" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(fanout)
+	if err == nil && n <= 0 {
+		err = fmt.Errorf("fanout %d should be positive", n)
+	}
+	return n, err
+}
+
+// member 一个压测用户, 房间内前pubs个用户推流
+type member struct {
+	index int
+	sess  *session
+	ice   []webrtc.ICEServer
+	pub   *publisher
+}
+
+// run 执行压测: 入会、推流、订阅、收流, 最后清理
+func run(cfg Config, fanout int, audio, video []frame, duration, ramp, settle time.Duration) *Report {
+	r := &Report{Start: time.Now(), Config: cfg, Sessions: cfg.Sessions, Errors: make(map[string]int)}
+	var lock sync.Mutex
+	stop := make(chan struct{})
+	sampler := startSampler(cfg.SFU, 5*time.Second)
+
+	// 入会, 用户按序号轮流分到各房间
+	members := make([]*member, cfg.Sessions)
+	joins := make([]float64, 0, cfg.Sessions)
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Sessions; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			uid := fmt.Sprintf("%s_u%d", cfg.Prefix, i)
+			rid := fmt.Sprintf("%s_r%d", cfg.Prefix, i%cfg.Rooms)
+			s, err := dial(cfg.URL, uid, rid)
+			if err != nil {
+				r.errorf(&lock, "dial err, err is %v", err)
+				return
+			}
+			start := time.Now()
+			res, err := s.request("join", map[string]interface{}{"rid": rid})
+			if err != nil {
+				s.conn.Close()
+				r.errorf(&lock, "join err, err is %v", err)
+				return
+			}
+			go s.keepalive(stop)
+			lock.Lock()
+			joins = append(joins, ms(time.Since(start)))
+			members[i] = &member{index: i / cfg.Rooms, sess: s, ice: iceServers(res)}
+			lock.Unlock()
+		}(i)
+		time.Sleep(ramp)
+	}
+	wg.Wait()
+	r.Join = summarize(joins)
+	r.Joined = len(joins)
+	log.Printf("joined %d/%d", r.Joined, cfg.Sessions)
+
+	// 推流
+	publishes := make([]float64, 0)
+	for _, m := range members {
+		if m == nil || m.index >= cfg.Pubs {
+			continue
+		}
+		wg.Add(1)
+		go func(m *member) {
+			defer wg.Done()
+			start := time.Now()
+			p, err := publish(m.sess, m.ice, audio, video, stop)
+			if err != nil {
+				r.errorf(&lock, "publish err, err is %v", err)
+				return
+			}
+			lock.Lock()
+			publishes = append(publishes, ms(time.Since(start)))
+			m.pub = p
+			lock.Unlock()
+		}(m)
+		time.Sleep(ramp)
+	}
+	wg.Wait()
+	r.Publish = summarize(publishes)
+	r.Published = len(publishes)
+	log.Printf("published %d", r.Published)
+	// sfu收到数据后才有track, 之前订阅会失败
+	time.Sleep(settle)
+
+	// 订阅, 每个订阅者从不同的推流端开始选择, 分散负载
+	roomPubs := make(map[string][]*publisher)
+	for _, m := range members {
+		if m != nil && m.pub != nil {
+			roomPubs[m.sess.rid] = append(roomPubs[m.sess.rid], m.pub)
+		}
+	}
+	subs := make([]*subscriber, 0)
+	for _, m := range members {
+		if m == nil || m.index < cfg.Pubs {
+			continue
+		}
+		list := roomPubs[m.sess.rid]
+		count := len(list)
+		if fanout > 0 && fanout < count {
+			count = fanout
+		}
+		for k := 0; k < count; k++ {
+			p := list[(m.index+k)%len(list)]
+			wg.Add(1)
+			go func(m *member, p *publisher) {
+				defer wg.Done()
+				sub, err := subscribe(m.sess, m.ice, p)
+				if err != nil {
+					r.errorf(&lock, "subscribe err, err is %v", err)
+					return
+				}
+				lock.Lock()
+				subs = append(subs, sub)
+				lock.Unlock()
+			}(m, p)
+			time.Sleep(ramp)
+		}
+	}
+	wg.Wait()
+	r.Subscribed = len(subs)
+	log.Printf("subscribed %d, receiving media for %v", r.Subscribed, duration)
+
+	// 收流, 可以提前中断
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case <-time.After(duration):
+	case <-ch:
+		log.Printf("interrupted, cleaning up")
+	}
+	signal.Stop(ch)
+
+	r.media(subs)
+	r.Nodes = sampler.finish()
+	placement(r, members, subs)
+
+	// 清理
+	close(stop)
+	for _, sub := range subs {
+		sub.pc.Close()
+	}
+	for _, m := range members {
+		if m == nil {
+			continue
+		}
+		if m.pub != nil {
+			m.pub.pc.Close()
+		}
+		m.sess.close()
+	}
+	return r
+}
+
+// placement 按publish返回的sfuid统计各节点上的推流和订阅数, 没有配置状态地址的节点也列出
+func placement(r *Report, members []*member, subs []*subscriber) {
+	find := func(sfuid string) *Node {
+		for _, node := range r.Nodes {
+			if node.NodeID == sfuid {
+				return node
+			}
+		}
+		node := &Node{NodeID: sfuid}
+		r.Nodes = append(r.Nodes, node)
+		return node
+	}
+	for _, m := range members {
+		if m != nil && m.pub != nil {
+			find(m.pub.sfuid).Pubs++
+		}
+	}
+	for _, sub := range subs {
+		find(sub.pub.sfuid).Subs++
+	}
+}
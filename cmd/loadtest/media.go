@@ -0,0 +1,356 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v3/pkg/media/oggreader"
+)
+
+const (
+	audioClockRate = 48000
+	videoClockRate = 90000
+)
+
+// frame 一帧预编码数据, 按duration间隔发送
+type frame struct {
+	data     []byte
+	duration time.Duration
+}
+
+// loadIVF 读取IVF文件中的VP8帧, 没有指定文件时使用合成的关键帧
+func loadIVF(path string) ([]frame, error) {
+	if path == "" {
+		return []frame{{data: make([]byte, 1000), duration: time.Second / 30}}, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader, header, err := ivfreader.NewWith(file)
+	if err != nil {
+		return nil, err
+	}
+	if header.FourCC != "VP80" {
+		return nil, fmt.Errorf("ivf codec %s not supported, only VP80", header.FourCC)
+	}
+	// 时间戳单位为 分子/分母 秒
+	unit := time.Duration(float64(time.Second) * float64(header.TimebaseNumerator) / float64(header.TimebaseDenominator))
+	frames := make([]frame, 0)
+	var last uint64
+	for {
+		data, fh, err := reader.ParseNextFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		duration := time.Second / 30
+		if len(frames) > 0 && fh.Timestamp > last {
+			duration = time.Duration(fh.Timestamp-last) * unit
+			frames[len(frames)-1].duration = duration
+		}
+		last = fh.Timestamp
+		frames = append(frames, frame{data: data, duration: duration})
+	}
+	if len(frames) == 0 {
+		return nil, errors.New("ivf has no frame")
+	}
+	return frames, nil
+}
+
+// loadOgg 读取Ogg文件中的Opus页, 没有指定文件时使用合成的静音帧
+func loadOgg(path string) ([]frame, error) {
+	if path == "" {
+		return []frame{{data: []byte{0xfc, 0xff, 0xfe}, duration: 20 * time.Millisecond}}, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader, _, err := oggreader.NewWith(file)
+	if err != nil {
+		return nil, err
+	}
+	frames := make([]frame, 0)
+	var last uint64
+	for {
+		data, ph, err := reader.ParseNextPage()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// 跳过注释页等没有音频的页
+		if ph.GranulePosition <= last {
+			continue
+		}
+		samples := uint32(ph.GranulePosition - last)
+		last = ph.GranulePosition
+		frames = append(frames, frame{data: data, duration: time.Duration(samples) * time.Second / audioClockRate})
+	}
+	if len(frames) == 0 {
+		return nil, errors.New("ogg has no page")
+	}
+	return frames, nil
+}
+
+// newPeerConnection 使用join返回的iceServers新建连接
+func newPeerConnection(ice []webrtc.ICEServer) (*webrtc.PeerConnection, error) {
+	return webrtc.NewPeerConnection(webrtc.Configuration{ICEServers: ice})
+}
+
+// iceServers 解析join返回的iceServers
+func iceServers(res map[string]interface{}) []webrtc.ICEServer {
+	list, _ := res["iceServers"].([]interface{})
+	servers := make([]webrtc.ICEServer, 0, len(list))
+	for _, item := range list {
+		mp, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		server := webrtc.ICEServer{}
+		urls, _ := mp["urls"].([]interface{})
+		for _, url := range urls {
+			server.URLs = append(server.URLs, fmt.Sprint(url))
+		}
+		if username, ok := mp["username"].(string); ok {
+			server.Username = username
+			server.Credential = mp["credential"]
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// negotiate 发送offer, 设置answer并等待连接建立
+func negotiate(s *session, pc *webrtc.PeerConnection, method string, data map[string]interface{}) (map[string]interface{}, error) {
+	up := make(chan struct{})
+	var once sync.Once
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			once.Do(func() { close(up) })
+		}
+	})
+	desc, err := pc.CreateOffer(nil)
+	if err != nil {
+		return nil, err
+	}
+	// 没有开启trickle, 等候选地址收集完再发送offer
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err = pc.SetLocalDescription(desc); err != nil {
+		return nil, err
+	}
+	<-gathered
+	data["jsep"] = map[string]interface{}{"type": "offer", "sdp": pc.LocalDescription().SDP}
+	res, err := s.request(method, data)
+	if err != nil {
+		return nil, err
+	}
+	jsep, _ := res["jsep"].(map[string]interface{})
+	sdp, _ := jsep["sdp"].(string)
+	if err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sdp}); err != nil {
+		return nil, err
+	}
+	select {
+	case <-up:
+		return res, nil
+	case <-time.After(connectTimeout):
+		return nil, fmt.Errorf("%s peer connection timeout", method)
+	}
+}
+
+// publisher 循环推送预编码文件的推流端
+type publisher struct {
+	rid   string
+	uid   string
+	mid   string
+	sfuid string
+	video bool
+	pc    *webrtc.PeerConnection
+}
+
+// publish 发布音视频流, 连接建立后开始循环发送数据
+func publish(s *session, ice []webrtc.ICEServer, audio, video []frame, stop chan struct{}) (*publisher, error) {
+	pc, err := newPeerConnection(ice)
+	if err != nil {
+		return nil, err
+	}
+	audioTrack, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", s.uid)
+	if err == nil {
+		_, err = pc.AddTrack(audioTrack)
+	}
+	var videoTrack *webrtc.TrackLocalStaticSample
+	if err == nil && len(video) > 0 {
+		videoTrack, err = webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", s.uid)
+		if err == nil {
+			_, err = pc.AddTrack(videoTrack)
+		}
+	}
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	res, err := negotiate(s, pc, "publish", map[string]interface{}{
+		"rid":   s.rid,
+		"minfo": map[string]interface{}{"audio": true, "video": videoTrack != nil},
+	})
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	go send(audioTrack, audio, stop)
+	if videoTrack != nil {
+		go send(videoTrack, video, stop)
+	}
+	return &publisher{
+		rid:   s.rid,
+		uid:   s.uid,
+		mid:   fmt.Sprint(res["mid"]),
+		sfuid: fmt.Sprint(res["sfuid"]),
+		video: videoTrack != nil,
+		pc:    pc,
+	}, nil
+}
+
+// send 按帧时长循环发送, 按绝对时间调度避免累计误差
+func send(track *webrtc.TrackLocalStaticSample, frames []frame, stop chan struct{}) {
+	next := time.Now()
+	for i := 0; ; i = (i + 1) % len(frames) {
+		f := frames[i]
+		if err := track.WriteSample(media.Sample{Data: f.data, Duration: f.duration}); err == io.ErrClosedPipe {
+			return
+		}
+		next = next.Add(f.duration)
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
+
+// trackStats 一路接收的RTP统计, 丢包按序号计算, 抖动按RFC3550计算
+type trackStats struct {
+	kind    string
+	clock   float64
+	packets int64
+	baseSeq uint32
+	maxSeq  uint32
+	transit float64
+	jitter  float64
+}
+
+// update 收到一个RTP包
+func (t *trackStats) update(pkt *rtp.Packet, arrival time.Time) {
+	seq := uint32(pkt.SequenceNumber)
+	if t.packets == 0 {
+		t.baseSeq, t.maxSeq = seq, seq
+	} else {
+		// 序号回绕时扩展到32位
+		ext := t.maxSeq&0xffff0000 | seq
+		if int32(ext-t.maxSeq) < -0x8000 {
+			ext += 0x10000
+		} else if int32(ext-t.maxSeq) > 0x8000 {
+			ext -= 0x10000
+		}
+		if int32(ext-t.maxSeq) > 0 {
+			t.maxSeq = ext
+		}
+	}
+	transit := float64(arrival.UnixNano())/float64(time.Second)*t.clock - float64(pkt.Timestamp)
+	if t.packets > 0 {
+		t.jitter += (math.Abs(transit-t.transit) - t.jitter) / 16
+	}
+	t.transit = transit
+	t.packets++
+}
+
+// lost 丢包数
+func (t *trackStats) lost() int64 {
+	if t.packets == 0 {
+		return 0
+	}
+	lost := int64(t.maxSeq-t.baseSeq+1) - t.packets
+	if lost < 0 {
+		return 0
+	}
+	return lost
+}
+
+// jitterMs 抖动, 单位毫秒
+func (t *trackStats) jitterMs() float64 {
+	return t.jitter / t.clock * 1000
+}
+
+// subscriber 订阅一路流并统计接收情况
+type subscriber struct {
+	pub   *publisher
+	pc    *webrtc.PeerConnection
+	start time.Time
+	lock  sync.Mutex
+	first time.Duration
+	stats []*trackStats
+}
+
+// subscribe 订阅流, 连接建立后统计RTP
+func subscribe(s *session, ice []webrtc.ICEServer, p *publisher) (*subscriber, error) {
+	pc, err := newPeerConnection(ice)
+	if err != nil {
+		return nil, err
+	}
+	kinds := []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio}
+	if p.video {
+		kinds = append(kinds, webrtc.RTPCodecTypeVideo)
+	}
+	for _, kind := range kinds {
+		if _, err = pc.AddTransceiverFromKind(kind, webrtc.RtpTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			pc.Close()
+			return nil, err
+		}
+	}
+	sub := &subscriber{pub: p, pc: pc, start: time.Now()}
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		stats := &trackStats{kind: track.Kind().String(), clock: float64(track.Codec().ClockRate)}
+		sub.lock.Lock()
+		sub.stats = append(sub.stats, stats)
+		sub.lock.Unlock()
+		for {
+			pkt, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			now := time.Now()
+			sub.lock.Lock()
+			// 首帧时间: 有视频时以视频为准, 否则以音频为准
+			if sub.first == 0 && (track.Kind() == webrtc.RTPCodecTypeVideo || !p.video) {
+				sub.first = now.Sub(sub.start)
+			}
+			stats.update(pkt, now)
+			sub.lock.Unlock()
+		}
+	})
+	_, err = negotiate(s, pc, "subscribe", map[string]interface{}{
+		"rid":   p.rid,
+		"mid":   p.mid,
+		"sfuid": p.sfuid,
+	})
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return sub, nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Summary 一组耗时的统计, 单位毫秒
+type Summary struct {
+	Count int     `json:"count"`
+	Min   float64 `json:"min"`
+	Avg   float64 `json:"avg"`
+	P50   float64 `json:"p50"`
+	P95   float64 `json:"p95"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+// summarize 计算平均值和分位数
+func summarize(values []float64) Summary {
+	if len(values) == 0 {
+		return Summary{}
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	sum := 0.0
+	for _, v := range sorted {
+		sum += v
+	}
+	pick := func(p float64) float64 {
+		return sorted[int(p*float64(len(sorted)-1)+0.5)]
+	}
+	return Summary{
+		Count: len(sorted),
+		Min:   sorted[0],
+		Avg:   sum / float64(len(sorted)),
+		P50:   pick(0.50),
+		P95:   pick(0.95),
+		P99:   pick(0.99),
+		Max:   sorted[len(sorted)-1],
+	}
+}
+
+// ms 转换为毫秒
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Media 一类媒体的接收统计
+type Media struct {
+	Tracks   int     `json:"tracks"`
+	Packets  int64   `json:"packets"`
+	Lost     int64   `json:"lost"`
+	LossRate float64 `json:"lossRate"`
+	Jitter   Summary `json:"jitter"`
+}
+
+// Node 一个sfu节点的统计, cpu为百分比, 多核时可能超过100
+type Node struct {
+	Addr       string  `json:"addr"`
+	DC         string  `json:"dc"`
+	NodeID     string  `json:"nodeid"`
+	CPU        float64 `json:"cpu"`
+	CPUPeak    float64 `json:"cpuPeak"`
+	CPUs       int     `json:"cpus"`
+	Load       int     `json:"load"`
+	LoadPeak   int     `json:"loadPeak"`
+	Goroutines int     `json:"goroutines"`
+	Pubs       int     `json:"pubs"`
+	Subs       int     `json:"subs"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// Report 一次压测的结果, 以json输出, 用于不同版本之间对比
+type Report struct {
+	Start      time.Time      `json:"start"`
+	Config     Config         `json:"config"`
+	Sessions   int            `json:"sessions"`
+	Joined     int            `json:"joined"`
+	Published  int            `json:"published"`
+	Subscribed int            `json:"subscribed"`
+	Join       Summary        `json:"join"`
+	Publish    Summary        `json:"publish"`
+	TTFF       Summary        `json:"ttff"`
+	NoMedia    int            `json:"noMedia"`
+	Audio      Media          `json:"audio"`
+	Video      Media          `json:"video"`
+	Nodes      []*Node        `json:"nodes"`
+	Errors     map[string]int `json:"errors"`
+}
+
+// media 汇总所有订阅者的接收统计
+func (r *Report) media(subs []*subscriber) {
+	jitter := map[string][]float64{"audio": nil, "video": nil}
+	for _, sub := range subs {
+		sub.lock.Lock()
+		if sub.first == 0 {
+			r.NoMedia++
+		}
+		for _, stats := range sub.stats {
+			m := &r.Audio
+			if stats.kind == "video" {
+				m = &r.Video
+			}
+			m.Tracks++
+			m.Packets += stats.packets
+			m.Lost += stats.lost()
+			if stats.packets > 1 {
+				jitter[stats.kind] = append(jitter[stats.kind], stats.jitterMs())
+			}
+		}
+		sub.lock.Unlock()
+	}
+	ttff := make([]float64, 0, len(subs))
+	for _, sub := range subs {
+		if sub.first > 0 {
+			ttff = append(ttff, ms(sub.first))
+		}
+	}
+	r.TTFF = summarize(ttff)
+	for kind, m := range map[string]*Media{"audio": &r.Audio, "video": &r.Video} {
+		if m.Packets+m.Lost > 0 {
+			m.LossRate = float64(m.Lost) / float64(m.Packets+m.Lost)
+		}
+		m.Jitter = summarize(jitter[kind])
+	}
+}
+
+// errorf 记录错误, 相同错误只计数
+func (r *Report) errorf(lock *sync.Mutex, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	lock.Lock()
+	r.Errors[msg]++
+	lock.Unlock()
+}
+
+// print 输出可读的结果
+func (r *Report) print() {
+	fmt.Printf("sessions %d, joined %d, published %d, subscribed %d, no media %d\n", r.Sessions, r.Joined, r.Published, r.Subscribed, r.NoMedia)
+	for _, line := range []struct {
+		name string
+		s    Summary
+	}{{"join", r.Join}, {"publish", r.Publish}, {"ttff", r.TTFF}, {"audio jitter", r.Audio.Jitter}, {"video jitter", r.Video.Jitter}} {
+		fmt.Printf("%-13s ms: count %d, avg %.1f, p50 %.1f, p95 %.1f, p99 %.1f, max %.1f\n", line.name, line.s.Count, line.s.Avg, line.s.P50, line.s.P95, line.s.P99, line.s.Max)
+	}
+	fmt.Printf("audio loss %.3f%% (%d/%d), video loss %.3f%% (%d/%d)\n",
+		r.Audio.LossRate*100, r.Audio.Lost, r.Audio.Packets+r.Audio.Lost, r.Video.LossRate*100, r.Video.Lost, r.Video.Packets+r.Video.Lost)
+	for _, node := range r.Nodes {
+		if node.Error != "" {
+			fmt.Printf("sfu %s: %s\n", node.Addr, node.Error)
+			continue
+		}
+		fmt.Printf("sfu %s (%s): cpu %.1f%%, peak %.1f%%, load %d, peak %d, pubs %d, subs %d\n",
+			node.NodeID, node.Addr, node.CPU, node.CPUPeak, node.Load, node.LoadPeak, node.Pubs, node.Subs)
+	}
+	for msg, count := range r.Errors {
+		fmt.Printf("error x%d: %s\n", count, msg)
+	}
+}
+
+// write 写入json文件
+func (r *Report) write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// stats sfu节点/stats返回的状态
+type stats struct {
+	DC         string  `json:"dc"`
+	NodeID     string  `json:"nodeid"`
+	Load       int     `json:"load"`
+	CPU        float64 `json:"cpu"`
+	CPUs       int     `json:"cpus"`
+	Goroutines int     `json:"goroutines"`
+	Time       int64   `json:"time"`
+}
+
+// fetchStats 查询sfu节点状态
+func fetchStats(addr string) (*stats, error) {
+	url := addr
+	if !strings.HasPrefix(url, "http") {
+		url = "http://" + url
+	}
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(url, "/") + "/stats")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("stats status %d", resp.StatusCode)
+	}
+	s := &stats{}
+	if err = json.NewDecoder(resp.Body).Decode(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// sampler 定时采样sfu节点状态, cpu按相邻两次采样计算
+type sampler struct {
+	nodes []*Node
+	first []*stats
+	last  []*stats
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// startSampler 开始采样
+func startSampler(addrs []string, cycle time.Duration) *sampler {
+	s := &sampler{
+		nodes: make([]*Node, len(addrs)),
+		first: make([]*stats, len(addrs)),
+		last:  make([]*stats, len(addrs)),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	for i, addr := range addrs {
+		s.nodes[i] = &Node{Addr: addr}
+	}
+	s.sample()
+	go func() {
+		defer close(s.done)
+		t := time.NewTicker(cycle)
+		defer t.Stop()
+		for {
+			select {
+			case <-s.stop:
+				s.sample()
+				return
+			case <-t.C:
+				s.sample()
+			}
+		}
+	}()
+	return s
+}
+
+// sample 采样一次所有节点
+func (s *sampler) sample() {
+	for i, node := range s.nodes {
+		cur, err := fetchStats(node.Addr)
+		if err != nil {
+			node.Error = err.Error()
+			continue
+		}
+		node.Error = ""
+		node.DC, node.NodeID, node.CPUs = cur.DC, cur.NodeID, cur.CPUs
+		node.Load, node.Goroutines = cur.Load, cur.Goroutines
+		if cur.Load > node.LoadPeak {
+			node.LoadPeak = cur.Load
+		}
+		if s.first[i] == nil {
+			s.first[i] = cur
+		}
+		if prev := s.last[i]; prev != nil {
+			if cpu := cpuPercent(prev, cur); cpu > node.CPUPeak {
+				node.CPUPeak = cpu
+			}
+		}
+		s.last[i] = cur
+	}
+}
+
+// cpuPercent 两次采样之间的CPU使用率
+func cpuPercent(prev, cur *stats) float64 {
+	if cur.Time <= prev.Time {
+		return 0
+	}
+	return (cur.CPU - prev.CPU) / (float64(cur.Time-prev.Time) / 1000) * 100
+}
+
+// finish 停止采样, 返回各节点整个压测期间的统计
+func (s *sampler) finish() []*Node {
+	close(s.stop)
+	<-s.done
+	for i, node := range s.nodes {
+		if s.first[i] != nil && s.last[i] != nil {
+			node.CPU = cpuPercent(s.first[i], s.last[i])
+		}
+	}
+	return s.nodes
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func TestSummarize(t *testing.T) {
+	if s := summarize(nil); s.Count != 0 || s.Max != 0 {
+		t.Fatalf("empty values should give an empty summary, got %+v", s)
+	}
+	values := make([]float64, 0, 100)
+	for i := 100; i >= 1; i-- {
+		values = append(values, float64(i))
+	}
+	s := summarize(values)
+	if s.Count != 100 || s.Min != 1 || s.Max != 100 || s.Avg != 50.5 {
+		t.Fatalf("unexpected summary %+v", s)
+	}
+	if s.P50 != 51 || s.P95 != 95 || s.P99 != 99 {
+		t.Fatalf("unexpected percentiles p50 %.0f p95 %.0f p99 %.0f", s.P50, s.P95, s.P99)
+	}
+	if values[0] != 100 {
+		t.Fatal("summarize should not sort the input")
+	}
+}
+
+func TestTrackStatsLossAcrossWrap(t *testing.T) {
+	stats := &trackStats{kind: "audio", clock: 48000}
+	now := time.Now()
+	// 65534, 65535, 跳过0, 1, 2
+	for i, seq := range []uint16{65534, 65535, 1, 2} {
+		stats.update(&rtp.Packet{Header: rtp.Header{SequenceNumber: seq, Timestamp: uint32(i * 960)}}, now.Add(time.Duration(i)*20*time.Millisecond))
+	}
+	if stats.packets != 4 || stats.lost() != 1 {
+		t.Fatalf("4 packets and 1 lost expected, got %d packets and %d lost", stats.packets, stats.lost())
+	}
+	// 乱序到达的旧包不影响最大序号
+	stats.update(&rtp.Packet{Header: rtp.Header{SequenceNumber: 0, Timestamp: 0}}, now)
+	if stats.lost() != 0 {
+		t.Fatalf("late packet should fill the gap, got %d lost", stats.lost())
+	}
+}
+
+func TestReportMedia(t *testing.T) {
+	audio := func(packets int64, lost uint32) *trackStats {
+		return &trackStats{kind: "audio", clock: 48000, packets: packets, baseSeq: 1, maxSeq: uint32(packets) + lost, jitter: 480}
+	}
+	subs := []*subscriber{
+		{first: 100 * time.Millisecond, stats: []*trackStats{audio(90, 10), {kind: "video", clock: 90000, packets: 50, baseSeq: 1, maxSeq: 50}}},
+		{first: 300 * time.Millisecond, stats: []*trackStats{audio(100, 0)}},
+		{stats: []*trackStats{audio(0, 0)}},
+	}
+	r := &Report{}
+	r.media(subs)
+	if r.NoMedia != 1 {
+		t.Fatalf("one subscriber without media expected, got %d", r.NoMedia)
+	}
+	if r.Audio.Tracks != 3 || r.Audio.Packets != 190 || r.Audio.Lost != 10 || r.Audio.LossRate != 0.05 {
+		t.Fatalf("unexpected audio stats %+v", r.Audio)
+	}
+	if r.Video.Tracks != 1 || r.Video.Lost != 0 || r.Video.LossRate != 0 {
+		t.Fatalf("unexpected video stats %+v", r.Video)
+	}
+	// 没有收到包的track不参与抖动统计
+	if r.Audio.Jitter.Count != 2 || r.Audio.Jitter.Avg != 10 {
+		t.Fatalf("unexpected audio jitter %+v", r.Audio.Jitter)
+	}
+	if r.TTFF.Count != 2 || r.TTFF.Min != 100 || r.TTFF.Max != 300 {
+		t.Fatalf("unexpected ttff %+v", r.TTFF)
+	}
+}
+
+func TestSamplerCPU(t *testing.T) {
+	// 每次采样间隔1秒, cpu时间依次增加0.5秒、1.5秒和0秒, 整体为3秒内2秒
+	var calls int32
+	cpu := []float64{10, 10.5, 12, 12}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := int(atomic.AddInt32(&calls, 1)) - 1
+		if i >= len(cpu) {
+			i = len(cpu) - 1
+		}
+		json.NewEncoder(w).Encode(stats{NodeID: "sfu_1", Load: 10 * (i + 1), CPU: cpu[i], CPUs: 4, Time: int64(i) * 1000})
+	}))
+	defer srv.Close()
+
+	s := startSampler([]string{srv.URL}, time.Hour)
+	s.sample()
+	s.sample()
+	nodes := s.finish()
+	node := nodes[0]
+	if node.Error != "" || node.NodeID != "sfu_1" {
+		t.Fatalf("unexpected node %+v", node)
+	}
+	if node.CPUPeak != 150 || math.Abs(node.CPU-200.0/3) > 1e-6 || node.LoadPeak != 40 {
+		t.Fatalf("cpu 66.7, peak 150 and load peak 40 expected, got %+v", node)
+	}
+}
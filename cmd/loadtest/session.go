@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// message protoo消息, 请求、应答和通知共用
+type message struct {
+	Request      bool            `json:"request,omitempty"`
+	Response     bool            `json:"response,omitempty"`
+	Notification bool            `json:"notification,omitempty"`
+	ID           int             `json:"id,omitempty"`
+	Method       string          `json:"method,omitempty"`
+	OK           bool            `json:"ok,omitempty"`
+	Data         json.RawMessage `json:"data,omitempty"`
+	ErrorCode    int             `json:"errorCode,omitempty"`
+	ErrorReason  string          `json:"errorReason,omitempty"`
+}
+
+// session 一个信令连接, 通知直接丢弃
+type session struct {
+	uid    string
+	rid    string
+	conn   *websocket.Conn
+	lock   sync.Mutex
+	nextID int
+	waits  map[int]chan message
+	closed chan struct{}
+}
+
+// dial 以uid连接信令
+func dial(url, uid, rid string) (*session, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?peer="+uid, nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &session{
+		uid:    uid,
+		rid:    rid,
+		conn:   conn,
+		waits:  make(map[int]chan message),
+		closed: make(chan struct{}),
+	}
+	go s.readLoop()
+	return s, nil
+}
+
+// readLoop 读取应答, 连接关闭后结束
+func (s *session) readLoop() {
+	defer close(s.closed)
+	for {
+		var msg message
+		if err := s.conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		if !msg.Response {
+			continue
+		}
+		s.lock.Lock()
+		if ch, ok := s.waits[msg.ID]; ok {
+			ch <- msg
+			delete(s.waits, msg.ID)
+		}
+		s.lock.Unlock()
+	}
+}
+
+// request 发送请求并等待应答
+func (s *session) request(method string, data map[string]interface{}) (map[string]interface{}, error) {
+	s.lock.Lock()
+	s.nextID++
+	id := s.nextID
+	ch := make(chan message, 1)
+	s.waits[id] = ch
+	err := s.conn.WriteJSON(map[string]interface{}{"request": true, "id": id, "method": method, "data": data})
+	s.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case msg := <-ch:
+		if !msg.OK {
+			return nil, fmt.Errorf("%s rejected, code is %d, reason is %s", method, msg.ErrorCode, msg.ErrorReason)
+		}
+		res := make(map[string]interface{})
+		if len(msg.Data) > 0 {
+			json.Unmarshal(msg.Data, &res)
+		}
+		return res, nil
+	case <-s.closed:
+		return nil, errors.New("connection closed")
+	case <-time.After(requestTimeout):
+		return nil, fmt.Errorf("%s timeout", method)
+	}
+}
+
+// keepalive 定时保活, 防止用户在register过期
+func (s *session) keepalive(stop chan struct{}) {
+	t := time.NewTicker(keepaliveCycle)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-s.closed:
+			return
+		case <-t.C:
+			s.request("keepalive", map[string]interface{}{"rid": s.rid})
+		}
+	}
+}
+
+// close 离开房间并关闭连接
+func (s *session) close() {
+	s.request("leave", map[string]interface{}{"rid": s.rid})
+	s.conn.Close()
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"goRTCServer/pkg/bus"
+	"goRTCServer/pkg/discovery"
+	"goRTCServer/pkg/proto"
+	"goRTCServer/pkg/utils"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// services 集群中的服务名称
+var services = []string{"signal", "register", "sfu"}
+
+// command 子命令, args为最少参数个数
+type command struct {
+	args int
+	run  func(c *ctl, args []string) error
+}
+
+var commands = map[string]command{
+	"nodes":   {0, (*ctl).nodes},
+	"rooms":   {0, (*ctl).rooms},
+	"room":    {1, (*ctl).room},
+	"kick":    {2, (*ctl).kick},
+	"drain":   {1, func(c *ctl, args []string) error { return c.drain(args[0], true) }},
+	"undrain": {1, func(c *ctl, args []string) error { return c.drain(args[0], false) }},
+	"tail":    {0, (*ctl).tail},
+}
+
+// lookup 根据命令行参数查找子命令, 命令不存在或参数不足时返回false
+func lookup(args []string) (command, bool) {
+	if len(args) == 0 {
+		return command{}, false
+	}
+	cmd, ok := commands[args[0]]
+	return cmd, ok && len(args)-1 >= cmd.args
+}
+
+// ctl 管理客户端, 节点信息来自服务发现, 其他信息通过RPC查询
+type ctl struct {
+	bus     bus.Bus
+	watch   discovery.Discovery
+	timeout time.Duration
+	out     io.Writer
+	lock    sync.Mutex
+	onNode  discovery.ServiceWatchCallback
+}
+
+// newCtl 新建管理客户端, 同步所有节点并监控节点变化
+func newCtl(b bus.Bus, watch discovery.Discovery, timeout time.Duration, out io.Writer) *ctl {
+	c := &ctl{bus: b, watch: watch, timeout: timeout, out: out}
+	watch.WatchServiceNode("", c.nodeChanged)
+	return c
+}
+
+// nodeChanged 节点状态改变, 转给设置的回调
+func (c *ctl) nodeChanged(state int32, node discovery.Node) {
+	c.lock.Lock()
+	onNode := c.onNode
+	c.lock.Unlock()
+	if onNode != nil {
+		onNode(state, node)
+	}
+}
+
+// request 向指定节点发送RPC请求
+func (c *ctl) request(node discovery.Node, method string, data map[string]interface{}) (map[string]interface{}, error) {
+	rpc := c.bus.NewRequestor(discovery.GetPRCChannel(node))
+	rpc.SetRequestTimeout(c.timeout)
+	resp, err := rpc.SyncRequest(method, data)
+	if err != nil {
+		return nil, err
+	}
+	return utils.Unmarshal(string(resp)), nil
+}
+
+// register 向任意一个register节点发送RPC请求
+func (c *ctl) register(method string, data map[string]interface{}) (map[string]interface{}, error) {
+	nodes, find := c.watch.GetNodes("register")
+	if !find {
+		return nil, errors.New("no register node")
+	}
+	for _, node := range nodes {
+		return c.request(node, method, data)
+	}
+	return nil, nil
+}
+
+// table 输出表格
+func (c *ctl) table(header string, rows [][]string) {
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, header)
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+}
+
+// list 获取对象列表
+func list(v interface{}) []map[string]interface{} {
+	items, _ := v.([]interface{})
+	res := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		if mp, ok := item.(map[string]interface{}); ok {
+			res = append(res, mp)
+		}
+	}
+	return res
+}
+
+// str 获取字段的字符串形式, 数字和布尔值也转换为字符串
+func str(mp map[string]interface{}, key string) string {
+	v, ok := mp[key]
+	if !ok || v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// sortRows 按前两列排序
+func sortRows(rows [][]string) {
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i][0] != rows[j][0] {
+			return rows[i][0] < rows[j][0]
+		}
+		return rows[i][1] < rows[j][1]
+	})
+}
+
+// nodes 列出节点, 可以指定服务名称
+func (c *ctl) nodes(args []string) error {
+	names := services
+	if len(args) > 0 {
+		names = args[:1]
+	}
+	rows := make([][]string, 0)
+	for _, name := range names {
+		nodes, _ := c.watch.GetNodes(name)
+		for _, node := range nodes {
+			drain := ""
+			if node.Drain {
+				drain = "drain"
+			}
+			rows = append(rows, []string{node.Name, node.NodeID, node.NodeDC, node.NodePayload, drain, node.TURN})
+		}
+	}
+	sortRows(rows)
+	c.table("NAME\tID\tDC\tLOAD\tSTATE\tTURN", rows)
+	return nil
+}
+
+// rooms 列出所有房间
+func (c *ctl) rooms(args []string) error {
+	res, err := c.register(proto.AdminToRegisterGetRooms, utils.Map())
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0)
+	for _, room := range list(res["rooms"]) {
+		rows = append(rows, []string{utils.Val(room, "rid"), str(room, "users"), str(room, "pubs"), utils.Val(room, "mix")})
+	}
+	c.table("RID\tUSERS\tSTREAMS\tMIX", rows)
+	return nil
+}
+
+// room 查看房间内的用户和流, 以及所在的节点
+func (c *ctl) room(args []string) error {
+	rid := args[0]
+	res, err := c.register(proto.SignalToRegisterGetRoomUsers, utils.Map("rid", rid, "uid", ""))
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0)
+	for _, user := range list(res["users"]) {
+		for _, session := range list(user["sessions"]) {
+			rows = append(rows, []string{utils.Val(user, "uid"), utils.Val(session, "session"), utils.Val(session, "signalid")})
+		}
+	}
+	sortRows(rows)
+	c.table("UID\tSESSION\tSIGNAL", rows)
+
+	res, err = c.register(proto.SignalToRegisterGetRoomPubs, utils.Map("rid", rid, "uid", ""))
+	if err != nil {
+		return err
+	}
+	rows = rows[:0]
+	for _, pub := range list(res["pubs"]) {
+		minfo, _ := pub["minfo"].(map[string]interface{})
+		rows = append(rows, []string{utils.Val(pub, "uid"), utils.Val(pub, "session"), utils.Val(pub, "mid"), utils.Val(pub, "sfuid"), str(minfo, "audio"), str(minfo, "video")})
+	}
+	sortRows(rows)
+	fmt.Fprintln(c.out)
+	c.table("UID\tSESSION\tMID\tSFU\tAUDIO\tVIDEO", rows)
+
+	// 没有混音时register返回错误
+	if res, err = c.register(proto.SignalToRegisterGetMixInfo, utils.Map("rid", rid)); err == nil {
+		fmt.Fprintf(c.out, "\nmix on %s\n", utils.Val(res, "sfuid"))
+	}
+	return nil
+}
+
+// kick 通过用户会话所在的signal节点踢出用户, 没有指定session时踢出用户所有的会话
+func (c *ctl) kick(args []string) error {
+	rid, uid := args[0], args[1]
+	query := utils.Map("rid", rid, "uid", uid)
+	if len(args) > 2 {
+		query["session"] = args[2]
+	}
+	res, err := c.register(proto.SignalToRegisterGetSignalInfo, query)
+	if err != nil {
+		return err
+	}
+	sessions := list(res["sessions"])
+	if len(args) > 2 {
+		sessions = []map[string]interface{}{res}
+	}
+	for _, session := range sessions {
+		signalID := utils.Val(session, "signalid")
+		node, find := c.watch.GetNodeByID(signalID)
+		if !find {
+			return fmt.Errorf("signal node %s not found", signalID)
+		}
+		data := utils.Map("rid", rid, "uid", uid, "session", utils.Val(session, "session"))
+		if _, err = c.request(*node, proto.SignalToSignalOnKick, data); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "kicked %s(%s) from %s on %s\n", uid, utils.Val(session, "session"), rid, signalID)
+	}
+	return nil
+}
+
+// drain 排空或恢复sfu节点, 已有的流不受影响
+func (c *ctl) drain(nid string, drain bool) error {
+	node, find := c.watch.GetNodeByID(nid)
+	if !find {
+		return fmt.Errorf("node %s not found", nid)
+	}
+	if node.Name != "sfu" {
+		return fmt.Errorf("node %s is %s, only sfu can be drained", nid, node.Name)
+	}
+	res, err := c.request(*node, proto.AdminToSfuDrain, utils.Map("drain", drain))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "%s drain %s, load %s\n", nid, str(res, "drain"), str(res, "load"))
+	return nil
+}
+
+// tail 订阅signal和sfu节点的广播, 输出指定房间的事件, 不指定房间时输出所有事件
+func (c *ctl) tail(args []string) error {
+	rid := ""
+	if len(args) > 0 {
+		rid = args[0]
+	}
+	show := func(msg bus.Notification, channel string) {
+		data := utils.Unmarshal(string(msg.Data))
+		if rid != "" && utils.Val(data, "rid") != rid {
+			return
+		}
+		nid := strings.TrimPrefix(channel, discovery.GetEventChannel(discovery.Node{}))
+		fmt.Fprintf(c.out, "%s %s %s %s\n", time.Now().Format("15:04:05.000"), nid, msg.Method, string(msg.Data))
+	}
+	listen := func(state int32, node discovery.Node) {
+		if state == discovery.ServerUp && (node.Name == "signal" || node.Name == "sfu") {
+			c.bus.OnBroadcast(discovery.GetEventChannel(node), show)
+		}
+	}
+	// 之后上线的节点通过回调订阅, 已有节点立即订阅, 重复订阅只生效一次
+	c.lock.Lock()
+	c.onNode = listen
+	c.lock.Unlock()
+	for _, name := range []string{"signal", "sfu"} {
+		nodes, _ := c.watch.GetNodes(name)
+		for _, node := range nodes {
+			listen(discovery.ServerUp, node)
+		}
+	}
+	fmt.Fprintf(c.out, "tailing events of %s, press Ctrl+C to stop\n", roomName(rid))
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	<-ch
+	return nil
+}
+
+// roomName 输出用的房间名称
+func roomName(rid string) string {
+	if rid == "" {
+		return "all rooms"
+	}
+	return "room " + rid
+}
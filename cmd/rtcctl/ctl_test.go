@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"goRTCServer/pkg/bus"
+	"goRTCServer/pkg/discovery"
+	"goRTCServer/pkg/proto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCtl 使用进程内的bus和静态节点新建管理客户端
+func newTestCtl(t *testing.T, nodes ...discovery.Node) (*ctl, *bus.Memory, *bytes.Buffer) {
+	b := bus.NewMemory()
+	w := discovery.NewStatic(nodes).NewWatcher()
+	t.Cleanup(func() {
+		w.Close()
+		b.Close()
+	})
+	out := &bytes.Buffer{}
+	return newCtl(b, w, time.Second, out), b, out
+}
+
+func TestLookup(t *testing.T) {
+	cases := []struct {
+		args []string
+		ok   bool
+	}{
+		{nil, false},
+		{[]string{"nodes"}, true},
+		{[]string{"nodes", "sfu"}, true},
+		{[]string{"room"}, false},
+		{[]string{"room", "rid"}, true},
+		{[]string{"kick", "rid"}, false},
+		{[]string{"kick", "rid", "uid", "session"}, true},
+		{[]string{"unknown"}, false},
+	}
+	for _, c := range cases {
+		if _, ok := lookup(c.args); ok != c.ok {
+			t.Errorf("lookup(%v) = %v, want %v", c.args, ok, c.ok)
+		}
+	}
+}
+
+func TestNodesTable(t *testing.T) {
+	c, _, out := newTestCtl(t,
+		discovery.Node{NodeDC: "sz", NodeID: "sz_sfu_2", Name: "sfu", NodePayload: "12", Drain: true},
+		discovery.Node{NodeDC: "sz", NodeID: "sz_sfu_1", Name: "sfu", TURN: "turn:10.0.0.1:3478"},
+		discovery.Node{NodeDC: "sz", NodeID: "sz_signal_1", Name: "signal"},
+	)
+	if err := c.nodes(nil); err != nil {
+		t.Fatalf("nodes err, err is %v", err)
+	}
+	// 按名称和id排序, 列对齐
+	want := strings.Join([]string{
+		"NAME    ID           DC  LOAD  STATE  TURN",
+		"sfu     sz_sfu_1     sz  0            turn:10.0.0.1:3478",
+		"sfu     sz_sfu_2     sz  12    drain  ",
+		"signal  sz_signal_1  sz  0            ",
+		"",
+	}, "\n")
+	if out.String() != want {
+		t.Fatalf("nodes table mismatch\ngot:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	out.Reset()
+	c.nodes([]string{"signal"})
+	if strings.Contains(out.String(), "sfu") || !strings.Contains(out.String(), "sz_signal_1") {
+		t.Fatalf("nodes signal should only list signal nodes, got:\n%s", out.String())
+	}
+}
+
+func TestRoomsTable(t *testing.T) {
+	reg := discovery.Node{NodeDC: "sz", NodeID: "sz_register_1", Name: "register"}
+	c, b, out := newTestCtl(t, reg)
+	b.OnRequest(discovery.GetPRCChannel(reg), func(req bus.Request, accept bus.RespondFunc, reject bus.RejectFunc) {
+		if req.Method != proto.AdminToRegisterGetRooms {
+			reject(400, "unexpected method "+req.Method)
+			return
+		}
+		accept(map[string]interface{}{"rooms": []interface{}{
+			map[string]interface{}{"rid": "room1", "users": 3, "pubs": 2, "mix": "sz_sfu_1"},
+			map[string]interface{}{"rid": "room2", "users": 1, "pubs": 0, "mix": ""},
+		}})
+	})
+	if err := c.rooms(nil); err != nil {
+		t.Fatalf("rooms err, err is %v", err)
+	}
+	want := strings.Join([]string{
+		"RID    USERS  STREAMS  MIX",
+		"room1  3      2        sz_sfu_1",
+		"room2  1      0        ",
+		"",
+	}, "\n")
+	if out.String() != want {
+		t.Fatalf("rooms table mismatch\ngot:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestDrainOnlySFU(t *testing.T) {
+	c, _, _ := newTestCtl(t, discovery.Node{NodeDC: "sz", NodeID: "sz_signal_1", Name: "signal"})
+	if err := c.drain("sz_signal_1", true); err == nil || !strings.Contains(err.Error(), "only sfu") {
+		t.Fatalf("drain a signal node should fail, err is %v", err)
+	}
+	if err := c.drain("sz_sfu_9", true); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("drain an unknown node should fail, err is %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+// rtcctl 集群管理工具: 通过etcd查看服务节点, 通过nats调用register、signal和sfu的RPC
+// 查看房间、踢人、排空sfu节点, 以及订阅节点的广播实时查看房间事件
+package main
+
+import (
+	"flag"
+	"fmt"
+	"goRTCServer/pkg/bus"
+	"goRTCServer/pkg/etcd"
+	"os"
+	"strings"
+	"time"
+)
+
+func showHelp() {
+	fmt.Printf("Usage:%s {params} {command} {args}\n", os.Args[0])
+	fmt.Println("      -etcd {etcd addrs, comma separated}")
+	fmt.Println("      -nats {nats url}")
+	fmt.Println("      -timeout {rpc timeout}")
+	fmt.Println("      -h (show help info)")
+	fmt.Println("Commands:")
+	fmt.Println("      nodes [name]          list nodes with dc, load and drain state")
+	fmt.Println("      rooms                 list rooms with users, streams and mix sfu")
+	fmt.Println("      room {rid}            show users with signal node and streams with sfu node")
+	fmt.Println("      kick {rid} {uid} [session]  kick all or one session of a user out of the room")
+	fmt.Println("      drain {sfuid}         stop placing new streams on the sfu node")
+	fmt.Println("      undrain {sfuid}       place new streams on the sfu node again")
+	fmt.Println("      tail [rid]            print room events until interrupted")
+}
+
+func main() {
+	etcdAddrs := flag.String("etcd", "127.0.0.1:2379", "etcd addrs, comma separated")
+	natsURL := flag.String("nats", "nats://127.0.0.1:4222", "nats url")
+	timeout := flag.Duration("timeout", 5*time.Second, "rpc timeout")
+	help := flag.Bool("h", false, "help info")
+	flag.Parse()
+	args := flag.Args()
+	if *help || len(args) == 0 {
+		showHelp()
+		return
+	}
+	cmd, ok := lookup(args)
+	if !ok {
+		showHelp()
+		os.Exit(-1)
+	}
+
+	watcher, err := etcd.NewServiceWatcher(strings.Split(*etcdAddrs, ","))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "connect etcd err, err is %v\n", err)
+		os.Exit(1)
+	}
+	defer watcher.Close()
+	b := bus.NewNats(*natsURL)
+	defer b.Close()
+
+	c := newCtl(b, watcher, *timeout, os.Stdout)
+	if err = cmd.run(c, args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s err, err is %v\n", args[0], err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,78 @@
+package bus
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// DefaultRequestTimeout RPC请求默认的超时时间
+const DefaultRequestTimeout = 15 * time.Second
+
+// Error RPC请求的错误
+type Error struct {
+	Code   int
+	Reason string
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("[%d] %s", e.Code, e.Reason)
+}
+
+// Request RPC请求
+type Request struct {
+	Method string
+	Data   json.RawMessage
+}
+
+// Notification 广播消息
+type Notification struct {
+	Method string
+	Data   json.RawMessage
+}
+
+// RespondFunc 应答RPC请求, data会被转换为json
+type RespondFunc func(data interface{})
+
+// RejectFunc 拒绝RPC请求
+type RejectFunc func(errorCode int, errorReason string)
+
+// RequestFunc RPC请求的处理函数
+type RequestFunc func(request Request, accept RespondFunc, reject RejectFunc)
+
+// BroadcastFunc 广播的处理函数, channel为收到广播的频道
+type BroadcastFunc func(msg Notification, channel string)
+
+// Requestor 向指定节点发送RPC请求
+type Requestor interface {
+	// SyncRequest 发送请求并等待应答, 超时返回480错误
+	SyncRequest(method string, data interface{}) (json.RawMessage, *Error)
+	// SetRequestTimeout 设置请求的超时时间
+	SetRequestTimeout(d time.Duration)
+}
+
+// Broadcaster 向节点的事件频道广播消息
+type Broadcaster interface {
+	// Say 广播消息
+	Say(method string, data interface{})
+}
+
+// Bus 服务之间的RPC和广播
+type Bus interface {
+	// OnRequest 处理指定频道的RPC请求
+	OnRequest(channel string, listener RequestFunc)
+	// OnBroadcast 接收指定频道的广播, 同一个处理函数重复注册只生效一次
+	OnBroadcast(channel string, listener BroadcastFunc)
+	// NewRequestor 新建向指定频道发送请求的对象
+	NewRequestor(channel string) Requestor
+	// NewBroadcaster 新建向指定频道广播的对象
+	NewBroadcaster(channel string) Broadcaster
+	// Close 关闭资源
+	Close()
+}
+
+// sameFunc 判断两个处理函数是否相同
+func sameFunc(a, b BroadcastFunc) bool {
+	return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
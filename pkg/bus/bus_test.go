@@ -0,0 +1,101 @@
+package bus
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBus Memory和Nats共用的行为测试, settle为订阅生效需要等待的时间
+func testBus(t *testing.T, b Bus, prefix string, settle time.Duration) {
+	b.OnRequest(prefix+"rpc", func(request Request, accept RespondFunc, reject RejectFunc) {
+		switch request.Method {
+		case "echo":
+			var data map[string]interface{}
+			json.Unmarshal(request.Data, &data)
+			accept(data)
+		case "fail":
+			reject(411, "failed")
+		}
+	})
+	var lock sync.Mutex
+	got := make([]string, 0)
+	listener := func(msg Notification, channel string) {
+		lock.Lock()
+		got = append(got, msg.Method)
+		lock.Unlock()
+	}
+	b.OnBroadcast(prefix+"event", listener)
+	// 同一个处理函数重复注册只生效一次
+	b.OnBroadcast(prefix+"event", listener)
+	time.Sleep(settle)
+
+	req := b.NewRequestor(prefix + "rpc")
+	resp, err := req.SyncRequest("echo", map[string]interface{}{"rid": "room"})
+	if err != nil {
+		t.Fatalf("echo err, err is %v", err)
+	}
+	var data map[string]interface{}
+	if json.Unmarshal(resp, &data); data["rid"] != "room" {
+		t.Fatalf("unexpected echo response %s", resp)
+	}
+	if _, err := req.SyncRequest("fail", nil); err == nil || err.Code != 411 || err.Reason != "failed" {
+		t.Fatalf("reject should return the error, err is %v", err)
+	}
+	req.SetRequestTimeout(100 * time.Millisecond)
+	if _, err := req.SyncRequest("ignored", nil); err == nil || err.Code != 480 {
+		t.Fatalf("unanswered request should time out with 480, err is %v", err)
+	}
+
+	caster := b.NewBroadcaster(prefix + "event")
+	for _, method := range []string{"a", "b", "c"} {
+		caster.Say(method, nil)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lock.Lock()
+		n := len(got)
+		lock.Unlock()
+		if n >= 3 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(settle)
+	lock.Lock()
+	defer lock.Unlock()
+	if len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Fatalf("broadcasts should arrive once and in order, got %v", got)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	m := NewMemory()
+	defer m.Shutdown()
+	testBus(t, m, "memory-", 0)
+}
+
+func TestMemoryNoListenerAndShutdown(t *testing.T) {
+	m := NewMemory()
+	if _, err := m.NewRequestor("nobody").SyncRequest("echo", nil); err == nil || err.Code != 500 {
+		t.Fatalf("request without listener should fail, err is %v", err)
+	}
+	m.OnRequest("rpc", func(request Request, accept RespondFunc, reject RejectFunc) { accept(nil) })
+	m.Shutdown()
+	if _, err := m.NewRequestor("rpc").SyncRequest("echo", nil); err == nil || err.Reason != "bus closed" {
+		t.Fatalf("request after shutdown should fail, err is %v", err)
+	}
+}
+
+// TestNats 需要nats服务, 设置RTC_TEST_NATS_URL后运行, 例如nats://127.0.0.1:4222
+func TestNats(t *testing.T) {
+	url := os.Getenv("RTC_TEST_NATS_URL")
+	if url == "" {
+		t.Skip("RTC_TEST_NATS_URL not set")
+	}
+	n := NewNats(url)
+	defer n.Close()
+	testBus(t, n, "test-"+time.Now().Format("150405.000")+"-", 200*time.Millisecond)
+}
@@ -0,0 +1,213 @@
+package bus
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const memoryQueueSize = 1024
+
+// memoryChannel 一个频道的处理函数, 和nats订阅一样同一频道的消息按顺序处理
+type memoryChannel struct {
+	request    RequestFunc
+	broadcasts []BroadcastFunc
+	tasks      chan func()
+}
+
+// Memory 进程内的消息总线, 同一进程内的所有服务共享, 用于all-in-one模式和测试
+type Memory struct {
+	lock     sync.RWMutex
+	channels map[string]*memoryChannel
+	stop     chan struct{}
+	once     sync.Once
+}
+
+var _ Bus = (*Memory)(nil)
+
+// NewMemory 新建一个进程内的消息总线
+func NewMemory() *Memory {
+	return &Memory{
+		channels: make(map[string]*memoryChannel),
+		stop:     make(chan struct{}),
+	}
+}
+
+// channel 获取频道, 不存在时创建并启动处理协程
+func (m *Memory) channel(name string) *memoryChannel {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ch, ok := m.channels[name]
+	if !ok {
+		ch = &memoryChannel{tasks: make(chan func(), memoryQueueSize)}
+		m.channels[name] = ch
+		go m.run(ch)
+	}
+	return ch
+}
+
+// run 按顺序处理频道的消息
+func (m *Memory) run(ch *memoryChannel) {
+	for {
+		select {
+		case task := <-ch.tasks:
+			task()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// post 投递消息到频道, 总线关闭后丢弃
+func (m *Memory) post(ch *memoryChannel, task func()) bool {
+	// 队列有空间时select会随机选择, 先检查是否已经关闭
+	select {
+	case <-m.stop:
+		return false
+	default:
+	}
+	select {
+	case ch.tasks <- task:
+		return true
+	case <-m.stop:
+		return false
+	}
+}
+
+// OnRequest 处理指定频道的RPC请求
+func (m *Memory) OnRequest(channel string, listener RequestFunc) {
+	ch := m.channel(channel)
+	m.lock.Lock()
+	ch.request = listener
+	m.lock.Unlock()
+}
+
+// OnBroadcast 接收指定频道的广播
+func (m *Memory) OnBroadcast(channel string, listener BroadcastFunc) {
+	ch := m.channel(channel)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, v := range ch.broadcasts {
+		if sameFunc(v, listener) {
+			return
+		}
+	}
+	ch.broadcasts = append(ch.broadcasts, listener)
+}
+
+// NewRequestor 新建向指定频道发送请求的对象
+func (m *Memory) NewRequestor(channel string) Requestor {
+	return &memoryRequestor{bus: m, channel: channel, timeout: DefaultRequestTimeout}
+}
+
+// NewBroadcaster 新建向指定频道广播的对象
+func (m *Memory) NewBroadcaster(channel string) Broadcaster {
+	return &memoryBroadcaster{bus: m, channel: channel}
+}
+
+// Close 总线由所有服务共享, 单个服务关闭时不释放, 由创建者调用Shutdown释放
+func (m *Memory) Close() {
+}
+
+// Shutdown 停止所有频道的处理协程
+func (m *Memory) Shutdown() {
+	m.once.Do(func() {
+		close(m.stop)
+	})
+}
+
+// memoryRequestor 进程内的RPC请求
+type memoryRequestor struct {
+	bus     *Memory
+	channel string
+	timeout time.Duration
+}
+
+// SyncRequest 发送请求并等待应答, 超时返回480错误
+func (r *memoryRequestor) SyncRequest(method string, data interface{}) (json.RawMessage, *Error) {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return nil, &Error{Code: 500, Reason: fmt.Sprintf("marshal request err, err is %v", err)}
+	}
+	r.bus.lock.RLock()
+	ch := r.bus.channels[r.channel]
+	var listener RequestFunc
+	if ch != nil {
+		listener = ch.request
+	}
+	r.bus.lock.RUnlock()
+	if listener == nil {
+		return nil, &Error{Code: 500, Reason: fmt.Sprintf("Not found listener for %s!", r.channel)}
+	}
+
+	type result struct {
+		data json.RawMessage
+		err  *Error
+	}
+	done := make(chan result, 1)
+	request := Request{Method: method, Data: buf}
+	accept := func(data interface{}) {
+		buf, err := json.Marshal(data)
+		if err != nil {
+			return
+		}
+		select {
+		case done <- result{data: buf}:
+		default:
+		}
+	}
+	reject := func(errorCode int, errorReason string) {
+		select {
+		case done <- result{err: &Error{Code: errorCode, Reason: errorReason}}:
+		default:
+		}
+	}
+	if !r.bus.post(ch, func() { listener(request, accept, reject) }) {
+		return nil, &Error{Code: 500, Reason: "bus closed"}
+	}
+
+	timer := time.NewTimer(r.timeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.data, res.err
+	case <-timer.C:
+		return nil, &Error{Code: 480, Reason: fmt.Sprintf("Request timeout %fs, method[%s]", r.timeout.Seconds(), method)}
+	}
+}
+
+// SetRequestTimeout 设置请求的超时时间
+func (r *memoryRequestor) SetRequestTimeout(d time.Duration) {
+	r.timeout = d
+}
+
+// memoryBroadcaster 进程内的广播
+type memoryBroadcaster struct {
+	bus     *Memory
+	channel string
+}
+
+// Say 广播消息, 没有接收者时丢弃
+func (b *memoryBroadcaster) Say(method string, data interface{}) {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	b.bus.lock.RLock()
+	ch := b.bus.channels[b.channel]
+	var listeners []BroadcastFunc
+	if ch != nil {
+		listeners = append(listeners, ch.broadcasts...)
+	}
+	b.bus.lock.RUnlock()
+	if len(listeners) == 0 {
+		return
+	}
+	notification := Notification{Method: method, Data: buf}
+	b.bus.post(ch, func() {
+		for _, listener := range listeners {
+			listener(notification, b.channel)
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package bus
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	nprotoo "github.com/cloudwebrtc/nats-protoo"
+)
+
+// Nats 基于nats的消息总线, 用于分布式部署
+type Nats struct {
+	np         *nprotoo.NatsProtoo
+	lock       sync.Mutex
+	broadcasts map[string][]BroadcastFunc
+}
+
+var _ Bus = (*Nats)(nil)
+
+// NewNats 连接nats服务
+func NewNats(url string) *Nats {
+	return &Nats{
+		np:         nprotoo.NewNatsProtoo(url),
+		broadcasts: make(map[string][]BroadcastFunc),
+	}
+}
+
+// OnRequest 处理指定频道的RPC请求
+func (n *Nats) OnRequest(channel string, listener RequestFunc) {
+	n.np.OnRequest(channel, func(request nprotoo.Request, accept nprotoo.RespondFunc, reject nprotoo.RejectFunc) {
+		listener(Request{Method: request.Method, Data: json.RawMessage(request.Data)}, RespondFunc(accept), RejectFunc(reject))
+	})
+}
+
+// OnBroadcast 接收指定频道的广播, 同一个处理函数重复注册只生效一次
+func (n *Nats) OnBroadcast(channel string, listener BroadcastFunc) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for _, v := range n.broadcasts[channel] {
+		if sameFunc(v, listener) {
+			return
+		}
+	}
+	n.broadcasts[channel] = append(n.broadcasts[channel], listener)
+	n.np.OnBroadcast(channel, func(msg nprotoo.Notification, subj string) {
+		listener(Notification{Method: msg.Method, Data: json.RawMessage(msg.Data)}, subj)
+	})
+}
+
+// NewRequestor 新建向指定频道发送请求的对象
+func (n *Nats) NewRequestor(channel string) Requestor {
+	return &natsRequestor{req: n.np.NewRequestor(channel)}
+}
+
+// NewBroadcaster 新建向指定频道广播的对象
+func (n *Nats) NewBroadcaster(channel string) Broadcaster {
+	return n.np.NewBroadcaster(channel)
+}
+
+// Close 关闭连接
+func (n *Nats) Close() {
+	n.np.Close()
+}
+
+// natsRequestor 基于nats的RPC请求
+type natsRequestor struct {
+	req *nprotoo.Requestor
+}
+
+// SyncRequest 发送请求并等待应答, 超时返回480错误
+func (r *natsRequestor) SyncRequest(method string, data interface{}) (json.RawMessage, *Error) {
+	resp, err := r.req.SyncRequest(method, data)
+	if err != nil {
+		return nil, &Error{Code: err.Code, Reason: err.Reason}
+	}
+	return json.RawMessage(resp), nil
+}
+
+// SetRequestTimeout 设置请求的超时时间
+func (r *natsRequestor) SetRequestTimeout(d time.Duration) {
+	r.req.SetRequestTimeout(d)
+}
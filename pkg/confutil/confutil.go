@@ -0,0 +1,138 @@
+// Package confutil 各服务conf共用的配置工具: 环境变量覆盖、配置比较和配置文件监控
+package confutil
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// EnvPrefix 环境变量前缀
+const EnvPrefix = "RTC"
+
+// debounce 配置文件连续变化时合并为一次重新加载
+const debounce = 500 * time.Millisecond
+
+// BindEnv 按mapstructure标签把配置项绑定到环境变量, 配置文件中没有的配置项也可以设置,
+// 例如etcd.addrs对应RTC_SIGNAL_ETCD_ADDRS和RTC_ETCD_ADDRS, 带服务名的优先, 列表用逗号分隔.
+// 结构体列表和map(如ice.server)不能通过环境变量设置
+func BindEnv(v *viper.Viper, service string, cfg interface{}) {
+	for _, key := range keys(reflect.TypeOf(cfg), "") {
+		env := strings.ToUpper(strings.Replace(key, ".", "_", -1))
+		v.BindEnv(key, EnvPrefix+"_"+strings.ToUpper(service)+"_"+env, EnvPrefix+"_"+env)
+	}
+}
+
+// keys 获取结构体所有可以通过环境变量设置的配置项
+func keys(t reflect.Type, prefix string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	res := make([]string, 0)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("mapstructure")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		key := prefix + tag
+		switch {
+		case f.Type.Kind() == reflect.Struct:
+			res = append(res, keys(f.Type, key+".")...)
+		case f.Type.Kind() == reflect.Map:
+		case f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() == reflect.Struct:
+		default:
+			res = append(res, key)
+		}
+	}
+	return res
+}
+
+// Diff 比较两个相同类型的配置, 返回值不同的配置项, 结构体列表和map整体比较
+func Diff(old, cur interface{}) []string {
+	return diff(reflect.Indirect(reflect.ValueOf(old)), reflect.Indirect(reflect.ValueOf(cur)), "")
+}
+
+func diff(a, b reflect.Value, prefix string) []string {
+	res := make([]string, 0)
+	for i := 0; i < a.NumField(); i++ {
+		f := a.Type().Field(i)
+		tag := f.Tag.Get("mapstructure")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		key := prefix + tag
+		if f.Type.Kind() == reflect.Struct {
+			res = append(res, diff(a.Field(i), b.Field(i), key+".")...)
+		} else if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			res = append(res, key)
+		}
+	}
+	return res
+}
+
+// Section 配置项是否属于指定的配置段
+func Section(key string, sections ...string) bool {
+	for _, s := range sections {
+		if key == s || strings.HasPrefix(key, s+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch 监控配置文件变化和SIGHUP信号, 触发时调用reload, 返回停止监控的函数.
+// 监控配置文件所在的目录, 编辑器重新写入文件和k8s ConfigMap替换软链接时也能收到通知
+func Watch(file string, reload func()) (func(), error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	path, _ := filepath.Abs(file)
+	dir := filepath.Dir(path)
+	if err = watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	real, _ := filepath.EvalSymlinks(path)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	stop := make(chan struct{})
+	go func() {
+		var timer <-chan time.Time
+		for {
+			select {
+			case <-stop:
+				return
+			case <-hup:
+				reload()
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				cur, _ := filepath.EvalSymlinks(path)
+				// 文件本身变化, 或者软链接指向了新的文件
+				if filepath.Clean(ev.Name) == path || cur != real {
+					real = cur
+					timer = time.After(debounce)
+				}
+			case <-timer:
+				timer = nil
+				reload()
+			case <-watcher.Errors:
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(hup)
+		close(stop)
+		watcher.Close()
+	}, nil
+}
@@ -0,0 +1,88 @@
+package confutil
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type testConfig struct {
+	Etcd struct {
+		Addrs []string `mapstructure:"addrs"`
+	} `mapstructure:"etcd"`
+	Log struct {
+		Level string `mapstructure:"level"`
+	} `mapstructure:"log"`
+	Nodes []struct {
+		ID string `mapstructure:"id"`
+	} `mapstructure:"node"`
+	Ignored string
+}
+
+func TestBindEnvServicePrefixWins(t *testing.T) {
+	t.Setenv("RTC_LOG_LEVEL", "info")
+	t.Setenv("RTC_SIGNAL_LOG_LEVEL", "warn")
+	t.Setenv("RTC_ETCD_ADDRS", "10.0.0.1:2379,10.0.0.2:2379")
+	v := viper.New()
+	c := &testConfig{}
+	BindEnv(v, "signal", c)
+	if err := v.Unmarshal(c); err != nil {
+		t.Fatalf("unmarshal err, err is %v", err)
+	}
+	if c.Log.Level != "warn" {
+		t.Fatalf("service env should win, level is %s", c.Log.Level)
+	}
+	if !reflect.DeepEqual(c.Etcd.Addrs, []string{"10.0.0.1:2379", "10.0.0.2:2379"}) {
+		t.Fatalf("list env should be split by comma, addrs is %v", c.Etcd.Addrs)
+	}
+}
+
+func TestKeysSkipStructLists(t *testing.T) {
+	got := keys(reflect.TypeOf(&testConfig{}), "")
+	if !reflect.DeepEqual(got, []string{"etcd.addrs", "log.level"}) {
+		t.Fatalf("unexpected keys %v", got)
+	}
+}
+
+func TestDiffAndSection(t *testing.T) {
+	a, b := &testConfig{}, &testConfig{}
+	a.Log.Level, b.Log.Level = "debug", "info"
+	b.Etcd.Addrs = []string{"10.0.0.1:2379"}
+	got := Diff(a, b)
+	if !reflect.DeepEqual(got, []string{"etcd.addrs", "log.level"}) {
+		t.Fatalf("unexpected diff %v", got)
+	}
+	if !Section("log.level", "log") || Section("logger.level", "log") || !Section("ice", "ice") {
+		t.Fatal("section should match whole prefixes only")
+	}
+}
+
+func TestWatchReloadsOnWrite(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "signal.toml")
+	if err := os.WriteFile(file, []byte("a = 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := make(chan struct{}, 1)
+	stop, err := Watch(file, func() {
+		select {
+		case reloaded <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		t.Fatalf("watch err, err is %v", err)
+	}
+	defer stop()
+	if err := os.WriteFile(file, []byte("a = 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reload not called after the file changed")
+	}
+}
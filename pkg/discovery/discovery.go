@@ -0,0 +1,47 @@
+package discovery
+
+const (
+	// ServerUp 服务存活
+	ServerUp = 0
+	// ServerDown 服务死亡
+	ServerDown = 1
+)
+
+// ServiceWatchCallback 定义服务节点状态改变的回调
+type ServiceWatchCallback func(status int32, node Node)
+
+// Registrar 服务注册
+type Registrar interface {
+	// NodeInfo 返回服务节点信息
+	NodeInfo() Node
+	// GetRPCChannel 获取RPC对象string
+	GetRPCChannel() string
+	// GetEventChannel 获取广播对象string
+	GetEventChannel() string
+	// SetTURN 设置节点内置TURN服务的地址, 需要在RegisterNode之前调用
+	SetTURN(urls []string)
+	// SetURL 设置客户端连接节点的地址, 需要在RegisterNode之前调用
+	SetURL(url string)
+	// RegisterNode 注册服务节点
+	RegisterNode() error
+	// UpdateNodePayload 更新节点负载
+	UpdateNodePayload(payload int) error
+	// SetDrain 设置节点是否排空, 排空的节点不会再被按负载选中
+	SetDrain(drain bool) error
+	// Close 关闭资源
+	Close()
+}
+
+// Discovery 服务发现
+type Discovery interface {
+	// WatchServiceNode 监控指定前缀的所有服务节点的状态
+	WatchServiceNode(prefix string, callback ServiceWatchCallback)
+	// GetNodes 根据服务名称获取所有该服务节点的所有对象
+	GetNodes(serviceName string) (map[string]Node, bool)
+	// GetNodeByID 根据服务节点的ID获取服务节点对象
+	GetNodeByID(nid string) (*Node, bool)
+	// GetNodeByPayload 获取指定区域内指定服务节点负载最低的节点, 跳过排空中的节点
+	GetNodeByPayload(dc, name string) (*Node, bool)
+	// Close 关闭资源
+	Close()
+}
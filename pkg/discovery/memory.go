@@ -0,0 +1,307 @@
+package discovery
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// watchEvent 节点状态改变事件
+type watchEvent struct {
+	status int32
+	node   Node
+}
+
+// Memory 进程内的服务注册中心, 同一进程内的所有服务共享, 用于all-in-one模式和测试
+type Memory struct {
+	lock     sync.Mutex
+	nodes    map[string]Node
+	watchers []*MemoryWatcher
+}
+
+// NewMemory 新建一个进程内的服务注册中心
+func NewMemory() *Memory {
+	return &Memory{
+		nodes: make(map[string]Node),
+	}
+}
+
+// NewNode 新建一个注册到该注册中心的服务注册对象
+func (m *Memory) NewNode(dc, nid, name string) Registrar {
+	return &MemoryNode{
+		registry: m,
+		node: Node{
+			NodeDC:      dc,
+			NodeID:      nid,
+			Name:        name,
+			NodePayload: "0",
+		},
+	}
+}
+
+// NewWatcher 新建一个该注册中心的服务发现对象
+func (m *Memory) NewWatcher() Discovery {
+	w := &MemoryWatcher{
+		registry: m,
+		events:   make(chan watchEvent, 1024),
+		stop:     make(chan struct{}),
+	}
+	m.lock.Lock()
+	m.watchers = append(m.watchers, w)
+	m.lock.Unlock()
+	return w
+}
+
+// put 写入节点并通知所有服务发现对象
+func (m *Memory) put(node Node) {
+	m.lock.Lock()
+	m.nodes[node.NodeID] = node
+	watchers := append([]*MemoryWatcher(nil), m.watchers...)
+	m.lock.Unlock()
+	for _, w := range watchers {
+		w.notify(watchEvent{status: ServerUp, node: node})
+	}
+}
+
+// delete 删除节点并通知所有服务发现对象
+func (m *Memory) delete(nid string) {
+	m.lock.Lock()
+	node, ok := m.nodes[nid]
+	delete(m.nodes, nid)
+	watchers := append([]*MemoryWatcher(nil), m.watchers...)
+	m.lock.Unlock()
+	if !ok {
+		return
+	}
+	for _, w := range watchers {
+		w.notify(watchEvent{status: ServerDown, node: node})
+	}
+}
+
+// removeWatcher 移除服务发现对象
+func (m *Memory) removeWatcher(w *MemoryWatcher) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i, v := range m.watchers {
+		if v == w {
+			m.watchers = append(m.watchers[:i], m.watchers[i+1:]...)
+			return
+		}
+	}
+}
+
+// snapshot 获取所有节点
+func (m *Memory) snapshot() []Node {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	res := make([]Node, 0, len(m.nodes))
+	for _, node := range m.nodes {
+		res = append(res, node)
+	}
+	return res
+}
+
+var _ Registrar = (*MemoryNode)(nil)
+
+// MemoryNode 进程内的服务注册对象
+type MemoryNode struct {
+	registry   *Memory
+	lock       sync.Mutex
+	node       Node
+	registered bool
+}
+
+// NodeInfo 返回服务节点信息
+func (s *MemoryNode) NodeInfo() Node {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.node
+}
+
+// GetRPCChannel 获取RPC对象string
+func (s *MemoryNode) GetRPCChannel() string {
+	return GetPRCChannel(s.NodeInfo())
+}
+
+// GetEventChannel 获取广播对象string
+func (s *MemoryNode) GetEventChannel() string {
+	return GetEventChannel(s.NodeInfo())
+}
+
+// SetTURN 设置节点内置TURN服务的地址, 需要在RegisterNode之前调用
+func (s *MemoryNode) SetTURN(urls []string) {
+	s.lock.Lock()
+	s.node.TURN = strings.Join(urls, ",")
+	s.lock.Unlock()
+}
+
+// SetURL 设置客户端连接节点的地址, 需要在RegisterNode之前调用
+func (s *MemoryNode) SetURL(url string) {
+	s.lock.Lock()
+	s.node.URL = url
+	s.lock.Unlock()
+}
+
+// RegisterNode 注册服务节点
+func (s *MemoryNode) RegisterNode() error {
+	s.lock.Lock()
+	node := s.node
+	if node.NodeDC == "" || node.NodeID == "" || node.Name == "" {
+		s.lock.Unlock()
+		return errors.New("Node dc id or name must be non empty")
+	}
+	s.registered = true
+	s.lock.Unlock()
+	s.registry.put(node)
+	return nil
+}
+
+// UpdateNodePayload 更新节点负载
+func (s *MemoryNode) UpdateNodePayload(payload int) error {
+	s.lock.Lock()
+	if s.node.NodePayload == strconv.Itoa(payload) {
+		s.lock.Unlock()
+		return nil
+	}
+	s.node.NodePayload = strconv.Itoa(payload)
+	node, registered := s.node, s.registered
+	s.lock.Unlock()
+	if registered {
+		s.registry.put(node)
+	}
+	return nil
+}
+
+// SetDrain 设置节点是否排空
+func (s *MemoryNode) SetDrain(drain bool) error {
+	s.lock.Lock()
+	if s.node.Drain == drain {
+		s.lock.Unlock()
+		return nil
+	}
+	s.node.Drain = drain
+	node, registered := s.node, s.registered
+	s.lock.Unlock()
+	if registered {
+		s.registry.put(node)
+	}
+	return nil
+}
+
+// Close 注销服务节点
+func (s *MemoryNode) Close() {
+	s.lock.Lock()
+	nid, registered := s.node.NodeID, s.registered
+	s.registered = false
+	s.lock.Unlock()
+	if registered {
+		s.registry.delete(nid)
+	}
+}
+
+var _ Discovery = (*MemoryWatcher)(nil)
+
+// MemoryWatcher 进程内的服务发现对象, 节点状态改变按顺序在单独的goroutine中回调
+type MemoryWatcher struct {
+	registry *Memory
+	events   chan watchEvent
+	stop     chan struct{}
+	once     sync.Once
+	stopOnce sync.Once
+	lock     sync.Mutex
+	prefix   string
+	callback ServiceWatchCallback
+}
+
+// notify 投递节点状态改变事件, 还没有开始监控时丢弃
+func (s *MemoryWatcher) notify(ev watchEvent) {
+	s.lock.Lock()
+	watching := s.callback != nil
+	s.lock.Unlock()
+	if !watching {
+		return
+	}
+	select {
+	case s.events <- ev:
+	case <-s.stop:
+	}
+}
+
+// WatchServiceNode 监控指定前缀的所有服务节点的状态, 已经存在的节点立即回调
+func (s *MemoryWatcher) WatchServiceNode(prefix string, callback ServiceWatchCallback) {
+	s.lock.Lock()
+	s.prefix = prefix
+	s.callback = callback
+	s.lock.Unlock()
+	s.once.Do(func() {
+		go s.loop()
+	})
+	for _, node := range s.registry.snapshot() {
+		s.notify(watchEvent{status: ServerUp, node: node})
+	}
+}
+
+// loop 按顺序回调节点状态改变
+func (s *MemoryWatcher) loop() {
+	for {
+		select {
+		case ev := <-s.events:
+			s.lock.Lock()
+			prefix, callback := s.prefix, s.callback
+			s.lock.Unlock()
+			if callback != nil && strings.HasPrefix(ev.node.NodeID, prefix) {
+				callback(ev.status, ev.node)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// GetNodes 根据服务名称获取所有该服务节点的所有对象
+func (s *MemoryWatcher) GetNodes(serviceName string) (map[string]Node, bool) {
+	mapNodes := make(map[string]Node)
+	for _, node := range s.registry.snapshot() {
+		if node.Name == serviceName {
+			mapNodes[node.NodeID] = node
+		}
+	}
+	return mapNodes, len(mapNodes) > 0
+}
+
+// GetNodeByID 根据服务节点的ID获取服务节点对象
+func (s *MemoryWatcher) GetNodeByID(nid string) (*Node, bool) {
+	s.registry.lock.Lock()
+	defer s.registry.lock.Unlock()
+	node, ok := s.registry.nodes[nid]
+	if ok {
+		return &node, true
+	}
+	return nil, false
+}
+
+// GetNodeByPayload 获取指定区域内指定服务节点负载最低的节点, 跳过排空中的节点
+func (s *MemoryWatcher) GetNodeByPayload(dc, name string) (*Node, bool) {
+	var nodePtr *Node
+	payload := 65535
+	for _, node := range s.registry.snapshot() {
+		if node.NodeDC == dc && node.Name == name && !node.Drain {
+			pay, _ := strconv.Atoi(node.NodePayload)
+			if pay < payload {
+				n := node
+				nodePtr = &n
+				payload = pay
+			}
+		}
+	}
+	return nodePtr, nodePtr != nil
+}
+
+// Close 停止监控
+func (s *MemoryWatcher) Close() {
+	s.registry.removeWatcher(s)
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
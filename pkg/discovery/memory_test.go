@@ -0,0 +1,99 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+)
+
+// waitEvent 等待指定节点的状态回调
+func waitEvent(t *testing.T, events chan watchEvent, nid string, status int32) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.node.NodeID == nid && ev.status == status {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("wait node %s status %d timeout", nid, status)
+		}
+	}
+}
+
+func TestMemoryWatch(t *testing.T) {
+	m := NewMemory()
+	early := m.NewNode("dc1", "sfu-1", "sfu")
+	if err := early.RegisterNode(); err != nil {
+		t.Fatalf("register err, err is %v", err)
+	}
+	w := m.NewWatcher()
+	defer w.Close()
+	events := make(chan watchEvent, 16)
+	w.WatchServiceNode("sfu-", func(status int32, node Node) {
+		events <- watchEvent{status: status, node: node}
+	})
+	// 开始监控前已经存在的节点也要回调
+	waitEvent(t, events, "sfu-1", ServerUp)
+
+	late := m.NewNode("dc1", "sfu-2", "sfu")
+	late.RegisterNode()
+	waitEvent(t, events, "sfu-2", ServerUp)
+	// 前缀不匹配的节点不回调
+	m.NewNode("dc1", "signal-1", "signal").RegisterNode()
+	late.Close()
+	waitEvent(t, events, "sfu-2", ServerDown)
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event %v", ev)
+	default:
+	}
+	if nodes, _ := w.GetNodes("sfu"); len(nodes) != 1 {
+		t.Fatalf("only sfu-1 should be left, nodes is %v", nodes)
+	}
+}
+
+func TestMemoryNodeByPayloadSkipsDrain(t *testing.T) {
+	m := NewMemory()
+	w := m.NewWatcher()
+	defer w.Close()
+	a := m.NewNode("dc1", "sfu-a", "sfu")
+	b := m.NewNode("dc1", "sfu-b", "sfu")
+	c := m.NewNode("dc2", "sfu-c", "sfu")
+	for _, n := range []Registrar{a, b, c} {
+		n.RegisterNode()
+	}
+	a.UpdateNodePayload(5)
+	b.UpdateNodePayload(3)
+	if node, ok := w.GetNodeByPayload("dc1", "sfu"); !ok || node.NodeID != "sfu-b" {
+		t.Fatalf("lowest payload node should be sfu-b, node is %v", node)
+	}
+	b.SetDrain(true)
+	if node, ok := w.GetNodeByPayload("dc1", "sfu"); !ok || node.NodeID != "sfu-a" {
+		t.Fatalf("draining node should be skipped, node is %v", node)
+	}
+	a.SetDrain(true)
+	if node, ok := w.GetNodeByPayload("dc1", "sfu"); ok {
+		t.Fatalf("no node should be selected when all are draining, node is %v", node)
+	}
+	if node, ok := w.GetNodeByID("sfu-b"); !ok || !node.Drain || node.NodePayload != "3" {
+		t.Fatalf("node info should carry payload and drain, node is %v", node)
+	}
+}
+
+func TestMemoryRegisterNeedsIdentity(t *testing.T) {
+	if err := NewMemory().NewNode("dc1", "", "sfu").RegisterNode(); err == nil {
+		t.Fatal("register without node id should fail")
+	}
+}
+
+func TestStatic(t *testing.T) {
+	m := NewStatic([]Node{{NodeDC: "dc1", NodeID: "sfu-1", Name: "sfu"}, {NodeDC: "dc1", NodeID: "sfu-2", Name: "sfu", NodePayload: "7"}})
+	w := m.NewWatcher()
+	defer w.Close()
+	if node, ok := w.GetNodeByPayload("dc1", "sfu"); !ok || node.NodeID != "sfu-1" || node.NodePayload != "0" {
+		t.Fatalf("static node without payload should default to 0, node is %v", node)
+	}
+	if nodes, _ := w.GetNodes("sfu"); len(nodes) != 2 {
+		t.Fatalf("static nodes should always be present, nodes is %v", nodes)
+	}
+}
@@ -1,12 +1,15 @@
-package etcd
+package discovery
 
 import "encoding/json"
 
 const (
-	NDC   = "NodeDC"
-	NID   = "NodeID"
-	NNAME = "NodeName"
-	NLOAD = "NODEPAYLOAD"
+	NDC    = "NodeDC"
+	NID    = "NodeID"
+	NNAME  = "NodeName"
+	NLOAD  = "NODEPAYLOAD"
+	NTURN  = "NodeTURN"
+	NDRAIN = "NodeDrain"
+	NURL   = "NodeURL"
 )
 
 type Node struct {
@@ -14,11 +17,14 @@ type Node struct {
 	NodeID      string // 节点id
 	Name        string // 节点名称
 	NodePayload string // 节点负载
+	TURN        string // 节点内置TURN服务的地址, 多个用逗号分隔
+	Drain       bool   // 节点排空中, 不再按负载分配给新的流
+	URL         string // 客户端连接节点的地址, signal节点关闭时推荐给客户端
 }
 
 // Encode 将map转换为string
 func Encode(data map[string]string) string {
-	if data == nil {
+	if data != nil {
 		str, _ := json.Marshal(data)
 		return string(str)
 	}
@@ -42,6 +48,15 @@ func (n *Node) GetNodeValue() string {
 	data[NID] = n.NodeID
 	data[NNAME] = n.Name
 	data[NLOAD] = n.NodePayload
+	if n.TURN != "" {
+		data[NTURN] = n.TURN
+	}
+	if n.Drain {
+		data[NDRAIN] = "1"
+	}
+	if n.URL != "" {
+		data[NURL] = n.URL
+	}
 	return Encode(data)
 }
 
@@ -0,0 +1,14 @@
+package discovery
+
+// NewStatic 新建静态配置的服务注册和发现, 用于节点固定的小规模部署
+// 配置的节点一直认为是存活的, 节点负载和内置TURN地址只在本进程内可见
+func NewStatic(nodes []Node) *Memory {
+	m := NewMemory()
+	for _, node := range nodes {
+		if node.NodePayload == "" {
+			node.NodePayload = "0"
+		}
+		m.nodes[node.NodeID] = node
+	}
+	return m
+}
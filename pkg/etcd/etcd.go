@@ -15,6 +15,7 @@ const (
 	defaultDialTimeout      = time.Second * 5
 	defaultGrantTimeout     = 5
 	defaultOperationTimeout = time.Second * 5
+	defaultRetryInterval    = time.Second * 2
 )
 
 // watchCallback watch 回调
@@ -23,6 +24,7 @@ type WatchCallback func(watchChan clientv3.WatchChan)
 type Etcd struct {
 	client        *clientv3.Client            // etcd 客户端
 	liveKeyID     map[string]clientv3.LeaseID // 租约map
+	liveKeyValue  map[string]string           // 保活的key当前的值, 租约丢失后用于重新写入
 	liveKeyIDLock sync.RWMutex                // map租约锁
 	stop          bool                        // 停止开关
 }
@@ -40,18 +42,21 @@ func NewEtcd(endpoints []string) (*Etcd, error) {
 	etcd := new(Etcd)
 	etcd.client = cli
 	etcd.liveKeyID = make(map[string]clientv3.LeaseID)
+	etcd.liveKeyValue = make(map[string]string)
 	etcd.stop = false
 	return etcd, nil
 }
 
 // keep 写入key-value并且保活
 func (e *Etcd) Keep(key, value string) error {
-	resp, err := e.client.Grant(context.TODO(), defaultGrantTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultOperationTimeout)
+	defer cancel()
+	resp, err := e.client.Grant(ctx, defaultGrantTimeout)
 	if err != nil {
 		log.Printf("Etcd Grant err, key is %s, err is %v", key, err)
 		return err
 	}
-	_, err = e.client.Put(context.TODO(), key, value, clientv3.WithLease(resp.ID))
+	_, err = e.client.Put(ctx, key, value, clientv3.WithLease(resp.ID))
 	if err != nil {
 		log.Printf("Etcd put err, key is %s, err is %v", key, err)
 		return err
@@ -61,29 +66,45 @@ func (e *Etcd) Keep(key, value string) error {
 		log.Printf("Etcd KeepAlive err, key is %s, err is %v", key, err)
 		return err
 	}
-	// 读chan
-	go func() {
-		for {
-			if e.stop {
-				return
-			}
-			<-ch
-		}
-	}()
-
 	// 加入map
 	e.liveKeyIDLock.Lock()
 	e.liveKeyID[key] = resp.ID
+	e.liveKeyValue[key] = value
 	e.liveKeyIDLock.Unlock()
+	// 读chan
+	go e.keepAlive(key, resp.ID, ch)
 	log.Printf("Etcd Keep ok, key is %s, value is %s", key, value)
 	return nil
 }
 
+// keepAlive 读取续约应答, 续约通道关闭说明租约丢失(etcd重启、网络中断超过租约时间等), 重新写入key
+func (e *Etcd) keepAlive(key string, id clientv3.LeaseID, ch <-chan *clientv3.LeaseKeepAliveResponse) {
+	for range ch {
+	}
+	for {
+		e.liveKeyIDLock.RLock()
+		stop := e.stop
+		value, ok := e.liveKeyValue[key]
+		cur := e.liveKeyID[key]
+		e.liveKeyIDLock.RUnlock()
+		// 已经关闭、删除或者已经重新写入
+		if stop || !ok || cur != id {
+			return
+		}
+		log.Printf("Etcd lease lost, key is %s, keep again", key)
+		if err := e.Keep(key, value); err == nil {
+			return
+		}
+		time.Sleep(defaultRetryInterval)
+	}
+}
+
 // update 更新k-v
 func (e *Etcd) Update(key, value string) error {
 	// 查询原来的id
 	e.liveKeyIDLock.Lock()
 	id := e.liveKeyID[key]
+	e.liveKeyValue[key] = value
 	e.liveKeyIDLock.Unlock()
 
 	// 更新写入
@@ -102,15 +123,19 @@ func (e *Etcd) Update(key, value string) error {
 func (e *Etcd) Delete(key string, prefix bool) error {
 	var err error
 	if prefix {
+		e.liveKeyIDLock.Lock()
 		for k := range e.liveKeyID {
 			if strings.HasPrefix(k, key) {
 				delete(e.liveKeyID, k)
+				delete(e.liveKeyValue, k)
 			}
 		}
+		e.liveKeyIDLock.Unlock()
 		_, err = e.client.Delete(context.TODO(), key, clientv3.WithPrefix())
 	} else {
 		e.liveKeyIDLock.Lock()
 		delete(e.liveKeyID, key)
+		delete(e.liveKeyValue, key)
 		e.liveKeyIDLock.Unlock()
 		_, err = e.client.Delete(context.TODO(), key)
 	}
@@ -132,14 +157,15 @@ func (e *Etcd) Watch(key string, watchFunc WatchCallback, prefix bool) error {
 
 // close 关闭etcd对象
 func (e *Etcd) Close() error {
+	e.liveKeyIDLock.Lock()
+	defer e.liveKeyIDLock.Unlock()
 	if e.stop {
 		return errors.New("Etcd aleady close")
 	}
 	e.stop = true
-	e.liveKeyIDLock.Lock()
-	defer e.liveKeyIDLock.Unlock()
 	for k, _ := range e.liveKeyID {
 		delete(e.liveKeyID, k)
+		delete(e.liveKeyValue, k)
 		e.client.Delete(context.TODO(), k)
 	}
 	return e.client.Close()
@@ -2,99 +2,174 @@ package etcd
 
 import (
 	"errors"
+	"goRTCServer/pkg/discovery"
 	"log"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-// ServiceNode 服务注册对象
+var _ discovery.Registrar = (*ServiceNode)(nil)
+
+// ServiceNode 服务注册对象, 基于etcd实现discovery.Registrar
+// 节点信息由lock保护, 负载和排空状态的修改由一个goroutine按顺序写入etcd, 后写入的总是最新状态
 type ServiceNode struct {
-	etcd *Etcd
-	node Node
+	etcd      *Etcd
+	lock      sync.Mutex
+	node      discovery.Node
+	update    chan struct{}
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
 // NewServiceNode 新建一个服务注册对象
-func NewServiceNode(endpoints []string, dc, nid, name string) *ServiceNode {
+func NewServiceNode(endpoints []string, dc, nid, name string) (*ServiceNode, error) {
 	etcd, err := NewEtcd(endpoints)
 	if err != nil {
 		log.Printf("NewServiceNode err, err = %v", err)
-		return nil
+		return nil, err
 	}
 	return &ServiceNode{
 		etcd: etcd,
-		node: Node{
+		node: discovery.Node{
 			NodeDC:      dc,
 			NodeID:      nid,
 			Name:        name,
 			NodePayload: "0",
 		},
-	}
+		update: make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+	}, nil
 }
 
 // Close 关闭资源
 func (s *ServiceNode) Close() {
+	s.closeOnce.Do(func() { close(s.stop) })
 	if s.etcd != nil {
 		s.etcd.Close()
 	}
 }
 
 // NodeInfo 返回服务节点信息
-func (s *ServiceNode) NodeInfo() Node {
+func (s *ServiceNode) NodeInfo() discovery.Node {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	return s.node
 }
 
 // GetRPCChannel 获取RPC对象string
 func (s *ServiceNode) GetRPCChannel() string {
-	return GetPRCChannel(s.node)
+	return discovery.GetPRCChannel(s.NodeInfo())
 }
 
 // GetEventChannel 获取广播对象string
 func (s *ServiceNode) GetEventChannel() string {
-	return GetEventChannel(s.node)
+	return discovery.GetEventChannel(s.NodeInfo())
+}
+
+// SetTURN 设置节点内置TURN服务的地址, 需要在RegisterNode之前调用
+func (s *ServiceNode) SetTURN(urls []string) {
+	s.lock.Lock()
+	s.node.TURN = strings.Join(urls, ",")
+	s.lock.Unlock()
+}
+
+// SetURL 设置客户端连接节点的地址, 需要在RegisterNode之前调用
+func (s *ServiceNode) SetURL(url string) {
+	s.lock.Lock()
+	s.node.URL = url
+	s.lock.Unlock()
 }
 
 // RegisterNode 注册服务节点
 func (s *ServiceNode) RegisterNode() error {
-	if s.node.NodeDC == "" || s.node.NodeID == "" || s.node.Name == "" {
+	node := s.NodeInfo()
+	if node.NodeDC == "" || node.NodeID == "" || node.Name == "" {
 		return errors.New("Node dc id or name must be non empty")
 	}
-	go s.keepRegistered(s.node)
+	go s.run(node)
 	return nil
 }
 
 // UpdateNodePayload 更新节点负载
 func (s *ServiceNode) UpdateNodePayload(payload int) error {
-	if s.node.NodePayload != strconv.Itoa(payload) {
-		s.node.NodePayload = strconv.Itoa(payload)
-		go s.updateRegistered(s.node)
+	s.lock.Lock()
+	changed := s.node.NodePayload != strconv.Itoa(payload)
+	s.node.NodePayload = strconv.Itoa(payload)
+	s.lock.Unlock()
+	if changed {
+		s.notifyUpdate()
 	}
 	return nil
 }
 
-// keepRegister 注册一个服务节点到etcd服务上
-func (s *ServiceNode) keepRegistered(node Node) {
+// SetDrain 设置节点是否排空
+func (s *ServiceNode) SetDrain(drain bool) error {
+	s.lock.Lock()
+	changed := s.node.Drain != drain
+	s.node.Drain = drain
+	s.lock.Unlock()
+	if changed {
+		s.notifyUpdate()
+	}
+	return nil
+}
+
+// notifyUpdate 通知写入goroutine节点信息有变化, 多次变化合并为一次写入
+func (s *ServiceNode) notifyUpdate() {
+	select {
+	case s.update <- struct{}{}:
+	default:
+	}
+}
+
+// run 注册服务节点, 之后按顺序把节点信息的变化写入etcd
+func (s *ServiceNode) run(node discovery.Node) {
+	if !s.keepRegistered(node) {
+		return
+	}
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.update:
+			s.updateRegistered()
+		}
+	}
+}
+
+// keepRegister 注册一个服务节点到etcd服务上, 节点关闭时返回false
+func (s *ServiceNode) keepRegistered(node discovery.Node) bool {
 	for {
 		err := s.etcd.Keep(node.NodeID, node.GetNodeValue())
-		if err != nil {
-			log.Printf("keeyRegistered node err, err is %v", err)
-			time.Sleep(5 * time.Second)
-		} else {
+		if err == nil {
 			log.Printf("Node[%s] keepRegistered succes!", node.NodeID)
-			return
+			return true
+		}
+		log.Printf("keeyRegistered node err, err is %v", err)
+		select {
+		case <-s.stop:
+			return false
+		case <-time.After(5 * time.Second):
 		}
 	}
 }
 
-// updateRegistered 更新一个服务节点到etcd服务上
-func (s *ServiceNode) updateRegistered(node Node) {
+// updateRegistered 把最新的节点信息更新到etcd服务上, 失败时重试, 重试时使用重试期间的最新状态
+func (s *ServiceNode) updateRegistered() {
 	for {
+		node := s.NodeInfo()
 		err := s.etcd.Update(node.NodeID, node.GetNodeValue())
-		if err != nil {
-			log.Printf("updateRegistered node err, err is %v", err)
-			time.Sleep(5 * time.Second)
-		} else {
+		if err == nil {
 			log.Printf("Node[%s] updateRegistered success!", node.NodeID)
 			return
 		}
+		log.Printf("updateRegistered node err, err is %v", err)
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(5 * time.Second):
+		}
 	}
 }
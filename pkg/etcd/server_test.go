@@ -0,0 +1,58 @@
+package etcd
+
+import (
+	"goRTCServer/pkg/discovery"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestServiceNodeUpdates 需要etcd服务, 设置RTC_TEST_ETCD_ADDRS后运行, 多个地址用逗号分隔, 例如127.0.0.1:2379
+// 并发修改负载和排空状态, etcd中最终保存的是最后一次修改的状态
+func TestServiceNodeUpdates(t *testing.T) {
+	addrs := os.Getenv("RTC_TEST_ETCD_ADDRS")
+	if addrs == "" {
+		t.Skip("RTC_TEST_ETCD_ADDRS not set")
+	}
+	nid := "test-" + time.Now().Format("150405.000")
+	s, err := NewServiceNode(strings.Split(addrs, ","), "dc1", nid, "sfu")
+	if err != nil {
+		t.Fatalf("new service node err, err is %v", err)
+	}
+	defer s.Close()
+	defer s.etcd.Delete(nid, false)
+	if err = s.RegisterNode(); err != nil {
+		t.Fatalf("register node err, err is %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				s.UpdateNodePayload(i*100 + j)
+				s.SetDrain(j%2 == 0)
+				s.NodeInfo()
+			}
+		}(i)
+	}
+	wg.Wait()
+	s.UpdateNodePayload(7)
+	s.SetDrain(true)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		value, _ := s.etcd.GetValue(nid)
+		data := discovery.Decode([]byte(value))
+		if data[discovery.NLOAD] == "7" && data[discovery.NDRAIN] == "1" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("etcd should keep the last state, value is %s", value)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
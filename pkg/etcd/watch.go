@@ -1,46 +1,41 @@
 package etcd
 
 import (
+	"goRTCServer/pkg/discovery"
 	"log"
 	"strconv"
 	"sync"
+	"time"
 
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
-const (
-	// ServerUp 服务存活
-	ServerUp = 0
-	// ServerDown 服务死亡
-	ServerDown = 1
-)
-
-// ServiceWatchCallback 定义服务节点状态改变的回调
-type ServiceWatchCallback func(status int32, node Node)
+var _ discovery.Discovery = (*ServiceWatcher)(nil)
 
-// ServiceWatcher 服务发现对象
+// ServiceWatcher 服务发现对象, 基于etcd实现discovery.Discovery
 type ServiceWatcher struct {
 	etcd     *Etcd
 	bstop    bool
-	nodes    map[string]Node
+	prefix   string
+	nodes    map[string]discovery.Node
 	nodeLock sync.Mutex
-	callback ServiceWatchCallback
+	callback discovery.ServiceWatchCallback
 }
 
 // NewServiceWatcher 新建一个服务发现对象
-func NewServiceWatcher(endpoints []string) *ServiceWatcher {
+func NewServiceWatcher(endpoints []string) (*ServiceWatcher, error) {
 	etcd, err := NewEtcd(endpoints)
 	if err != nil {
 		log.Printf("NewServiceWatcher err, err is %v", err)
-		return nil
+		return nil, err
 	}
 	return &ServiceWatcher{
 		etcd:     etcd,
 		bstop:    false,
-		nodes:    make(map[string]Node),
+		nodes:    make(map[string]discovery.Node),
 		nodeLock: sync.Mutex{},
 		callback: nil,
-	}
+	}, nil
 }
 
 // Close 关闭资源
@@ -52,10 +47,10 @@ func (s *ServiceWatcher) Close() {
 }
 
 // GetNodes 根据服务名称获取所有该服务节点的所有对象
-func (s *ServiceWatcher) GetNodes(serviceName string) (map[string]Node, bool) {
+func (s *ServiceWatcher) GetNodes(serviceName string) (map[string]discovery.Node, bool) {
 	s.nodeLock.Lock()
 	defer s.nodeLock.Unlock()
-	mapNodes := make(map[string]Node)
+	mapNodes := make(map[string]discovery.Node)
 	for _, node := range s.nodes {
 		if node.Name == serviceName {
 			mapNodes[node.NodeID] = node
@@ -68,7 +63,7 @@ func (s *ServiceWatcher) GetNodes(serviceName string) (map[string]Node, bool) {
 }
 
 // GetNodeByID 根据服务节点的ID获取服务节点对象
-func (s *ServiceWatcher) GetNodeByID(nid string) (*Node, bool) {
+func (s *ServiceWatcher) GetNodeByID(nid string) (*discovery.Node, bool) {
 	s.nodeLock.Lock()
 	defer s.nodeLock.Unlock()
 	node, ok := s.nodes[nid]
@@ -78,17 +73,18 @@ func (s *ServiceWatcher) GetNodeByID(nid string) (*Node, bool) {
 	return nil, false
 }
 
-// GetNodeByPayload 获取指定区域内指定服务节点负载最低的节点
-func (s *ServiceWatcher) GetNodeByPayload(dc, name string) (*Node, bool) {
-	var nodePtr *Node = nil
+// GetNodeByPayload 获取指定区域内指定服务节点负载最低的节点, 跳过排空中的节点
+func (s *ServiceWatcher) GetNodeByPayload(dc, name string) (*discovery.Node, bool) {
+	var nodePtr *discovery.Node = nil
 	var payload int = 65535
 	s.nodeLock.Lock()
 	defer s.nodeLock.Unlock()
 	for _, node := range s.nodes {
-		if node.NodeDC == dc && node.NodeDC == name {
+		if node.NodeDC == dc && node.Name == name && !node.Drain {
 			pay, _ := strconv.Atoi(node.NodePayload)
 			if pay < payload {
-				nodePtr = &node
+				n := node
+				nodePtr = &n
 				payload = pay
 			}
 		}
@@ -118,17 +114,25 @@ func (s *ServiceWatcher) WatchNode(ch clientv3.WatchChan) {
 			if s.bstop {
 				return
 			}
-			msg := <-ch
+			msg, ok := <-ch
+			if !ok {
+				// watch被etcd关闭(etcd重启、历史版本被压缩等), 重新同步节点并监控
+				s.rewatch()
+				return
+			}
 			for _, ev := range msg.Events {
 				if ev.Type == clientv3.EventTypePut {
 					nid := string(ev.Kv.Key)
-					mpNode := Decode(ev.Kv.Value)
+					mpNode := discovery.Decode(ev.Kv.Value)
 					if mpNode["NodeID"] != "" && mpNode["NodeID"] == nid {
-						node := Node{
-							NodeDC:      mpNode[NDC],
-							NodeID:      mpNode[NID],
-							Name:        mpNode[NNAME],
-							NodePayload: mpNode[NLOAD],
+						node := discovery.Node{
+							NodeDC:      mpNode[discovery.NDC],
+							NodeID:      mpNode[discovery.NID],
+							Name:        mpNode[discovery.NNAME],
+							NodePayload: mpNode[discovery.NLOAD],
+							TURN:        mpNode[discovery.NTURN],
+							Drain:       mpNode[discovery.NDRAIN] == "1",
+							URL:         mpNode[discovery.NURL],
 						}
 						s.nodeLock.Lock()
 						s.nodes[nid] = node
@@ -136,7 +140,7 @@ func (s *ServiceWatcher) WatchNode(ch clientv3.WatchChan) {
 
 						log.Printf("Node update, ID is [%s]", nid)
 						if s.callback != nil {
-							s.callback(ServerUp, node)
+							s.callback(discovery.ServerUp, node)
 						}
 					}
 				} else if ev.Type == clientv3.EventTypeDelete {
@@ -145,7 +149,7 @@ func (s *ServiceWatcher) WatchNode(ch clientv3.WatchChan) {
 					if ok {
 						log.Printf("Node delete, ID is [%s]", nid)
 						if s.callback != nil {
-							s.callback(ServerDown, *node)
+							s.callback(discovery.ServerDown, *node)
 						}
 						s.DeleteNodeByID(nid)
 					}
@@ -156,8 +160,9 @@ func (s *ServiceWatcher) WatchNode(ch clientv3.WatchChan) {
 }
 
 // WatchServiceNode 监控指定服务名称的所有服务节点的状态
-func (s *ServiceWatcher) WatchServiceNode(prefix string, callback ServiceWatchCallback) {
+func (s *ServiceWatcher) WatchServiceNode(prefix string, callback discovery.ServiceWatchCallback) {
 	s.callback = callback
+	s.prefix = prefix
 	s.GetServiceNodes(prefix)
 	s.etcd.Watch(prefix, s.WatchNode, true)
 }
@@ -167,16 +172,20 @@ func (s *ServiceWatcher) GetServiceNodes(prefix string) {
 	resp, err := s.etcd.GetResponseByPrefix(prefix)
 	if err != nil {
 		log.Println(err.Error())
+		return
 	}
 
 	for _, kv := range resp.Kvs {
-		mpNode := Decode(kv.Value)
+		mpNode := discovery.Decode(kv.Value)
 		if mpNode["NodeID"] != "" {
-			node := Node{
-				mpNode[NDC],
-				mpNode[NID],
-				mpNode[NNAME],
-				mpNode[NLOAD],
+			node := discovery.Node{
+				NodeDC:      mpNode[discovery.NDC],
+				NodeID:      mpNode[discovery.NID],
+				Name:        mpNode[discovery.NNAME],
+				NodePayload: mpNode[discovery.NLOAD],
+				TURN:        mpNode[discovery.NTURN],
+				Drain:       mpNode[discovery.NDRAIN] == "1",
+				URL:         mpNode[discovery.NURL],
 			}
 			s.nodeLock.Lock()
 			s.nodes[node.NodeID] = node
@@ -184,8 +193,42 @@ func (s *ServiceWatcher) GetServiceNodes(prefix string) {
 
 			log.Printf("Find Node , nodeID is [%s]", node.NodeID)
 			if s.callback != nil {
-				s.callback(ServerUp, node)
+				s.callback(discovery.ServerUp, node)
+			}
+		}
+	}
+}
+
+// rewatch watch关闭后重新获取节点并监控, 期间消失的节点回调ServerDown
+func (s *ServiceWatcher) rewatch() {
+	for !s.bstop {
+		time.Sleep(defaultRetryInterval)
+		resp, err := s.etcd.GetResponseByPrefix(s.prefix)
+		if err != nil {
+			log.Printf("ServiceWatcher rewatch err, err is %v", err)
+			continue
+		}
+		alive := make(map[string]bool)
+		for _, kv := range resp.Kvs {
+			alive[string(kv.Key)] = true
+		}
+		s.nodeLock.Lock()
+		gone := make([]discovery.Node, 0)
+		for nid, node := range s.nodes {
+			if !alive[nid] {
+				gone = append(gone, node)
+				delete(s.nodes, nid)
+			}
+		}
+		s.nodeLock.Unlock()
+		for _, node := range gone {
+			log.Printf("Node delete, ID is [%s]", node.NodeID)
+			if s.callback != nil {
+				s.callback(discovery.ServerDown, node)
 			}
 		}
+		s.GetServiceNodes(s.prefix)
+		s.etcd.Watch(s.prefix, s.WatchNode, true)
+		return
 	}
 }
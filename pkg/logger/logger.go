@@ -10,10 +10,18 @@ import (
 
 var LogKf *logrus.Logger
 
+// DoInit 初始化日志, 没有配置kafka地址时只输出到标准输出
 func DoInit(url string, topic string) (*logrus.Logger, error) {
-	if url == "" || topic == "" {
-		logrus.Errorf("url or topic 为空")
-		return nil, errors.New("url or topic 为空")
+	if topic == "" {
+		logrus.Errorf("topic 为空")
+		return nil, errors.New("topic 为空")
+	}
+	if url == "" {
+		if LogKf == nil {
+			LogKf = logrus.New()
+			LogKf.SetLevel(logrus.ErrorLevel)
+		}
+		return LogKf, nil
 	}
 	producer, err := logkafka.SimpleProducer([]string{url}, sarama.CompressionSnappy, sarama.WaitForLocal, nil)
 	if err != nil {
@@ -31,41 +39,21 @@ func SetLevel(l logrus.Level) {
 }
 
 func Infof(format string, v ...interface{}) {
-	if v == nil {
-		LogKf.Infof(format, nil)
-	} else {
-		LogKf.Infof(format, v)
-	}
+	LogKf.Infof(format, v...)
 }
 
 func Debugf(format string, v ...interface{}) {
-	if v == nil {
-		LogKf.Debugf(format, nil)
-	} else {
-		LogKf.Debugf(format, v)
-	}
+	LogKf.Debugf(format, v...)
 }
 
 func Warnf(format string, v ...interface{}) {
-	if v == nil {
-		LogKf.Warnf(format, nil)
-	} else {
-		LogKf.Warnf(format, v)
-	}
+	LogKf.Warnf(format, v...)
 }
 
 func Errorf(format string, v ...interface{}) {
-	if v == nil {
-		LogKf.Errorf(format, nil)
-	} else {
-		LogKf.Errorf(format, v)
-	}
+	LogKf.Errorf(format, v...)
 }
 
 func Panicf(format string, v ...interface{}) {
-	if v == nil {
-		LogKf.Panicf(format, nil)
-	} else {
-		LogKf.Panicf(format, v)
-	}
+	LogKf.Panicf(format, v...)
 }
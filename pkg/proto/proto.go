@@ -6,26 +6,62 @@ const (
 	/*
 		client->singal服务器之间通信
 	*/
-	ClientToSignalJoin         = "join"        // 加入房间
-	ClientToSignalLeave        = "leave"       // 离开房间
-	ClientToSignalKeepAlive    = "keepalive"   // 保活
-	ClientToSignalPublish      = "publish"     // 发布流
-	ClientToSignalUnPublish    = "unpublish"   // 取消发布流
-	ClientToSignalSubscribe    = "subscribe"   // 订阅流
-	ClientToSignalUnSubscribe  = "unsubscribe" // 取消订阅流
-	ClientToSignalBroadcast    = "broadcast"   // 广播
-	ClientToSignalGetRoomUsers = "getusers"    // 获取房间内用户数据
-	ClientToSignalGetRoomPubs  = "getpubs"     // 获取房间内用户流信息
+	ClientToSignalJoin         = "join"          // 加入房间
+	ClientToSignalLeave        = "leave"         // 离开房间
+	ClientToSignalKeepAlive    = "keepalive"     // 保活
+	ClientToSignalPublish      = "publish"       // 发布流
+	ClientToSignalUnPublish    = "unpublish"     // 取消发布流
+	ClientToSignalSubscribe    = "subscribe"     // 订阅流
+	ClientToSignalUnSubscribe  = "unsubscribe"   // 取消订阅流
+	ClientToSignalBroadcast    = "broadcast"     // 广播
+	ClientToSignalGetRoomUsers = "getusers"      // 获取房间内用户数据
+	ClientToSignalGetRoomPubs  = "getpubs"       // 获取房间内用户流信息
+	ClientToSignalStartMix     = "startmix"      // 开启房间混音
+	ClientToSignalStopMix      = "stopmix"       // 关闭房间混音
+	ClientToSignalSubMix       = "submix"        // 订阅房间混音
+	ClientToSignalUnSubMix     = "unsubmix"      // 取消订阅房间混音
+	ClientToSignalRTPPublish   = "rtp_publish"   // 创建RTP推流端口
+	ClientToSignalRTPForward   = "rtp_forward"   // 将流转发到RTP地址
+	ClientToSignalRTPUnForward = "rtp_unforward" // 停止RTP转发
+	ClientToSignalStartHLS     = "starthls"      // 开启HLS直播输出
+	ClientToSignalStopHLS      = "stophls"       // 关闭HLS直播输出
+	ClientToSignalStartRTMP    = "startrtmp"     // 开启RTMP推流
+	ClientToSignalStopRTMP     = "stoprtmp"      // 停止RTMP推流
+	ClientToSignalRTMPStatus   = "rtmpstatus"    // 查询RTMP推流状态
+	ClientToSignalRestartICE   = "restart_ice"   // 重建推流/拉流连接
+	ClientToSignalReconnectPC  = "reconnect_pc"  // restart_ice的旧名称, 保留兼容
+	ClientToSignalSetRoom      = "set_room"      // 设置房间人数/密码/等候室
+	ClientToSignalAdmit        = "admit"         // 主持人允许等候室用户进入
+	ClientToSignalDeny         = "deny"          // 主持人拒绝等候室用户进入
+	ClientToSignalSetRoomMeta  = "set_room_meta" // 设置房间元数据
+	ClientToSignalSetUserMeta  = "set_user_meta" // 设置自己的用户元数据
+	ClientToSignalGetRoomMeta  = "get_room_meta" // 获取房间和用户元数据
+	ClientToSignalChat         = "chat"          // 发送聊天消息
+	ClientToSignalChatHistory  = "chat_history"  // 分页获取聊天记录
+	ClientToSignalMute         = "mute"          // 停止发送某一类媒体
+	ClientToSignalUnMute       = "unmute"        // 恢复发送某一类媒体
+	ClientToSignalPauseSub     = "pause_sub"     // 暂停接收订阅的流
+	ClientToSignalResumeSub    = "resume_sub"    // 恢复接收订阅的流
 
 	/*
 		signal->client通信
 	*/
-	SignalToClientOnJoin         = "peer_join"     // 有用户加入房间
-	SignalToClientOnLeave        = "peer_leave"    // 有用户离开房间
-	SignalToClientOnStreamAdd    = "stream_add"    // 有人发布流
-	SignalToClientOnStreamRemove = "stream_remove" // 有人取消发布
-	SignalToClientBroadcast      = "broadcast"     // 有人发送广播
-	SignalToClientOnKick         = "peer_kick"     // 被服务器踢下线
+	SignalToClientOnJoin         = "peer_join"         // 有用户加入房间
+	SignalToClientOnLeave        = "peer_leave"        // 有用户离开房间
+	SignalToClientOnStreamAdd    = "stream_add"        // 有人发布流
+	SignalToClientOnStreamRemove = "stream_remove"     // 有人取消发布
+	SignalToClientBroadcast      = "broadcast"         // 有人发送广播
+	SignalToClientOnKick         = "peer_kick"         // 被服务器踢下线
+	SignalToClientOnMixStart     = "mix_start"         // 房间开启混音
+	SignalToClientOnMixStop      = "mix_stop"          // 房间关闭混音
+	SignalToClientOnLobbyJoin    = "lobby_join"        // 有用户进入等候室, 只通知主持人
+	SignalToClientOnLobbyAdmit   = "lobby_admit"       // 等候室用户被允许进入
+	SignalToClientOnLobbyDeny    = "lobby_deny"        // 等候室用户被拒绝进入
+	SignalToClientOnRoomMeta     = "room_meta_changed" // 房间元数据变化
+	SignalToClientOnUserMeta     = "user_meta_changed" // 用户元数据变化
+	SignalToClientOnChat         = "chat"              // 收到聊天消息
+	SignalToClientOnStreamUpdate = "stream_update"     // 有人静音/取消静音
+	SignalToClientReconnect      = "reconnect"         // signal节点关闭, 需要重连到其他节点
 
 	/*
 		signal->signal通信
@@ -36,15 +72,39 @@ const (
 	SignalToSignalOnStreamRemove = SignalToClientOnStreamRemove // 有用户取消发布
 	SignalToSignalBroadcast      = SignalToClientBroadcast      // 有用户发广播
 	SignalToSignalOnKick         = SignalToClientOnKick         // 被服务端踢下线
+	SignalToSignalOnMixStart     = SignalToClientOnMixStart     // 房间开启混音
+	SignalToSignalOnMixStop      = SignalToClientOnMixStop      // 房间关闭混音
+	SignalToSignalOnLobbyJoin    = SignalToClientOnLobbyJoin    // 有用户进入等候室
+	SignalToSignalOnLobbyAdmit   = SignalToClientOnLobbyAdmit   // 等候室用户被允许进入
+	SignalToSignalOnLobbyDeny    = SignalToClientOnLobbyDeny    // 等候室用户被拒绝进入
+	SignalToSignalOnRoomMeta     = SignalToClientOnRoomMeta     // 房间元数据变化
+	SignalToSignalOnUserMeta     = SignalToClientOnUserMeta     // 用户元数据变化
+	SignalToSignalOnChat         = SignalToClientOnChat         // 收到聊天消息
+	SignalToSignalOnStreamUpdate = SignalToClientOnStreamUpdate // 有人静音/取消静音
 
 	/*
 		signal <-> sfu通信
 	*/
-	SignalToSfuPublish        = ClientToSignalPublish     // signal->sfu 发布流
-	SignalToSfuUnPublish      = ClientToSignalUnPublish   // signal->sfu 取消发布流
-	SignalToSfuSubscribe      = ClientToSignalSubscribe   // signal->sfu 订阅流
-	SignalToSfuUnSubscribe    = ClientToSignalUnSubscribe // signal->sfu 取消订阅
-	SfuToSignalOnStreamRemove = "sfu_stream_remove"       // sfu->signal 通知流被移除
+	SignalToSfuPublish        = ClientToSignalPublish      // signal->sfu 发布流
+	SignalToSfuUnPublish      = ClientToSignalUnPublish    // signal->sfu 取消发布流
+	SignalToSfuSubscribe      = ClientToSignalSubscribe    // signal->sfu 订阅流
+	SignalToSfuUnSubscribe    = ClientToSignalUnSubscribe  // signal->sfu 取消订阅
+	SignalToSfuStartMix       = ClientToSignalStartMix     // signal->sfu 开启房间混音
+	SignalToSfuStopMix        = ClientToSignalStopMix      // signal->sfu 关闭房间混音
+	SignalToSfuSubMix         = ClientToSignalSubMix       // signal->sfu 订阅房间混音
+	SignalToSfuUnSubMix       = ClientToSignalUnSubMix     // signal->sfu 取消订阅房间混音
+	SignalToSfuRTPPublish     = ClientToSignalRTPPublish   // signal->sfu 创建RTP推流端口
+	SignalToSfuRTPForward     = ClientToSignalRTPForward   // signal->sfu 将流转发到RTP地址
+	SignalToSfuRTPUnForward   = ClientToSignalRTPUnForward // signal->sfu 停止RTP转发
+	SignalToSfuStartHLS       = ClientToSignalStartHLS     // signal->sfu 开启HLS直播输出
+	SignalToSfuStopHLS        = ClientToSignalStopHLS      // signal->sfu 关闭HLS直播输出
+	SignalToSfuStartRTMP      = ClientToSignalStartRTMP    // signal->sfu 开启RTMP推流
+	SignalToSfuStopRTMP       = ClientToSignalStopRTMP     // signal->sfu 停止RTMP推流
+	SignalToSfuRTMPStatus     = ClientToSignalRTMPStatus   // signal->sfu 查询RTMP推流状态
+	SignalToSfuRestartICE     = ClientToSignalRestartICE   // signal->sfu 重建推流/拉流连接
+	SignalToSfuMute           = ClientToSignalMute         // signal->sfu 停止/恢复转发某一类媒体
+	SignalToSfuPauseSub       = ClientToSignalPauseSub     // signal->sfu 暂停/恢复向订阅者转发
+	SfuToSignalOnStreamRemove = "sfu_stream_remove"        // sfu->signal 通知流被移除
 
 	/*
 		signal -> register通信
@@ -58,6 +118,33 @@ const (
 	SignalToRegisterGetSfuInfo     = "getSfuInfo"    // signal->register 获取对应的sfu
 	SignalToRegisterGetRoomUsers   = "getRoomUsers"  // signal->register 获取房间其他用户数据
 	SignalToRegisterGetRoomPubs    = "getRoomPubs"   // signal->register 获取房间其他用户推流数据
+	SignalToRegisterOnMixAdd       = "mix_add"       // signal->register 房间开启混音
+	SignalToRegisterOnMixRemove    = "mix_remove"    // signal->register 房间关闭混音
+	SignalToRegisterGetMixInfo     = "getMixInfo"    // signal->register 获取房间混音所在的sfu
+	SignalToRegisterSetRoom        = "setRoom"       // signal->register 设置房间人数/密码/等候室
+	SignalToRegisterLobbyAdmit     = "lobbyAdmit"    // signal->register 允许等候室用户进入
+	SignalToRegisterLobbyDeny      = "lobbyDeny"     // signal->register 拒绝等候室用户进入
+	SignalToRegisterSetRoomMeta    = "setRoomMeta"   // signal->register 设置房间元数据
+	SignalToRegisterSetUserMeta    = "setUserMeta"   // signal->register 设置用户元数据
+	SignalToRegisterGetRoomMeta    = "getRoomMeta"   // signal->register 获取房间和用户元数据
+	SignalToRegisterChat           = "chat"          // signal->register 保存聊天消息
+	SignalToRegisterChatHistory    = "chatHistory"   // signal->register 获取聊天记录
+	SignalToRegisterOnStreamUpdate = "stream_update" // signal->register 更新流的静音状态
+	SignalToRegisterGetRoomHost    = "getRoomHost"   // signal->register 获取房间主持人
+
+	/*
+		admin(rtcctl) -> 各服务通信
+	*/
+	AdminToRegisterGetRooms = "getRooms" // admin->register 获取所有房间的人数和流数
+	AdminToSfuDrain         = "drain"    // admin->sfu 排空/恢复节点, 排空后不再分配新的流
+
+	/*
+		同一用户多个连接(会话)加入同一房间时的策略
+	*/
+	DefaultSession = "default" // 连接没有携带session时使用的默认会话
+	SessionMulti   = "multi"   // 允许同时在线多个会话
+	SessionReplace = "replace" // 新会话加入时踢出旧会话
+	SessionReject  = "reject"  // 已有会话在线时拒绝新会话
 )
 
 // GetUIDFromMID 从mid中获取uid
@@ -65,17 +152,90 @@ func GetUIDFromMID(mid string) string {
 	return strings.Split(mid, "#")[0]
 }
 
-// GetUserNodeKey 获取用户的signal服务器
-func GetUserNodeKey(rid, uid string) string {
-	return "/node/rid/" + rid + "/uid/" + uid
+// GetUserNodeKey 获取用户某个会话的signal服务器
+func GetUserNodeKey(rid, uid, session string) string {
+	return "/node/rid/" + rid + "/uid/" + uid + "/session/" + session
+}
+
+// ParseUserNodeKey 从用户的signal key中解析出uid session
+func ParseUserNodeKey(key string) (uid, session string) {
+	arr := strings.Split(key, "/")
+	if len(arr) < 8 {
+		return "", ""
+	}
+	return arr[5], arr[7]
 }
 
 // GetMediaInfoKey  获取用户流信息
 func GetMediaInfoKey(rid, uid, mid string) string {
-	return "/media/rid" + rid + "/uid/" + uid + "/mid/" + mid
+	return "/media/rid/" + rid + "/uid/" + uid + "/mid/" + mid
 }
 
 // GetMediaPubKey 获取用户流的sfu服务器
 func GetMediaPubKey(rid, uid, mid string) string {
-	return "/pub/rid" + rid + "/uid/" + uid + "/mid/" + mid
+	return "/pub/rid/" + rid + "/uid/" + uid + "/mid/" + mid
+}
+
+// GetRoomSettingsKey 房间设置, {rid}保证集群模式下同一房间的key在同一个slot
+func GetRoomSettingsKey(rid string) string {
+	return "/room/{" + rid + "}/settings"
+}
+
+// GetRoomMembersKey 房间成员, 有序集合, score为过期时间
+func GetRoomMembersKey(rid string) string {
+	return "/room/{" + rid + "}/members"
+}
+
+// GetRoomPublishersKey 房间发布者, 有序集合, score为过期时间
+func GetRoomPublishersKey(rid string) string {
+	return "/room/{" + rid + "}/publishers"
+}
+
+// GetRoomUserSessionsKey 用户在房间内的会话, 有序集合, score为过期时间, 用于原子的检查多会话策略
+func GetRoomUserSessionsKey(rid, uid string) string {
+	return "/room/{" + rid + "}/sessions/" + uid
+}
+
+// GetRoomLobbyKey 房间等候室, hash, 值为wait或admit
+func GetRoomLobbyKey(rid string) string {
+	return "/room/{" + rid + "}/lobby"
+}
+
+// GetRoomMetaKey 房间和用户元数据, hash, 字段为room或uid:$uid
+func GetRoomMetaKey(rid string) string {
+	return "/room/{" + rid + "}/meta"
+}
+
+// GetRoomMetaVersionKey 元数据的版本号, hash, 字段和GetRoomMetaKey一致
+func GetRoomMetaVersionKey(rid string) string {
+	return "/room/{" + rid + "}/metaver"
+}
+
+// GetRoomChatKey 房间最近的聊天消息, 列表, 按id递增
+func GetRoomChatKey(rid string) string {
+	return "/room/{" + rid + "}/chat"
+}
+
+// GetRoomChatSeqKey 房间聊天消息的id序号
+func GetRoomChatSeqKey(rid string) string {
+	return "/room/{" + rid + "}/chatseq"
+}
+
+// GetRoomChatRateKey 用户当前一秒内发送的聊天消息数
+func GetRoomChatRateKey(rid, uid string) string {
+	return "/room/{" + rid + "}/chatrate/" + uid
+}
+
+// GetMixKey 获取房间混音所在的sfu服务器
+func GetMixKey(rid string) string {
+	return "/mix/rid/" + rid
+}
+
+// ParseMediaPubKey 从流的sfu key中解析出rid uid mid
+func ParseMediaPubKey(key string) (rid, uid, mid string) {
+	arr := strings.Split(key, "/")
+	if len(arr) < 8 {
+		return "", "", ""
+	}
+	return arr[3], arr[5], arr[7]
 }
@@ -168,3 +168,27 @@ func (r *Redis) HGetAll(k string) map[string]string {
 	}
 	return r.singleClient.HGetAll(context.Background(), k).Val()
 }
+
+// Eval redis执行lua脚本, 脚本内的操作是原子的, 集群模式下keys需要在同一个slot
+func (r *Redis) Eval(script string, keys []string, args ...interface{}) (interface{}, error) {
+	if r.clusterMode {
+		return r.cluster.Eval(context.Background(), script, keys, args...).Result()
+	}
+	return r.singleClient.Eval(context.Background(), script, keys, args...).Result()
+}
+
+// ZRem redis删除有序集合key的member
+func (r *Redis) ZRem(k, member string) error {
+	if r.clusterMode {
+		return r.cluster.ZRem(context.Background(), k, member).Err()
+	}
+	return r.singleClient.ZRem(context.Background(), k, member).Err()
+}
+
+// LRange redis读取列表key在start到stop之间的元素
+func (r *Redis) LRange(k string, start, stop int64) []string {
+	if r.clusterMode {
+		return r.cluster.LRange(context.Background(), k, start, stop).Val()
+	}
+	return r.singleClient.LRange(context.Background(), k, start, stop).Val()
+}
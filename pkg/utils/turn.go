@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TURNCredential 生成TURN REST API格式的临时账号, username为"过期时间戳:uid", 密码为base64(hmac-sha1(secret, username))
+func TURNCredential(secret, uid string, ttl time.Duration) (string, string) {
+	username := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	if uid != "" {
+		username += ":" + uid
+	}
+	return username, turnPassword(secret, username)
+}
+
+// CheckTURNCredential 校验临时账号是否过期, 未过期返回对应的密码
+func CheckTURNCredential(secret, username string) (string, bool) {
+	expire, err := strconv.ParseInt(strings.SplitN(username, ":", 2)[0], 10, 64)
+	if err != nil || time.Now().Unix() > expire {
+		return "", false
+	}
+	return turnPassword(secret, username), true
+}
+
+// turnPassword 根据username计算密码
+func turnPassword(secret, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTURNCredential(t *testing.T) {
+	username, password := TURNCredential("secret", "uid_1", time.Hour)
+	if !strings.HasSuffix(username, ":uid_1") {
+		t.Fatalf("username should end with the uid, username is %s", username)
+	}
+	got, ok := CheckTURNCredential("secret", username)
+	if !ok || got != password {
+		t.Fatalf("credential should be valid, ok is %v", ok)
+	}
+	if got, _ := CheckTURNCredential("other", username); got == password {
+		t.Fatal("password must depend on the secret")
+	}
+}
+
+func TestTURNCredentialExpired(t *testing.T) {
+	username, _ := TURNCredential("secret", "uid_1", -time.Minute)
+	if _, ok := CheckTURNCredential("secret", username); ok {
+		t.Fatal("expired credential should be rejected")
+	}
+	if _, ok := CheckTURNCredential("secret", "not-a-timestamp:uid_1"); ok {
+		t.Fatal("malformed username should be rejected")
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
-import "goRTCServer/server/register/src"
+import (
+	"goRTCServer/server/register/conf"
+	"goRTCServer/server/register/src"
+)
 
 func close() {
 	src.Stop()
 }
 func main() {
+	conf.Init()
 	defer close()
 	src.Start()
 	select {}
@@ -1,17 +1,31 @@
 package conf
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"goRTCServer/pkg/confutil"
+	"goRTCServer/pkg/discovery"
+	"goRTCServer/pkg/proto"
 	"os"
+	"strings"
+	"sync"
 
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
+// hotSections 可以热加载的配置段, 其他配置修改后需要重启
+var hotSections = []string{"log", "room"}
+
 var (
 	cfg = config{}
+	// lock 保护可以热加载的配置项
+	lock sync.RWMutex
 	// Global 全局设置
 	Global = &cfg.Global
+	// Discovery 服务发现设置
+	Discovery = &cfg.Discovery
 	// Etcd Etcd设置
 	Etcd = &cfg.Etcd
 	// Nats 消息中间件设置
@@ -20,15 +34,24 @@ var (
 	Redis = &cfg.Redis
 	// Kafka 中间件
 	Kafka = &cfg.Kafka
+	// Chat 聊天设置
+	Chat = &cfg.Chat
 )
 
-func init() {
+// Init 解析命令行参数并加载配置, 失败时退出
+func Init() {
 	if !cfg.parse() {
 		showHelp()
 		os.Exit(-1)
 	}
 }
 
+// Load 加载指定的配置文件, all-in-one模式下各服务分别加载自己的配置
+func Load(file string) bool {
+	cfg.CfgFile = file
+	return cfg.load()
+}
+
 type global struct {
 	Pprof  string `mapstructure:"pprof"`
 	NodeDC string `mapstructure:"dc"`
@@ -54,13 +77,77 @@ type kafka struct {
 	URL string `mapstructure:"url"`
 }
 
+type chat struct {
+	History  int `mapstructure:"history"`  // 每个房间保存的最近消息数
+	MaxBytes int `mapstructure:"maxbytes"` // 单条消息序列化后的最大字节数
+	MaxLimit int `mapstructure:"maxlimit"` // chat_history一次最多获取的消息数
+	Rate     int `mapstructure:"rate"`     // 每个用户在一个房间内每秒最多发送的消息数
+}
+
+type logcfg struct {
+	Level string `mapstructure:"level"` // debug(默认)、info、warn、error
+}
+
+// GetLogLevel 获取日志级别
+func GetLogLevel() logrus.Level {
+	lock.RLock()
+	defer lock.RUnlock()
+	level, _ := logrus.ParseLevel(cfg.Log.Level)
+	return level
+}
+
+type room struct {
+	MaxUsers int    `mapstructure:"maxusers"` // 房间没有设置时的默认人数上限, 0不限制
+	MaxPubs  int    `mapstructure:"maxpubs"`  // 房间没有设置时的默认发布人数上限, 0不限制
+	Sessions string `mapstructure:"sessions"` // 房间没有设置时同一用户多个会话的策略, multi/replace(默认)/reject
+}
+
+// GetRoomLimits 获取房间默认的人数和发布人数上限
+func GetRoomLimits() (maxusers, maxpubs int) {
+	lock.RLock()
+	defer lock.RUnlock()
+	return cfg.Room.MaxUsers, cfg.Room.MaxPubs
+}
+
+// GetRoomSessions 获取房间默认的多会话策略
+func GetRoomSessions() string {
+	lock.RLock()
+	defer lock.RUnlock()
+	return cfg.Room.Sessions
+}
+
+type staticnode struct {
+	NodeDC string   `mapstructure:"dc"`
+	NodeID string   `mapstructure:"id"`
+	Name   string   `mapstructure:"name"`
+	TURN   []string `mapstructure:"turn"`
+}
+
+type discoverycfg struct {
+	Type  string       `mapstructure:"type"` // etcd(默认)或static
+	Nodes []staticnode `mapstructure:"node"` // static时所有节点的列表
+}
+
+// StaticNodes 静态配置的所有节点
+func StaticNodes() []discovery.Node {
+	nodes := make([]discovery.Node, 0, len(cfg.Discovery.Nodes))
+	for _, n := range cfg.Discovery.Nodes {
+		nodes = append(nodes, discovery.Node{NodeDC: n.NodeDC, NodeID: n.NodeID, Name: n.Name, TURN: strings.Join(n.TURN, ",")})
+	}
+	return nodes
+}
+
 type config struct {
-	Global  global `mapstructure:"global"`
-	Etcd    etcd   `mapstructure:"etcd"`
-	Nats    nats   `mapstructure:"nats"`
-	Redis   redis  `mapstructure:"redis"`
-	Kafka   kafka  `mapstructure:"kafka"`
-	CfgFile string
+	Global    global       `mapstructure:"global"`
+	Discovery discoverycfg `mapstructure:"discovery"`
+	Etcd      etcd         `mapstructure:"etcd"`
+	Nats      nats         `mapstructure:"nats"`
+	Redis     redis        `mapstructure:"redis"`
+	Kafka     kafka        `mapstructure:"kafka"`
+	Chat      chat         `mapstructure:"chat"`
+	Log       logcfg       `mapstructure:"log"`
+	Room      room         `mapstructure:"room"`
+	CfgFile   string
 }
 
 func showHelp() {
@@ -70,26 +157,130 @@ func showHelp() {
 }
 
 func (c *config) load() bool {
-	_, err := os.Stat(c.CfgFile)
+	n, err := read(c.CfgFile)
 	if err != nil {
+		fmt.Printf("config file %s load failed. %v\n", c.CfgFile, err)
 		return false
 	}
+	lock.Lock()
+	*c = *n
+	lock.Unlock()
+	fmt.Printf("config %s load ok!\n", c.CfgFile)
+	return true
+}
+
+// read 读取配置文件, 环境变量覆盖文件中的配置, 填充默认值并校验
+func read(file string) (*config, error) {
+	if _, err := os.Stat(file); err != nil {
+		return nil, err
+	}
+	v := viper.New()
+	v.SetConfigFile(file)
+	v.SetConfigType("toml")
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	c := &config{CfgFile: file}
+	confutil.BindEnv(v, "register", c)
+	if err := v.UnmarshalExact(c); err != nil {
+		return nil, err
+	}
+	if c.Chat.History <= 0 {
+		c.Chat.History = 100
+	}
+	if c.Chat.MaxBytes <= 0 {
+		c.Chat.MaxBytes = 4096
+	}
+	if c.Chat.MaxLimit <= 0 {
+		c.Chat.MaxLimit = 100
+	}
+	if c.Chat.Rate <= 0 {
+		c.Chat.Rate = 5
+	}
+	if c.Discovery.Type == "" {
+		c.Discovery.Type = "etcd"
+	}
+	if c.Log.Level == "" {
+		c.Log.Level = "debug"
+	}
+	if c.Room.Sessions == "" {
+		c.Room.Sessions = proto.SessionReplace
+	}
+	if errs := c.validate(); len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "; "))
+	}
+	return c, nil
+}
 
-	viper.SetConfigFile(c.CfgFile)
-	viper.SetConfigType("toml")
+// validate 校验配置, 返回所有错误, 每个错误都带配置项名称
+func (c *config) validate() []string {
+	errs := make([]string, 0)
+	if c.Global.NodeDC == "" || c.Global.NodeID == "" || c.Global.Name == "" {
+		errs = append(errs, "global.dc, global.id and global.name must be non empty")
+	}
+	if c.Nats.URL == "" {
+		errs = append(errs, "nats.url must be non empty")
+	}
+	if len(c.Redis.Addrs) == 0 {
+		errs = append(errs, "redis.addrs must be non empty")
+	}
+	switch c.Discovery.Type {
+	case "etcd":
+		if len(c.Etcd.Addrs) == 0 {
+			errs = append(errs, "etcd.addrs must be non empty when discovery.type is etcd")
+		}
+	case "static":
+		for i, n := range c.Discovery.Nodes {
+			if n.NodeDC == "" || n.NodeID == "" || n.Name == "" {
+				errs = append(errs, fmt.Sprintf("discovery.node[%d] dc, id and name must be non empty", i))
+			}
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("discovery.type must be etcd or static, got %q", c.Discovery.Type))
+	}
+	if _, err := logrus.ParseLevel(c.Log.Level); err != nil {
+		errs = append(errs, fmt.Sprintf("log.level must be debug, info, warn or error, got %q", c.Log.Level))
+	}
+	if c.Room.MaxUsers < 0 {
+		errs = append(errs, fmt.Sprintf("room.maxusers must not be negative, got %d", c.Room.MaxUsers))
+	}
+	if c.Room.MaxPubs < 0 {
+		errs = append(errs, fmt.Sprintf("room.maxpubs must not be negative, got %d", c.Room.MaxPubs))
+	}
+	switch c.Room.Sessions {
+	case proto.SessionMulti, proto.SessionReplace, proto.SessionReject:
+	default:
+		errs = append(errs, fmt.Sprintf("room.sessions must be multi, replace or reject, got %q", c.Room.Sessions))
+	}
+	return errs
+}
 
-	err = viper.ReadInConfig()
+// Reload 重新读取配置文件, 只更新可以热加载的配置项(日志级别、房间默认上限和多会话策略),
+// 返回更新了的配置项和修改了但需要重启才能生效的配置项, 配置错误时保持原来的配置
+func Reload() (changed, restart []string, err error) {
+	n, err := read(cfg.CfgFile)
 	if err != nil {
-		fmt.Printf("config file %s read failed. %v\n", c.CfgFile, err)
-		return false
+		return nil, nil, err
 	}
-	err = viper.GetViper().UnmarshalExact(c)
-	if err != nil {
-		fmt.Printf("config file %s loaded failed. %v\n", c.CfgFile, err)
-		return false
+	lock.Lock()
+	defer lock.Unlock()
+	for _, key := range confutil.Diff(&cfg, n) {
+		if confutil.Section(key, hotSections...) {
+			changed = append(changed, key)
+		} else {
+			restart = append(restart, key)
+		}
 	}
-	fmt.Printf("config %s load ok!\n", c.CfgFile)
-	return true
+	cfg.Log = n.Log
+	cfg.Room = n.Room
+	return changed, restart, nil
+}
+
+// Watch 配置文件变化或收到SIGHUP时重新加载, 结果通过onReload通知, 返回停止监控的函数
+func Watch(onReload func(changed, restart []string, err error)) (func(), error) {
+	return confutil.Watch(cfg.CfgFile, func() {
+		onReload(Reload())
+	})
 }
 
 func (c *config) parse() bool {
@@ -0,0 +1,127 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"goRTCServer/pkg/bus"
+	"goRTCServer/pkg/logger"
+	"goRTCServer/pkg/proto"
+	"goRTCServer/pkg/utils"
+	"goRTCServer/server/register/conf"
+	"time"
+)
+
+const (
+	defaultChatLimit = 50
+	chatRateLimited  = "rate"
+)
+
+// chatScript 检查发送频率, 分配消息id并追加到房间消息列表, 只保留最近的消息
+// KEYS: seq list rate ARGV: msg(不带id的json) history ttl rate
+var chatScript = `
+local n = redis.call('INCR', KEYS[3])
+if n == 1 then
+	redis.call('EXPIRE', KEYS[3], 1)
+end
+if n > tonumber(ARGV[4]) then
+	return 'rate'
+end
+local id = redis.call('INCR', KEYS[1])
+local msg = '{"id":' .. id .. ',' .. string.sub(ARGV[1], 2)
+redis.call('RPUSH', KEYS[2], msg)
+redis.call('LTRIM', KEYS[2], -tonumber(ARGV[2]), -1)
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+redis.call('EXPIRE', KEYS[2], ARGV[3])
+return msg
+`
+
+// chatVisible 广播消息所有人可见, 私聊消息只有发送者和接收者可见
+func chatVisible(msg map[string]interface{}, uid string) bool {
+	to, ok := msg["to"].([]interface{})
+	if !ok || len(to) == 0 || utils.Val(msg, "uid") == uid {
+		return true
+	}
+	for _, v := range to {
+		if fmt.Sprint(v) == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// chatHistory 获取uid可见的id小于before的最近limit条消息, before为0时从最新开始, 按id递增返回
+func chatHistory(rid, uid string, before, limit int) ([]interface{}, bool) {
+	if limit <= 0 {
+		limit = defaultChatLimit
+	}
+	if limit > conf.Chat.MaxLimit {
+		limit = conf.Chat.MaxLimit
+	}
+	list := regRedis.LRange(proto.GetRoomChatKey(rid), 0, -1)
+	res := make([]interface{}, 0, limit)
+	more := false
+	for i := len(list) - 1; i >= 0; i-- {
+		msg := utils.Unmarshal(list[i])
+		if msg == nil || (before > 0 && utils.InterfaceToInt(msg["id"]) >= before) || !chatVisible(msg, uid) {
+			continue
+		}
+		if len(res) == limit {
+			more = true
+			break
+		}
+		res = append(res, msg)
+	}
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return res, more
+}
+
+/*
+	"method", proto.SignalToRegisterChat, "rid", rid, "uid", uid, "to", to, "text", text, "data", data
+*/
+// chat 保存聊天消息, 返回带id和时间戳的消息
+func chat(data map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	logger.Debugf("register.chat, data is %v", data)
+	rid := utils.Val(data, "rid")
+	uid := utils.Val(data, "uid")
+	msg := utils.Map("rid", rid, "uid", uid, "ts", time.Now().UnixNano()/int64(time.Millisecond))
+	if to, ok := data["to"].([]interface{}); ok && len(to) > 0 {
+		msg["to"] = to
+	}
+	if data["text"] != nil {
+		msg["text"] = utils.Val(data, "text")
+	}
+	if data["data"] != nil {
+		msg["data"] = data["data"]
+	}
+	buf, _ := json.Marshal(msg)
+	if len(buf) > conf.Chat.MaxBytes {
+		return nil, &bus.Error{Code: 421, Reason: fmt.Sprintf("chat message too large, max is %d bytes", conf.Chat.MaxBytes)}
+	}
+	keys := []string{proto.GetRoomChatSeqKey(rid), proto.GetRoomChatKey(rid), proto.GetRoomChatRateKey(rid, uid)}
+	res, err := regRedis.Eval(chatScript, keys, string(buf), conf.Chat.History, int(redisKeyTTL.Seconds()), conf.Chat.Rate)
+	if err != nil {
+		logger.Errorf("register.chat redis.Eval err, err is %v, data is %v", err, data)
+		return nil, &bus.Error{Code: 418, Reason: fmt.Sprintf("chat err, err is %v", err)}
+	}
+	if fmt.Sprint(res) == chatRateLimited {
+		return nil, &bus.Error{Code: 423, Reason: fmt.Sprintf("chat rate limited, max is %d messages per second", conf.Chat.Rate)}
+	}
+	return utils.Unmarshal(fmt.Sprint(res)), nil
+}
+
+/*
+	"method", proto.SignalToRegisterChatHistory, "rid", rid, "uid", uid, "before", before, "limit", limit
+*/
+// getChatHistory 分页获取聊天记录
+func getChatHistory(data map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	rid := utils.Val(data, "rid")
+	uid := utils.Val(data, "uid")
+	limit := utils.InterfaceToInt(data["limit"])
+	if limit < 0 || limit > conf.Chat.MaxLimit {
+		return nil, &bus.Error{Code: 422, Reason: fmt.Sprintf("chat history limit must be between 0 and %d", conf.Chat.MaxLimit)}
+	}
+	msgs, more := chatHistory(rid, uid, utils.InterfaceToInt(data["before"]), limit)
+	return utils.Map("rid", rid, "messages", msgs, "more", more), nil
+}
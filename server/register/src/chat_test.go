@@ -0,0 +1,62 @@
+package src
+
+import (
+	"goRTCServer/pkg/utils"
+	"goRTCServer/server/register/conf"
+	"testing"
+)
+
+func TestChatHistoryAndVisibility(t *testing.T) {
+	history, rate := conf.Chat.History, conf.Chat.Rate
+	conf.Chat.History, conf.Chat.Rate = 3, 100
+	defer func() { conf.Chat.History, conf.Chat.Rate = history, rate }()
+
+	for i, to := range [][]interface{}{nil, {"b"}, nil, nil} {
+		msg, err := chat(map[string]interface{}{"rid": "lua_chat", "uid": "a", "text": "hi", "to": to})
+		if err != nil {
+			t.Fatalf("chat err, err is %v", err.Reason)
+		}
+		if id := utils.InterfaceToInt(msg["id"]); id != i+1 {
+			t.Fatalf("chat id should be %d, got %d", i+1, id)
+		}
+	}
+	// 只保留最近3条, 私聊只有接收者可见
+	msgs, more := chatHistory("lua_chat", "b", 0, 10)
+	if len(msgs) != 3 || more {
+		t.Fatalf("b should see the last 3 messages, got %v", msgs)
+	}
+	msgs, _ = chatHistory("lua_chat", "c", 0, 10)
+	if len(msgs) != 2 {
+		t.Fatalf("c should not see the private message, got %v", msgs)
+	}
+	msgs, more = chatHistory("lua_chat", "b", 4, 1)
+	if len(msgs) != 1 || !more || utils.InterfaceToInt(msgs[0].(map[string]interface{})["id"]) != 3 {
+		t.Fatalf("page before 4 should return id 3 with more, got %v", msgs)
+	}
+}
+
+func TestChatRejectsOverCaps(t *testing.T) {
+	rate := conf.Chat.Rate
+	conf.Chat.Rate = 2
+	defer func() { conf.Chat.Rate = rate }()
+
+	big := make([]byte, conf.Chat.MaxBytes)
+	if _, err := chat(map[string]interface{}{"rid": "lua_caps", "uid": "a", "text": string(big)}); err == nil || err.Code != 421 {
+		t.Fatalf("oversized message should be rejected with 421, err is %v", err)
+	}
+	if _, err := getChatHistory(map[string]interface{}{"rid": "lua_caps", "uid": "a", "limit": conf.Chat.MaxLimit + 1}); err == nil || err.Code != 422 {
+		t.Fatalf("limit over the cap should be rejected with 422, err is %v", err)
+	}
+	var last error
+	for i := 0; i < 3; i++ {
+		if _, err := chat(map[string]interface{}{"rid": "lua_caps", "uid": "a", "text": "hi"}); err != nil {
+			last = err
+			if err.Code != 423 {
+				t.Fatalf("rate limited chat should return 423, err is %v", err)
+			}
+		}
+	}
+	if last == nil {
+		t.Fatal("third message within a second should be rate limited")
+	}
+}
@@ -1,15 +1,15 @@
 package src
 
 import (
+	"goRTCServer/pkg/bus"
+	"goRTCServer/pkg/discovery"
 	"goRTCServer/pkg/etcd"
 	"goRTCServer/pkg/logger"
 	myRedis "goRTCServer/pkg/redis"
 	"goRTCServer/server/register/conf"
+	"log"
 	"net/http"
 	"time"
-
-	nprotoo "github.com/cloudwebrtc/nats-protoo"
-	"github.com/sirupsen/logrus"
 )
 
 const (
@@ -19,24 +19,43 @@ const (
 
 var (
 	regRedis *myRedis.Redis
-	regNde   *etcd.ServiceNode
-	regNats  *nprotoo.NatsProtoo
+	regNode  discovery.Registrar
+	regBus   bus.Bus
+	stopConf func()
 )
 
-func init() {
-	logger.DoInit(conf.Kafka.URL, "rtc_register")
-	logger.SetLevel(logrus.DebugLevel)
+// Start 启动服务, 使用nats, 服务注册按配置使用etcd或静态配置
+func Start() {
+	node, err := newRegistrar()
+	if err != nil {
+		log.Fatalf("register start err, err is %v", err)
+	}
+	StartWith(bus.NewNats(conf.Nats.URL), node)
 }
 
-// 启动服务
-func Start() {
+// newRegistrar 根据配置新建服务注册对象
+func newRegistrar() (discovery.Registrar, error) {
+	if conf.Discovery.Type == "static" {
+		return discovery.NewStatic(conf.StaticNodes()).NewNode(conf.Global.NodeDC, conf.Global.NodeID, conf.Global.Name), nil
+	}
+	node, err := etcd.NewServiceNode(conf.Etcd.Addrs, conf.Global.NodeDC, conf.Global.NodeID, conf.Global.Name)
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// StartWith 使用指定的消息总线和服务注册启动服务
+func StartWith(b bus.Bus, node discovery.Registrar) {
+	logger.DoInit(conf.Kafka.URL, "rtc_register")
+	logger.SetLevel(conf.GetLogLevel())
 	// 服务注册
-	node := etcd.NewServiceNode(conf.Etcd.Addrs, conf.Global.NodeDC, conf.Global.NodeID, conf.Global.Name)
-	node.RegisterNode()
+	regNode = node
+	regNode.RegisterNode()
 
 	// 消息注册
-	regNats = nprotoo.NewNatsProtoo(conf.Nats.URL)
-	regNats.OnRequest(node.GetRPCChannel(), handleRPCMsg)
+	regBus = b
+	regBus.OnRequest(regNode.GetRPCChannel(), handleRPCMsg)
 
 	// 数据库
 	regRedis = myRedis.NewRedis(myRedis.Config(*conf.Redis))
@@ -44,14 +63,36 @@ func Start() {
 	if conf.Global.Pprof != "" {
 		go debug()
 	}
+	// 配置热加载
+	stop, err := conf.Watch(onConfigReload)
+	if err != nil {
+		logger.Errorf("watch config err, err is %v", err)
+	}
+	stopConf = stop
+}
+
+// onConfigReload 配置重新加载后更新日志级别, 记录变化的配置项
+func onConfigReload(changed, restart []string, err error) {
+	if err != nil {
+		logger.Errorf("config reload failed, keep current config, err is %v", err)
+		return
+	}
+	logger.SetLevel(conf.GetLogLevel())
+	logger.Infof("config reloaded, changed %v", changed)
+	if len(restart) > 0 {
+		logger.Warnf("config changed but need restart to take effect, keys %v", restart)
+	}
 }
 
 func Stop() {
-	if regNats != nil {
-		regNats.Close()
+	if stopConf != nil {
+		stopConf()
+	}
+	if regBus != nil {
+		regBus.Close()
 	}
-	if regNde != nil {
-		regNde.Close()
+	if regNode != nil {
+		regNode.Close()
 	}
 }
 
@@ -0,0 +1,32 @@
+package src
+
+import (
+	"fmt"
+	"goRTCServer/pkg/logger"
+	myRedis "goRTCServer/pkg/redis"
+	"goRTCServer/server/register/conf"
+	"os"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+var store *miniredis.Miniredis
+
+// TestMain lua脚本在进程内的redis上测试, 不启动消息总线和服务注册
+func TestMain(m *testing.M) {
+	if !conf.Load("../../../cfg/register.toml") {
+		fmt.Println("load config failed")
+		os.Exit(1)
+	}
+	logger.DoInit("", "register_test")
+	var err error
+	if store, err = miniredis.Run(); err != nil {
+		fmt.Printf("start memory redis err, err is %v\n", err)
+		os.Exit(1)
+	}
+	regRedis = myRedis.NewRedis(myRedis.Config{Addrs: []string{store.Addr()}})
+	code := m.Run()
+	store.Close()
+	os.Exit(code)
+}
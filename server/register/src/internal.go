@@ -2,27 +2,27 @@ package src
 
 import (
 	"fmt"
+	"goRTCServer/pkg/bus"
 	"goRTCServer/pkg/logger"
 	"goRTCServer/pkg/proto"
 	"goRTCServer/pkg/utils"
+	"sort"
 	"strings"
-
-	nprotoo "github.com/cloudwebrtc/nats-protoo"
 )
 
 // 处理RPC请求
-func handleRPCMsg(request nprotoo.Request, accept nprotoo.RespondFunc, reject nprotoo.RejectFunc) {
+func handleRPCMsg(request bus.Request, accept bus.RespondFunc, reject bus.RejectFunc) {
 	go handleRPCRequest(request, accept, reject)
 }
 
 // 接收signal消息处理
-func handleRPCRequest(req nprotoo.Request, accept nprotoo.RespondFunc, reject nprotoo.RejectFunc) {
+func handleRPCRequest(req bus.Request, accept bus.RespondFunc, reject bus.RejectFunc) {
 	defer utils.Recover("register.handleRPCRequest")
 	method := req.Method
 	data := utils.Unmarshal(string(req.Data))
 
 	var res map[string]interface{}
-	err := &nprotoo.Error{Code: 400, Reason: fmt.Sprintf("Unknown method [%s]", method)}
+	err := &bus.Error{Code: 400, Reason: fmt.Sprintf("Unknown method [%s]", method)}
 
 	// 根据method处理
 	switch method {
@@ -44,6 +44,34 @@ func handleRPCRequest(req nprotoo.Request, accept nprotoo.RespondFunc, reject np
 		res, err = getRoomUsers(data)
 	case proto.SignalToRegisterGetRoomPubs:
 		res, err = getRoomPubs(data)
+	case proto.SignalToRegisterOnMixAdd:
+		res, err = mixAdd(data)
+	case proto.SignalToRegisterOnMixRemove:
+		res, err = mixRemove(data)
+	case proto.SignalToRegisterGetMixInfo:
+		res, err = getMixInfo(data)
+	case proto.SignalToRegisterSetRoom:
+		res, err = setRoom(data)
+	case proto.SignalToRegisterLobbyAdmit:
+		res, err = lobbyAdmit(data)
+	case proto.SignalToRegisterLobbyDeny:
+		res, err = lobbyDeny(data)
+	case proto.SignalToRegisterSetRoomMeta:
+		res, err = setRoomMeta(data)
+	case proto.SignalToRegisterSetUserMeta:
+		res, err = setUserMeta(data)
+	case proto.SignalToRegisterGetRoomMeta:
+		res, err = getRoomMeta(data)
+	case proto.SignalToRegisterChat:
+		res, err = chat(data)
+	case proto.SignalToRegisterChatHistory:
+		res, err = getChatHistory(data)
+	case proto.SignalToRegisterOnStreamUpdate:
+		res, err = streamUpdate(data)
+	case proto.SignalToRegisterGetRoomHost:
+		res, err = getRoomHost(data)
+	case proto.AdminToRegisterGetRooms:
+		res, err = getRooms(data)
 	}
 	// 判断成功
 	if err != nil {
@@ -54,38 +82,69 @@ func handleRPCRequest(req nprotoo.Request, accept nprotoo.RespondFunc, reject np
 }
 
 /*
-	"method", proto.SignalToRegisterOnJoin "rid", rid, "uid" uid "signalId" signalId
+	"method", proto.SignalToRegisterOnJoin "rid", rid, "uid" uid "session" session "signalId" signalId "password" password
 */
-// 有人加入房间
-func clientJoin(data map[string]interface{}) (map[string]interface{}, *nprotoo.Error) {
+// 有人加入房间, 同一用户的其他会话按房间的多会话策略处理, replace时返回需要踢出的会话
+func clientJoin(data map[string]interface{}) (map[string]interface{}, *bus.Error) {
 	logger.LogKf.Debugf("register.join, data is %v", data)
 	rid := utils.Val(data, "rid")
 	uid := utils.Val(data, "uid")
+	session := getSession(data)
 	// 获取用户的signal服务器
 	signalId := utils.Val(data, "signalId")
 
-	uKey := proto.GetUserNodeKey(rid, uid)
+	// 同一用户的其他会话
+	others := userSessions(rid, uid)
+	delete(others, session)
+	policy := roomSessions(rid)
+
+	// 检查多会话策略、房间人数、密码和等候室
+	status, rerr := roomAdmit(rid, uid, session, utils.Val(data, "password"))
+	if rerr != nil {
+		logger.Errorf("register.clientJoin room admit err, err is %v, data is %v", rerr, data)
+		return nil, &bus.Error{Code: 401, Reason: fmt.Sprintf("client join err is %v", rerr)}
+	}
+	switch status {
+	case joinReject:
+		return nil, &bus.Error{Code: 420, Reason: "user already in room"}
+	case joinLobby:
+		return utils.Map("rid", rid, "uid", uid, "lobby", true, "host", roomHost(rid)), nil
+	case joinFull:
+		return nil, &bus.Error{Code: 414, Reason: "room is full"}
+	case joinPassword:
+		return nil, &bus.Error{Code: 415, Reason: "room password error"}
+	}
+
+	uKey := proto.GetUserNodeKey(rid, uid, session)
 	err := regRedis.Set(uKey, signalId, redisShort)
 	if err != nil {
-		logger.LogKf.Error("signal.clientJoin redis.set err, err is %v, data is %v", err, data)
-		return nil, &nprotoo.Error{
+		logger.LogKf.Errorf("signal.clientJoin redis.set err, err is %v, data is %v", err, data)
+		return nil, &bus.Error{
 			Code:   401,
 			Reason: fmt.Sprintf("client join err is %v", err),
 		}
 	}
-	return utils.Map("rid", rid, "uid", uid, "signalID", signalId), nil
+	res := utils.Map("rid", rid, "uid", uid, "session", session, "signalID", signalId)
+	if len(others) > 0 && policy == proto.SessionReplace {
+		res["replaced"] = sessionList(others)
+	}
+	if roomHost(rid) == uid {
+		res["waiting"] = roomWaiting(rid)
+	}
+	return res, nil
 }
 
 /*
-	"method", proto.SignalToRegisterOnLeave "rid" rid "uid" uid
+	"method", proto.SignalToRegisterOnLeave "rid" rid "uid" uid "session" session
 */
-// 有人退出房间
-func clientLeave(data map[string]interface{}) (map[string]interface{}, *nprotoo.Error) {
+// 有人退出房间, 用户所有会话都退出后才离开房间, last表示是否是最后一个会话
+func clientLeave(data map[string]interface{}) (map[string]interface{}, *bus.Error) {
 	logger.LogKf.Debugf("register.leave, data is %v", data)
 	rid := utils.Val(data, "rid")
 	uid := utils.Val(data, "uid")
+	session := getSession(data)
 	// 获取用户的Signal服务器
-	uKey := proto.GetUserNodeKey(rid, uid)
+	uKey := proto.GetUserNodeKey(rid, uid, session)
 	uVaule := regRedis.Get(uKey)
 	if len(uVaule) > 0 {
 		// del this user cache
@@ -94,48 +153,72 @@ func clientLeave(data map[string]interface{}) (map[string]interface{}, *nprotoo.
 			logger.Debugf("register.clientLeave redis.Del err, err is %v, data is %v", err, data)
 		}
 	}
-	return utils.Map("rid", rid, "uid", uid), nil
+	roomSessionLeave(rid, uid, session)
+	last := len(userSessions(rid, uid)) == 0
+	if last {
+		roomLeave(rid, uid)
+	}
+	return utils.Map("rid", rid, "uid", uid, "session", session, "last", last), nil
 }
 
 /*
-	"method", proto.SignalToRegisterKeepAlive, "rid" rid "uid" uid
+	"method", proto.SignalToRegisterKeepAlive, "rid" rid "uid" uid "session" session
 */
 // 保活处理
-func keepalive(data map[string]interface{}) (map[string]interface{}, *nprotoo.Error) {
+func keepalive(data map[string]interface{}) (map[string]interface{}, *bus.Error) {
 	logger.LogKf.Debugf("register.keepalive, data is %v", data)
 	rid := utils.Val(data, "rid")
 	uid := utils.Val(data, "uid")
 	// 获取用户的Signal服务器
-	uKey := proto.GetUserNodeKey(rid, uid)
+	uKey := proto.GetUserNodeKey(rid, uid, getSession(data))
 
 	err := regRedis.Expire(uKey, redisShort)
 	if err != nil {
 		logger.Errorf("register.keepalive redis.Expire err, err is %v, data ois %v", err, data)
-		return nil, &nprotoo.Error{
+		return nil, &bus.Error{
 			Code:   402,
 			Reason: fmt.Sprintf("keep alive err is %v", err),
 		}
 	}
+	if err := roomRefresh(rid, uid, getSession(data)); err != nil {
+		logger.Errorf("register.keepalive room refresh err, err is %v, data is %v", err, data)
+	}
 	return utils.Map("rid", rid, "uid", uid), nil
 }
 
 /*
 	"method", proto.SignalToRegisterOnStreamAdd
 */
-// 有人发布流
-func streamAdd(data map[string]interface{}) (map[string]interface{}, *nprotoo.Error) {
+// 有人发布流, 发布流的会话保存在流信息中
+func streamAdd(data map[string]interface{}) (map[string]interface{}, *bus.Error) {
 	logger.Debugf("register.streamAdd, data is %v", data)
 	rid := utils.Val(data, "rid")
 	uid := utils.Val(data, "uid")
 	mid := utils.Val(data, "mid")
 	sfuId := utils.Val(data, "sfuid")
-	minfo := utils.Val(data, "minfo")
+	info := make(map[string]interface{})
+	if m, ok := data["minfo"].(map[string]interface{}); ok {
+		for k, v := range m {
+			info[k] = v
+		}
+	}
+	info["session"] = getSession(data)
+	minfo := utils.Marshal(info)
+	// 检查发布人数
+	status, rerr := roomPublish(rid, uid)
+	if rerr != nil {
+		logger.Errorf("register.streamAdd room publish err, err is %v, data is %v", rerr, data)
+		return nil, &bus.Error{Code: 405, Reason: fmt.Sprintf("streamAdd err, err is %v", rerr)}
+	}
+	if status != joinOK {
+		return nil, &bus.Error{Code: 412, Reason: "room publisher limit reached"}
+	}
 	// 获取用户的流信息
 	uKey := proto.GetMediaInfoKey(rid, uid, mid)
 	err := regRedis.Set(uKey, minfo, redisKeyTTL)
 	if err != nil {
 		logger.Errorf("register.steamAdd media redis.Set err, err is %v, data is %v", err, data)
-		return nil, &nprotoo.Error{
+		return nil, &bus.Error{
 			Code:   405,
 			Reason: fmt.Sprintf("streamAdd err, err is %v", err),
 		}
@@ -145,104 +228,104 @@ func streamAdd(data map[string]interface{}) (map[string]interface{}, *nprotoo.Er
 	err = regRedis.Set(uKey, sfuId, redisKeyTTL)
 	if err != nil {
 		logger.Errorf("register.streamAdd pub redis.Set err, err is %v, data is %v", err, data)
-		return nil, &nprotoo.Error{
+		return nil, &bus.Error{
 			Code:   406,
 			Reason: fmt.Sprintf("streamAdd err, err is %v", err),
 		}
 	}
 	// 生成resp对象
-	return utils.Map("rid", rid, "uid", uid, "mid", mid, "sfuid", sfuId, "minfo", data["minfo"]), nil
+	return pubInfo(rid, uid, mid, sfuId, info), nil
 }
 
 /*
-	"method", proto.SignalToRegisterOnStreamRemove
+	"method", proto.SignalToRegisterOnStreamRemove "rid" rid "uid" uid "mid" mid "session" session
 */
-// 有人取消发布流
-func streamRemove(data map[string]interface{}) (map[string]interface{}, *nprotoo.Error) {
+// 有人取消发布流, mid为空时删除用户的流, 指定了session时只删除该会话发布的流
+func streamRemove(data map[string]interface{}) (map[string]interface{}, *bus.Error) {
 	logger.Debugf("register.streamRemove, data is %v", data)
 	rid := utils.Val(data, "rid")
 	uid := utils.Val(data, "uid")
 	mid := utils.Val(data, "mid")
+	session := utils.Val(data, "session")
 	// 判断mid是否为空
 	rmPubs := make([]map[string]interface{}, 0)
-	var ukey string
+	ukey := proto.GetMediaPubKey(rid, uid, mid)
 	if mid == "" {
-		ukey = "/media/rid/" + rid + "/uid/" + uid + "/mid/*"
-		ukeys := regRedis.Keys(ukey)
-		for _, key := range ukeys {
-			ukey = key
-			// 删除key值
-			err := regRedis.Del(ukey)
-			if err != nil {
-				logger.Errorf("register.streamRemove media redis.Del err, err is %v, data is %v", err, data)
-			}
+		ukey = proto.GetMediaPubKey(rid, uid, "*")
+	}
+	for _, key := range regRedis.Keys(ukey) {
+		_, _, id := proto.ParseMediaPubKey(key)
+		mKey := proto.GetMediaInfoKey(rid, uid, id)
+		pub := pubInfo(rid, uid, id, regRedis.Get(key), utils.Unmarshal(regRedis.Get(mKey)))
+		if mid == "" && session != "" && pub["session"] != session {
+			continue
 		}
-		ukey = "/pub/rid/" + rid + "/uid/" + uid + "/mid/*"
-		ukeys = regRedis.Keys(ukey)
-		for _, key := range ukeys {
-			ukey = key
-			// 删除key值
-			arr := strings.Split(key, "/")
-			mid := arr[7]
-			err := regRedis.Del(ukey)
-			if err != nil {
-				logger.Errorf("register.streamRemove media redis.Del err, err is %v, data is %v", err, data)
-			}
-			rmPubs = append(rmPubs, utils.Map("rid", rid, "uid", uid, "mid", mid))
+		// 删除key值
+		if err := regRedis.Del(mKey); err != nil {
+			logger.Errorf("register.streamRemove media redis.Del err, err is %v, data is %v", err, data)
 		}
-	} else {
-		// 获取用户流信息
-		ukey = proto.GetMediaPubKey(rid, uid, mid)
-		uKeys := regRedis.Keys(ukey)
-		for _, key := range uKeys {
-			ukey = key
-			// 删除key值
-			err := regRedis.Del(ukey)
-			if err != nil {
-				logger.Errorf("register.streamRemove pub redis.Del err, err is %v, data is %v", err, data)
-			}
-		}
-		// 获取用户流的sfu服务器
-		ukey = proto.GetMediaPubKey(rid, uid, mid)
-		uKeys = regRedis.Keys(ukey)
-		for _, key := range uKeys {
-			ukey = key
-			arr := strings.Split(key, "/")
-			mid := arr[7]
-			// 删除key值
-			err := regRedis.Del(ukey)
-			if err != nil {
-				logger.Errorf("register.streamRemove pub redis.Del err, err is %v, data is %v", err, data)
-			}
-			rmPubs = append(rmPubs, utils.Map("rid", rid, "uid", uid, "mid", mid))
+		if err := regRedis.Del(key); err != nil {
+			logger.Errorf("register.streamRemove pub redis.Del err, err is %v, data is %v", err, data)
 		}
+		rmPubs = append(rmPubs, utils.Map("rid", rid, "uid", uid, "session", pub["session"], "mid", id, "sfuid", pub["sfuid"]))
 	}
+	roomUnpublish(rid, uid)
 	return utils.Map("rmPubs", rmPubs), nil
 }
 
 /*
-	"method" proto.SignalToRegisterGetUserInfo
+	"method", proto.SignalToRegisterOnStreamUpdate, "rid", rid, "uid", uid, "mid", mid, "kind", kind, "mute", mute
+*/
+// streamUpdate 更新流信息中的静音状态, minfo中增加audiomuted/videomuted
+func streamUpdate(data map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	logger.Debugf("register.streamUpdate, data is %v", data)
+	rid := utils.Val(data, "rid")
+	uid := utils.Val(data, "uid")
+	mid := utils.Val(data, "mid")
+	kind := utils.Val(data, "kind")
+	mKey := proto.GetMediaInfoKey(rid, uid, mid)
+	minfo := utils.Unmarshal(regRedis.Get(mKey))
+	if minfo == nil {
+		return nil, &bus.Error{Code: 419, Reason: fmt.Sprintf("cann't find stream by key: %s", mKey)}
+	}
+	minfo[kind+"muted"] = utils.InterfaceToBool(data["mute"])
+	err := regRedis.Set(mKey, utils.Marshal(minfo), redisKeyTTL)
+	if err != nil {
+		logger.Errorf("register.streamUpdate media redis.Set err, err is %v, data is %v", err, data)
+		return nil, &bus.Error{Code: 405, Reason: fmt.Sprintf("streamUpdate err, err is %v", err)}
+	}
+	sfuId := regRedis.Get(proto.GetMediaPubKey(rid, uid, mid))
+	return pubInfo(rid, uid, mid, sfuId, minfo), nil
+}
+
+/*
+	"method" proto.SignalToRegisterGetUserInfo "rid" rid "uid" uid "session" session
 */
-// 获取rid, uid指定的用户是否在线
-func getUserOnlineByUid(data map[string]interface{}) (map[string]interface{}, *nprotoo.Error) {
+// 获取rid, uid指定的用户是否在线, 指定了session时只查询该会话, 否则返回用户所有的会话
+func getUserOnlineByUid(data map[string]interface{}) (map[string]interface{}, *bus.Error) {
 	rid := utils.Val(data, "rid")
 	uid := utils.Val(data, "uid")
+	session := utils.Val(data, "session")
 	// 获取用户的signal服务器
-	ukey := proto.GetUserNodeKey(rid, uid)
-	uKeys := regRedis.Keys(ukey)
-	if len(uKeys) > 0 {
-		signalId := regRedis.Get(ukey)
-		return utils.Map("rid", rid, "uid", uid, "signalid", signalId), nil
-	} else {
-		return nil, &nprotoo.Error{Code: 410, Reason: fmt.Sprintf("cann't find signal node by key: %v", ukey)}
+	sessions := userSessions(rid, uid)
+	if session != "" {
+		if signalId, ok := sessions[session]; ok {
+			return utils.Map("rid", rid, "uid", uid, "session", session, "signalid", signalId), nil
+		}
+		return nil, &bus.Error{Code: 410, Reason: fmt.Sprintf("cann't find signal node by key: %v", proto.GetUserNodeKey(rid, uid, session))}
+	}
+	if len(sessions) == 0 {
+		return nil, &bus.Error{Code: 410, Reason: fmt.Sprintf("cann't find signal node by key: %v", proto.GetUserNodeKey(rid, uid, "*"))}
 	}
+	list := sessionList(sessions)
+	return utils.Map("rid", rid, "uid", uid, "signalid", list[0]["signalid"], "sessions", list), nil
 }
 
 /*
 	"method" proto.SignalToRegisterGetSfuInfo
 */
 // 获取mid指定对应的sfu节点
-func getSfuByMid(data map[string]interface{}) (map[string]interface{}, *nprotoo.Error) {
+func getSfuByMid(data map[string]interface{}) (map[string]interface{}, *bus.Error) {
 	rid := utils.Val(data, "rid")
 	mid := utils.Val(data, "mid")
 	uid := proto.GetUIDFromMID(mid)
@@ -253,32 +336,47 @@ func getSfuByMid(data map[string]interface{}) (map[string]interface{}, *nprotoo.
 		sfuId := regRedis.Get(ukey)
 		return utils.Map("rid", rid, "sfuid", sfuId), nil
 	} else {
-		return nil, &nprotoo.Error{Code: 410, Reason: fmt.Sprintf("cann't find sfu node by key: %v", ukey)}
+		return nil, &bus.Error{Code: 410, Reason: fmt.Sprintf("cann't find sfu node by key: %v", ukey)}
 	}
 }
 
 /*
-	“method” proto.SignalToRegisterGetRoomUsers
+	“method” proto.SignalToRegisterGetRoomUsers "rid" rid "uid" uid "session" session
 */
-// 获取房间内其他用户的数据
-func getRoomUsers(data map[string]interface{}) (map[string]interface{}, *nprotoo.Error) {
+// 获取房间内其他用户的数据, 同一用户的会话合并到sessions中, 指定了session时只去掉请求者自己的这个会话
+func getRoomUsers(data map[string]interface{}) (map[string]interface{}, *bus.Error) {
 	logger.Debugf("register.getRoomUsers, data is %v", data)
 	rid := utils.Val(data, "rid")
 	uid := utils.Val(data, "uid")
+	session := utils.Val(data, "session")
 	// 查询数据库
-	users := make([]map[string]interface{}, 0)
+	grouped := make(map[string]map[string]string)
 	ukey := "/node/rid/" + rid + "/uid/*"
 	ukeys := regRedis.Keys(ukey)
 	for _, ke := range ukeys {
 		// 去掉指定的uid
-		arr := strings.Split(ke, "/")
-		id := arr[5]
-		if id == uid {
+		id, s := proto.ParseUserNodeKey(ke)
+		if id == "" || (id == uid && (session == "" || s == session)) {
 			continue
 		}
 		signalId := regRedis.Get(ke)
-		usuer := utils.Map("rid", rid, "uid", id, "signalid", signalId)
-		users = append(users, usuer)
+		if signalId == "" {
+			continue
+		}
+		if grouped[id] == nil {
+			grouped[id] = make(map[string]string)
+		}
+		grouped[id][s] = signalId
+	}
+	ids := make([]string, 0, len(grouped))
+	for id := range grouped {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	users := make([]map[string]interface{}, 0, len(ids))
+	for _, id := range ids {
+		list := sessionList(grouped[id])
+		users = append(users, utils.Map("rid", rid, "uid", id, "signalid", list[0]["signalid"], "sessions", list))
 	}
 	// return
 	resp := utils.Map("users", users)
@@ -286,33 +384,164 @@ func getRoomUsers(data map[string]interface{}) (map[string]interface{}, *nprotoo
 }
 
 /*
-	"method", proto.SignalToRegisterGetRoomPubs
+	"method", proto.SignalToRegisterGetRoomPubs "rid" rid "uid" uid "session" session
 */
-// 获取房间内其他用户的推流数据
-func getRoomPubs(data map[string]interface{}) (map[string]interface{}, *nprotoo.Error) {
+// 获取房间内其他用户的推流数据, 指定了session时只去掉请求者自己的这个会话发布的流
+func getRoomPubs(data map[string]interface{}) (map[string]interface{}, *bus.Error) {
 	logger.Debugf("register.getRoomPubs, data is %v", data)
 	rid := utils.Val(data, "rid")
 	uid := utils.Val(data, "uid")
+	session := utils.Val(data, "session")
 	// 查询数据库
 	pubs := make([]map[string]interface{}, 0)
 	uKey := "/pub/rid/" + rid + "/uid/*"
 	uKeys := regRedis.Keys(uKey)
 	for _, key := range uKeys {
 		// 去掉指定的uid
-		arr := strings.Split(key, "/")
-		id := arr[5]
-		mid := arr[7]
-		if id == uid {
+		_, id, mid := proto.ParseMediaPubKey(key)
+		if id == uid && session == "" {
 			continue
 		}
 		sfuid := regRedis.Get(key)
-		mKey := proto.GetMediaInfoKey(rid, uid, mid)
-		minfo := regRedis.Get(mKey)
-
-		pub := utils.Map("rid", rid, "uid", uid, "mid", mid, "sfuid", sfuid, "minfo", utils.Unmarshal(minfo))
+		mKey := proto.GetMediaInfoKey(rid, id, mid)
+		pub := pubInfo(rid, id, mid, sfuid, utils.Unmarshal(regRedis.Get(mKey)))
+		if id == uid && pub["session"] == session {
+			continue
+		}
 		pubs = append(pubs, pub)
 	}
 
 	resp := utils.Map("pubs", pubs)
 	return resp, nil
 }
+
+/*
+	"method", proto.AdminToRegisterGetRooms
+*/
+// 获取所有有用户或推流的房间, 返回每个房间的人数(同一用户的多个会话算一人)、推流数和混音所在的sfu
+func getRooms(data map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	logger.Debugf("register.getRooms, data is %v", data)
+	stats := make(map[string]map[string]interface{})
+	room := func(rid string) map[string]interface{} {
+		if _, ok := stats[rid]; !ok {
+			stats[rid] = utils.Map("rid", rid, "users", 0, "pubs", 0, "mix", regRedis.Get(proto.GetMixKey(rid)))
+		}
+		return stats[rid]
+	}
+	users := make(map[string]bool)
+	for _, key := range regRedis.Keys("/node/rid/*/uid/*") {
+		arr := strings.Split(key, "/")
+		if len(arr) < 6 || users[arr[3]+"/"+arr[5]] {
+			continue
+		}
+		users[arr[3]+"/"+arr[5]] = true
+		r := room(arr[3])
+		r["users"] = r["users"].(int) + 1
+	}
+	for _, key := range regRedis.Keys("/pub/rid/*/uid/*/mid/*") {
+		r := room(strings.Split(key, "/")[3])
+		r["pubs"] = r["pubs"].(int) + 1
+	}
+	rids := make([]string, 0, len(stats))
+	for rid := range stats {
+		rids = append(rids, rid)
+	}
+	sort.Strings(rids)
+	rooms := make([]map[string]interface{}, 0, len(rids))
+	for _, rid := range rids {
+		rooms = append(rooms, stats[rid])
+	}
+	return utils.Map("rooms", rooms), nil
+}
+
+/*
+	"method", proto.SignalToRegisterOnMixAdd, "rid", rid, "sfuid", sfuid
+*/
+// 房间开启混音, 记录混音所在的sfu
+func mixAdd(data map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	logger.Debugf("register.mixAdd, data is %v", data)
+	rid := utils.Val(data, "rid")
+	sfuId := utils.Val(data, "sfuid")
+	err := regRedis.Set(proto.GetMixKey(rid), sfuId, redisKeyTTL)
+	if err != nil {
+		logger.Errorf("register.mixAdd redis.Set err, err is %v, data is %v", err, data)
+		return nil, &bus.Error{Code: 407, Reason: fmt.Sprintf("mixAdd err, err is %v", err)}
+	}
+	return utils.Map("rid", rid, "sfuid", sfuId), nil
+}
+
+/*
+	"method", proto.SignalToRegisterOnMixRemove, "rid", rid
+*/
+// 房间关闭混音
+func mixRemove(data map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	logger.Debugf("register.mixRemove, data is %v", data)
+	rid := utils.Val(data, "rid")
+	err := regRedis.Del(proto.GetMixKey(rid))
+	if err != nil {
+		logger.Errorf("register.mixRemove redis.Del err, err is %v, data is %v", err, data)
+	}
+	return utils.Map("rid", rid), nil
+}
+
+/*
+	"method", proto.SignalToRegisterGetMixInfo, "rid", rid
+*/
+// 获取房间混音所在的sfu
+func getMixInfo(data map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	rid := utils.Val(data, "rid")
+	ukey := proto.GetMixKey(rid)
+	sfuId := regRedis.Get(ukey)
+	if sfuId == "" {
+		return nil, &bus.Error{Code: 410, Reason: fmt.Sprintf("cann't find mix sfu node by key: %v", ukey)}
+	}
+	return utils.Map("rid", rid, "sfuid", sfuId), nil
+}
+
+// getSession 获取请求中的会话, 没有时使用默认会话
+func getSession(data map[string]interface{}) string {
+	if session := utils.Val(data, "session"); session != "" {
+		return session
+	}
+	return proto.DefaultSession
+}
+
+// userSessions 获取用户在房间内在线的会话, key为session, 值为所在的signal节点
+func userSessions(rid, uid string) map[string]string {
+	sessions := make(map[string]string)
+	for _, key := range regRedis.Keys(proto.GetUserNodeKey(rid, uid, "*")) {
+		_, session := proto.ParseUserNodeKey(key)
+		if signalId := regRedis.Get(key); session != "" && signalId != "" {
+			sessions[session] = signalId
+		}
+	}
+	return sessions
+}
+
+// sessionList 会话列表, 按session排序
+func sessionList(sessions map[string]string) []map[string]interface{} {
+	keys := make([]string, 0, len(sessions))
+	for session := range sessions {
+		keys = append(keys, session)
+	}
+	sort.Strings(keys)
+	list := make([]map[string]interface{}, 0, len(keys))
+	for _, session := range keys {
+		list = append(list, utils.Map("session", session, "signalid", sessions[session]))
+	}
+	return list
+}
+
+// pubInfo 生成流信息, 保存在minfo中的会话放到外层, 没有时为默认会话
+func pubInfo(rid, uid, mid, sfuId string, minfo map[string]interface{}) map[string]interface{} {
+	session := proto.DefaultSession
+	info := make(map[string]interface{}, len(minfo))
+	for k, v := range minfo {
+		if k != "session" {
+			info[k] = v
+		} else if s, ok := v.(string); ok && s != "" {
+			session = s
+		}
+	}
+	return utils.Map("rid", rid, "uid", uid, "session", session, "mid", mid, "sfuid", sfuId, "minfo", info)
+}
@@ -0,0 +1,164 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"goRTCServer/pkg/bus"
+	"goRTCServer/pkg/logger"
+	"goRTCServer/pkg/proto"
+	"goRTCServer/pkg/utils"
+	"strconv"
+	"strings"
+)
+
+const (
+	metaRoomField  = "room"
+	metaUserPrefix = "uid:"
+	maxMetaRetry   = 5
+)
+
+// casMetaScript 版本号一致时写入数据并递增版本号, 版本号为-1时不比较
+// KEYS: meta version ARGV: field version data ttl
+var casMetaScript = `
+local cur = tonumber(redis.call('HGET', KEYS[2], ARGV[1]) or '0')
+local expect = tonumber(ARGV[2])
+if expect >= 0 and expect ~= cur then
+	return {0, cur}
+end
+cur = cur + 1
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+redis.call('HSET', KEYS[2], ARGV[1], cur)
+redis.call('EXPIRE', KEYS[1], ARGV[4])
+redis.call('EXPIRE', KEYS[2], ARGV[4])
+return {1, cur}
+`
+
+// metaUserField 用户元数据的字段名
+func metaUserField(uid string) string {
+	return metaUserPrefix + uid
+}
+
+// getMeta 获取元数据和版本号
+func getMeta(rid, field string) (map[string]interface{}, int) {
+	data := utils.Unmarshal(regRedis.HGet(proto.GetRoomMetaKey(rid), field))
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	version, _ := strconv.Atoi(regRedis.HGet(proto.GetRoomMetaVersionKey(rid), field))
+	return data, version
+}
+
+// mergeMeta 合并元数据, 值为null的字段删除
+func mergeMeta(data, update map[string]interface{}) map[string]interface{} {
+	res := make(map[string]interface{}, len(data)+len(update))
+	for k, v := range data {
+		res[k] = v
+	}
+	for k, v := range update {
+		if v == nil {
+			delete(res, k)
+		} else {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+// setMeta 合并并写入元数据, 指定版本号时做compare-and-set, 否则冲突后重试
+func setMeta(rid, field string, update map[string]interface{}, expect int) (map[string]interface{}, int, *bus.Error) {
+	keys := []string{proto.GetRoomMetaKey(rid), proto.GetRoomMetaVersionKey(rid)}
+	for i := 0; i < maxMetaRetry; i++ {
+		data, version := getMeta(rid, field)
+		if expect >= 0 && expect != version {
+			return data, version, &bus.Error{Code: 416, Reason: fmt.Sprintf("meta version conflict, current version is %d", version)}
+		}
+		data = mergeMeta(data, update)
+		buf, _ := json.Marshal(data)
+		res, err := regRedis.Eval(casMetaScript, keys, field, version, string(buf), int(redisKeyTTL.Seconds()))
+		if err != nil {
+			logger.Errorf("register.setMeta redis.Eval err, err is %v, rid is %s, field is %s", err, rid, field)
+			return nil, 0, &bus.Error{Code: 417, Reason: fmt.Sprintf("set meta err, err is %v", err)}
+		}
+		arr, _ := res.([]interface{})
+		if len(arr) == 2 && utils.InterfaceToInt(arr[0]) == 1 {
+			return data, utils.InterfaceToInt(arr[1]), nil
+		}
+	}
+	return nil, 0, &bus.Error{Code: 416, Reason: "meta version conflict, retry later"}
+}
+
+// delUserMeta 用户离开房间时删除用户元数据
+func delUserMeta(rid, uid string) {
+	regRedis.HDel(proto.GetRoomMetaKey(rid), metaUserField(uid))
+	regRedis.HDel(proto.GetRoomMetaVersionKey(rid), metaUserField(uid))
+}
+
+// roomMeta 房间和所有用户的元数据
+func roomMeta(rid string) map[string]interface{} {
+	metas := regRedis.HGetAll(proto.GetRoomMetaKey(rid))
+	versions := regRedis.HGetAll(proto.GetRoomMetaVersionKey(rid))
+	room := utils.Map("version", 0, "data", utils.Map())
+	users := make(map[string]interface{})
+	for field, value := range metas {
+		data := utils.Unmarshal(value)
+		if data == nil {
+			continue
+		}
+		version, _ := strconv.Atoi(versions[field])
+		item := utils.Map("version", version, "data", data)
+		if field == metaRoomField {
+			room = item
+		} else if strings.HasPrefix(field, metaUserPrefix) {
+			users[strings.TrimPrefix(field, metaUserPrefix)] = item
+		}
+	}
+	return utils.Map("room", room, "users", users)
+}
+
+// metaVersion 请求中的版本号, 不带为-1
+func metaVersion(data map[string]interface{}) int {
+	if data["version"] == nil {
+		return -1
+	}
+	return utils.InterfaceToInt(data["version"])
+}
+
+/*
+	"method", proto.SignalToRegisterSetRoomMeta, "rid", rid, "uid", uid, "data", data, "version", version
+*/
+// setRoomMeta 设置房间元数据
+func setRoomMeta(data map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	logger.Debugf("register.setRoomMeta, data is %v", data)
+	rid := utils.Val(data, "rid")
+	update, _ := data["data"].(map[string]interface{})
+	meta, version, err := setMeta(rid, metaRoomField, update, metaVersion(data))
+	if err != nil {
+		return nil, err
+	}
+	return utils.Map("rid", rid, "uid", utils.Val(data, "uid"), "version", version, "data", meta), nil
+}
+
+/*
+	"method", proto.SignalToRegisterSetUserMeta, "rid", rid, "uid", uid, "data", data, "version", version
+*/
+// setUserMeta 设置用户元数据
+func setUserMeta(data map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	logger.Debugf("register.setUserMeta, data is %v", data)
+	rid := utils.Val(data, "rid")
+	uid := utils.Val(data, "uid")
+	update, _ := data["data"].(map[string]interface{})
+	meta, version, err := setMeta(rid, metaUserField(uid), update, metaVersion(data))
+	if err != nil {
+		return nil, err
+	}
+	return utils.Map("rid", rid, "uid", uid, "version", version, "data", meta), nil
+}
+
+/*
+	"method", proto.SignalToRegisterGetRoomMeta, "rid", rid
+*/
+// getRoomMeta 获取房间和所有用户的元数据
+func getRoomMeta(data map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	rid := utils.Val(data, "rid")
+	return roomMeta(rid), nil
+}
@@ -0,0 +1,28 @@
+package src
+
+import "testing"
+
+func TestSetMetaVersion(t *testing.T) {
+	data, version, err := setMeta("lua_meta", metaRoomField, map[string]interface{}{"title": "a", "topic": "b"}, -1)
+	if err != nil || version != 1 || data["title"] != "a" {
+		t.Fatalf("first set should create version 1, data is %v, version is %d, err is %v", data, version, err)
+	}
+	// 版本号不一致时拒绝
+	if _, current, err := setMeta("lua_meta", metaRoomField, map[string]interface{}{"title": "c"}, 0); err == nil || err.Code != 416 || current != 1 {
+		t.Fatalf("stale version should conflict, current is %d, err is %v", current, err)
+	}
+	// 值为null的字段删除, 其他字段合并
+	data, version, err = setMeta("lua_meta", metaRoomField, map[string]interface{}{"topic": nil, "title": "c"}, 1)
+	if err != nil || version != 2 || data["title"] != "c" || data["topic"] != nil {
+		t.Fatalf("merge should update title and drop topic, data is %v, version is %d, err is %v", data, version, err)
+	}
+	setMeta("lua_meta", metaUserField("u1"), map[string]interface{}{"hand": true}, -1)
+	meta := roomMeta("lua_meta")
+	if users := meta["users"].(map[string]interface{}); users["u1"] == nil {
+		t.Fatalf("user meta should be listed, meta is %v", meta)
+	}
+	delUserMeta("lua_meta", "u1")
+	if users := roomMeta("lua_meta")["users"].(map[string]interface{}); len(users) != 0 {
+		t.Fatalf("user meta should be deleted, users is %v", users)
+	}
+}
@@ -0,0 +1,308 @@
+package src
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"goRTCServer/pkg/bus"
+	"goRTCServer/pkg/logger"
+	"goRTCServer/pkg/proto"
+	"goRTCServer/pkg/utils"
+	"goRTCServer/server/register/conf"
+	"strconv"
+	"time"
+)
+
+const (
+	joinOK       = "ok"
+	joinLobby    = "lobby"
+	joinFull     = "full"
+	joinPassword = "password"
+	joinReject   = "reject"
+)
+
+// joinScript 原子的检查房间设置并加入成员, 不同signal同时加入也不会超过人数上限
+// 房间没有主持人时, 第一个加入的人(房间创建者)成为主持人
+// 多会话策略为reject时, 同一用户已经有其他在线会话则拒绝, 同时加入的两个会话只有一个成功
+// KEYS: settings members lobby sessions
+// ARGV: uid now expire password maxusers(房间没有设置时的默认值) ttl session policy(房间没有设置时的默认值)
+var joinScript = `
+local cfg = {}
+local kv = redis.call('HGETALL', KEYS[1])
+for i = 1, #kv, 2 do cfg[kv[i]] = kv[i + 1] end
+local uid = ARGV[1]
+local function admit()
+	redis.call('ZADD', KEYS[2], ARGV[3], uid)
+	redis.call('ZADD', KEYS[4], ARGV[3], ARGV[7])
+	redis.call('EXPIRE', KEYS[4], ARGV[6])
+	if not cfg['host'] then
+		redis.call('HSET', KEYS[1], 'host', uid)
+		redis.call('EXPIRE', KEYS[1], ARGV[6])
+	end
+	return 'ok'
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', ARGV[2])
+redis.call('ZREMRANGEBYSCORE', KEYS[4], '-inf', ARGV[2])
+if (cfg['sessions'] or ARGV[8]) == 'reject' then
+	local others = redis.call('ZCARD', KEYS[4])
+	if redis.call('ZSCORE', KEYS[4], ARGV[7]) then
+		others = others - 1
+	end
+	if others > 0 then
+		return 'reject'
+	end
+end
+if redis.call('ZSCORE', KEYS[2], uid) then
+	return admit()
+end
+if cfg['host'] ~= uid then
+	if cfg['password'] and cfg['password'] ~= '' and cfg['password'] ~= ARGV[4] then
+		return 'password'
+	end
+	if cfg['lobby'] == '1' and redis.call('HGET', KEYS[3], uid) ~= 'admit' then
+		redis.call('HSET', KEYS[3], uid, 'wait')
+		redis.call('EXPIRE', KEYS[3], 86400)
+		return 'lobby'
+	end
+end
+local max = tonumber(cfg['maxusers'] or ARGV[5]) or 0
+if max > 0 and redis.call('ZCARD', KEYS[2]) >= max then
+	return 'full'
+end
+return admit()
+`
+
+// publishScript 原子的检查发布人数并加入发布者
+// KEYS: settings publishers ARGV: uid now expire maxpubs(房间没有设置时的默认值)
+var publishScript = `
+local uid = ARGV[1]
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', ARGV[2])
+if not redis.call('ZSCORE', KEYS[2], uid) then
+	local max = tonumber(redis.call('HGET', KEYS[1], 'maxpubs') or ARGV[4]) or 0
+	if max > 0 and redis.call('ZCARD', KEYS[2]) >= max then
+		return 'full'
+	end
+end
+redis.call('ZADD', KEYS[2], ARGV[3], uid)
+return 'ok'
+`
+
+// refreshScript 保活时刷新成员、发布者和会话的过期时间
+// KEYS: members publishers sessions ARGV: uid expire session
+var refreshScript = `
+redis.call('ZADD', KEYS[1], 'XX', ARGV[2], ARGV[1])
+redis.call('ZADD', KEYS[2], 'XX', ARGV[2], ARGV[1])
+redis.call('ZADD', KEYS[3], 'XX', ARGV[2], ARGV[3])
+return 'ok'
+`
+
+// setRoomScript 设置房间, 只有主持人可以修改
+// KEYS: settings ARGV: uid ttl field value ...
+var setRoomScript = `
+if redis.call('HGET', KEYS[1], 'host') ~= ARGV[1] then
+	return 'forbidden'
+end
+for i = 3, #ARGV, 2 do
+	redis.call('HSET', KEYS[1], ARGV[i], ARGV[i + 1])
+end
+redis.call('EXPIRE', KEYS[1], ARGV[2])
+return 'ok'
+`
+
+// lobbyAdmitScript 原子的检查主持人和等候状态并允许进入, 只有正在等待的用户可以被允许
+// KEYS: settings lobby ARGV: uid target
+var lobbyAdmitScript = `
+if redis.call('HGET', KEYS[1], 'host') ~= ARGV[1] then
+	return 'forbidden'
+end
+if redis.call('HGET', KEYS[2], ARGV[2]) ~= 'wait' then
+	return 'notwaiting'
+end
+redis.call('HSET', KEYS[2], ARGV[2], 'admit')
+return 'ok'
+`
+
+// hashPassword 房间密码只保存摘要
+func hashPassword(password string) string {
+	if password == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// expireAt 成员的过期时间, 和用户节点key的过期时间一致, 通过keepalive刷新
+func expireAt() string {
+	return strconv.FormatInt(time.Now().Add(redisShort).Unix(), 10)
+}
+
+// roomAdmit 检查房间设置和多会话策略并加入成员, 房间没有设置人数上限和多会话策略时使用配置的默认值
+func roomAdmit(rid, uid, session, password string) (string, error) {
+	maxusers, _ := conf.GetRoomLimits()
+	keys := []string{proto.GetRoomSettingsKey(rid), proto.GetRoomMembersKey(rid), proto.GetRoomLobbyKey(rid), proto.GetRoomUserSessionsKey(rid, uid)}
+	res, err := regRedis.Eval(joinScript, keys, uid, time.Now().Unix(), expireAt(), hashPassword(password), maxusers, int(redisKeyTTL.Seconds()), session, conf.GetRoomSessions())
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprint(res), nil
+}
+
+// roomPublish 检查发布人数并加入发布者, 房间没有设置发布人数上限时使用配置的默认值
+func roomPublish(rid, uid string) (string, error) {
+	_, maxpubs := conf.GetRoomLimits()
+	keys := []string{proto.GetRoomSettingsKey(rid), proto.GetRoomPublishersKey(rid)}
+	res, err := regRedis.Eval(publishScript, keys, uid, time.Now().Unix(), expireAt(), maxpubs)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprint(res), nil
+}
+
+// roomRefresh 刷新成员、发布者和会话的过期时间
+func roomRefresh(rid, uid, session string) error {
+	keys := []string{proto.GetRoomMembersKey(rid), proto.GetRoomPublishersKey(rid), proto.GetRoomUserSessionsKey(rid, uid)}
+	_, err := regRedis.Eval(refreshScript, keys, uid, expireAt(), session)
+	return err
+}
+
+// roomSessionLeave 会话离开房间
+func roomSessionLeave(rid, uid, session string) {
+	regRedis.ZRem(proto.GetRoomUserSessionsKey(rid, uid), session)
+}
+
+// roomLeave 成员离开房间
+func roomLeave(rid, uid string) {
+	regRedis.Del(proto.GetRoomUserSessionsKey(rid, uid))
+	regRedis.ZRem(proto.GetRoomMembersKey(rid), uid)
+	regRedis.ZRem(proto.GetRoomPublishersKey(rid), uid)
+	regRedis.HDel(proto.GetRoomLobbyKey(rid), uid)
+	delUserMeta(rid, uid)
+}
+
+// roomUnpublish 用户没有其他流时移出发布者
+func roomUnpublish(rid, uid string) {
+	if len(regRedis.Keys("/pub/rid/"+rid+"/uid/"+uid+"/mid/*")) == 0 {
+		regRedis.ZRem(proto.GetRoomPublishersKey(rid), uid)
+	}
+}
+
+// roomSessions 获取房间的多会话策略, 房间没有设置时使用配置的默认值
+func roomSessions(rid string) string {
+	if policy := regRedis.HGet(proto.GetRoomSettingsKey(rid), "sessions"); policy != "" {
+		return policy
+	}
+	return conf.GetRoomSessions()
+}
+
+// validSessions 是否是支持的多会话策略
+func validSessions(policy string) bool {
+	return policy == proto.SessionMulti || policy == proto.SessionReplace || policy == proto.SessionReject
+}
+
+// roomHost 获取房间主持人
+func roomHost(rid string) string {
+	return regRedis.HGet(proto.GetRoomSettingsKey(rid), "host")
+}
+
+// roomWaiting 获取等候室中等待的用户
+func roomWaiting(rid string) []string {
+	res := make([]string, 0)
+	for uid, state := range regRedis.HGetAll(proto.GetRoomLobbyKey(rid)) {
+		if state == "wait" {
+			res = append(res, uid)
+		}
+	}
+	return res
+}
+
+/*
+	"method", proto.SignalToRegisterSetRoom, "rid", rid, "uid", uid, "maxusers", maxusers, "maxpubs", maxpubs, "password", password, "lobby", lobby, "sessions", sessions
+*/
+// setRoom 设置房间人数上限、发布人数上限、密码、等候室和多会话策略
+func setRoom(data map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	logger.Debugf("register.setRoom, data is %v", data)
+	rid := utils.Val(data, "rid")
+	uid := utils.Val(data, "uid")
+	args := []interface{}{uid, int(redisKeyTTL.Seconds())}
+	if data["maxusers"] != nil {
+		args = append(args, "maxusers", utils.InterfaceToInt(data["maxusers"]))
+	}
+	if data["maxpubs"] != nil {
+		args = append(args, "maxpubs", utils.InterfaceToInt(data["maxpubs"]))
+	}
+	if data["password"] != nil {
+		args = append(args, "password", hashPassword(utils.Val(data, "password")))
+	}
+	if data["lobby"] != nil {
+		lobby := "0"
+		if utils.InterfaceToBool(data["lobby"]) {
+			lobby = "1"
+		}
+		args = append(args, "lobby", lobby)
+	}
+	if data["sessions"] != nil {
+		sessions := utils.Val(data, "sessions")
+		if !validSessions(sessions) {
+			return nil, &bus.Error{Code: 411, Reason: fmt.Sprintf("setRoom err, invalid sessions %q", sessions)}
+		}
+		args = append(args, "sessions", sessions)
+	}
+	res, err := regRedis.Eval(setRoomScript, []string{proto.GetRoomSettingsKey(rid)}, args...)
+	if err != nil {
+		logger.Errorf("register.setRoom redis.Eval err, err is %v, data is %v", err, data)
+		return nil, &bus.Error{Code: 411, Reason: fmt.Sprintf("setRoom err, err is %v", err)}
+	}
+	if fmt.Sprint(res) != joinOK {
+		return nil, &bus.Error{Code: 413, Reason: "only host can change room settings"}
+	}
+	settings := regRedis.HGetAll(proto.GetRoomSettingsKey(rid))
+	return utils.Map("rid", rid, "host", uid, "maxusers", utils.InterfaceToInt(settings["maxusers"]),
+		"maxpubs", utils.InterfaceToInt(settings["maxpubs"]), "password", settings["password"] != "", "lobby", settings["lobby"] == "1", "sessions", roomSessions(rid)), nil
+}
+
+/*
+	"method", proto.SignalToRegisterGetRoomHost, "rid", rid
+*/
+// getRoomHost 获取房间主持人, 没有主持人时host为空
+func getRoomHost(data map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	rid := utils.Val(data, "rid")
+	return utils.Map("rid", rid, "host", roomHost(rid)), nil
+}
+
+/*
+	"method", proto.SignalToRegisterLobbyAdmit, "rid", rid, "uid", uid, "target", target
+*/
+// lobbyAdmit 主持人允许等候室用户进入
+func lobbyAdmit(data map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	rid := utils.Val(data, "rid")
+	uid := utils.Val(data, "uid")
+	target := utils.Val(data, "target")
+	keys := []string{proto.GetRoomSettingsKey(rid), proto.GetRoomLobbyKey(rid)}
+	res, err := regRedis.Eval(lobbyAdmitScript, keys, uid, target)
+	if err != nil {
+		logger.Errorf("register.lobbyAdmit redis.Eval err, err is %v, data is %v", err, data)
+		return nil, &bus.Error{Code: 411, Reason: fmt.Sprintf("lobbyAdmit err, err is %v", err)}
+	}
+	switch fmt.Sprint(res) {
+	case "forbidden":
+		return nil, &bus.Error{Code: 413, Reason: "only host can admit"}
+	case "notwaiting":
+		return nil, &bus.Error{Code: 424, Reason: fmt.Sprintf("user %s is not waiting in lobby", target)}
+	}
+	return utils.Map("rid", rid, "uid", target), nil
+}
+
+/*
+	"method", proto.SignalToRegisterLobbyDeny, "rid", rid, "uid", uid, "target", target
+*/
+// lobbyDeny 主持人拒绝等候室用户进入
+func lobbyDeny(data map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	rid := utils.Val(data, "rid")
+	uid := utils.Val(data, "uid")
+	target := utils.Val(data, "target")
+	if roomHost(rid) != uid {
+		return nil, &bus.Error{Code: 413, Reason: "only host can deny"}
+	}
+	regRedis.HDel(proto.GetRoomLobbyKey(rid), target)
+	return utils.Map("rid", rid, "uid", target), nil
+}
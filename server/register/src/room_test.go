@@ -0,0 +1,127 @@
+package src
+
+import (
+	"goRTCServer/pkg/proto"
+	"testing"
+)
+
+func mustAdmit(t *testing.T, rid, uid, password, want string) {
+	t.Helper()
+	got, err := roomAdmit(rid, uid, proto.DefaultSession, password)
+	if err != nil {
+		t.Fatalf("admit %s err, err is %v", uid, err)
+	}
+	if got != want {
+		t.Fatalf("admit %s should return %s, got %s", uid, want, got)
+	}
+}
+
+func mustSetRoom(t *testing.T, rid, uid string, settings map[string]interface{}) {
+	t.Helper()
+	data := map[string]interface{}{"rid": rid, "uid": uid}
+	for k, v := range settings {
+		data[k] = v
+	}
+	if _, err := setRoom(data); err != nil {
+		t.Fatalf("set room err, err is %v", err.Reason)
+	}
+}
+
+func TestJoinScriptMaxUsers(t *testing.T) {
+	mustAdmit(t, "lua_full", "a", "", joinOK)
+	mustSetRoom(t, "lua_full", "a", map[string]interface{}{"maxusers": 2})
+	mustAdmit(t, "lua_full", "b", "", joinOK)
+	mustAdmit(t, "lua_full", "c", "", joinFull)
+	// 已经在房间中的人重新加入不受上限影响
+	mustAdmit(t, "lua_full", "b", "", joinOK)
+
+	// 过期的成员不占用名额
+	store.ZAdd(proto.GetRoomMembersKey("lua_full"), 1, "b")
+	mustAdmit(t, "lua_full", "c", "", joinOK)
+}
+
+func TestJoinScriptPasswordAndLobby(t *testing.T) {
+	mustAdmit(t, "lua_lobby", "host", "", joinOK)
+	mustSetRoom(t, "lua_lobby", "host", map[string]interface{}{"password": "123456", "lobby": true})
+	mustAdmit(t, "lua_lobby", "a", "wrong", joinPassword)
+	mustAdmit(t, "lua_lobby", "a", "123456", joinLobby)
+	if waiting := roomWaiting("lua_lobby"); len(waiting) != 1 || waiting[0] != "a" {
+		t.Fatalf("a should be waiting, waiting is %v", waiting)
+	}
+	if _, err := lobbyAdmit(map[string]interface{}{"rid": "lua_lobby", "uid": "a", "target": "a"}); err == nil {
+		t.Fatal("only host can admit")
+	}
+	if _, err := lobbyAdmit(map[string]interface{}{"rid": "lua_lobby", "uid": "host", "target": "b"}); err == nil || err.Code != 424 {
+		t.Fatalf("admit a user not in lobby should fail with 424, err is %v", err)
+	}
+	if _, err := lobbyAdmit(map[string]interface{}{"rid": "lua_lobby", "uid": "host", "target": "a"}); err != nil {
+		t.Fatalf("host admit err, err is %v", err.Reason)
+	}
+	// 已经允许的用户不在等待, 重复允许返回错误
+	if _, err := lobbyAdmit(map[string]interface{}{"rid": "lua_lobby", "uid": "host", "target": "a"}); err == nil || err.Code != 424 {
+		t.Fatalf("admit twice should fail with 424, err is %v", err)
+	}
+	mustAdmit(t, "lua_lobby", "a", "123456", joinOK)
+	// 主持人不校验密码和等候室
+	roomLeave("lua_lobby", "host")
+	mustAdmit(t, "lua_lobby", "host", "", joinOK)
+}
+
+func TestSetRoomOnlyHost(t *testing.T) {
+	if _, err := setRoom(map[string]interface{}{"rid": "lua_host", "uid": "a", "maxusers": 1}); err == nil || err.Code != 413 {
+		t.Fatalf("set room without host should be rejected, err is %v", err)
+	}
+	mustAdmit(t, "lua_host", "a", "", joinOK)
+	mustAdmit(t, "lua_host", "b", "", joinOK)
+	if _, err := setRoom(map[string]interface{}{"rid": "lua_host", "uid": "b", "maxusers": 1}); err == nil || err.Code != 413 {
+		t.Fatalf("set room by non host should be rejected, err is %v", err)
+	}
+	if host := roomHost("lua_host"); host != "a" {
+		t.Fatalf("host should be a, host is %s", host)
+	}
+	if _, err := setRoom(map[string]interface{}{"rid": "lua_host", "uid": "a", "sessions": "bogus"}); err == nil {
+		t.Fatal("invalid sessions policy should be rejected")
+	}
+}
+
+func TestPublishScriptMaxPubs(t *testing.T) {
+	mustAdmit(t, "lua_pub", "a", "", joinOK)
+	mustSetRoom(t, "lua_pub", "a", map[string]interface{}{"maxpubs": 1})
+	for _, c := range []struct {
+		uid, want string
+	}{{"a", joinOK}, {"a", joinOK}, {"b", joinFull}} {
+		got, err := roomPublish("lua_pub", c.uid)
+		if err != nil || got != c.want {
+			t.Fatalf("publish %s should return %s, got %s, err is %v", c.uid, c.want, got, err)
+		}
+	}
+}
+
+func TestJoinScriptRejectSessions(t *testing.T) {
+	admit := func(session, want string) {
+		t.Helper()
+		got, err := roomAdmit("lua_reject", "a", session, "")
+		if err != nil || got != want {
+			t.Fatalf("admit session %s should return %s, got %s, err is %v", session, want, got, err)
+		}
+	}
+	admit("s1", joinOK)
+	mustSetRoom(t, "lua_reject", "a", map[string]interface{}{"sessions": "reject"})
+	admit("s2", joinReject)
+	// 同一会话重新加入不受影响
+	admit("s1", joinOK)
+
+	// 会话离开或过期后其他会话可以加入
+	roomSessionLeave("lua_reject", "a", "s1")
+	admit("s2", joinOK)
+	store.ZAdd(proto.GetRoomUserSessionsKey("lua_reject", "a"), 1, "s2")
+	admit("s3", joinOK)
+
+	// 保活刷新会话的过期时间
+	if err := roomRefresh("lua_reject", "a", "s3"); err != nil {
+		t.Fatalf("room refresh err, err is %v", err)
+	}
+	admit("s4", joinReject)
+	roomLeave("lua_reject", "a")
+	admit("s4", joinOK)
+}
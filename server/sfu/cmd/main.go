@@ -1,12 +1,16 @@
 package main
 
-import "goRTCServer/server/sfu/src"
+import (
+	"goRTCServer/server/sfu/conf"
+	"goRTCServer/server/sfu/src"
+)
 
 func close() {
 	src.Stop()
 }
 
 func main() {
+	conf.Init()
 	defer close()
 	src.Start()
 	select {}
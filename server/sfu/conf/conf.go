@@ -1,17 +1,31 @@
 package conf
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"goRTCServer/pkg/confutil"
+	"goRTCServer/pkg/discovery"
+	"net"
 	"os"
+	"strings"
+	"sync"
 
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
+// hotSections 可以热加载的配置段, 其他配置修改后需要重启
+var hotSections = []string{"log", "webrtc.iceserver"}
+
 var (
 	cfg = config{}
+	// lock 保护可以热加载的配置项
+	lock sync.RWMutex
 	// Global 全局设置
 	Global = &cfg.Global
+	// Discovery 服务发现设置
+	Discovery = &cfg.Discovery
 	// Etcd Etcd设置
 	Etcd = &cfg.Etcd
 	// Nats 消息中间件设置
@@ -21,15 +35,32 @@ var (
 	// Kafka 中间件
 	Kafka = &cfg.Kafka
 	Ogg   = &cfg.Ogg
+	// RTP 普通RTP推流/转发参数
+	RTP = &cfg.RTP
+	// FFmpeg 转码程序设置
+	FFmpeg = &cfg.FFmpeg
+	// HLS 直播输出设置
+	HLS = &cfg.HLS
+	// RTMP RTMP推流设置
+	RTMP = &cfg.RTMP
+	// TURN 内置TURN服务设置
+	TURN = &cfg.TURN
 )
 
-func init() {
+// Init 解析命令行参数并加载配置, 失败时退出
+func Init() {
 	if !cfg.parse() {
 		showHelp()
 		os.Exit(-1)
 	}
 }
 
+// Load 加载指定的配置文件, all-in-one模式下各服务分别加载自己的配置
+func Load(file string) bool {
+	cfg.CfgFile = file
+	return cfg.load()
+}
+
 type global struct {
 	Pprof  string `mapstructure:"pprof"`
 	NodeDC string `mapstructure:"dc"`
@@ -49,6 +80,40 @@ type ogg struct {
 	OPEN bool `mapstructure:"open"`
 }
 
+type rtpcfg struct {
+	Host         string   `mapstructure:"host"`
+	PortRange    []uint16 `mapstructure:"portrange"`
+	ForwardAllow []string `mapstructure:"forwardallow"`
+}
+
+type ffmpeg struct {
+	Path string `mapstructure:"path"`
+}
+
+type rtmpcfg struct {
+	Allow []string `mapstructure:"allow"`
+}
+
+type hls struct {
+	Dir      string `mapstructure:"dir"`
+	HTTP     string `mapstructure:"http"`
+	URL      string `mapstructure:"url"`
+	Segment  int    `mapstructure:"segment"`
+	ListSize int    `mapstructure:"listsize"`
+}
+
+type turncfg struct {
+	Enable    bool   `mapstructure:"enable"`
+	Listen    string `mapstructure:"listen"`
+	TLSListen string `mapstructure:"tlslisten"`
+	Cert      string `mapstructure:"cert"`
+	Key       string `mapstructure:"key"`
+	PublicIP  string `mapstructure:"publicip"`
+	Host      string `mapstructure:"host"`
+	Realm     string `mapstructure:"realm"`
+	Secret    string `mapstructure:"secret"`
+}
+
 type kafka struct {
 	URL string `mapstructure:"url"`
 }
@@ -62,16 +127,70 @@ type iceserver struct {
 type webrtc struct {
 	ICEPortRange []uint16    `mapstructure:"portrange"`
 	ICEServers   []iceserver `mapstructure:"iceserver"`
+	Grace        int         `mapstructure:"grace"`
+	PLIInterval  int         `mapstructure:"pliinterval"`
+	NAT1To1IPs   []string    `mapstructure:"nat1to1ips"`
+	NAT1To1Type  string      `mapstructure:"nat1to1type"`
+	NetworkTypes []string    `mapstructure:"networktypes"`
+	UDPMux       int         `mapstructure:"udpmux"`
+	TCPMux       int         `mapstructure:"tcpmux"`
+}
+
+type logcfg struct {
+	Level string `mapstructure:"level"` // debug(默认)、info、warn、error
+}
+
+// GetLogLevel 获取日志级别
+func GetLogLevel() logrus.Level {
+	lock.RLock()
+	defer lock.RUnlock()
+	level, _ := logrus.ParseLevel(cfg.Log.Level)
+	return level
+}
+
+// GetICEServers 获取新建连接使用的ICE服务
+func GetICEServers() []iceserver {
+	lock.RLock()
+	defer lock.RUnlock()
+	return cfg.WebRTC.ICEServers
+}
+
+type staticnode struct {
+	NodeDC string   `mapstructure:"dc"`
+	NodeID string   `mapstructure:"id"`
+	Name   string   `mapstructure:"name"`
+	TURN   []string `mapstructure:"turn"`
+}
+
+type discoverycfg struct {
+	Type  string       `mapstructure:"type"` // etcd(默认)或static
+	Nodes []staticnode `mapstructure:"node"` // static时所有节点的列表
+}
+
+// StaticNodes 静态配置的所有节点
+func StaticNodes() []discovery.Node {
+	nodes := make([]discovery.Node, 0, len(cfg.Discovery.Nodes))
+	for _, n := range cfg.Discovery.Nodes {
+		nodes = append(nodes, discovery.Node{NodeDC: n.NodeDC, NodeID: n.NodeID, Name: n.Name, TURN: strings.Join(n.TURN, ",")})
+	}
+	return nodes
 }
 
 type config struct {
-	Global  global `mapstructure:"global"`
-	Etcd    etcd   `mapstructure:"etcd"`
-	Nats    nats   `mapstructure:"nats"`
-	WebRTC  webrtc `mapstructure:"webrtc"`
-	Kafka   kafka  `mapstructure:"kafka"`
-	Ogg     ogg    `mapstructure:"ogg"`
-	CfgFile string
+	Global    global       `mapstructure:"global"`
+	Discovery discoverycfg `mapstructure:"discovery"`
+	Etcd      etcd         `mapstructure:"etcd"`
+	Nats      nats         `mapstructure:"nats"`
+	WebRTC    webrtc       `mapstructure:"webrtc"`
+	Kafka     kafka        `mapstructure:"kafka"`
+	Ogg       ogg          `mapstructure:"ogg"`
+	RTP       rtpcfg       `mapstructure:"rtp"`
+	FFmpeg    ffmpeg       `mapstructure:"ffmpeg"`
+	HLS       hls          `mapstructure:"hls"`
+	RTMP      rtmpcfg      `mapstructure:"rtmp"`
+	TURN      turncfg      `mapstructure:"turn"`
+	Log       logcfg       `mapstructure:"log"`
+	CfgFile   string
 }
 
 func showHelp() {
@@ -81,37 +200,167 @@ func showHelp() {
 }
 
 func (c *config) load() bool {
-	_, err := os.Stat(c.CfgFile)
+	n, err := read(c.CfgFile)
 	if err != nil {
+		fmt.Printf("config file %s load failed. %v\n", c.CfgFile, err)
 		return false
 	}
+	lock.Lock()
+	*c = *n
+	lock.Unlock()
+	fmt.Printf("config %s load ok!\n", c.CfgFile)
+	return true
+}
 
-	viper.SetConfigFile(c.CfgFile)
-	viper.SetConfigType("toml")
-
-	err = viper.ReadInConfig()
-	if err != nil {
-		fmt.Printf("config file %s read failed. %v\n", c.CfgFile, err)
-		return false
+// read 读取配置文件, 环境变量覆盖文件中的配置, 填充默认值并校验
+func read(file string) (*config, error) {
+	if _, err := os.Stat(file); err != nil {
+		return nil, err
 	}
-	err = viper.GetViper().UnmarshalExact(c)
-	if err != nil {
-		fmt.Printf("config file %s loaded failed. %v\n", c.CfgFile, err)
-		return false
+	v := viper.New()
+	v.SetConfigFile(file)
+	v.SetConfigType("toml")
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	c := &config{CfgFile: file}
+	confutil.BindEnv(v, "sfu", c)
+	if err := v.UnmarshalExact(c); err != nil {
+		return nil, err
 	}
+	if c.WebRTC.Grace <= 0 {
+		c.WebRTC.Grace = 10
+	}
+	if c.WebRTC.PLIInterval <= 0 {
+		c.WebRTC.PLIInterval = 1000
+	}
+	if c.TURN.Listen == "" {
+		c.TURN.Listen = ":3478"
+	}
+	if c.TURN.TLSListen == "" {
+		c.TURN.TLSListen = ":5349"
+	}
+	if c.TURN.Realm == "" {
+		c.TURN.Realm = "goRTCServer"
+	}
+	if c.FFmpeg.Path == "" {
+		c.FFmpeg.Path = "ffmpeg"
+	}
+	if c.HLS.Dir == "" {
+		c.HLS.Dir = "./hls"
+	}
+	if c.HLS.Segment <= 0 {
+		c.HLS.Segment = 2
+	}
+	if c.HLS.ListSize <= 0 {
+		c.HLS.ListSize = 6
+	}
+	if c.Discovery.Type == "" {
+		c.Discovery.Type = "etcd"
+	}
+	if c.Log.Level == "" {
+		c.Log.Level = "debug"
+	}
+	if errs := c.validate(); len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "; "))
+	}
+	return c, nil
+}
 
-	if len(c.WebRTC.ICEPortRange) > 2 {
-		fmt.Printf("config file %s loaded failed. range port must be [min,max]\n", c.CfgFile)
-		return false
+// validate 校验配置, 返回所有错误, 每个错误都带配置项名称
+func (c *config) validate() []string {
+	errs := make([]string, 0)
+	if c.Global.NodeDC == "" || c.Global.NodeID == "" || c.Global.Name == "" {
+		errs = append(errs, "global.dc, global.id and global.name must be non empty")
+	}
+	if c.Nats.URL == "" {
+		errs = append(errs, "nats.url must be non empty")
+	}
+	if r := c.WebRTC.ICEPortRange; len(r) != 0 && (len(r) != 2 || r[1] < r[0] || r[1]-r[0] <= 100) {
+		errs = append(errs, fmt.Sprintf("webrtc.portrange must be [min, max] and max - min > 100, got %v", r))
+	}
+	if t := c.WebRTC.NAT1To1Type; t != "" && t != "host" && t != "srflx" {
+		errs = append(errs, fmt.Sprintf("webrtc.nat1to1type must be host or srflx, got %q", t))
+	}
+	if c.WebRTC.NAT1To1Type == "srflx" && len(c.WebRTC.NAT1To1IPs) > 0 && len(c.WebRTC.ICEServers) > 0 {
+		errs = append(errs, "webrtc.nat1to1type srflx cannot be used with webrtc.iceserver")
 	}
+	for _, t := range c.WebRTC.NetworkTypes {
+		if t != "udp4" && t != "udp6" && t != "tcp4" && t != "tcp6" {
+			errs = append(errs, fmt.Sprintf("webrtc.networktypes only support udp4, udp6, tcp4 and tcp6, got %q", t))
+		}
+	}
+	if p := c.WebRTC.UDPMux; p < 0 || p > 65535 {
+		errs = append(errs, fmt.Sprintf("webrtc.udpmux must be a port, got %d", p))
+	}
+	if p := c.WebRTC.TCPMux; p < 0 || p > 65535 {
+		errs = append(errs, fmt.Sprintf("webrtc.tcpmux must be a port, got %d", p))
+	}
+	if r := c.RTP.PortRange; len(r) != 0 && (len(r) != 2 || r[1] <= r[0]) {
+		errs = append(errs, fmt.Sprintf("rtp.portrange must be [min, max], got %v", r))
+	}
+	for _, h := range c.RTMP.Allow {
+		if h == "" || strings.Contains(h, "/") {
+			errs = append(errs, fmt.Sprintf("rtmp.allow must be host or host:port, got %q", h))
+		}
+	}
+	for _, a := range c.RTP.ForwardAllow {
+		if _, _, err := net.ParseCIDR(a); err != nil && net.ParseIP(a) == nil {
+			errs = append(errs, fmt.Sprintf("rtp.forwardallow must be ip or cidr, got %q", a))
+		}
+	}
+	if c.TURN.Enable && c.TURN.Secret == "" {
+		errs = append(errs, "turn.secret must be set when turn.enable is true")
+	}
+	if (c.TURN.Cert == "") != (c.TURN.Key == "") {
+		errs = append(errs, "turn.cert and turn.key must be set together")
+	}
+	switch c.Discovery.Type {
+	case "etcd":
+		if len(c.Etcd.Adds) == 0 {
+			errs = append(errs, "etcd.addrs must be non empty when discovery.type is etcd")
+		}
+	case "static":
+		for i, n := range c.Discovery.Nodes {
+			if n.NodeDC == "" || n.NodeID == "" || n.Name == "" {
+				errs = append(errs, fmt.Sprintf("discovery.node[%d] dc, id and name must be non empty", i))
+			}
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("discovery.type must be etcd or static, got %q", c.Discovery.Type))
+	}
+	if _, err := logrus.ParseLevel(c.Log.Level); err != nil {
+		errs = append(errs, fmt.Sprintf("log.level must be debug, info, warn or error, got %q", c.Log.Level))
+	}
+	return errs
+}
 
-	if len(c.WebRTC.ICEPortRange) != 0 && c.WebRTC.ICEPortRange[1]-c.WebRTC.ICEPortRange[0] <= 100 {
-		fmt.Printf("config file %s loaded failed. range port must be [min, max] and max - min >= %d\n", c.CfgFile, 100)
-		return false
+// Reload 重新读取配置文件, 只更新可以热加载的配置项(日志级别、ICE服务),
+// 返回更新了的配置项和修改了但需要重启才能生效的配置项, 配置错误时保持原来的配置
+func Reload() (changed, restart []string, err error) {
+	n, err := read(cfg.CfgFile)
+	if err != nil {
+		return nil, nil, err
 	}
+	lock.Lock()
+	defer lock.Unlock()
+	for _, key := range confutil.Diff(&cfg, n) {
+		if confutil.Section(key, hotSections...) {
+			changed = append(changed, key)
+		} else {
+			restart = append(restart, key)
+		}
+	}
+	cfg.Log = n.Log
+	cfg.WebRTC.ICEServers = n.WebRTC.ICEServers
+	return changed, restart, nil
+}
 
-	fmt.Printf("config %s load ok!\n", c.CfgFile)
-	return true
+// Watch 配置文件变化或收到SIGHUP时重新加载, 结果通过onReload通知, 返回停止监控的函数
+func Watch(onReload func(changed, restart []string, err error)) (func(), error) {
+	return confutil.Watch(cfg.CfgFile, func() {
+		onReload(Reload())
+	})
 }
 
 func (c *config) parse() bool {
@@ -0,0 +1,352 @@
+package rtc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"goRTCServer/pkg/logger"
+	"goRTCServer/server/sfu/conf"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	keyFrameCycle   = 2 * time.Second
+	keyFrameTries   = 3 // ffmpeg启动后请求关键帧的次数, 之后由ffmpeg自己按分片时长生成关键帧
+	ffmpegRetryMin  = time.Second
+	ffmpegRetryMax  = 30 * time.Second
+	ffmpegStableRun = time.Minute
+)
+
+// ffmpegInput ffmpeg的一路输入, 作为Router的sink把音视频通过本机RTP发给ffmpeg
+type ffmpegInput struct {
+	proc     *ffmpegProc
+	router   *Router
+	forward  *RTPForward
+	sdp      string
+	hasAudio bool
+	hasVideo bool
+}
+
+// ID sink的id
+func (in *ffmpegInput) ID() string {
+	return in.proc.id
+}
+
+// WriteAudioRTP 音频包发给ffmpeg
+func (in *ffmpegInput) WriteAudioRTP(pkt *rtp.Packet) error {
+	return in.forward.WriteAudioRTP(pkt)
+}
+
+// WriteVideoRTP 视频包发给ffmpeg
+func (in *ffmpegInput) WriteVideoRTP(pkt *rtp.Packet) error {
+	return in.forward.WriteVideoRTP(pkt)
+}
+
+// Close Router关闭或删除sink时移出ffmpeg
+func (in *ffmpegInput) Close() {
+	in.forward.Close()
+	go in.proc.delInput(in)
+}
+
+// ffmpegProc 把一个或多个Router的音视频交给ffmpeg转码输出, hls/rtmp共用
+type ffmpegProc struct {
+	id      string
+	inputs  []*ffmpegInput
+	output  func(inputs []*ffmpegInput) []string // 根据输入生成ffmpeg的输出参数
+	restart bool                                 // ffmpeg退出后是否自动重启
+	onClose func()                               // 所有输入都移除后的回调
+
+	stop     bool
+	cmd      *exec.Cmd
+	sdpFiles []string
+	state    string
+	lastErr  string
+	restarts int
+	started  time.Time
+	sync.Mutex
+}
+
+// newFFmpegProc 创建ffmpeg输出并加入到各个Router的sink中
+func newFFmpegProc(id string, routers []*Router, output func([]*ffmpegInput) []string, restart bool) (*ffmpegProc, error) {
+	if _, err := exec.LookPath(conf.FFmpeg.Path); err != nil {
+		return nil, fmt.Errorf("ffmpeg not found: %v", err)
+	}
+	p := &ffmpegProc{
+		id:      id,
+		output:  output,
+		restart: restart,
+		state:   "starting",
+	}
+	for _, r := range routers {
+		in, err := p.newInput(r)
+		if err != nil {
+			p.closeInputs()
+			return nil, err
+		}
+		p.inputs = append(p.inputs, in)
+	}
+	if len(p.inputs) == 0 {
+		return nil, errors.New("ffmpeg no input")
+	}
+	if err := p.start(); err != nil {
+		p.closeInputs()
+		return nil, err
+	}
+	for _, in := range p.inputs {
+		in.router.AddSink(in)
+	}
+	return p, nil
+}
+
+// newInput 为Router申请本机端口并生成sdp
+func (p *ffmpegProc) newInput(r *Router) (*ffmpegInput, error) {
+	pub := r.GetPub()
+	if pub == nil || (pub.AudioTrack() == nil && pub.VideoTrack() == nil) {
+		return nil, fmt.Errorf("router no audio and video track, id is %s", r.Id)
+	}
+	audioPort, err := freeRTPPort()
+	if err != nil {
+		return nil, err
+	}
+	videoPort, err := freeRTPPort()
+	if err != nil {
+		return nil, err
+	}
+	forward, err := newRTPForward(r, p.id, "127.0.0.1", audioPort, videoPort)
+	if err != nil {
+		return nil, err
+	}
+	return &ffmpegInput{
+		proc:     p,
+		router:   r,
+		forward:  forward,
+		sdp:      ffmpegSDP(pub, audioPort, videoPort),
+		hasAudio: pub.AudioTrack() != nil,
+		hasVideo: pub.VideoTrack() != nil,
+	}, nil
+}
+
+// freeRTPPort 获取一对空闲的本机RTP/RTCP端口
+func freeRTPPort() (int, error) {
+	rtpConn, rtcpConn, err := listenRTPPair()
+	if err != nil {
+		return 0, err
+	}
+	port := rtpConn.LocalAddr().(*net.UDPAddr).Port
+	rtpConn.Close()
+	rtcpConn.Close()
+	return port, nil
+}
+
+// ffmpegSDP 生成ffmpeg读取本机RTP用的sdp
+func ffmpegSDP(pub *Pub, audioPort, videoPort int) string {
+	var b strings.Builder
+	b.WriteString("v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=goRTCServer\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\n")
+	if track := pub.AudioTrack(); track != nil {
+		fmt.Fprintf(&b, "m=audio %d RTP/AVP %d\r\na=rtpmap:%d opus/48000/2\r\n", audioPort, track.PayloadType, track.PayloadType)
+	}
+	if track := pub.VideoTrack(); track != nil {
+		fmt.Fprintf(&b, "m=video %d RTP/AVP %d\r\na=rtpmap:%d VP8/90000\r\n", videoPort, track.PayloadType, track.PayloadType)
+	}
+	return b.String()
+}
+
+// start 启动ffmpeg进程, 每路输入的sdp写到临时文件
+func (p *ffmpegProc) start() error {
+	p.Lock()
+	inputs := append([]*ffmpegInput{}, p.inputs...)
+	p.Unlock()
+
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	files := make([]string, 0, len(inputs))
+	for _, in := range inputs {
+		f, err := os.CreateTemp("", "ffmpeg-*.sdp")
+		if err != nil {
+			removeFiles(files)
+			return err
+		}
+		f.WriteString(in.sdp)
+		f.Close()
+		files = append(files, f.Name())
+		args = append(args, "-protocol_whitelist", "file,udp,rtp", "-fflags", "+genpts", "-f", "sdp", "-i", f.Name())
+	}
+	args = append(args, p.output(inputs)...)
+	cmd := exec.Command(conf.FFmpeg.Path, args...)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		logger.Errorf("ffmpeg start err, err is %v, id is %s", err, p.id)
+		removeFiles(files)
+		return err
+	}
+	logger.Debugf("ffmpeg start, id is %s, pid is %d, inputs is %d", p.id, cmd.Process.Pid, len(inputs))
+
+	p.Lock()
+	if p.stop {
+		// 重启过程中被关闭
+		p.Unlock()
+		cmd.Process.Kill()
+		removeFiles(files)
+		return nil
+	}
+	p.cmd = cmd
+	p.sdpFiles = files
+	p.state = "running"
+	p.started = time.Now()
+	p.Unlock()
+	go p.wait(cmd, stderr, files)
+	go p.DoKeyFrame(cmd)
+	return nil
+}
+
+// removeFiles 删除临时文件
+func removeFiles(files []string) {
+	for _, f := range files {
+		os.Remove(f)
+	}
+}
+
+// wait 等待ffmpeg退出, 需要时延迟重启
+func (p *ffmpegProc) wait(cmd *exec.Cmd, stderr *bytes.Buffer, files []string) {
+	err := cmd.Wait()
+	removeFiles(files)
+	p.Lock()
+	if p.stop || p.cmd != cmd {
+		// 被关闭或者输入变化后已经重启
+		p.Unlock()
+		return
+	}
+	p.lastErr = strings.TrimSpace(stderr.String())
+	if p.lastErr == "" && err != nil {
+		p.lastErr = err.Error()
+	}
+	logger.Errorf("ffmpeg exit, err is %v, id is %s, stderr is %s", err, p.id, p.lastErr)
+	if !p.restart {
+		p.state = "failed"
+		p.Unlock()
+		return
+	}
+	// 运行一段时间后退出的重新计算退避时间
+	if time.Since(p.started) > ffmpegStableRun {
+		p.restarts = 0
+	}
+	p.restarts++
+	p.state = "reconnecting"
+	delay := ffmpegRetryMin << uint(p.restarts-1)
+	if delay > ffmpegRetryMax || delay <= 0 {
+		delay = ffmpegRetryMax
+	}
+	p.Unlock()
+
+	time.Sleep(delay)
+	p.Lock()
+	restart := !p.stop && p.cmd == cmd
+	p.Unlock()
+	if !restart {
+		return
+	}
+	if err := p.start(); err != nil {
+		p.Lock()
+		p.lastErr = err.Error()
+		p.state = "failed"
+		p.Unlock()
+	}
+}
+
+// delInput 移除一路输入, 还有其他输入则重启ffmpeg, 没有则关闭
+func (p *ffmpegProc) delInput(in *ffmpegInput) {
+	p.Lock()
+	if p.stop {
+		p.Unlock()
+		return
+	}
+	for i, v := range p.inputs {
+		if v == in {
+			p.inputs = append(p.inputs[:i], p.inputs[i+1:]...)
+			break
+		}
+	}
+	left := len(p.inputs)
+	cmd := p.cmd
+	p.cmd = nil
+	p.Unlock()
+
+	if cmd != nil && cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+	if left == 0 {
+		p.Close()
+		return
+	}
+	logger.Debugf("ffmpeg input removed, restart, id is %s, router is %s", p.id, in.router.Id)
+	if err := p.start(); err != nil {
+		p.Lock()
+		p.lastErr = err.Error()
+		p.state = "failed"
+		p.Unlock()
+	}
+}
+
+// DoKeyFrame ffmpeg启动或重启后向发布者请求关键帧, 解码器从关键帧开始才能输出画面;
+// 输出重新编码并按分片时长强制关键帧, 运行中不需要发布者的关键帧, 只请求keyFrameTries次
+func (p *ffmpegProc) DoKeyFrame(cmd *exec.Cmd) {
+	for i := 0; i < keyFrameTries; i++ {
+		p.Lock()
+		if p.stop || p.cmd != cmd {
+			p.Unlock()
+			return
+		}
+		inputs := append([]*ffmpegInput{}, p.inputs...)
+		p.Unlock()
+		for _, in := range inputs {
+			in.router.requestKeyframe()
+		}
+		time.Sleep(keyFrameCycle)
+	}
+}
+
+// Status 获取ffmpeg的运行状态
+func (p *ffmpegProc) Status() (state string, inputs int, restarts int, lastErr string) {
+	p.Lock()
+	defer p.Unlock()
+	return p.state, len(p.inputs), p.restarts, p.lastErr
+}
+
+// closeInputs 关闭还没加入Router的输入
+func (p *ffmpegProc) closeInputs() {
+	for _, in := range p.inputs {
+		in.forward.Close()
+	}
+}
+
+// Close 停止ffmpeg并从Router中移除
+func (p *ffmpegProc) Close() {
+	p.Lock()
+	if p.stop {
+		p.Unlock()
+		return
+	}
+	p.stop = true
+	p.state = "stopped"
+	cmd := p.cmd
+	inputs := p.inputs
+	p.Unlock()
+
+	if cmd != nil && cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+	for _, in := range inputs {
+		in.router.DelSink(p.id)
+	}
+	if p.onClose != nil {
+		p.onClose()
+	}
+	logger.Debugf("ffmpeg close, id is %s", p.id)
+}
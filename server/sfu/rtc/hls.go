@@ -0,0 +1,96 @@
+package rtc
+
+import (
+	"fmt"
+	"goRTCServer/pkg/logger"
+	"goRTCServer/pkg/proto"
+	"goRTCServer/server/sfu/conf"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// HLSSinkID HLS输出在Router中的sink id
+	HLSSinkID   = "hls"
+	hlsHTTPPath = "/hls/"
+	hlsPlaylist = "index.m3u8"
+)
+
+// HLSOutput 把Router的音视频转码成HLS分片, vp8转h264, opus转aac
+type HLSOutput struct {
+	*ffmpegProc
+	URL string
+}
+
+// hlsPath 流在HLS目录下的相对路径 rid/mid
+func hlsPath(id string) string {
+	rid, _, mid := proto.ParseMediaPubKey(id)
+	return path.Join(rid, strings.ReplaceAll(mid, "#", "_"))
+}
+
+// HLSURL 获取流的播放地址
+func HLSURL(id string) string {
+	prefix := strings.TrimSuffix(conf.HLS.URL, "/")
+	if prefix == "" {
+		_, port, _ := net.SplitHostPort(conf.HLS.HTTP)
+		prefix = "http://" + net.JoinHostPort(rtpHost(), port) + strings.TrimSuffix(hlsHTTPPath, "/")
+	}
+	return prefix + "/" + hlsPath(id) + "/" + hlsPlaylist
+}
+
+// NewHLSOutput 创建HLS输出, 低延迟模式使用1秒的fmp4分片, Router销毁时自动停止并删除分片
+func NewHLSOutput(r *Router, lowLatency bool) (*HLSOutput, error) {
+	dir := filepath.Join(conf.HLS.Dir, filepath.FromSlash(hlsPath(r.Id)))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	segment, segType, segName, flags := conf.HLS.Segment, "mpegts", "seg_%05d.ts", "delete_segments+independent_segments"
+	if lowLatency {
+		segment, segType, segName, flags = 1, "fmp4", "seg_%05d.m4s", flags+"+program_date_time"
+	}
+	args := []string{
+		"-c:v", "libx264", "-preset", "veryfast", "-tune", "zerolatency", "-pix_fmt", "yuv420p",
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", segment),
+		"-c:a", "aac", "-ar", "48000", "-b:a", "128k",
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(segment),
+		"-hls_list_size", strconv.Itoa(conf.HLS.ListSize),
+		"-hls_segment_type", segType,
+		"-hls_flags", flags,
+		"-hls_segment_filename", filepath.Join(dir, segName),
+		filepath.Join(dir, hlsPlaylist),
+	}
+	output := func([]*ffmpegInput) []string { return args }
+	proc, err := newFFmpegProc(HLSSinkID, []*Router{r}, output, true)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	proc.onClose = func() {
+		os.RemoveAll(dir)
+	}
+	logger.Debugf("hls output start, id is %s, dir is %s", r.Id, dir)
+	return &HLSOutput{ffmpegProc: proc, URL: HLSURL(r.Id)}, nil
+}
+
+// ServeHLS 提供HLS分片的http服务
+func ServeHLS(addr string) {
+	files := http.StripPrefix(hlsHTTPPath, http.FileServer(http.Dir(conf.HLS.Dir)))
+	mux := http.NewServeMux()
+	mux.HandleFunc(hlsHTTPPath, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if strings.HasSuffix(req.URL.Path, ".m3u8") {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		files.ServeHTTP(w, req)
+	})
+	logger.Debugf("hls http server start, addr is %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Errorf("hls http server err, err is %v", err)
+	}
+}
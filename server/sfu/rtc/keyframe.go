@@ -0,0 +1,95 @@
+package rtc
+
+import (
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+)
+
+const (
+	maxGOPPackets   = 2048 // 关键帧组缓存的最大包数, 超过后丢弃缓存直到下一个关键帧
+	videoFrameTicks = 3000 // 回放时和之前发送的帧间隔的时间戳, 90kHz下约为一帧
+)
+
+// isVP8Keyframe 判断是否为VP8关键帧的第一个包
+func isVP8Keyframe(pkt *rtp.Packet) bool {
+	vp8 := &codecs.VP8Packet{}
+	if _, err := vp8.Unmarshal(pkt.Payload); err != nil {
+		return false
+	}
+	// 第一个分区的开始, VP8帧头的P位为0表示关键帧
+	return vp8.S == 1 && vp8.PID == 0 && len(vp8.Payload) > 0 && vp8.Payload[0]&0x01 == 0
+}
+
+// gopCache 缓存最近一个关键帧开始的视频包, 新的订阅者连接后先回放缓存, 不需要等待下一个关键帧
+type gopCache struct {
+	pkts []*rtp.Packet
+}
+
+// push 缓存视频包, 收到新的关键帧时清空之前的缓存
+func (g *gopCache) push(pkt *rtp.Packet) {
+	if isVP8Keyframe(pkt) && (len(g.pkts) == 0 || g.pkts[0].Timestamp != pkt.Timestamp) {
+		g.pkts = append(g.pkts[:0:0], pkt)
+		return
+	}
+	if len(g.pkts) == 0 {
+		return
+	}
+	if len(g.pkts) >= maxGOPPackets {
+		g.pkts = nil
+		return
+	}
+	g.pkts = append(g.pkts, pkt)
+}
+
+// packets 获取缓存的视频包, 第一个包为关键帧
+func (g *gopCache) packets() []*rtp.Packet {
+	return g.pkts
+}
+
+// reset 清空缓存
+func (g *gopCache) reset() {
+	g.pkts = nil
+}
+
+// seqRewriter 改写发给订阅者的视频包序号和时间戳, 回放缓存后和之前发送的包保持连续
+type seqRewriter struct {
+	started   bool
+	lastSeq   uint16
+	lastTS    uint32
+	seqOffset uint16
+	tsOffset  uint32
+}
+
+// resync 下一个发送的包为first, 计算偏移使其紧接在上一个发送的包之后
+func (w *seqRewriter) resync(first *rtp.Packet) {
+	if !w.started {
+		return
+	}
+	w.seqOffset = w.lastSeq + 1 - first.SequenceNumber
+	w.tsOffset = w.lastTS + videoFrameTicks - first.Timestamp
+}
+
+// rewrite 按偏移改写包, 偏移为0时不复制
+func (w *seqRewriter) rewrite(pkt *rtp.Packet) *rtp.Packet {
+	out := pkt
+	if w.seqOffset != 0 || w.tsOffset != 0 {
+		cp := *pkt
+		cp.SequenceNumber += w.seqOffset
+		cp.Timestamp += w.tsOffset
+		out = &cp
+	}
+	// NACK重传的旧包不更新最后发送的位置
+	if !w.started || int16(out.SequenceNumber-w.lastSeq) > 0 {
+		w.lastSeq = out.SequenceNumber
+	}
+	if !w.started || int32(out.Timestamp-w.lastTS) > 0 {
+		w.lastTS = out.Timestamp
+	}
+	w.started = true
+	return out
+}
+
+// origin 订阅者看到的序号对应的原始序号, 用于处理NACK
+func (w *seqRewriter) origin(seq uint16) uint16 {
+	return seq - w.seqOffset
+}
@@ -0,0 +1,84 @@
+package rtc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+func vp8Packet(seq uint16, ts uint32, key bool) *rtp.Packet {
+	// VP8描述符S=1, 帧头P位为0表示关键帧
+	payload := []byte{0x10, 0x00, 0x00, 0x00}
+	if !key {
+		payload = []byte{0x00, 0x01, 0x00, 0x00}
+	}
+	return &rtp.Packet{Header: rtp.Header{SequenceNumber: seq, Timestamp: ts}, Payload: payload}
+}
+
+func TestGOPCacheStartsAtKeyframe(t *testing.T) {
+	var g gopCache
+	g.push(vp8Packet(1, 100, false))
+	if len(g.packets()) != 0 {
+		t.Fatal("cache should wait for a keyframe")
+	}
+	g.push(vp8Packet(2, 200, true))
+	g.push(vp8Packet(3, 200, false))
+	g.push(vp8Packet(4, 300, true))
+	if pkts := g.packets(); len(pkts) != 1 || pkts[0].SequenceNumber != 4 {
+		t.Fatalf("new keyframe should restart the cache, got %d packets", len(pkts))
+	}
+}
+
+func newVideoSub(t *testing.T) *Sub {
+	sub, err := NewSub("rid#uid#mid")
+	if err != nil {
+		t.Fatalf("new sub: %v", err)
+	}
+	track, err := webrtc.NewTrackLocalStaticRTP(vp8Codec, "video", "pion")
+	if err != nil {
+		t.Fatalf("new track: %v", err)
+	}
+	if sub.TrackVideo, err = sub.pc.AddTrack(track); err != nil {
+		t.Fatalf("add track: %v", err)
+	}
+	sub.needKey = true
+	t.Cleanup(func() { sub.pc.Close() })
+	return sub
+}
+
+func TestSubNotAliveUntilConnected(t *testing.T) {
+	sub := newVideoSub(t)
+	if sub.alive || sub.Dead() {
+		t.Fatal("new sub should wait for the connection within the grace period")
+	}
+	if err := sub.WriteVideoRTP(vp8Packet(1, 100, true)); err == nil {
+		t.Fatal("write before the connection is up should fail")
+	}
+}
+
+func TestReplayGOPOnConnect(t *testing.T) {
+	r := &Router{Id: "rid#uid#mid", subs: make(map[string]*Sub)}
+	r.gop.push(vp8Packet(10, 100, true))
+	r.gop.push(vp8Packet(11, 100, false))
+	sub := newVideoSub(t)
+	sub.onConnect = func() { r.replayOnConnect(sub) }
+	r.subs[sub.Id] = sub
+
+	// 没有新的包到达, 连接建立后也要回放缓存
+	sub.OnPeerConnect(webrtc.PeerConnectionStateConnected)
+	deadline := time.Now().Add(time.Second)
+	for {
+		r.Lock()
+		done := !sub.needKey && sub.videoSeq.lastSeq == 11
+		r.Unlock()
+		if done {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("gop should be replayed when the sub connects")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,433 @@
+package rtc
+
+import (
+	"errors"
+	"goRTCServer/pkg/logger"
+	"goRTCServer/pkg/proto"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	mixSampleRate  = 48000
+	mixChannels    = 1
+	mixFrameSize   = mixSampleRate / 50 // 20ms一帧
+	mixMaxBuffer   = mixFrameSize * 10  // 每路最多缓存200ms
+	mixCycle       = 20 * time.Millisecond
+	mixSinkID      = "mixer"
+	maxOpusFrame   = 5760 // 120ms
+	maxOpusPacket  = 1500
+	DefaultMixTopN = 3
+)
+
+// audioDecoder 音频解码
+type audioDecoder interface {
+	Decode(data []byte, pcm []int16) (int, error)
+}
+
+// audioEncoder 音频编码
+type audioEncoder interface {
+	Encode(pcm []int16, data []byte) (int, error)
+}
+
+var (
+	mixers    = make(map[string]*Mixer)
+	mixerLock sync.Mutex
+)
+
+// StartMixer 开启房间混音
+func StartMixer(rid string, topN int) (*Mixer, error) {
+	mixerLock.Lock()
+	m := mixers[rid]
+	if m != nil {
+		mixerLock.Unlock()
+		m.SetTopN(topN)
+		return m, nil
+	}
+	// 检查是否支持opus编解码
+	if _, err := newOpusEncoder(); err != nil {
+		mixerLock.Unlock()
+		return nil, err
+	}
+	m = NewMixer(rid, topN)
+	mixers[rid] = m
+	mixerLock.Unlock()
+
+	// 加入房间内已有的发布者
+	routerLock.Lock()
+	list := make([]*Router, 0)
+	for id, router := range routers {
+		if id2rid(id) == rid {
+			list = append(list, router)
+		}
+	}
+	routerLock.Unlock()
+	for _, router := range list {
+		m.AddRouter(router)
+	}
+	go m.DoMixWork()
+	logger.Debugf("start mixer, rid is %s, topn is %d", rid, topN)
+	return m, nil
+}
+
+// GetMixer 获取房间的混音对象
+func GetMixer(rid string) *Mixer {
+	mixerLock.Lock()
+	defer mixerLock.Unlock()
+	return mixers[rid]
+}
+
+// StopMixer 关闭房间混音
+func StopMixer(rid string) {
+	mixerLock.Lock()
+	m := mixers[rid]
+	delete(mixers, rid)
+	mixerLock.Unlock()
+	if m != nil {
+		logger.Debugf("stop mixer, rid is %s", rid)
+		m.Close()
+	}
+}
+
+// id2rid 从Router的id中获取rid
+func id2rid(id string) string {
+	rid, _, _ := proto.ParseMediaPubKey(id)
+	return rid
+}
+
+// Mixer 房间混音对象, 解码房间内发布者的opus, 选出音量最大的N路混音,
+// 每个订阅者收到一路去掉自己声音的混音
+type Mixer struct {
+	Rid     string
+	topN    int
+	stop    bool
+	sources map[string]*mixSource
+	subs    map[string]*Sub
+	encs    map[string]audioEncoder
+	sync.Mutex
+}
+
+// NewMixer 新建混音对象
+func NewMixer(rid string, topN int) *Mixer {
+	if topN <= 0 {
+		topN = DefaultMixTopN
+	}
+	return &Mixer{
+		Rid:     rid,
+		topN:    topN,
+		stop:    false,
+		sources: make(map[string]*mixSource),
+		subs:    make(map[string]*Sub),
+		encs:    make(map[string]audioEncoder),
+	}
+}
+
+// SetTopN 设置同时混音的最大路数
+func (m *Mixer) SetTopN(topN int) {
+	if topN <= 0 {
+		return
+	}
+	m.Lock()
+	m.topN = topN
+	m.Unlock()
+}
+
+// AddRouter 将发布者的音频加入混音
+func (m *Mixer) AddRouter(r *Router) {
+	if m.stopped() {
+		return
+	}
+	dec, err := newOpusDecoder()
+	if err != nil {
+		logger.Errorf("mixer new decoder err, err is %v, id is %s", err, r.Id)
+		return
+	}
+	_, uid, _ := proto.ParseMediaPubKey(r.Id)
+	src := &mixSource{
+		id:    r.Id,
+		uid:   uid,
+		mixer: m,
+		dec:   dec,
+		buf:   make([]int16, maxOpusFrame),
+		pcm:   make([]int16, 0, mixMaxBuffer),
+	}
+	m.Lock()
+	if m.stop {
+		m.Unlock()
+		return
+	}
+	m.sources[r.Id] = src
+	m.Unlock()
+	// AddSink会关闭同id的旧source, 旧source只会删除自己, 不影响新加入的source
+	r.AddSink(src)
+	logger.Debugf("mixer add router, rid is %s, id is %s", m.Rid, r.Id)
+}
+
+// delSource 删除混音源, 同一个Router已经换成新的source时不删除
+func (m *Mixer) delSource(src *mixSource) {
+	m.Lock()
+	defer m.Unlock()
+	if m.sources[src.id] == src {
+		delete(m.sources, src.id)
+	}
+}
+
+// AddSub 增加混音订阅者
+func (m *Mixer) AddSub(sid, sdp string) (string, error) {
+	if m.stopped() {
+		return "", errors.New("mixer is stopped")
+	}
+	sub, err := NewSub(sid)
+	if err != nil {
+		logger.Errorf("mixer add sub err, err is %v, rid is %s, sid is %s", err, m.Rid, sid)
+		return "", err
+	}
+	err = sub.AddMixTrack("mix_" + m.Rid)
+	if err != nil {
+		sub.Close()
+		return "", err
+	}
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}
+	answer, err := sub.Answer(offer)
+	if err != nil {
+		logger.Errorf("mixer sub answer err, err is %v, rid is %s, sid is %s", err, m.Rid, sid)
+		sub.Close()
+		return "", err
+	}
+	m.Lock()
+	m.subs[sid] = sub
+	m.Unlock()
+	logger.Debugf("mixer add sub, rid is %s, sid is %s", m.Rid, sid)
+	return answer.SDP, nil
+}
+
+// DelSub 删除混音订阅者
+func (m *Mixer) DelSub(sid string) {
+	m.Lock()
+	defer m.Unlock()
+	sub := m.subs[sid]
+	if sub != nil {
+		sub.Close()
+		delete(m.subs, sid)
+	}
+}
+
+// GetSubs 获取混音订阅者数量
+func (m *Mixer) GetSubs() int {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.subs)
+}
+
+// Close 关闭混音
+func (m *Mixer) Close() {
+	m.Lock()
+	m.stop = true
+	ids := make([]string, 0, len(m.sources))
+	for id := range m.sources {
+		ids = append(ids, id)
+	}
+	for sid, sub := range m.subs {
+		sub.Close()
+		delete(m.subs, sid)
+	}
+	m.Unlock()
+	// 不能在持有混音锁的情况下操作Router, Router关闭sink时会回调delSource
+	for _, id := range ids {
+		if r := GetRouter(id); r != nil {
+			r.DelSink(mixSinkID)
+		}
+	}
+}
+
+// stopped 混音是否已经关闭
+func (m *Mixer) stopped() bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.stop
+}
+
+// DoMixWork 每20ms混音一次
+func (m *Mixer) DoMixWork() {
+	t := time.NewTicker(mixCycle)
+	defer t.Stop()
+	for range t.C {
+		if m.stopped() {
+			return
+		}
+		m.mix()
+	}
+}
+
+// mixFrame 一路音频的一帧数据
+type mixFrame struct {
+	uid    string
+	pcm    []int16
+	energy int64
+}
+
+// mix 混音并编码发送
+func (m *Mixer) mix() {
+	m.Lock()
+	defer m.Unlock()
+
+	// 1.读取每一路的数据并计算音量
+	frames := make([]mixFrame, 0, len(m.sources))
+	for _, src := range m.sources {
+		pcm := src.readFrame()
+		if pcm == nil {
+			continue
+		}
+		frames = append(frames, mixFrame{uid: src.uid, pcm: pcm, energy: energy(pcm)})
+	}
+	if len(frames) == 0 || len(m.subs) == 0 {
+		return
+	}
+
+	// 2.选出音量最大的N路
+	sort.Slice(frames, func(i, j int) bool {
+		return frames[i].energy > frames[j].energy
+	})
+	if len(frames) > m.topN {
+		frames = frames[:m.topN]
+	}
+	total := make([]int32, mixFrameSize)
+	speakers := make(map[string][]int16)
+	for _, f := range frames {
+		for i, v := range f.pcm {
+			total[i] += int32(v)
+		}
+		speakers[f.uid] = f.pcm
+	}
+
+	// 3.不在前N路的订阅者共用一路编码, 前N路的发言者各自去掉自己的声音
+	packets := make(map[string][]byte)
+	for sid, sub := range m.subs {
+		if sub.Dead() {
+			sub.Close()
+			delete(m.subs, sid)
+			continue
+		}
+		key := ""
+		if _, ok := speakers[sub.UID()]; ok {
+			key = sub.UID()
+		}
+		pkt, ok := packets[key]
+		if !ok {
+			pkt = m.encode(key, total, speakers[key])
+			packets[key] = pkt
+		}
+		if pkt != nil {
+			sub.WriteAudioSample(pkt, mixFrameSize)
+		}
+	}
+
+	// 不再发言的人的编码器释放掉
+	for key := range m.encs {
+		if _, ok := packets[key]; !ok && key != "" {
+			delete(m.encs, key)
+		}
+	}
+}
+
+// encode 去掉own后编码
+func (m *Mixer) encode(key string, total []int32, own []int16) []byte {
+	enc := m.encs[key]
+	if enc == nil {
+		var err error
+		enc, err = newOpusEncoder()
+		if err != nil {
+			logger.Errorf("mixer new encoder err, err is %v, rid is %s", err, m.Rid)
+			return nil
+		}
+		m.encs[key] = enc
+	}
+	pcm := make([]int16, mixFrameSize)
+	for i := range pcm {
+		v := total[i]
+		if own != nil {
+			v -= int32(own[i])
+		}
+		if v > 32767 {
+			v = 32767
+		} else if v < -32768 {
+			v = -32768
+		}
+		pcm[i] = int16(v)
+	}
+	data := make([]byte, maxOpusPacket)
+	n, err := enc.Encode(pcm, data)
+	if err != nil {
+		logger.Errorf("mixer encode err, err is %v, rid is %s", err, m.Rid)
+		return nil
+	}
+	return data[:n]
+}
+
+// energy 计算一帧的能量
+func energy(pcm []int16) int64 {
+	var sum int64
+	for _, v := range pcm {
+		sum += int64(v) * int64(v)
+	}
+	return sum / int64(len(pcm))
+}
+
+// mixSource 一路发布者的音频, 作为Router的sink接收音频包并解码
+type mixSource struct {
+	id    string
+	uid   string
+	mixer *Mixer
+	dec   audioDecoder
+	buf   []int16
+	pcm   []int16
+	sync.Mutex
+}
+
+// ID sink的id
+func (s *mixSource) ID() string {
+	return mixSinkID
+}
+
+// WriteAudioRTP 解码音频包
+func (s *mixSource) WriteAudioRTP(pkt *rtp.Packet) error {
+	n, err := s.dec.Decode(pkt.Payload, s.buf)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.pcm = append(s.pcm, s.buf[:n*mixChannels]...)
+	// 缓存过多说明混音跟不上, 丢掉旧的数据
+	if len(s.pcm) > mixMaxBuffer {
+		s.pcm = append(s.pcm[:0], s.pcm[len(s.pcm)-mixMaxBuffer:]...)
+	}
+	return nil
+}
+
+// WriteVideoRTP 混音不处理视频
+func (s *mixSource) WriteVideoRTP(pkt *rtp.Packet) error {
+	return nil
+}
+
+// Close Router关闭时移出混音
+func (s *mixSource) Close() {
+	s.mixer.delSource(s)
+}
+
+// readFrame 读取一帧数据, 不足一帧返回nil
+func (s *mixSource) readFrame() []int16 {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.pcm) < mixFrameSize {
+		return nil
+	}
+	frame := make([]int16, mixFrameSize)
+	copy(frame, s.pcm[:mixFrameSize])
+	s.pcm = append(s.pcm[:0], s.pcm[mixFrameSize:]...)
+	return frame
+}
@@ -0,0 +1,76 @@
+package rtc
+
+import "testing"
+
+// fakeEncoder 记录最后一次编码的pcm, 不依赖libopus
+type fakeEncoder struct {
+	pcm []int16
+}
+
+func (e *fakeEncoder) Encode(pcm []int16, data []byte) (int, error) {
+	e.pcm = append(e.pcm[:0], pcm...)
+	data[0] = 1
+	return 1, nil
+}
+
+func frame(v int16) []int16 {
+	pcm := make([]int16, mixFrameSize)
+	for i := range pcm {
+		pcm[i] = v
+	}
+	return pcm
+}
+
+func TestMixTopNWithoutOwnVoice(t *testing.T) {
+	m := NewMixer("room", 2)
+	for uid, v := range map[string]int16{"a": 100, "b": 200, "c": 10} {
+		m.sources[uid] = &mixSource{id: uid, uid: uid, mixer: m, pcm: frame(v)}
+		m.subs[uid+"#sub"] = &Sub{Id: uid + "#sub", alive: true}
+	}
+	encs := map[string]*fakeEncoder{"": {}, "a": {}, "b": {}, "gone": {}}
+	for key, enc := range encs {
+		m.encs[key] = enc
+	}
+	m.mix()
+
+	// 音量最大的a和b参与混音, c只能听到a+b, a和b听不到自己
+	for key, want := range map[string]int16{"": 300, "a": 200, "b": 100} {
+		if pcm := encs[key].pcm; len(pcm) != mixFrameSize || pcm[0] != want {
+			t.Fatalf("mix for %q should be %d, got %v", key, want, pcm[:1])
+		}
+	}
+	if _, ok := m.encs["gone"]; ok {
+		t.Fatal("encoder of a speaker no longer in top n should be released")
+	}
+}
+
+func TestMixSourceKeepsRecentAudio(t *testing.T) {
+	s := &mixSource{pcm: make([]int16, mixFrameSize-1)}
+	if s.readFrame() != nil {
+		t.Fatal("less than one frame should not be read")
+	}
+	s.pcm = append(s.pcm, 1, 2)
+	if f := s.readFrame(); len(f) != mixFrameSize || len(s.pcm) != 1 || s.pcm[0] != 2 {
+		t.Fatalf("one frame should be read and the rest kept, left %v", s.pcm)
+	}
+}
+
+func TestReplacedMixSourceKeepsNewSource(t *testing.T) {
+	m := NewMixer("room", 2)
+	r := NewRouter("room#a#mid")
+	t.Cleanup(r.Close)
+	// 与AddRouter的顺序相同, 先登记source再挂到Router上
+	for i := 0; i < 2; i++ {
+		src := &mixSource{id: r.Id, uid: "a", mixer: m}
+		m.sources[r.Id] = src
+		r.AddSink(src)
+	}
+	// Router上替换下来的旧source关闭时不能删掉新的source
+	if src := m.sources[r.Id]; src == nil || r.GetSink(mixSinkID) != src {
+		t.Fatalf("new source should stay in mixer, got %v", src)
+	}
+	r.DelSink(mixSinkID)
+	if _, ok := m.sources[r.Id]; ok {
+		t.Fatal("source should be removed when its router sink is closed")
+	}
+}
@@ -0,0 +1,22 @@
+//go:build opus
+
+package rtc
+
+import (
+	"gopkg.in/hraban/opus.v2"
+)
+
+// newOpusDecoder 新建opus解码器, 解码为48k单声道pcm
+func newOpusDecoder() (audioDecoder, error) {
+	return opus.NewDecoder(mixSampleRate, mixChannels)
+}
+
+// newOpusEncoder 新建opus编码器
+func newOpusEncoder() (audioEncoder, error) {
+	enc, err := opus.NewEncoder(mixSampleRate, mixChannels, opus.AppVoIP)
+	if err != nil {
+		return nil, err
+	}
+	enc.SetInBandFEC(true)
+	return enc, nil
+}
@@ -0,0 +1,17 @@
+//go:build !opus
+
+package rtc
+
+import "errors"
+
+var errNoOpus = errors.New("sfu built without opus codec, rebuild with -tags opus (requires libopus)")
+
+// newOpusDecoder 未启用opus编译选项, 不支持解码
+func newOpusDecoder() (audioDecoder, error) {
+	return nil, errNoOpus
+}
+
+// newOpusEncoder 未启用opus编译选项, 不支持编码
+func newOpusEncoder() (audioEncoder, error) {
+	return nil, errNoOpus
+}
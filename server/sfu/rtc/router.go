@@ -11,23 +11,38 @@ import (
 
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
-	"github.com/pion/webrtc/v2"
-	"github.com/pion/webrtc/v2/pkg/media/oggwriter"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
 )
 
 const liveCycle = 6 * time.Second
 
+// Sink Router的额外输出对象, 如混音等
+type Sink interface {
+	ID() string
+	WriteAudioRTP(pkt *rtp.Packet) error
+	WriteVideoRTP(pkt *rtp.Packet) error
+	Close()
+}
+
 // Router 对象
 type Router struct {
-	Id   string
-	stop bool
-	pub  *Pub
-	subs map[string]*Sub
+	Id    string
+	stop  bool
+	pub   *Pub
+	subs  map[string]*Sub
+	sinks map[string]Sink
 	sync.Mutex
 	audioAlive time.Time
 	videoAlive time.Time
 	pktBuffer  map[uint16]*rtp.Packet
 	oggWriter  *oggwriter.OggWriter
+	audioMuted bool // 静音, 不转发音频
+	videoMuted bool // 关闭画面, 不转发视频
+	gop        gopCache
+	pliLock    sync.Mutex
+	pubLock    sync.Mutex // 保护pub, 持有Router锁时也可以获取
+	lastPLI    time.Time
 }
 
 // NewRouter 创建新的Router对象
@@ -43,6 +58,7 @@ func NewRouter(id string) *Router {
 		stop:       false,
 		pub:        nil,
 		subs:       make(map[string]*Sub),
+		sinks:      make(map[string]Sink),
 		Mutex:      sync.Mutex{},
 		audioAlive: time.Now().Add(liveCycle),
 		videoAlive: time.Now().Add(liveCycle),
@@ -67,12 +83,35 @@ func (r *Router) AddPub(mid, sdp string) (string, error) {
 	}
 
 	logger.Debugf("router add pub, pub is %s", r.Id)
-	r.pub = pub
+	r.setPub(pub)
 	go r.DoAudioWork()
 	go r.DoVideoWork()
+	go r.DoDataWork()
+	// 房间开启了混音, 加入混音
+	if m := GetMixer(id2rid(r.Id)); m != nil {
+		m.AddRouter(r)
+	}
 	return answer.SDP, nil
 }
 
+// AddRTPPub 增加普通RTP推流, audioPT/videoPT为推流端使用的payload type
+func (r *Router) AddRTPPub(mid string, audio, video bool, audioPT, videoPT uint8) (*Pub, error) {
+	pub, err := NewRTPPub(mid, audio, video, audioPT, videoPT)
+	if err != nil {
+		logger.Errorf("router add rtp pub err, err is %v, id is %s, mid is %s", err, r.Id, mid)
+		return nil, err
+	}
+
+	logger.Debugf("router add rtp pub, pub is %s", r.Id)
+	r.setPub(pub)
+	go r.DoAudioWork()
+	go r.DoVideoWork()
+	if m := GetMixer(id2rid(r.Id)); m != nil {
+		m.AddRouter(r)
+	}
+	return pub, nil
+}
+
 // AddSub
 func (r *Router) AddSub(sid, sdp string) (string, error) {
 	sub, err := NewSub(sid)
@@ -80,32 +119,38 @@ func (r *Router) AddSub(sid, sdp string) (string, error) {
 		logger.Errorf("router add sub err, err is %v, id is %s, sid is %s", err, r.Id, sid)
 		return "", err
 	}
-	if r.pub != nil {
-		if r.pub.TrackAudio != nil {
-			if r.pub.TrackAudio.Track() != nil {
-				err := sub.AddTrack(r.pub.TrackAudio.Track())
-				if err != nil {
-					logger.Errorf("router sub add audio track err, err is %v, id is %s, sid is %s", err, r.Id, sid)
-					sub.Close()
-					return "", err
-				}
+	pub := r.GetPub()
+	if pub != nil {
+		if pub.AudioTrack() != nil {
+			err := sub.AddTrack(pub.AudioTrack())
+			if err != nil {
+				logger.Errorf("router sub add audio track err, err is %v, id is %s, sid is %s", err, r.Id, sid)
+				sub.Close()
+				return "", err
 			}
 		}
 	}
 
-	if r.pub != nil {
-		if r.pub.TrackVideo != nil {
-			if r.pub.TrackVideo.Track() != nil {
-				err := sub.AddTrack(r.pub.TrackVideo.Track())
-				if err != nil {
-					logger.Errorf("router sub add Video track err, err is %v, id is %s, sid is %s", err, r.Id, sid)
-					sub.Close()
-					return "", err
-				}
+	if pub != nil {
+		if pub.VideoTrack() != nil {
+			err := sub.AddTrack(pub.VideoTrack())
+			if err != nil {
+				logger.Errorf("router sub add Video track err, err is %v, id is %s, sid is %s", err, r.Id, sid)
+				sub.Close()
+				return "", err
 			}
 		}
 	}
-	if sub.TrackVideo == nil && sub.TrackVideo == nil {
+	// 订阅端offer中带有数据通道, 则创建数据通道转发消息
+	if strings.Contains(sdp, "m=application") {
+		err := sub.AddDataChannels()
+		if err != nil {
+			logger.Errorf("router sub add data channel err, err is %v, id is %s, sid is %s", err, r.Id, sid)
+			sub.Close()
+			return "", err
+		}
+	}
+	if sub.TrackAudio == nil && sub.TrackVideo == nil && !sub.HasData() {
 		sub.Close()
 		return "", errors.New("router sub no audio and video track")
 	}
@@ -114,10 +159,12 @@ func (r *Router) AddSub(sid, sdp string) (string, error) {
 	if err != nil {
 		logger.Errorf("router sub offer err, err is %v, id is %s, sid is %s", err, r.Id, sid)
 		sub.Close()
+		return "", err
 	}
 	logger.Debugf("router add sub, sub is %s", sub.Id)
 
 	r.Lock()
+	sub.onConnect = func() { r.replayOnConnect(sub) }
 	r.subs[sid] = sub
 	r.Unlock()
 
@@ -127,9 +174,36 @@ func (r *Router) AddSub(sid, sdp string) (string, error) {
 
 // GetPub 获取Pub对象
 func (r *Router) GetPub() *Pub {
+	r.pubLock.Lock()
+	defer r.pubLock.Unlock()
 	return r.pub
 }
 
+// setPub 设置Pub对象, 返回原来的Pub
+func (r *Router) setPub(pub *Pub) *Pub {
+	r.pubLock.Lock()
+	defer r.pubLock.Unlock()
+	old := r.pub
+	r.pub = pub
+	return old
+}
+
+// closed 判断Router是否已经关闭
+func (r *Router) closed() bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.stop
+}
+
+// working 判断Router和Pub是否都还在工作, 返回当前的Pub
+func (r *Router) working() (*Pub, bool) {
+	pub := r.GetPub()
+	if r.closed() || pub == nil || pub.Stopped() {
+		return nil, false
+	}
+	return pub, true
+}
+
 // GetSub 获取Sub对象
 func (r *Router) GetSub(sid string) *Sub {
 	r.Lock()
@@ -148,6 +222,34 @@ func (r *Router) DelSub(sid string) {
 	}
 }
 
+// AddSink 增加额外输出
+func (r *Router) AddSink(sink Sink) {
+	r.Lock()
+	defer r.Unlock()
+	if old := r.sinks[sink.ID()]; old != nil {
+		old.Close()
+	}
+	r.sinks[sink.ID()] = sink
+}
+
+// GetSink 获取额外输出
+func (r *Router) GetSink(id string) Sink {
+	r.Lock()
+	defer r.Unlock()
+	return r.sinks[id]
+}
+
+// DelSink 删除额外输出
+func (r *Router) DelSink(id string) {
+	r.Lock()
+	defer r.Unlock()
+	sink := r.sinks[id]
+	if sink != nil {
+		sink.Close()
+		delete(r.sinks, id)
+	}
+}
+
 // GetSubCount 获取sub数量
 func (r *Router) GetSubs() int {
 	r.Lock()
@@ -160,37 +262,164 @@ func (r *Router) GetSubs() int {
 	return res
 }
 
+// ReconnectPub 重建发布者的连接
+func (r *Router) ReconnectPub(sdp string) (string, error) {
+	pub := r.GetPub()
+	if pub == nil {
+		return "", errors.New("router pub is nil")
+	}
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}
+	answer, err := pub.Reconnect(offer)
+	if err != nil {
+		logger.Errorf("router reconnect pub err, err is %v, id is %s", err, r.Id)
+		return "", err
+	}
+	// 新连接的序号和时间戳重新开始, 丢弃旧的缓存, 订阅者等新的关键帧后重新对齐
+	r.Lock()
+	r.gop.reset()
+	for _, sub := range r.subs {
+		sub.needKey = true
+	}
+	r.Unlock()
+	return answer.SDP, nil
+}
+
+// ReconnectSub 重建订阅者的连接
+func (r *Router) ReconnectSub(sid, sdp string) (string, error) {
+	sub := r.GetSub(sid)
+	if sub == nil || sub.Stopped() {
+		return "", fmt.Errorf("router sub not found, sid is %s", sid)
+	}
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}
+	r.Lock()
+	answer, err := sub.Reconnect(offer)
+	r.Unlock()
+	if err != nil {
+		logger.Errorf("router reconnect sub err, err is %v, id is %s, sid is %s", err, r.Id, sid)
+		return "", err
+	}
+	return answer.SDP, nil
+}
+
+// PauseSub 暂停/恢复向订阅者转发音频和视频, 恢复视频时请求关键帧
+func (r *Router) PauseSub(sid string, audio, video bool) error {
+	r.Lock()
+	defer r.Unlock()
+	sub := r.subs[sid]
+	if sub == nil || sub.Stopped() {
+		return fmt.Errorf("router sub not found, sid is %s", sid)
+	}
+	resume := sub.pauseVideo && !video
+	sub.pauseAudio = audio
+	sub.pauseVideo = video
+	if resume && !r.videoMuted {
+		sub.needKey = true
+		r.requestKeyframe()
+	}
+	logger.Debugf("router pause sub, id is %s, sid is %s, audio is %v, video is %v", r.Id, sid, audio, video)
+	return nil
+}
+
+// SetMute 停止/恢复转发某一类媒体, kind为audio或video, 静音期间连接正常时Router保持存活
+func (r *Router) SetMute(kind string, mute bool) error {
+	pub := r.GetPub()
+	if pub == nil {
+		return errors.New("router pub is nil")
+	}
+	r.Lock()
+	defer r.Unlock()
+	switch kind {
+	case "audio":
+		if pub.AudioTrack() == nil {
+			return errors.New("router pub has no audio track")
+		}
+		r.audioMuted = mute
+	case "video":
+		if pub.VideoTrack() == nil {
+			return errors.New("router pub has no video track")
+		}
+		r.videoMuted = mute
+		// 关闭期间的缓存不再有效, 恢复画面时请求关键帧
+		r.gop.reset()
+		if !mute {
+			r.requestKeyframe()
+		}
+	default:
+		return fmt.Errorf("unknown media kind %s", kind)
+	}
+	logger.Debugf("router set mute, id is %s, kind is %s, mute is %v", r.Id, kind, mute)
+	return nil
+}
+
+// requestKeyframe 向发布者请求关键帧, 多个订阅者的请求合并为每个间隔最多一次
+func (r *Router) requestKeyframe() {
+	r.pliLock.Lock()
+	if time.Since(r.lastPLI) < pliInterval {
+		r.pliLock.Unlock()
+		return
+	}
+	r.lastPLI = time.Now()
+	r.pliLock.Unlock()
+	r.sendPLI()
+}
+
+// sendPLI 向发布者发送PLI
+func (r *Router) sendPLI() {
+	pub := r.GetPub()
+	if pub == nil || pub.VideoTrack() == nil {
+		return
+	}
+	pli := &rtcp.PictureLossIndication{MediaSSRC: pub.VideoTrack().SSRC}
+	if err := pub.WriteVideoRTCP(pli); err != nil {
+		logger.Debugf("router send pli err, err is %v, id is %s", err, r.Id)
+	}
+}
+
 // Alive 判断Router状态
 func (r *Router) Alive() bool {
+	r.Lock()
+	defer r.Unlock()
 	if r.stop {
 		return false
 	}
-	if r.pub != nil {
-		if r.pub.stop || !r.pub.alive {
+	if pub := r.GetPub(); pub != nil {
+		if pub.Dead() {
 			return false
 		}
-		bAudio := !r.audioAlive.Before(time.Now())
-		bVideo := !r.videoAlive.Before(time.Now())
-		return (!bAudio || !bVideo)
+		// 连接断开或刚重建, 宽限期内保留Router
+		if pub.InGrace() {
+			return true
+		}
+		// 静音只表示不再期待该类媒体的数据, 连接仍需正常, 否则按断流处理
+		connected := pub.Connected()
+		bAudio := (r.audioMuted && connected) || !r.audioAlive.Before(time.Now())
+		bVideo := (r.videoMuted && connected) || !r.videoAlive.Before(time.Now())
+		return bAudio || bVideo
 	}
 	return true
 }
 
 // Close 关闭Router
 func (r *Router) Close() {
+	r.Lock()
 	r.stop = true
-	if r.pub != nil {
-		r.pub.Close()
-		r.pub = nil
+	r.Unlock()
+	if pub := r.setPub(nil); pub != nil {
+		pub.Close()
 	}
 	r.Lock()
 	for sid, sub := range r.subs {
 		sub.Close()
 		delete(r.subs, sid)
 	}
+	for id, sink := range r.sinks {
+		sink.Close()
+		delete(r.sinks, id)
+	}
+	r.gop.reset()
+	r.pktBuffer = make(map[uint16]*rtp.Packet)
 	r.Unlock()
 
-	r.pktBuffer = make(map[uint16]*rtp.Packet)
 	if r.oggWriter != nil {
 		r.oggWriter.Close()
 	}
@@ -199,23 +428,31 @@ func (r *Router) Close() {
 // DoAudioWork 处理音频
 func (r *Router) DoAudioWork() {
 	for true {
-		if r.stop || r.pub == nil || r.pub.stop || !r.pub.alive {
+		pub, ok := r.working()
+		if !ok {
 			return
 		}
 
-		if r.pub != nil && r.pub.TrackAudio != nil {
-			pkt, err := r.pub.ReadAudioRTP()
+		if pub.AudioTrack() != nil {
+			pkt, err := pub.ReadAudioRTP()
 			if err == nil {
-				r.audioAlive = time.Now().Add(liveCycle)
 				r.Lock()
+				r.audioAlive = time.Now().Add(liveCycle)
+				if r.audioMuted {
+					r.Unlock()
+					continue
+				}
 				for sid, sub := range r.subs {
-					if sub.stop || !sub.alive {
+					if sub.Dead() {
 						sub.Close()
 						delete(r.subs, sid)
-					} else {
+					} else if !sub.pauseAudio {
 						sub.WriteAudioRTP(pkt)
 					}
 				}
+				for _, sink := range r.sinks {
+					sink.WriteAudioRTP(pkt)
+				}
 				if r.oggWriter != nil {
 					r.oggWriter.WriteRTP(pkt)
 				}
@@ -230,25 +467,34 @@ func (r *Router) DoAudioWork() {
 // DoVideoWork 处理视频
 func (r *Router) DoVideoWork() {
 	for {
-		if r.stop || r.pub == nil || r.pub.stop || !r.pub.alive {
+		pub, ok := r.working()
+		if !ok {
 			return
 		}
-		if r.pub != nil && r.pub.TrackVideo != nil {
-			pkt, err := r.pub.ReadVideoRTP()
+		if pub.VideoTrack() != nil {
+			pkt, err := pub.ReadVideoRTP()
 			if err == nil {
+				r.Lock()
+				r.videoAlive = time.Now().Add(liveCycle)
+				if r.videoMuted {
+					r.Unlock()
+					continue
+				}
 				// 缓存包
 				r.pktBuffer[pkt.SequenceNumber] = pkt
+				r.gop.push(pkt)
 				// 转发包
-				r.videoAlive = time.Now().Add(liveCycle)
-				r.Lock()
 				for sid, sub := range r.subs {
-					if sub.stop || !sub.alive {
+					if sub.Dead() {
 						sub.Close()
 						delete(r.subs, sid)
-					} else {
-						sub.WriteVideoRTP(pkt)
+					} else if !sub.pauseVideo {
+						r.writeVideo(sub, pkt)
 					}
 				}
+				for _, sink := range r.sinks {
+					sink.WriteVideoRTP(pkt)
+				}
 				r.Unlock()
 			}
 		} else {
@@ -257,10 +503,69 @@ func (r *Router) DoVideoWork() {
 	}
 }
 
+// writeVideo 转发视频包, 订阅者还在等待关键帧时先回放缓存的关键帧组
+func (r *Router) writeVideo(sub *Sub, pkt *rtp.Packet) {
+	// 缓存的最后一个包就是当前包
+	if sub.needKey && sub.active() && r.replayGOP(sub) {
+		return
+	}
+	sub.WriteVideoRTP(pkt)
+}
+
+// replayOnConnect 订阅者连接建立后立即回放缓存的关键帧组, 不等待发布者的下一个包
+func (r *Router) replayOnConnect(sub *Sub) {
+	r.Lock()
+	defer r.Unlock()
+	if !sub.needKey || !sub.active() || sub.pauseVideo || r.videoMuted {
+		return
+	}
+	r.replayGOP(sub)
+}
+
+// replayGOP 回放缓存的关键帧组, 没有缓存时请求关键帧并返回false, 调用时需要持有锁
+func (r *Router) replayGOP(sub *Sub) bool {
+	sub.needKey = false
+	pkts := r.gop.packets()
+	if len(pkts) == 0 {
+		r.requestKeyframe()
+		return false
+	}
+	sub.videoSeq.resync(pkts[0])
+	for _, p := range pkts {
+		sub.WriteVideoRTP(p)
+	}
+	logger.Debugf("router replay keyframe, id is %s, sid is %s, packets is %d", r.Id, sub.Id, len(pkts))
+	return true
+}
+
+// DoDataWork 处理数据通道消息, 单协程转发保证同一发布者的消息有序
+func (r *Router) DoDataWork() {
+	for {
+		pub, ok := r.working()
+		if !ok {
+			return
+		}
+		msg, err := pub.ReadData()
+		if err != nil {
+			return
+		}
+		r.Lock()
+		for _, sub := range r.subs {
+			if !sub.HasData() || !msg.Match(sub.UID()) {
+				continue
+			}
+			if err := sub.WriteData(msg); err != nil {
+				logger.Debugf("router write data err, err is %v, id is %s, sid is %s", err, r.Id, sub.Id)
+			}
+		}
+		r.Unlock()
+	}
+}
+
 // DoRTCPWork 处理RTCP包， 目前只处理视频
 func (r *Router) DoRTCPWork(sub *Sub) {
 	for true {
-		if r.stop || sub.TrackVideo == nil || sub.stop || !sub.alive {
+		if r.closed() || sub.TrackVideo == nil || sub.Stopped() {
 			return
 		}
 
@@ -269,26 +574,31 @@ func (r *Router) DoRTCPWork(sub *Sub) {
 			if err == nil {
 				switch (pkt).(type) {
 				case *rtcp.PictureLossIndication:
-					if r.pub != nil {
-						r.pub.WriteVideoRTCP(pkt)
-					}
+					r.requestKeyframe()
 				case *rtcp.TransportLayerNack:
+					if sub.pauseVideo {
+						continue
+					}
 					nack := (pkt.(*rtcp.TransportLayerNack))
+					r.Lock()
 					for _, pair := range nack.Nacks {
+						// 订阅者的序号可能被改写过, 换算为发布者的序号
+						seq := sub.videoSeq.origin(pair.PacketID)
 						nackpkt := &rtcp.TransportLayerNack{
 							SenderSSRC: nack.SenderSSRC,
 							MediaSSRC:  nack.MediaSSRC,
-							Nacks:      []rtcp.NackPair{{PacketID: pair.PacketID}},
+							Nacks:      []rtcp.NackPair{{PacketID: seq}},
 						}
-						if r.pub != nil {
-							nackpktTmp := r.pktBuffer[pair.PacketID]
+						if pub := r.GetPub(); pub != nil {
+							nackpktTmp := r.pktBuffer[seq]
 							if nackpktTmp != nil {
 								sub.WriteVideoRTP(nackpktTmp)
 							} else {
-								r.pub.WriteVideoRTCP(nackpkt)
+								pub.WriteVideoRTCP(nackpkt)
 							}
 						}
 					}
+					r.Unlock()
 				default:
 
 				}
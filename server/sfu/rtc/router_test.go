@@ -0,0 +1,32 @@
+package rtc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMutedRouterNeedsConnection(t *testing.T) {
+	r := NewRouter("rid#uid#mid")
+	pub, err := NewPub("rid#uid#mid")
+	if err != nil {
+		t.Fatalf("new pub: %v", err)
+	}
+	t.Cleanup(r.Close)
+	r.setPub(pub)
+	// 宽限期已过, 两类媒体都已经静音且没有数据
+	pub.downTime = time.Now().Add(-2 * routerGrace)
+	r.audioMuted, r.videoMuted = true, true
+	r.audioAlive = time.Now().Add(-time.Second)
+	r.videoAlive = time.Now().Add(-time.Second)
+	if pub.Connected() {
+		t.Fatal("pub without an answer should not be connected")
+	}
+	if r.Alive() {
+		t.Fatal("muted router without a connected pc should not stay alive")
+	}
+	// 未静音的媒体仍按数据判断
+	r.audioAlive = time.Now().Add(liveCycle)
+	if !r.Alive() {
+		t.Fatal("router with recent audio should stay alive")
+	}
+}
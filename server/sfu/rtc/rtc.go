@@ -3,22 +3,55 @@ package rtc
 import (
 	"goRTCServer/pkg/logger"
 	"goRTCServer/server/sfu/conf"
+	"net"
 	"sync"
 	"time"
 
-	"github.com/pion/webrtc/v2"
+	"github.com/pion/ice/v2"
+	"github.com/pion/transport/v2/vnet"
+	"github.com/pion/webrtc/v3"
 )
 
 const statCycle = 5 * time.Second
 const maxCleanSize = 100
 
+// maxICETCPBuffer ICE-TCP每个连接的读缓冲包数
+const maxICETCPBuffer = 8
+
+// 发布和订阅使用的编码, 负载类型和浏览器的默认值一致
+const (
+	payloadTypeOpus webrtc.PayloadType = 111
+	payloadTypeVP8  webrtc.PayloadType = 96
+)
+
+var (
+	opusCodec = webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeOpus,
+		ClockRate:   48000,
+		Channels:    2,
+		SDPFmtpLine: "minptime=10;useinbandfec=1;stereo=1",
+	}
+	vp8Codec = webrtc.RTPCodecCapability{
+		MimeType:     webrtc.MimeTypeVP8,
+		ClockRate:    90000,
+		RTCPFeedback: []webrtc.RTCPFeedback{{Type: "nack"}, {Type: "nack", Parameter: "pli"}, {Type: "ccm", Parameter: "fir"}},
+	}
+)
+
 var (
 	stop         bool
 	icePortStart uint16
 	icePortEnd   uint16
 	iceServers   []webrtc.ICEServer
+	iceLock      sync.RWMutex
+	networkTypes []webrtc.NetworkType
+	routerGrace  time.Duration
+	pliInterval  time.Duration
 	routers      map[string]*Router
 	routerLock   sync.Mutex
+	virtualNet   *vnet.Net
+	udpMux       ice.UDPMux
+	tcpMux       ice.TCPMux
 	CleanRouter  chan string
 )
 
@@ -30,26 +63,182 @@ func InitRTC() {
 		icePortEnd = conf.WebRTC.ICEPortRange[1]
 	}
 
-	iceServers = make([]webrtc.ICEServer, 0)
-	for _, iceServer := range conf.WebRTC.ICEServers {
+	networkTypes = make([]webrtc.NetworkType, 0)
+	for _, raw := range conf.WebRTC.NetworkTypes {
+		t, err := webrtc.NewNetworkType(raw)
+		if err != nil {
+			logger.Errorf("invalid network type, type is %s", raw)
+			continue
+		}
+		networkTypes = append(networkTypes, t)
+	}
+	routerGrace = time.Duration(conf.WebRTC.Grace) * time.Second
+	pliInterval = time.Duration(conf.WebRTC.PLIInterval) * time.Millisecond
+
+	LoadICEServers()
+
+	initMux()
+
+	routers = make(map[string]*Router)
+	CleanRouter = make(chan string, maxCleanSize)
+
+	go CheckRouter()
+
+}
+
+// LoadICEServers 从配置加载ICE服务, 配置热加载后调用, 只影响之后新建的连接
+func LoadICEServers() {
+	servers := make([]webrtc.ICEServer, 0)
+	for _, iceServer := range conf.GetICEServers() {
 		server := webrtc.ICEServer{
 			URLs:       iceServer.URLS,
 			Username:   iceServer.Username,
 			Credential: iceServer.Credentiail,
 		}
-		iceServers = append(iceServers, server)
+		servers = append(servers, server)
 	}
+	iceLock.Lock()
+	iceServers = servers
+	iceLock.Unlock()
+}
 
-	routers = make(map[string]*Router)
-	CleanRouter = make(chan string, maxCleanSize)
+// getICEServers 获取新建连接使用的ICE服务
+func getICEServers() []webrtc.ICEServer {
+	iceLock.RLock()
+	defer iceLock.RUnlock()
+	return iceServers
+}
 
-	go CheckRouter()
+// SetVNet 使用pion虚拟网络收发媒体, 需要在InitRTC之前调用, 用于没有网络的测试环境
+func SetVNet(n *vnet.Net) {
+	virtualNet = n
+}
 
+// initMux 按配置监听单端口UDP和ICE-TCP端口, 所有pub/sub的连接共用这两个端口
+func initMux() {
+	if conf.WebRTC.UDPMux != 0 {
+		mux, err := ice.NewMultiUDPMuxFromPort(conf.WebRTC.UDPMux)
+		if err != nil {
+			logger.Errorf("listen ice udp mux err, err is %v, port is %d", err, conf.WebRTC.UDPMux)
+		} else {
+			udpMux = mux
+		}
+	}
+	if conf.WebRTC.TCPMux != 0 {
+		l, err := net.ListenTCP("tcp", &net.TCPAddr{Port: conf.WebRTC.TCPMux})
+		if err != nil {
+			logger.Errorf("listen ice tcp mux err, err is %v, port is %d", err, conf.WebRTC.TCPMux)
+		} else {
+			tcpMux = webrtc.NewICETCPMux(nil, l, maxICETCPBuffer)
+		}
+	}
+}
+
+// closeMux 关闭单端口UDP和ICE-TCP的监听
+func closeMux() {
+	if udpMux != nil {
+		udpMux.Close()
+		udpMux = nil
+	}
+	if tcpMux != nil {
+		tcpMux.Close()
+		tcpMux = nil
+	}
+}
+
+// newSettingEngine 根据配置生成pub/sub共用的SettingEngine
+func newSettingEngine() webrtc.SettingEngine {
+	setting := webrtc.SettingEngine{}
+	if udpMux != nil {
+		// 单端口复用时不再使用portrange
+		setting.SetICEUDPMux(udpMux)
+	} else if icePortStart != 0 && icePortEnd != 0 {
+		setting.SetEphemeralUDPPortRange(icePortStart, icePortEnd)
+	}
+	if tcpMux != nil {
+		setting.SetICETCPMux(tcpMux)
+	}
+	if len(networkTypes) > 0 {
+		setting.SetNetworkTypes(networkTypes)
+	} else if tcpMux != nil {
+		// pion默认只收集udp候选, 开启ICE-TCP时补上tcp
+		setting.SetNetworkTypes([]webrtc.NetworkType{
+			webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6,
+			webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6,
+		})
+	}
+	// 部署在1:1 NAT后(云主机弹性IP, k8s hostNetwork等)时通告公网地址
+	if len(conf.WebRTC.NAT1To1IPs) > 0 {
+		candidateType := webrtc.ICECandidateTypeHost
+		if conf.WebRTC.NAT1To1Type == "srflx" {
+			candidateType = webrtc.ICECandidateTypeSrflx
+		}
+		setting.SetNAT1To1IPs(conf.WebRTC.NAT1To1IPs, candidateType)
+	}
+	if virtualNet != nil {
+		setting.SetVNet(virtualNet)
+	}
+	return setting
+}
+
+// newMediaEngine 生成pub/sub共用的MediaEngine, 只支持opus和vp8
+func newMediaEngine() (*webrtc.MediaEngine, error) {
+	engine := &webrtc.MediaEngine{}
+	err := engine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: opusCodec,
+		PayloadType:        payloadTypeOpus,
+	}, webrtc.RTPCodecTypeAudio)
+	if err != nil {
+		return nil, err
+	}
+	err = engine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: vp8Codec,
+		PayloadType:        payloadTypeVP8,
+	}, webrtc.RTPCodecTypeVideo)
+	if err != nil {
+		return nil, err
+	}
+	return engine, nil
+}
+
+// TrackInfo 发布者一路音频或视频的参数, 订阅者和转发根据它创建本地track
+type TrackInfo struct {
+	Kind        webrtc.RTPCodecType
+	Codec       webrtc.RTPCodecCapability
+	PayloadType webrtc.PayloadType
+	SSRC        uint32
+	ID          string
+	StreamID    string
+}
+
+// newTrackInfo 根据发布者的远端track生成
+func newTrackInfo(track *webrtc.TrackRemote) *TrackInfo {
+	return &TrackInfo{
+		Kind:        track.Kind(),
+		Codec:       track.Codec().RTPCodecCapability,
+		PayloadType: track.PayloadType(),
+		SSRC:        uint32(track.SSRC()),
+		ID:          track.ID(),
+		StreamID:    track.StreamID(),
+	}
 }
 
 // 销毁RTC
 func FreeRTC() {
 	stop = true
+	mixerLock.Lock()
+	list := make([]*Mixer, 0, len(mixers))
+	for rid, m := range mixers {
+		list = append(list, m)
+		delete(mixers, rid)
+	}
+	mixerLock.Unlock()
+	for _, m := range list {
+		m.Close()
+	}
+	StopAllRTMP()
+	// 所有连接关闭后再关闭共用的端口
+	defer closeMux()
 	routerLock.Lock()
 	defer routerLock.Unlock()
 	for id, router := range routers {
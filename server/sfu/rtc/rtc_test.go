@@ -0,0 +1,110 @@
+package rtc
+
+import (
+	"goRTCServer/pkg/logger"
+	"goRTCServer/server/sfu/conf"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestMain(m *testing.M) {
+	// 单元测试不加载配置, 使用默认的日志和宽限期
+	logger.DoInit("", "sfu_test")
+	routerGrace = 10 * time.Second
+	os.Exit(m.Run())
+}
+
+// freePort 找一个当前空闲的端口
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestICEMuxSinglePort(t *testing.T) {
+	old := conf.WebRTC
+	defer func() { conf.WebRTC = old }()
+	conf.WebRTC.UDPMux = freePort(t)
+	conf.WebRTC.TCPMux = freePort(t)
+	initMux()
+	defer closeMux()
+	if udpMux == nil || tcpMux == nil {
+		t.Fatal("udp and tcp mux should be listening")
+	}
+
+	pub, err := NewPub("rid#uid#mid")
+	if err != nil {
+		t.Fatalf("new pub: %v", err)
+	}
+	defer pub.Close()
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	defer client.Close()
+	if _, err = client.CreateDataChannel("data", nil); err != nil {
+		t.Fatalf("create data channel: %v", err)
+	}
+	connected := make(chan struct{})
+	client.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			close(connected)
+		}
+	})
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("create offer: %v", err)
+	}
+	gathered := webrtc.GatheringCompletePromise(client)
+	if err = client.SetLocalDescription(offer); err != nil {
+		t.Fatalf("set offer: %v", err)
+	}
+	<-gathered
+	answer, err := pub.Answer(*client.LocalDescription())
+	if err != nil {
+		t.Fatalf("answer: %v", err)
+	}
+
+	// 服务端的host候选只能使用配置的两个端口
+	var udp, tcp int
+	for _, line := range strings.Split(answer.SDP, "\n") {
+		if !strings.HasPrefix(line, "a=candidate:") {
+			continue
+		}
+		fields := strings.Fields(line)
+		port, _ := strconv.Atoi(fields[5])
+		switch strings.ToLower(fields[2]) {
+		case "udp":
+			udp++
+			if port != conf.WebRTC.UDPMux {
+				t.Fatalf("udp candidate should use mux port %d, got %s", conf.WebRTC.UDPMux, line)
+			}
+		case "tcp":
+			tcp++
+			if port != conf.WebRTC.TCPMux || !strings.Contains(line, "tcptype passive") {
+				t.Fatalf("tcp candidate should be passive on port %d, got %s", conf.WebRTC.TCPMux, line)
+			}
+		}
+	}
+	if udp == 0 || tcp == 0 {
+		t.Fatalf("answer should carry udp and tcp candidates, got %d udp and %d tcp", udp, tcp)
+	}
+
+	if err = client.SetRemoteDescription(answer); err != nil {
+		t.Fatalf("set answer: %v", err)
+	}
+	select {
+	case <-connected:
+	case <-time.After(10 * time.Second):
+		t.Fatal("client should connect through the mux port")
+	}
+}
@@ -0,0 +1,85 @@
+package rtc
+
+import (
+	"encoding/json"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// DataLabelReliable 可靠有序的数据通道
+	DataLabelReliable = "reliable"
+	// DataLabelUnreliable 不可靠(不重传)的有序数据通道, 适合光标位置、游戏状态等
+	DataLabelUnreliable = "unreliable"
+
+	maxDataChanSize = 256
+)
+
+// DataMsg 发布者通过数据通道发送的消息
+type DataMsg struct {
+	Label    string   // 通道名称 reliable/unreliable
+	To       []string // 指定接收者的uid, 为空则发给所有订阅者
+	IsString bool     // 是否为文本消息
+	Data     []byte   // 消息内容
+}
+
+// dataEnvelope 指定接收者的消息格式 {"to":["uid"],"data":...}
+type dataEnvelope struct {
+	To   []string        `json:"to"`
+	Data json.RawMessage `json:"data"`
+}
+
+// newDataMsg 解析数据通道消息, 文本消息中带有to字段则只转发给指定的uid
+func newDataMsg(label string, msg webrtc.DataChannelMessage) *DataMsg {
+	dm := &DataMsg{
+		Label:    label,
+		IsString: msg.IsString,
+		Data:     msg.Data,
+	}
+	if msg.IsString {
+		var env dataEnvelope
+		if err := json.Unmarshal(msg.Data, &env); err == nil && len(env.To) > 0 && len(env.Data) > 0 {
+			dm.To = env.To
+			dm.Data = env.Data
+		}
+	}
+	return dm
+}
+
+// Match 判断消息是否需要发给uid
+func (m *DataMsg) Match(uid string) bool {
+	if len(m.To) == 0 {
+		return true
+	}
+	for _, id := range m.To {
+		if id == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// dataLabel 根据通道参数得到对应的通道名称
+func dataLabel(dc *webrtc.DataChannel) string {
+	if dc.Label() == DataLabelReliable || dc.Label() == DataLabelUnreliable {
+		return dc.Label()
+	}
+	if !dc.Ordered() || dc.MaxRetransmits() != nil || dc.MaxPacketLifeTime() != nil {
+		return DataLabelUnreliable
+	}
+	return DataLabelReliable
+}
+
+// dataChannelInit 获取通道的创建参数
+func dataChannelInit(label string) *webrtc.DataChannelInit {
+	// 两种通道都保持有序, 不可靠通道丢包后不重传
+	ordered := true
+	if label == DataLabelUnreliable {
+		retransmits := uint16(0)
+		return &webrtc.DataChannelInit{
+			Ordered:        &ordered,
+			MaxRetransmits: &retransmits,
+		}
+	}
+	return &webrtc.DataChannelInit{Ordered: &ordered}
+}
@@ -0,0 +1,95 @@
+package rtc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestNewDataMsg(t *testing.T) {
+	dm := newDataMsg(DataLabelReliable, webrtc.DataChannelMessage{IsString: true, Data: []byte(`{"to":["u2"],"data":{"x":1}}`)})
+	if len(dm.To) != 1 || string(dm.Data) != `{"x":1}` {
+		t.Fatalf("envelope not unwrapped: %+v", dm)
+	}
+	if !dm.Match("u2") || dm.Match("u3") {
+		t.Fatal("directed message matched the wrong uid")
+	}
+	plain := newDataMsg(DataLabelReliable, webrtc.DataChannelMessage{IsString: true, Data: []byte(`hello`)})
+	if len(plain.To) != 0 || !plain.Match("anyone") {
+		t.Fatal("plain message should go to every subscriber")
+	}
+}
+
+func newQueueSub(size int) *Sub {
+	// 没有发送协程, 队列填满后模拟慢的订阅者
+	return &Sub{
+		Id:        "rid#uid#mid",
+		dataChans: make(map[string]*webrtc.DataChannel),
+		dataCh:    make(chan *DataMsg, size),
+	}
+}
+
+func TestWriteDataDropsUnreliableWhenFull(t *testing.T) {
+	s := newQueueSub(1)
+	msg := &DataMsg{Label: DataLabelUnreliable, Data: []byte("a")}
+	if err := s.WriteData(msg); err != nil {
+		t.Fatalf("first write: %v", err)
+	}
+	if err := s.WriteData(msg); err == nil {
+		t.Fatal("write to a full unreliable queue should be dropped")
+	}
+	if s.dataClosed {
+		t.Fatal("dropping unreliable messages must not close the data channel")
+	}
+}
+
+func TestWriteDataClosesReliableWhenFull(t *testing.T) {
+	s := newQueueSub(1)
+	msg := &DataMsg{Label: DataLabelReliable, Data: []byte("a")}
+	if err := s.WriteData(msg); err != nil {
+		t.Fatalf("first write: %v", err)
+	}
+	if err := s.WriteData(msg); err == nil {
+		t.Fatal("write to a full reliable queue should fail")
+	}
+	if !s.dataClosed || s.HasData() {
+		t.Fatal("reliable overflow should close the sub data channel")
+	}
+	if err := s.WriteData(msg); err == nil {
+		t.Fatal("write after close should fail")
+	}
+}
+
+func TestPubPushDataAfterClose(t *testing.T) {
+	// 没有转发协程, 队列填满后可靠消息会阻塞, 直到Pub关闭
+	p := &Pub{
+		Id:         "rid#uid#mid",
+		RtpAudioCh: make(chan *rtp.Packet),
+		RtpVideoCh: make(chan *rtp.Packet),
+		DataCh:     make(chan *DataMsg, 1),
+		done:       make(chan struct{}),
+	}
+	msg := &DataMsg{Label: DataLabelReliable, Data: []byte("a")}
+	p.pushData(DataLabelReliable, msg)
+	blocked := make(chan struct{})
+	go func() {
+		p.pushData(DataLabelReliable, msg)
+		close(blocked)
+	}()
+	p.Close()
+	select {
+	case <-blocked:
+	case <-time.After(time.Second):
+		t.Fatal("reliable push blocked after close")
+	}
+	// 关闭之后再收到的消息不能panic
+	p.pushData(DataLabelReliable, msg)
+	p.pushData(DataLabelUnreliable, msg)
+	if _, err := p.ReadData(); err == nil {
+		if _, err := p.ReadData(); err == nil {
+			t.Fatal("read after close should fail once the queue is drained")
+		}
+	}
+}
@@ -3,12 +3,14 @@ package rtc
 import (
 	"errors"
 	"goRTCServer/pkg/logger"
+	"goRTCServer/pkg/utils"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
-	"github.com/pion/rtp/codecs"
-	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v3"
 )
 
 const maxRTCChanSize = 100
@@ -21,31 +23,57 @@ type Pub struct {
 
 	TrackAudio *webrtc.RTPReceiver
 	TrackVideo *webrtc.RTPReceiver
+	audioInfo  *TrackInfo
+	videoInfo  *TrackInfo
 	RtpAudioCh chan *rtp.Packet
 	RtpVideoCh chan *rtp.Packet
+	DataCh     chan *DataMsg
+	done       chan struct{} // Close时关闭, 媒体和数据通道的发送方和接收方据此退出
+	downTime   time.Time     // 连接断开的时间
+	lock       sync.Mutex    // 保护stop, alive, pc, TrackAudio, TrackVideo, audioInfo, videoInfo和downTime
+
+	// 普通RTP推流, pc为nil
+	ingest *RTPIngest
 }
 
 func NewPub(pid string) (*Pub, error) {
+	pcnew, err := newPubPC(pid)
+	if err != nil {
+		return nil, err
+	}
+	pub := &Pub{
+		Id:         pid,
+		pc:         pcnew,
+		stop:       false,
+		alive:      true,
+		TrackAudio: nil,
+		TrackVideo: nil,
+		RtpAudioCh: make(chan *rtp.Packet, maxRTCChanSize),
+		RtpVideoCh: make(chan *rtp.Packet, maxRTCChanSize),
+		DataCh:     make(chan *DataMsg, maxDataChanSize),
+		done:       make(chan struct{}),
+	}
+	pub.bindPC(pcnew)
+	return pub, nil
+}
+
+// newPubPC 创建推流的PeerConnection
+func newPubPC(pid string) (*webrtc.PeerConnection, error) {
 	cfg := webrtc.Configuration{
-		ICEServers:         iceServers,
+		ICEServers:         getICEServers(),
 		ICETransportPolicy: webrtc.ICETransportPolicyAll,
 		SDPSemantics:       webrtc.SDPSemanticsUnifiedPlanWithFallback,
 	}
-	engine := webrtc.MediaEngine{}
-	opus := webrtc.NewRTPCodec(webrtc.RTPCodecTypeAudio, webrtc.Opus, 48000, 2, "minptime=10;useinbandfec=1;stereo=1",
-		webrtc.DefaultPayloadTypeOpus, &codecs.OpusPayloader{})
-	engine.RegisterCodec(opus)
-	engine.RegisterCodec(webrtc.NewRTPVP8Codec(webrtc.DefaultPayloadTypeVP8, 90000))
-
-	setting := webrtc.SettingEngine{}
-	if icePortStart != 0 && icePortEnd != 0 {
-		setting.SetEphemeralUDPPortRange(icePortStart, icePortEnd)
+	engine, err := newMediaEngine()
+	if err != nil {
+		logger.Errorf("pub new media engine err, err is %v, pubid is %s", err, pid)
+		return nil, err
 	}
-
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(engine), webrtc.WithSettingEngine(setting))
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(engine), webrtc.WithSettingEngine(newSettingEngine()))
 	pcnew, err := api.NewPeerConnection(cfg)
 	if err != nil {
 		logger.Errorf("pub new peer err, err is %v, pubid is %s", err, pid)
+		return nil, err
 	}
 	_, err = pcnew.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RtpTransceiverInit{
 		Direction: webrtc.RTPTransceiverDirectionRecvonly,
@@ -64,149 +92,419 @@ func NewPub(pid string) (*Pub, error) {
 		pcnew.Close()
 		return nil, err
 	}
+	return pcnew, nil
+}
+
+// bindPC 注册PeerConnection的回调, 重建连接后旧连接的回调不再生效
+func (p *Pub) bindPC(pc *webrtc.PeerConnection) {
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if p.getPC() == pc {
+			p.OnPeerConnect(state)
+		}
+	})
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		if p.getPC() == pc {
+			p.OnTrackRemote(track, receiver)
+		}
+	})
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		if p.getPC() == pc {
+			p.OnDataChannel(dc)
+		}
+	})
+}
+
+// getPC 获取当前的PeerConnection
+func (p *Pub) getPC() *webrtc.PeerConnection {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.pc
+}
+
+// setPC 替换当前的PeerConnection
+func (p *Pub) setPC(pc *webrtc.PeerConnection) {
+	p.lock.Lock()
+	p.pc = pc
+	p.lock.Unlock()
+}
+
+// Reconnect 用新的offer新建连接替换原来的连接, mid和Router保持不变
+func (p *Pub) Reconnect(offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	if p.ingest != nil {
+		return webrtc.SessionDescription{}, errors.New("rtp pub cannot reconnect")
+	}
+	pcnew, err := newPubPC(p.Id)
+	if err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	old := p.getPC()
+	p.setPC(pcnew)
+	p.bindPC(pcnew)
+	answer, err := p.Answer(offer)
+	if err != nil {
+		p.setPC(old)
+		pcnew.Close()
+		return webrtc.SessionDescription{}, err
+	}
+	// 重新计算宽限期, 等待新连接建立
+	p.lock.Lock()
+	p.downTime = time.Now()
+	p.lock.Unlock()
+	old.Close()
+	logger.Debugf("pub reconnect, pid is %s", p.Id)
+	return answer, nil
+}
+
+// Dead 判断Pub是否已经失效, 连接断开超过宽限期才算失效
+func (p *Pub) Dead() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.stop || (!p.alive && time.Since(p.downTime) > routerGrace)
+}
+
+// InGrace 判断Pub是否处于宽限期内, 连接断开或刚重建时还没有媒体数据
+func (p *Pub) InGrace() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return !p.alive || time.Since(p.downTime) < routerGrace
+}
+
+// Connected 判断Pub的连接是否已建立, 普通RTP推流没有连接
+func (p *Pub) Connected() bool {
+	pc := p.getPC()
+	return pc != nil && pc.ConnectionState() == webrtc.PeerConnectionStateConnected
+}
 
+// Stopped 判断Pub是否已经关闭
+func (p *Pub) Stopped() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.stop
+}
+
+// active 判断Pub是否在正常转发, 已关闭或连接断开时不再接收数据
+func (p *Pub) active() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return !p.stop && p.alive
+}
+
+// NewRTPPub 创建普通RTP推流的Pub
+func NewRTPPub(pid string, audio, video bool, audioPT, videoPT uint8) (*Pub, error) {
+	ingest, err := NewRTPIngest(pid, audio, video, audioPT, videoPT)
+	if err != nil {
+		logger.Errorf("pub new rtp ingest err, err is %v, pubid is %s", err, pid)
+		return nil, err
+	}
 	pub := &Pub{
 		Id:         pid,
-		pc:         pcnew,
 		stop:       false,
 		alive:      true,
-		TrackAudio: nil,
-		TrackVideo: nil,
 		RtpAudioCh: make(chan *rtp.Packet, maxRTCChanSize),
 		RtpVideoCh: make(chan *rtp.Packet, maxRTCChanSize),
+		DataCh:     make(chan *DataMsg, maxDataChanSize),
+		done:       make(chan struct{}),
+		ingest:     ingest,
+	}
+	if ingest.Audio != nil {
+		go ingest.Audio.DoRTCP()
+		go pub.DoRTPInput(ingest.Audio, pub.RtpAudioCh)
 	}
-	pcnew.OnConnectionStateChange(pub.OnPeerConnect)
-	pcnew.OnTrack(pub.OnTrackRemote)
+	if ingest.Video != nil {
+		go ingest.Video.DoRTCP()
+		go pub.DoRTPInput(ingest.Video, pub.RtpVideoCh)
+	}
+	go ingest.DoReport()
 	return pub, nil
 }
 
+// RTPAddrs 普通RTP推流的音视频地址
+func (p *Pub) RTPAddrs() (audio, video *RTPAddr) {
+	if p.ingest == nil {
+		return nil, nil
+	}
+	if p.ingest.Audio != nil {
+		addr := p.ingest.Audio.Addr()
+		audio = &addr
+	}
+	if p.ingest.Video != nil {
+		addr := p.ingest.Video.Addr()
+		video = &addr
+	}
+	return audio, video
+}
+
+// AudioTrack 获取音频track的参数
+func (p *Pub) AudioTrack() *TrackInfo {
+	if p.ingest != nil && p.ingest.Audio != nil {
+		return p.ingest.Audio.track
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.audioInfo
+}
+
+// VideoTrack 获取视频track的参数
+func (p *Pub) VideoTrack() *TrackInfo {
+	if p.ingest != nil && p.ingest.Video != nil {
+		return p.ingest.Video.track
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.videoInfo
+}
+
 // OnPeerConnect Pub连接状态的回到
 func (p *Pub) OnPeerConnect(state webrtc.PeerConnectionState) {
 	if state == webrtc.PeerConnectionStateConnected {
 		logger.Debugf("pub peer connected, pid is %s", p.Id)
+		p.lock.Lock()
 		p.alive = true
+		p.lock.Unlock()
 	} else if state == webrtc.PeerConnectionStateDisconnected {
 		logger.Debugf("pub peer disconnected, pid is %s", p.Id)
-		p.alive = false
+		p.setDown()
 	} else if state == webrtc.PeerConnectionStateFailed {
 		logger.Debugf("pub peer failed, pid is %s", p.Id)
-		p.alive = false
+		p.setDown()
+	}
+}
+
+// setDown 标记连接断开, 记录断开时间
+func (p *Pub) setDown() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.alive {
+		p.downTime = time.Now()
 	}
+	p.alive = false
 }
 
 // OnTrackRemote 接受到track的回调
-func (p *Pub) OnTrackRemote(track *webrtc.Track, receiver *webrtc.RTPReceiver) {
+func (p *Pub) OnTrackRemote(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
 	if track.Kind() == webrtc.RTPCodecTypeAudio {
+		p.lock.Lock()
 		p.TrackAudio = receiver
+		p.audioInfo = newTrackInfo(track)
+		p.lock.Unlock()
 		logger.Debugf("OnTrackRemote pub audio. pid is %s", p.Id)
-		go p.DoAudioRTP()
+		go p.DoAudioRTP(track, receiver)
 	}
 
 	if track.Kind() == webrtc.RTPCodecTypeVideo {
+		p.lock.Lock()
 		p.TrackVideo = receiver
+		p.videoInfo = newTrackInfo(track)
+		p.lock.Unlock()
 		logger.Debugf("OnTrackRemote pub video. pid is %s", p.Id)
-		go p.DoVideoRTP()
+		go p.DoVideoRTP(track, receiver)
+	}
+}
+
+// OnDataChannel 接收到数据通道的回调
+func (p *Pub) OnDataChannel(dc *webrtc.DataChannel) {
+	label := dataLabel(dc)
+	logger.Debugf("OnDataChannel pub data channel, pid is %s, label is %s", p.Id, dc.Label())
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		defer utils.Recover("pub.OnDataChannel")
+		if !p.active() {
+			return
+		}
+		p.pushData(label, newDataMsg(label, msg))
+	})
+}
+
+// pushData 把消息交给Router转发, DataCh不会关闭, Close之后通过done退出,
+// 避免关闭过程中收到消息时向已关闭的通道发送
+func (p *Pub) pushData(label string, dm *DataMsg) {
+	if label == DataLabelReliable {
+		select {
+		case p.DataCh <- dm:
+		case <-p.done:
+		}
+		return
+	}
+	// 不可靠通道在转发不及时的情况下直接丢弃
+	select {
+	case p.DataCh <- dm:
+	case <-p.done:
+	default:
+		logger.Debugf("pub data chan full, drop unreliable msg, pid is %s", p.Id)
 	}
 }
 
 // Close 关闭连接
 func (p *Pub) Close() {
 	logger.Debugf("pub close, pid is %s", p.Id)
+	p.lock.Lock()
+	if p.stop {
+		p.lock.Unlock()
+		return
+	}
 	p.stop = true
-	p.pc.Close()
-	close(p.RtpAudioCh)
-	close(p.RtpVideoCh)
+	pc := p.pc
+	p.lock.Unlock()
+	if p.ingest != nil {
+		p.ingest.Close()
+	}
+	if pc != nil {
+		pc.Close()
+	}
+	// 媒体和数据通道都不关闭, 收发协程通过done退出
+	close(p.done)
 }
 
 // Answer SDP交换
 func (p *Pub) Answer(offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
-	err := p.pc.SetRemoteDescription(offer)
+	pc := p.getPC()
+	err := pc.SetRemoteDescription(offer)
 	if err != nil {
 		logger.Errorf("pub set offer err, err is %v, pid is %s", err, p.Id)
 		return webrtc.SessionDescription{}, err
 	}
 
-	answer, err := p.pc.CreateAnswer(nil)
+	answer, err := pc.CreateAnswer(nil)
 	if err != nil {
 		logger.Errorf("pub create answer err, err is %v, pid is %s", err, p.Id)
 		return webrtc.SessionDescription{}, err
 	}
-	err = p.pc.SetLocalDescription(answer)
+	gathered := webrtc.GatheringCompletePromise(pc)
+	err = pc.SetLocalDescription(answer)
 	if err != nil {
 		logger.Errorf("pub set answer err, err is %v, pid is %s", err, p.Id)
 		return webrtc.SessionDescription{}, err
 	}
-	return answer, err
+	// 没有trickle, 等候选地址收集完再返回answer
+	<-gathered
+	return *pc.LocalDescription(), nil
 }
 
-// DoAudioRTP 处理音频包
-func (p *Pub) DoAudioRTP() {
-	if p.TrackAudio != nil && p.TrackAudio.Track() != nil {
-		for true {
-			if p.stop || !p.alive {
+// DoAudioRTP 处理音频包, 连接重建后旧的receiver退出
+func (p *Pub) DoAudioRTP(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	if track == nil || receiver == nil {
+		return
+	}
+	for {
+		if !p.current(receiver) {
+			return
+		}
+		rtp, _, err := track.ReadRTP()
+		if err != nil {
+			if err == io.EOF {
+				if p.current(receiver) {
+					p.setDown()
+				}
+				logger.Errorf("pub.TrackAudio Read RTP error, err is io.EOF")
 				return
 			}
-			rtp, err := p.TrackAudio.Track().ReadRTP()
-			if err != nil {
-				if err == io.EOF {
-					p.alive = false
-					logger.Errorf("pub.TrackAudio Read RTP error, err is io.EOF")
-				}
-			} else {
-				if p.stop || p.alive == false {
-					return
-				}
-				p.RtpAudioCh <- rtp
+		} else {
+			if !p.current(receiver) || !p.pushRTP(p.RtpAudioCh, rtp) {
+				return
 			}
 		}
 	}
 }
 
-// DoVideoRTP 处理视频包
-func (p *Pub) DoVideoRTP() {
-	if p.TrackVideo != nil && p.TrackVideo.Track() != nil {
-		for true {
-			if p.stop || !p.alive {
+// DoVideoRTP 处理视频包, 连接重建后旧的receiver退出
+func (p *Pub) DoVideoRTP(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	if track == nil || receiver == nil {
+		return
+	}
+	for {
+		if !p.current(receiver) {
+			return
+		}
+		rtp, _, err := track.ReadRTP()
+		if err != nil {
+			if err == io.EOF {
+				if p.current(receiver) {
+					p.setDown()
+				}
+				logger.Errorf("pub.TrackVideo Read RTP error, err is io.EOF")
 				return
 			}
-			rtp, err := p.TrackVideo.Track().ReadRTP()
-			if err != nil {
-				if err == io.EOF {
-					p.alive = false
-					logger.Errorf("pub.TrackVideo Read RTP error, err is io.EOF")
-				}
-			} else {
-				if p.stop || p.alive == false {
-					return
-				}
-				p.RtpVideoCh <- rtp
+		} else {
+			if !p.current(receiver) || !p.pushRTP(p.RtpVideoCh, rtp) {
+				return
 			}
 		}
 	}
 }
 
+// current 判断receiver是否还是当前连接的receiver, 关闭或重建连接后返回false
+func (p *Pub) current(receiver *webrtc.RTPReceiver) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return !p.stop && (p.TrackAudio == receiver || p.TrackVideo == receiver)
+}
+
+// pushRTP 把包交给Router转发, 关闭后返回false
+func (p *Pub) pushRTP(ch chan *rtp.Packet, pkt *rtp.Packet) bool {
+	select {
+	case ch <- pkt:
+		return true
+	case <-p.done:
+		return false
+	}
+}
+
+// DoRTPInput 处理普通RTP推流的包
+func (p *Pub) DoRTPInput(in *rtpInput, ch chan *rtp.Packet) {
+	defer utils.Recover("pub.DoRTPInput")
+	buf := make([]byte, maxRTPPacket)
+	for {
+		if p.Stopped() {
+			return
+		}
+		pkt, err := in.readRTP(buf)
+		if err != nil {
+			logger.Debugf("pub rtp input read err, err is %v, pid is %s", err, p.Id)
+			return
+		}
+		if pkt != nil && !p.pushRTP(ch, pkt) {
+			return
+		}
+	}
+}
+
 // ReadAudioRTP 读取音频RTP包
 func (p *Pub) ReadAudioRTP() (*rtp.Packet, error) {
-	rtp, ok := <-p.RtpAudioCh
-	if !ok {
+	select {
+	case rtp := <-p.RtpAudioCh:
+		return rtp, nil
+	case <-p.done:
 		return nil, errors.New("pub audio rtp chan close")
 	}
-	return rtp, nil
 }
 
 // ReadVideoRTP 读取视频RTP包
 func (p *Pub) ReadVideoRTP() (*rtp.Packet, error) {
-	rtp, ok := <-p.RtpVideoCh
-	if !ok {
+	select {
+	case rtp := <-p.RtpVideoCh:
+		return rtp, nil
+	case <-p.done:
 		return nil, errors.New("pub video rtp chan close")
 	}
-	return rtp, nil
+}
+
+// ReadData 读取数据通道消息
+func (p *Pub) ReadData() (*DataMsg, error) {
+	select {
+	case msg := <-p.DataCh:
+		return msg, nil
+	case <-p.done:
+		return nil, errors.New("pub data chan close")
+	}
 }
 
 // WriteVideoRtcp 发送RTCP包
 func (p *Pub) WriteVideoRTCP(pkg rtcp.Packet) error {
-	if p.pc == nil {
+	if p.ingest != nil {
+		return p.ingest.WriteVideoRTCP(pkg)
+	}
+	pc := p.getPC()
+	if pc == nil {
 		return errors.New("pub pc is nil")
 	}
-	return p.pc.WriteRTCP([]rtcp.Packet{pkg})
+	return pc.WriteRTCP([]rtcp.Packet{pkg})
 }
@@ -0,0 +1,611 @@
+package rtc
+
+import (
+	"errors"
+	"fmt"
+	"goRTCServer/pkg/logger"
+	"goRTCServer/pkg/utils"
+	"goRTCServer/server/sfu/conf"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	maxRTPPacket = 1500
+	ntpEpochDiff = 2208988800 // 1900到1970的秒数
+	rtpSinkFlag  = "rtp_"
+
+	maxRTPPortRetry = 100
+)
+
+var (
+	rtpPortLock sync.Mutex
+	rtpPortNext uint16
+)
+
+// RTPAddr 普通RTP的地址, RTCP端口一般为RTP端口+1
+type RTPAddr struct {
+	Host     string
+	RTPPort  int
+	RTCPPort int
+}
+
+// rtpHost 获取对外通告的地址
+func rtpHost() string {
+	if conf.RTP.Host != "" {
+		return conf.RTP.Host
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "127.0.0.1"
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+			return ipnet.IP.String()
+		}
+	}
+	return "127.0.0.1"
+}
+
+// listenRTPPair 监听一对相邻的RTP/RTCP端口, RTP为偶数端口
+func listenRTPPair() (*net.UDPConn, *net.UDPConn, error) {
+	if len(conf.RTP.PortRange) != 2 {
+		// 没有配置端口范围, 由系统分配RTP端口, 再尝试监听相邻的RTCP端口
+		for i := 0; i < maxRTPPortRetry; i++ {
+			rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{})
+			if err != nil {
+				return nil, nil, err
+			}
+			port := rtpConn.LocalAddr().(*net.UDPAddr).Port
+			if port%2 != 0 {
+				rtpConn.Close()
+				continue
+			}
+			rtcpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port + 1})
+			if err != nil {
+				rtpConn.Close()
+				continue
+			}
+			return rtpConn, rtcpConn, nil
+		}
+		return nil, nil, errors.New("no available rtp port")
+	}
+
+	rtpPortLock.Lock()
+	defer rtpPortLock.Unlock()
+	min, max := conf.RTP.PortRange[0]+conf.RTP.PortRange[0]%2, conf.RTP.PortRange[1]
+	if rtpPortNext < min || rtpPortNext >= max {
+		rtpPortNext = min
+	}
+	for i := 0; i <= int(max-min)/2; i++ {
+		port := rtpPortNext
+		rtpPortNext += 2
+		if rtpPortNext >= max {
+			rtpPortNext = min
+		}
+		rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: int(port)})
+		if err != nil {
+			continue
+		}
+		rtcpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: int(port) + 1})
+		if err != nil {
+			rtpConn.Close()
+			continue
+		}
+		return rtpConn, rtcpConn, nil
+	}
+	return nil, nil, errors.New("no available rtp port")
+}
+
+// newRTPTrack 创建描述RTP推流的track, 订阅者根据它创建对应的track
+func newRTPTrack(kind webrtc.RTPCodecType, id string) (*TrackInfo, error) {
+	if kind == webrtc.RTPCodecTypeAudio {
+		return &TrackInfo{Kind: kind, Codec: opusCodec, PayloadType: payloadTypeOpus, SSRC: rand.Uint32(), ID: id, StreamID: id}, nil
+	}
+	return &TrackInfo{Kind: kind, Codec: vp8Codec, PayloadType: payloadTypeVP8, SSRC: rand.Uint32(), ID: id, StreamID: id}, nil
+}
+
+// ntpTime 转换成NTP时间
+func ntpTime(t time.Time) uint64 {
+	sec := uint64(t.Unix()) + ntpEpochDiff
+	frac := uint64(t.Nanosecond()) * (1 << 32) / uint64(time.Second)
+	return sec<<32 | frac
+}
+
+// rtpInput 一路RTP推流输入(音频或视频)
+type rtpInput struct {
+	track    *TrackInfo
+	srcPT    uint8 // 推流端使用的payload type, 其他pt的包丢弃
+	rtpConn  *net.UDPConn
+	rtcpConn *net.UDPConn
+	remote   *net.UDPAddr // 对端RTCP地址
+	source   *net.UDPAddr // 第一个RTP包的来源, 只接收该地址的包
+	srcSSRC  uint32
+
+	// 接收统计, 用于发送RR
+	started    bool
+	baseSeq    uint16
+	maxSeq     uint16
+	cycles     uint32
+	received   uint32
+	lastSR     uint32
+	lastSRTime time.Time
+	sync.Mutex
+}
+
+// newRTPInput 创建一路RTP推流输入, pt为推流端opus/vp8使用的payload type
+func newRTPInput(kind webrtc.RTPCodecType, id string, pt uint8) (*rtpInput, error) {
+	track, err := newRTPTrack(kind, id)
+	if err != nil {
+		return nil, err
+	}
+	rtpConn, rtcpConn, err := listenRTPPair()
+	if err != nil {
+		return nil, err
+	}
+	return &rtpInput{track: track, srcPT: pt, rtpConn: rtpConn, rtcpConn: rtcpConn}, nil
+}
+
+// Addr 推流地址
+func (in *rtpInput) Addr() RTPAddr {
+	return RTPAddr{
+		Host:     rtpHost(),
+		RTPPort:  in.rtpConn.LocalAddr().(*net.UDPAddr).Port,
+		RTCPPort: in.rtcpConn.LocalAddr().(*net.UDPAddr).Port,
+	}
+}
+
+// readRTP 读取RTP包, ssrc和pt改写成track的值
+func (in *rtpInput) readRTP(buf []byte) (*rtp.Packet, error) {
+	n, addr, err := in.rtpConn.ReadFromUDP(buf)
+	if err != nil {
+		return nil, err
+	}
+	pkt := &rtp.Packet{}
+	if err := pkt.Unmarshal(append([]byte{}, buf[:n]...)); err != nil {
+		return nil, nil
+	}
+	if pkt.PayloadType != in.srcPT {
+		// 只转发opus/vp8, 其他编码的包直接丢弃
+		return nil, nil
+	}
+
+	in.Lock()
+	if in.source == nil {
+		in.source = addr
+	} else if !in.source.IP.Equal(addr.IP) || in.source.Port != addr.Port {
+		// 推流地址锁定为第一个来源, 丢弃其他地址注入的包
+		in.Unlock()
+		return nil, nil
+	}
+	if in.remote == nil {
+		// 没有收到RTCP前, 默认对端RTCP端口为RTP端口+1
+		in.remote = &net.UDPAddr{IP: addr.IP, Port: addr.Port + 1}
+	}
+	in.srcSSRC = pkt.SSRC
+	if !in.started {
+		in.started = true
+		in.baseSeq = pkt.SequenceNumber
+		in.maxSeq = pkt.SequenceNumber
+	} else if pkt.SequenceNumber-in.maxSeq < 0x8000 {
+		if pkt.SequenceNumber < in.maxSeq {
+			in.cycles += 1 << 16
+		}
+		in.maxSeq = pkt.SequenceNumber
+	}
+	in.received++
+	in.Unlock()
+
+	pkt.SSRC = in.track.SSRC
+	pkt.PayloadType = uint8(in.track.PayloadType)
+	return pkt, nil
+}
+
+// DoRTCP 接收对端的RTCP包, 记录SR用于计算RR
+func (in *rtpInput) DoRTCP() {
+	buf := make([]byte, maxRTPPacket)
+	for {
+		n, addr, err := in.rtcpConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		pkts, err := rtcp.Unmarshal(buf[:n])
+		if err != nil {
+			continue
+		}
+		in.Lock()
+		if in.source == nil || !in.source.IP.Equal(addr.IP) {
+			// 只接收推流端的RTCP
+			in.Unlock()
+			continue
+		}
+		in.remote = addr
+		for _, pkt := range pkts {
+			if sr, ok := pkt.(*rtcp.SenderReport); ok {
+				in.lastSR = uint32(sr.NTPTime >> 16)
+				in.lastSRTime = time.Now()
+			}
+		}
+		in.Unlock()
+	}
+}
+
+// WriteRTCP 发送RTCP包给对端
+func (in *rtpInput) WriteRTCP(pkts []rtcp.Packet) error {
+	in.Lock()
+	remote := in.remote
+	in.Unlock()
+	if remote == nil {
+		return errors.New("rtp input remote addr is nil")
+	}
+	data, err := rtcp.Marshal(pkts)
+	if err != nil {
+		return err
+	}
+	_, err = in.rtcpConn.WriteToUDP(data, remote)
+	return err
+}
+
+// report 生成接收报告
+func (in *rtpInput) report() *rtcp.ReceptionReport {
+	in.Lock()
+	defer in.Unlock()
+	if !in.started {
+		return nil
+	}
+	extMax := in.cycles + uint32(in.maxSeq)
+	expected := extMax - uint32(in.baseSeq) + 1
+	lost := uint32(0)
+	if expected > in.received {
+		lost = expected - in.received
+	}
+	rr := &rtcp.ReceptionReport{
+		SSRC:               in.srcSSRC,
+		TotalLost:          lost & 0xFFFFFF,
+		LastSequenceNumber: extMax,
+		LastSenderReport:   in.lastSR,
+	}
+	if expected > 0 {
+		rr.FractionLost = uint8(lost * 256 / expected)
+	}
+	if in.lastSR != 0 {
+		rr.Delay = uint32(time.Since(in.lastSRTime).Seconds() * 65536)
+	}
+	return rr
+}
+
+// Close 关闭端口
+func (in *rtpInput) Close() {
+	in.rtpConn.Close()
+	in.rtcpConn.Close()
+}
+
+// RTPIngest 普通RTP推流, 接收SIP网关、GStreamer等发来的opus/vp8
+type RTPIngest struct {
+	Id    string
+	ssrc  uint32
+	stop  bool
+	Audio *rtpInput
+	Video *rtpInput
+}
+
+// NewRTPIngest 创建RTP推流端口, audioPT/videoPT为推流端opus/vp8使用的payload type, 为0时使用111和96
+func NewRTPIngest(id string, audio, video bool, audioPT, videoPT uint8) (*RTPIngest, error) {
+	if !audio && !video {
+		return nil, errors.New("rtp ingest no audio and video")
+	}
+	if audioPT == 0 {
+		audioPT = uint8(payloadTypeOpus)
+	}
+	if videoPT == 0 {
+		videoPT = uint8(payloadTypeVP8)
+	}
+	ing := &RTPIngest{Id: id, ssrc: rand.Uint32()}
+	var err error
+	if audio {
+		if ing.Audio, err = newRTPInput(webrtc.RTPCodecTypeAudio, id, audioPT); err != nil {
+			return nil, err
+		}
+	}
+	if video {
+		if ing.Video, err = newRTPInput(webrtc.RTPCodecTypeVideo, id, videoPT); err != nil {
+			ing.Close()
+			return nil, err
+		}
+	}
+	return ing, nil
+}
+
+// DoReport 定时发送接收报告
+func (i *RTPIngest) DoReport() {
+	t := time.NewTicker(statCycle)
+	defer t.Stop()
+	for range t.C {
+		if i.stop {
+			return
+		}
+		for _, in := range []*rtpInput{i.Audio, i.Video} {
+			if in == nil {
+				continue
+			}
+			if rr := in.report(); rr != nil {
+				in.WriteRTCP([]rtcp.Packet{&rtcp.ReceiverReport{SSRC: i.ssrc, Reports: []rtcp.ReceptionReport{*rr}}})
+			}
+		}
+	}
+}
+
+// WriteVideoRTCP 把订阅者的PLI/NACK转发给推流端
+func (i *RTPIngest) WriteVideoRTCP(pkt rtcp.Packet) error {
+	if i.Video == nil {
+		return errors.New("rtp ingest no video")
+	}
+	i.Video.Lock()
+	ssrc := i.Video.srcSSRC
+	i.Video.Unlock()
+	switch p := pkt.(type) {
+	case *rtcp.PictureLossIndication:
+		return i.Video.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{SenderSSRC: i.ssrc, MediaSSRC: ssrc}})
+	case *rtcp.TransportLayerNack:
+		return i.Video.WriteRTCP([]rtcp.Packet{&rtcp.TransportLayerNack{SenderSSRC: i.ssrc, MediaSSRC: ssrc, Nacks: p.Nacks}})
+	}
+	return nil
+}
+
+// Close 关闭推流端口
+func (i *RTPIngest) Close() {
+	i.stop = true
+	if i.Audio != nil {
+		i.Audio.Close()
+	}
+	if i.Video != nil {
+		i.Video.Close()
+	}
+}
+
+// rtpOutput 一路RTP转发输出(音频或视频)
+type rtpOutput struct {
+	clockRate uint32
+	rtpConn   *net.UDPConn
+	rtcpConn  *net.UDPConn
+	dst       *net.UDPAddr
+	rtcpDst   *net.UDPAddr
+
+	// 发送统计, 用于发送SR
+	ssrc     uint32
+	packets  uint32
+	octets   uint32
+	lastTS   uint32
+	lastTime time.Time
+	sync.Mutex
+}
+
+// newRTPOutput 创建一路RTP转发输出
+func newRTPOutput(host string, port int, clockRate uint32) (*rtpOutput, error) {
+	ip, err := resolveIP(host)
+	if err != nil {
+		return nil, err
+	}
+	rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	rtcpConn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		rtpConn.Close()
+		return nil, err
+	}
+	return &rtpOutput{
+		clockRate: clockRate,
+		rtpConn:   rtpConn,
+		rtcpConn:  rtcpConn,
+		dst:       &net.UDPAddr{IP: ip, Port: port},
+		rtcpDst:   &net.UDPAddr{IP: ip, Port: port + 1},
+	}, nil
+}
+
+// writeRTP 发送RTP包
+func (o *rtpOutput) writeRTP(pkt *rtp.Packet) error {
+	data, err := pkt.Marshal()
+	if err != nil {
+		return err
+	}
+	o.Lock()
+	o.ssrc = pkt.SSRC
+	o.packets++
+	o.octets += uint32(len(pkt.Payload))
+	o.lastTS = pkt.Timestamp
+	o.lastTime = time.Now()
+	o.Unlock()
+	_, err = o.rtpConn.WriteToUDP(data, o.dst)
+	return err
+}
+
+// writeSR 发送发送者报告
+func (o *rtpOutput) writeSR() error {
+	o.Lock()
+	if o.packets == 0 {
+		o.Unlock()
+		return nil
+	}
+	now := time.Now()
+	sr := &rtcp.SenderReport{
+		SSRC:        o.ssrc,
+		NTPTime:     ntpTime(now),
+		RTPTime:     o.lastTS + uint32(now.Sub(o.lastTime).Seconds()*float64(o.clockRate)),
+		PacketCount: o.packets,
+		OctetCount:  o.octets,
+	}
+	o.Unlock()
+	data, err := rtcp.Marshal([]rtcp.Packet{sr})
+	if err != nil {
+		return err
+	}
+	_, err = o.rtcpConn.WriteToUDP(data, o.rtcpDst)
+	return err
+}
+
+// Close 关闭端口
+func (o *rtpOutput) Close() {
+	o.rtpConn.Close()
+	o.rtcpConn.Close()
+}
+
+// RTPForward 把Router的音视频转发到普通RTP地址, 音频发到port, 视频发到port+2
+type RTPForward struct {
+	id     string
+	router *Router
+	stop   bool
+	audio  *rtpOutput
+	video  *rtpOutput
+}
+
+// RTPForwardID 根据目标地址生成转发id
+func RTPForwardID(host string, port int) string {
+	return fmt.Sprintf("%s%s:%d", rtpSinkFlag, host, port)
+}
+
+// NewRTPForward 创建RTP转发, 目标地址必须在[rtp] forwardallow中
+func NewRTPForward(r *Router, host string, port int) (*RTPForward, error) {
+	if port <= 0 || port > 65535-3 {
+		return nil, fmt.Errorf("invalid rtp port %d", port)
+	}
+	ip, err := resolveIP(host)
+	if err != nil {
+		return nil, err
+	}
+	if !RTPForwardAllowed(ip) {
+		return nil, fmt.Errorf("rtp forward to %s is not allowed", ip)
+	}
+	return newRTPForward(r, RTPForwardID(host, port), ip.String(), port, port+2)
+}
+
+// RTPForwardAllowed 判断是否允许转发到ip, 没有配置[rtp] forwardallow时不允许转发
+func RTPForwardAllowed(ip net.IP) bool {
+	for _, a := range conf.RTP.ForwardAllow {
+		if _, ipnet, err := net.ParseCIDR(a); err == nil {
+			if ipnet.Contains(ip) {
+				return true
+			}
+		} else if allow := net.ParseIP(a); allow != nil && allow.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveIP 解析地址, host可以是ip或域名
+func resolveIP(host string) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+	addr, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return nil, err
+	}
+	return addr.IP, nil
+}
+
+// newRTPForward 创建RTP转发, 音视频分别发到audioPort和videoPort
+func newRTPForward(r *Router, id, host string, audioPort, videoPort int) (*RTPForward, error) {
+	audio, err := newRTPOutput(host, audioPort, 48000)
+	if err != nil {
+		return nil, err
+	}
+	video, err := newRTPOutput(host, videoPort, 90000)
+	if err != nil {
+		audio.Close()
+		return nil, err
+	}
+	f := &RTPForward{
+		id:     id,
+		router: r,
+		audio:  audio,
+		video:  video,
+	}
+	go f.DoReport()
+	go f.DoRTCP(f.video)
+	go f.DoRTCP(f.audio)
+	return f, nil
+}
+
+// ID sink的id
+func (f *RTPForward) ID() string {
+	return f.id
+}
+
+// WriteAudioRTP 转发音频包
+func (f *RTPForward) WriteAudioRTP(pkt *rtp.Packet) error {
+	if f.stop {
+		return errors.New("rtp forward is stopped")
+	}
+	return f.audio.writeRTP(pkt)
+}
+
+// WriteVideoRTP 转发视频包
+func (f *RTPForward) WriteVideoRTP(pkt *rtp.Packet) error {
+	if f.stop {
+		return errors.New("rtp forward is stopped")
+	}
+	return f.video.writeRTP(pkt)
+}
+
+// DoReport 定时发送SR
+func (f *RTPForward) DoReport() {
+	t := time.NewTicker(statCycle)
+	defer t.Stop()
+	for range t.C {
+		if f.stop {
+			return
+		}
+		f.audio.writeSR()
+		f.video.writeSR()
+	}
+}
+
+// DoRTCP 接收对端的RTCP, 关键帧请求和NACK转给发布者
+func (f *RTPForward) DoRTCP(o *rtpOutput) {
+	defer utils.Recover("RTPForward.DoRTCP")
+	buf := make([]byte, maxRTPPacket)
+	for {
+		n, addr, err := o.rtcpConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !addr.IP.Equal(o.dst.IP) {
+			// 只接收转发目标的RTCP, 其他地址不能向发布者请求关键帧
+			continue
+		}
+		pkts, err := rtcp.Unmarshal(buf[:n])
+		if err != nil {
+			continue
+		}
+		pub := f.router.GetPub()
+		if pub == nil || pub.VideoTrack() == nil {
+			continue
+		}
+		ssrc := pub.VideoTrack().SSRC
+		for _, pkt := range pkts {
+			switch p := pkt.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				pub.WriteVideoRTCP(&rtcp.PictureLossIndication{MediaSSRC: ssrc})
+			case *rtcp.TransportLayerNack:
+				pub.WriteVideoRTCP(&rtcp.TransportLayerNack{SenderSSRC: p.SenderSSRC, MediaSSRC: ssrc, Nacks: p.Nacks})
+			}
+		}
+	}
+}
+
+// Close 停止转发
+func (f *RTPForward) Close() {
+	logger.Debugf("rtp forward close, id is %s, router is %s", f.id, f.router.Id)
+	f.stop = true
+	f.audio.Close()
+	f.video.Close()
+}
@@ -0,0 +1,117 @@
+package rtc
+
+import (
+	"goRTCServer/server/sfu/conf"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestRTPForwardAllowed(t *testing.T) {
+	old := conf.RTP.ForwardAllow
+	defer func() { conf.RTP.ForwardAllow = old }()
+
+	conf.RTP.ForwardAllow = nil
+	if RTPForwardAllowed(net.ParseIP("10.0.0.1")) {
+		t.Fatal("forwarding must be denied without an allow list")
+	}
+	conf.RTP.ForwardAllow = []string{"10.0.0.0/8", "192.168.1.10"}
+	cases := []struct {
+		ip    string
+		allow bool
+	}{
+		{"10.1.2.3", true},
+		{"192.168.1.10", true},
+		{"192.168.1.11", false},
+		{"127.0.0.1", false},
+		{"169.254.169.254", false},
+	}
+	for _, c := range cases {
+		if got := RTPForwardAllowed(net.ParseIP(c.ip)); got != c.allow {
+			t.Errorf("RTPForwardAllowed(%s) = %v, want %v", c.ip, got, c.allow)
+		}
+	}
+	if _, err := NewRTPForward(nil, "127.0.0.1", 5004); err == nil {
+		t.Fatal("forward to an address outside the allow list should fail")
+	}
+}
+
+func TestRTPIngestLockedToFirstSource(t *testing.T) {
+	in, err := newRTPInput(webrtc.RTPCodecTypeAudio, "rid#uid#mid", 111)
+	if err != nil {
+		t.Fatalf("new rtp input: %v", err)
+	}
+	defer in.Close()
+	dst := in.rtpConn.LocalAddr().(*net.UDPAddr)
+	dst.IP = net.IPv4(127, 0, 0, 1)
+
+	send := func(conn *net.UDPConn, seq uint16) {
+		pkt := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 111, SequenceNumber: seq, SSRC: 1234}, Payload: []byte{1}}
+		data, _ := pkt.Marshal()
+		if _, err := conn.WriteToUDP(data, dst); err != nil {
+			t.Fatalf("send rtp: %v", err)
+		}
+	}
+	owner, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	other, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer owner.Close()
+	defer other.Close()
+
+	buf := make([]byte, maxRTPPacket)
+	read := func() *rtp.Packet {
+		in.rtpConn.SetReadDeadline(time.Now().Add(time.Second))
+		pkt, err := in.readRTP(buf)
+		if err != nil {
+			t.Fatalf("read rtp: %v", err)
+		}
+		return pkt
+	}
+	send(owner, 1)
+	if pkt := read(); pkt == nil || pkt.SequenceNumber != 1 {
+		t.Fatal("first source should be accepted")
+	}
+	send(other, 2)
+	if pkt := read(); pkt != nil {
+		t.Fatal("packet from another source should be dropped")
+	}
+	send(owner, 3)
+	if pkt := read(); pkt == nil || pkt.SequenceNumber != 3 {
+		t.Fatal("first source should still be accepted")
+	}
+}
+
+func TestRTPIngestDropsOtherPayloadType(t *testing.T) {
+	in, err := newRTPInput(webrtc.RTPCodecTypeVideo, "rid#uid#mid", 100)
+	if err != nil {
+		t.Fatalf("new rtp input: %v", err)
+	}
+	defer in.Close()
+	dst := in.rtpConn.LocalAddr().(*net.UDPAddr)
+	dst.IP = net.IPv4(127, 0, 0, 1)
+	conn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer conn.Close()
+
+	buf := make([]byte, maxRTPPacket)
+	for _, c := range []struct {
+		pt   uint8
+		keep bool
+	}{{96, false}, {100, true}} {
+		pkt := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: c.pt, SSRC: 1234}, Payload: []byte{1}}
+		data, _ := pkt.Marshal()
+		conn.WriteToUDP(data, dst)
+		in.rtpConn.SetReadDeadline(time.Now().Add(time.Second))
+		got, err := in.readRTP(buf)
+		if err != nil {
+			t.Fatalf("read rtp: %v", err)
+		}
+		if (got != nil) != c.keep {
+			t.Fatalf("packet with pt %d kept %v, want %v", c.pt, got != nil, c.keep)
+		}
+		if got != nil && (got.PayloadType != uint8(payloadTypeVP8) || got.SSRC != in.track.SSRC) {
+			t.Fatalf("pt and ssrc should be rewritten to the track, got pt %d ssrc %d", got.PayloadType, got.SSRC)
+		}
+	}
+}
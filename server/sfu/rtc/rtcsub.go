@@ -3,15 +3,22 @@ package rtc
 import (
 	"errors"
 	"goRTCServer/pkg/logger"
+	"goRTCServer/pkg/proto"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
-	"github.com/pion/rtp/codecs"
-	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
 )
 
-const maxRTCPChanSize = 100
+const (
+	maxRTCPChanSize = 100
+	// maxSubDataChanSize 每个订阅者数据通道发送队列的长度
+	maxSubDataChanSize = 64
+)
 
 // sub 订阅对象
 type Sub struct {
@@ -25,29 +32,22 @@ type Sub struct {
 	TrackVideo  *webrtc.RTPSender
 	RtcpAudioCh chan rtcp.Packet
 	RtcpVideoCh chan rtcp.Packet
+	dataChans   map[string]*webrtc.DataChannel
+	dataCh      chan *DataMsg // 数据通道发送队列, 慢的订阅者不阻塞其他人
+	dataClosed  bool          // 数据通道已关闭, 不再接收消息
+	dataLock    sync.Mutex    // 保护dataChans, dataCh和dataClosed
+	downTime    time.Time     // 连接断开的时间
+	lock        sync.Mutex    // 保护stop, alive和downTime
+	pauseAudio  bool          // 暂停转发音频
+	pauseVideo  bool          // 暂停转发视频, 只听声音时只暂停视频
+	needKey     bool          // 等待回放缓存的关键帧
+	onConnect   func()        // 连接建立后的回调, Router用来回放缓存的关键帧组
+	videoSeq    seqRewriter
 }
 
 func NewSub(sid string) (*Sub, error) {
-	cfg := webrtc.Configuration{
-		ICEServers:         iceServers,
-		ICETransportPolicy: webrtc.ICETransportPolicyAll,
-		SDPSemantics:       webrtc.SDPSemanticsUnifiedPlanWithFallback,
-	}
-	engine := webrtc.MediaEngine{}
-	opus := webrtc.NewRTPCodec(webrtc.RTPCodecTypeAudio, webrtc.Opus, 48000, 2, "minptime=10;useinbandfec=1;stereo=1",
-		webrtc.DefaultPayloadTypeOpus, &codecs.OpusPayloader{})
-	engine.RegisterCodec(opus)
-	engine.RegisterCodec(webrtc.NewRTPVP8Codec(webrtc.DefaultPayloadTypeVP8, 90000))
-
-	setting := webrtc.SettingEngine{}
-	if icePortStart != 0 && icePortEnd != 0 {
-		setting.SetEphemeralUDPPortRange(icePortStart, icePortEnd)
-	}
-
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(engine), webrtc.WithSettingEngine(setting))
-	pcnew, err := api.NewPeerConnection(cfg)
+	pcnew, err := newSubPC(sid)
 	if err != nil {
-		logger.Errorf("sub new peer err=%v, sid=%s", err, sid)
 		return nil, err
 	}
 
@@ -55,46 +55,177 @@ func NewSub(sid string) (*Sub, error) {
 		Id:          sid,
 		pc:          pcnew,
 		stop:        false,
-		alive:       true,
+		alive:       false,
+		downTime:    time.Now(),
 		writeErrcnt: 0,
 		TrackAudio:  nil,
 		TrackVideo:  nil,
 		RtcpAudioCh: make(chan rtcp.Packet, maxRTCPChanSize),
 		RtcpVideoCh: make(chan rtcp.Packet, maxRTCPChanSize),
+		dataChans:   make(map[string]*webrtc.DataChannel),
 	}
-	pcnew.OnConnectionStateChange(sub.OnPeerConnect)
+	sub.bindPC(pcnew)
 	return sub, nil
 }
 
+// newSubPC 创建订阅的PeerConnection
+func newSubPC(sid string) (*webrtc.PeerConnection, error) {
+	cfg := webrtc.Configuration{
+		ICEServers:         getICEServers(),
+		ICETransportPolicy: webrtc.ICETransportPolicyAll,
+		SDPSemantics:       webrtc.SDPSemanticsUnifiedPlanWithFallback,
+	}
+	engine, err := newMediaEngine()
+	if err != nil {
+		logger.Errorf("sub new media engine err=%v, sid=%s", err, sid)
+		return nil, err
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(engine), webrtc.WithSettingEngine(newSettingEngine()))
+	pcnew, err := api.NewPeerConnection(cfg)
+	if err != nil {
+		logger.Errorf("sub new peer err=%v, sid=%s", err, sid)
+		return nil, err
+	}
+	return pcnew, nil
+}
+
+// bindPC 注册PeerConnection的回调, 重建连接后旧连接的回调不再生效
+func (s *Sub) bindPC(pc *webrtc.PeerConnection) {
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if s.pc == pc {
+			s.OnPeerConnect(state)
+		}
+	})
+}
+
 // OnPeerConnect Sub连接状态回调
 func (s *Sub) OnPeerConnect(state webrtc.PeerConnectionState) {
 	if state == webrtc.PeerConnectionStateConnected {
 		logger.Debugf("sub peer connected = %s", s.Id)
+		s.lock.Lock()
 		s.alive = true
-		go s.DoVideoRtcp()
+		s.lock.Unlock()
+		go s.DoVideoRtcp(s.TrackVideo)
+		if s.onConnect != nil {
+			go s.onConnect()
+		}
 	}
 	if state == webrtc.PeerConnectionStateDisconnected {
 		logger.Debugf("sub peer disconnected = %s", s.Id)
-		s.alive = false
+		s.setDown()
 	}
 	if state == webrtc.PeerConnectionStateFailed {
 		logger.Debugf("sub peer failed = %s", s.Id)
-		s.alive = false
+		s.setDown()
 	}
 }
 
+// setDown 标记连接断开, 记录断开时间
+func (s *Sub) setDown() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.alive {
+		s.downTime = time.Now()
+	}
+	s.alive = false
+}
+
+// Dead 判断Sub是否已经失效, 连接断开超过宽限期才算失效
+func (s *Sub) Dead() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stop || (!s.alive && time.Since(s.downTime) > routerGrace)
+}
+
+// Stopped 判断Sub是否已经关闭
+func (s *Sub) Stopped() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stop
+}
+
+// active 判断Sub是否可以发送, 已关闭或连接未建立时不发送
+func (s *Sub) active() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return !s.stop && s.alive
+}
+
+// Reconnect 用新的offer新建连接替换原来的连接, 保持原来的track和数据通道
+func (s *Sub) Reconnect(offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	pcnew, err := newSubPC(s.Id)
+	if err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	var audio, video *webrtc.RTPSender
+	for _, old := range []*webrtc.RTPSender{s.TrackAudio, s.TrackVideo} {
+		if old == nil || old.Track() == nil {
+			continue
+		}
+		// 本地track可以同时绑定到多个连接, 旧连接关闭后自动解绑
+		t := old.Track()
+		sender, err := pcnew.AddTrack(t)
+		if err != nil {
+			logger.Errorf("sub reconnect add track err, err is %v, sid is %s", err, s.Id)
+			pcnew.Close()
+			return webrtc.SessionDescription{}, err
+		}
+		if t.Kind() == webrtc.RTPCodecTypeAudio {
+			audio = sender
+		} else {
+			video = sender
+		}
+	}
+	dataChans := make(map[string]*webrtc.DataChannel)
+	for label := range s.dataChans {
+		dc, err := pcnew.CreateDataChannel(label, dataChannelInit(label))
+		if err != nil {
+			logger.Errorf("sub reconnect create data channel err, err is %v, sid is %s, label is %s", err, s.Id, label)
+			pcnew.Close()
+			return webrtc.SessionDescription{}, err
+		}
+		dataChans[label] = dc
+	}
+
+	old := &Sub{pc: s.pc, TrackAudio: s.TrackAudio, TrackVideo: s.TrackVideo, dataChans: s.dataChans}
+	s.pc, s.TrackAudio, s.TrackVideo = pcnew, audio, video
+	s.setDataChans(dataChans)
+	s.bindPC(pcnew)
+	answer, err := s.Answer(offer)
+	if err != nil {
+		s.pc, s.TrackAudio, s.TrackVideo = old.pc, old.TrackAudio, old.TrackVideo
+		s.setDataChans(old.dataChans)
+		pcnew.Close()
+		return webrtc.SessionDescription{}, err
+	}
+	// 重新计算宽限期, 等待新连接建立
+	s.lock.Lock()
+	s.alive = false
+	s.downTime = time.Now()
+	s.lock.Unlock()
+	s.needKey = true
+	old.pc.Close()
+	logger.Debugf("sub reconnect, sid is %s", s.Id)
+	return answer, nil
+}
+
 // Close 关闭Sub
 func (s *Sub) Close() {
 	logger.Debugf("sub close = %s", s.Id)
+	s.lock.Lock()
 	s.stop = true
+	s.lock.Unlock()
+	s.dataLock.Lock()
+	s.closeData()
+	s.dataLock.Unlock()
 	s.pc.Close()
 	close(s.RtcpAudioCh)
 	close(s.RtcpVideoCh)
 }
 
-// AddTrack 增加Track
-func (s *Sub) AddTrack(remoteTrack *webrtc.Track) error {
-	track, err := s.pc.NewTrack(remoteTrack.PayloadType(), remoteTrack.SSRC(), remoteTrack.ID(), remoteTrack.Label())
+// AddTrack 按发布者track的参数增加转发用的Track
+func (s *Sub) AddTrack(remoteTrack *TrackInfo) error {
+	track, err := webrtc.NewTrackLocalStaticRTP(remoteTrack.Codec, remoteTrack.ID, remoteTrack.StreamID)
 	if err != nil {
 		logger.Errorf("sub new track err, err is %v, sid is %s", err, s.Id)
 		return err
@@ -104,15 +235,127 @@ func (s *Sub) AddTrack(remoteTrack *webrtc.Track) error {
 		logger.Errorf("sub add track err, err is %v, sid is %s", err, s.Id)
 		return err
 	}
-	if remoteTrack.Kind() == webrtc.RTPCodecTypeAudio {
+	if remoteTrack.Kind == webrtc.RTPCodecTypeAudio {
 		s.TrackAudio = sender
 	}
-	if remoteTrack.Kind() == webrtc.RTPCodecTypeVideo {
+	if remoteTrack.Kind == webrtc.RTPCodecTypeVideo {
 		s.TrackVideo = sender
+		s.needKey = true
+	}
+	return nil
+}
+
+// AddMixTrack 增加混音后的音频track
+func (s *Sub) AddMixTrack(label string) error {
+	track, err := webrtc.NewTrackLocalStaticSample(opusCodec, "mix", label)
+	if err != nil {
+		logger.Errorf("sub new mix track err, err is %v, sid is %s", err, s.Id)
+		return err
+	}
+	sender, err := s.pc.AddTrack(track)
+	if err != nil {
+		logger.Errorf("sub add mix track err, err is %v, sid is %s", err, s.Id)
+		return err
 	}
+	s.TrackAudio = sender
 	return nil
 }
 
+// AddDataChannels 创建可靠和不可靠两个数据通道, 用于转发发布者的消息
+func (s *Sub) AddDataChannels() error {
+	for _, label := range []string{DataLabelReliable, DataLabelUnreliable} {
+		dc, err := s.pc.CreateDataChannel(label, dataChannelInit(label))
+		if err != nil {
+			logger.Errorf("sub create data channel err, err is %v, sid is %s, label is %s", err, s.Id, label)
+			return err
+		}
+		s.dataLock.Lock()
+		s.dataChans[label] = dc
+		s.dataLock.Unlock()
+	}
+	s.dataLock.Lock()
+	defer s.dataLock.Unlock()
+	if s.dataCh == nil && !s.dataClosed {
+		s.dataCh = make(chan *DataMsg, maxSubDataChanSize)
+		go s.doDataWork(s.dataCh)
+	}
+	return nil
+}
+
+// HasData 是否有数据通道
+func (s *Sub) HasData() bool {
+	s.dataLock.Lock()
+	defer s.dataLock.Unlock()
+	return len(s.dataChans) > 0 && !s.dataClosed
+}
+
+// setDataChans 替换数据通道, 重建连接时使用
+func (s *Sub) setDataChans(dataChans map[string]*webrtc.DataChannel) {
+	s.dataLock.Lock()
+	s.dataChans = dataChans
+	s.dataLock.Unlock()
+}
+
+// UID 订阅者的uid
+func (s *Sub) UID() string {
+	return proto.GetUIDFromMID(s.Id)
+}
+
+// WriteData 数据通道消息放入发送队列
+// 队列满时不可靠通道的消息直接丢弃, 可靠通道无法保证送达则关闭该订阅者的数据通道
+func (s *Sub) WriteData(msg *DataMsg) error {
+	s.dataLock.Lock()
+	defer s.dataLock.Unlock()
+	if s.dataClosed || s.dataCh == nil {
+		return errors.New("sub data channel is closed")
+	}
+	select {
+	case s.dataCh <- msg:
+		return nil
+	default:
+	}
+	if msg.Label == DataLabelUnreliable {
+		return errors.New("sub data queue is full, message dropped")
+	}
+	s.closeData()
+	for _, dc := range s.dataChans {
+		dc.Close()
+	}
+	return errors.New("sub data queue is full, data channel closed")
+}
+
+// closeData 停止接收数据通道消息, 调用者需要持有dataLock
+func (s *Sub) closeData() {
+	if s.dataClosed {
+		return
+	}
+	s.dataClosed = true
+	if s.dataCh != nil {
+		close(s.dataCh)
+	}
+}
+
+// doDataWork 按顺序发送队列中的消息, 直到队列关闭
+func (s *Sub) doDataWork(ch chan *DataMsg) {
+	for msg := range ch {
+		s.dataLock.Lock()
+		dc := s.dataChans[msg.Label]
+		s.dataLock.Unlock()
+		if dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen {
+			continue
+		}
+		var err error
+		if msg.IsString {
+			err = dc.SendText(string(msg.Data))
+		} else {
+			err = dc.Send(msg.Data)
+		}
+		if err != nil {
+			logger.Debugf("sub write data err, err is %v, sid is %s, label is %s", err, s.Id, msg.Label)
+		}
+	}
+}
+
 // Answer 交换SDP
 func (s *Sub) Answer(offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
 	err := s.pc.SetRemoteDescription(offer)
@@ -126,59 +369,70 @@ func (s *Sub) Answer(offer webrtc.SessionDescription) (webrtc.SessionDescription
 		logger.Errorf("sub create sdp err, err is %v, sid is %s", err, s.Id)
 		return webrtc.SessionDescription{}, err
 	}
+	gathered := webrtc.GatheringCompletePromise(s.pc)
 	err = s.pc.SetLocalDescription(sdp)
 	if err != nil {
 		logger.Errorf("sub set sdp err, err is %v, sid is %s", err, s.Id)
 		return webrtc.SessionDescription{}, err
 	}
-	return sdp, nil
+	// 没有trickle, 等候选地址收集完再返回answer
+	<-gathered
+	return *s.pc.LocalDescription(), nil
 }
 
-// DoAudioRtcp 接收音频RTCP包
-func (s *Sub) DoAudioRtcp() {
-	if s.TrackAudio != nil {
-		for {
-			if s.stop || !s.alive {
-				return
-			}
+// DoAudioRtcp 接收音频RTCP包, 连接重建后旧的sender退出
+func (s *Sub) DoAudioRtcp(sender *webrtc.RTPSender) {
+	if sender == nil {
+		return
+	}
+	for {
+		if !s.active() || s.TrackAudio != sender {
+			return
+		}
 
-			rtcps, err := s.TrackAudio.ReadRTCP()
-			if err != nil {
-				if err == io.EOF {
-					s.alive = false
+		rtcps, _, err := sender.ReadRTCP()
+		if err != nil {
+			if err == io.EOF {
+				if s.TrackAudio == sender {
+					s.setDown()
 				}
-			} else {
-				for _, rtcp := range rtcps {
-					if s.stop || !s.alive {
-						return
-					}
-					s.RtcpAudioCh <- rtcp
+				return
+			}
+		} else {
+			for _, rtcp := range rtcps {
+				if !s.active() || s.TrackAudio != sender {
+					return
 				}
+				s.RtcpAudioCh <- rtcp
 			}
 		}
 	}
 }
 
-// DoVideoRtcp 接收视频RTCP包
-func (s *Sub) DoVideoRtcp() {
-	if s.TrackVideo != nil {
-		for {
-			if s.stop || !s.alive {
-				return
-			}
+// DoVideoRtcp 接收视频RTCP包, 连接重建后旧的sender退出
+func (s *Sub) DoVideoRtcp(sender *webrtc.RTPSender) {
+	if sender == nil {
+		return
+	}
+	for {
+		if !s.active() || s.TrackVideo != sender {
+			return
+		}
 
-			rtcps, err := s.TrackVideo.ReadRTCP()
-			if err != nil {
-				if err == io.EOF {
-					s.alive = false
+		rtcps, _, err := sender.ReadRTCP()
+		if err != nil {
+			if err == io.EOF {
+				if s.TrackVideo == sender {
+					s.setDown()
 				}
-			} else {
-				for _, rtcp := range rtcps {
-					if s.stop || !s.alive {
-						return
-					}
-					s.RtcpVideoCh <- rtcp
+				return
+			}
+		} else {
+			for _, rtcp := range rtcps {
+				if !s.active() || s.TrackVideo != sender {
+					return
 				}
+				s.RtcpVideoCh <- rtcp
 			}
 		}
 	}
@@ -202,22 +456,44 @@ func (s *Sub) ReadVideoRTCP() (rtcp.Packet, error) {
 	return pkt, nil
 }
 
+// rtpTrack 获取sender上转发RTP包的track, 发送时ssrc和负载类型改写成和订阅者协商的值,
+// 发布者重建连接后ssrc变化, 订阅者收到的ssrc保持不变
+func rtpTrack(sender *webrtc.RTPSender) *webrtc.TrackLocalStaticRTP {
+	if sender == nil {
+		return nil
+	}
+	track, _ := sender.Track().(*webrtc.TrackLocalStaticRTP)
+	return track
+}
+
 // WriteAudioRTP 写音频包
 func (s *Sub) WriteAudioRTP(pkt *rtp.Packet) error {
-	if s.TrackAudio != nil && s.TrackAudio.Track() != nil && !s.stop && !s.alive {
-		return s.TrackAudio.Track().WriteRTP(pkt)
+	if track := rtpTrack(s.TrackAudio); track != nil && s.active() {
+		return track.WriteRTP(pkt)
 	}
 	return errors.New("sub audio track is nil or peer not connect")
 }
 
 // WriteVideoRTP 写视频包
 func (s *Sub) WriteVideoRTP(pkt *rtp.Packet) error {
-	if s.TrackVideo != nil && s.TrackVideo.Track() != nil && !s.stop && !s.alive {
-		return s.TrackVideo.Track().WriteRTP(pkt)
+	if track := rtpTrack(s.TrackVideo); track != nil && s.active() {
+		return track.WriteRTP(s.videoSeq.rewrite(pkt))
 	}
 	return errors.New("sub video track is nil or peer not connect")
 }
 
+// WriteAudioSample 写编码后的音频帧
+func (s *Sub) WriteAudioSample(data []byte, samples uint32) error {
+	if s.TrackAudio == nil || !s.active() {
+		return errors.New("sub audio track is nil or peer not connect")
+	}
+	track, ok := s.TrackAudio.Track().(*webrtc.TrackLocalStaticSample)
+	if !ok {
+		return errors.New("sub audio track is not a sample track")
+	}
+	return track.WriteSample(media.Sample{Data: data, Duration: time.Duration(samples) * time.Second / mixSampleRate})
+}
+
 // return write error
 func (s *Sub) WriteErrTotal() int {
 	return s.writeErrcnt
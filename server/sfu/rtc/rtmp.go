@@ -0,0 +1,162 @@
+package rtc
+
+import (
+	"errors"
+	"fmt"
+	"goRTCServer/pkg/logger"
+	"goRTCServer/pkg/proto"
+	"goRTCServer/pkg/utils"
+	"goRTCServer/server/sfu/conf"
+	"math"
+	neturl "net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	rtmpSinkFlag = "rtmp_"
+	rtmpWidth    = 1280
+	rtmpHeight   = 720
+)
+
+var (
+	egresses   = make(map[string]*RTMPEgress)
+	egressLock sync.Mutex
+)
+
+// RTMPEgress 把一个或多个Router合成后推到RTMP地址, ffmpeg退出后自动重连
+type RTMPEgress struct {
+	*ffmpegProc
+	Id   string
+	URL  string
+	Rid  string   // 所在房间
+	Mids []string // 开启时合成的流, signal据此检查停止和查询的权限
+}
+
+// validRTMPURL 检查推流地址, 只允许推到[rtmp] allow中的rtmp/rtmps服务器
+func validRTMPURL(url string) error {
+	u, err := neturl.Parse(url)
+	if err != nil || (u.Scheme != "rtmp" && u.Scheme != "rtmps") || u.Host == "" {
+		return fmt.Errorf("invalid rtmp url %s", url)
+	}
+	for _, host := range conf.RTMP.Allow {
+		if host == u.Host || host == u.Hostname() {
+			return nil
+		}
+	}
+	return fmt.Errorf("rtmp host %s is not allowed", u.Host)
+}
+
+// StartRTMP 开启RTMP推流
+func StartRTMP(url string, routers []*Router) (*RTMPEgress, error) {
+	if err := validRTMPURL(url); err != nil {
+		return nil, err
+	}
+	if len(routers) == 0 {
+		return nil, errors.New("rtmp no router")
+	}
+	eid := rtmpSinkFlag + utils.RandStr(8)
+	output := func(inputs []*ffmpegInput) []string {
+		return rtmpArgs(inputs, url)
+	}
+	proc, err := newFFmpegProc(eid, routers, output, true)
+	if err != nil {
+		return nil, err
+	}
+	e := &RTMPEgress{ffmpegProc: proc, Id: eid, URL: url}
+	for _, r := range routers {
+		rid, _, mid := proto.ParseMediaPubKey(r.Id)
+		e.Rid = rid
+		e.Mids = append(e.Mids, mid)
+	}
+	egressLock.Lock()
+	egresses[eid] = e
+	egressLock.Unlock()
+	// 所有Router都销毁后移除
+	proc.onClose = func() {
+		egressLock.Lock()
+		delete(egresses, eid)
+		egressLock.Unlock()
+	}
+	logger.Debugf("rtmp egress start, eid is %s, url is %s, routers is %d", eid, url, len(routers))
+	return e, nil
+}
+
+// GetRTMP 获取房间中的RTMP推流, 不在该房间时返回nil
+func GetRTMP(rid, eid string) *RTMPEgress {
+	egressLock.Lock()
+	defer egressLock.Unlock()
+	if e := egresses[eid]; e != nil && e.Rid == rid {
+		return e
+	}
+	return nil
+}
+
+// StopRTMP 停止房间中的RTMP推流
+func StopRTMP(rid, eid string) bool {
+	e := GetRTMP(rid, eid)
+	if e == nil {
+		return false
+	}
+	logger.Debugf("rtmp egress stop, eid is %s", eid)
+	e.Close()
+	return true
+}
+
+// StopAllRTMP 停止所有RTMP推流
+func StopAllRTMP() {
+	egressLock.Lock()
+	list := make([]*RTMPEgress, 0, len(egresses))
+	for _, e := range egresses {
+		list = append(list, e)
+	}
+	egressLock.Unlock()
+	for _, e := range list {
+		e.Close()
+	}
+}
+
+// rtmpArgs 生成ffmpeg输出参数, 多路视频按网格拼接, 多路音频混音
+func rtmpArgs(inputs []*ffmpegInput, url string) []string {
+	videos, audios := make([]int, 0), make([]int, 0)
+	for i, in := range inputs {
+		if in.hasVideo {
+			videos = append(videos, i)
+		}
+		if in.hasAudio {
+			audios = append(audios, i)
+		}
+	}
+
+	filters := make([]string, 0)
+	args := make([]string, 0)
+	if len(videos) > 0 {
+		cols := int(math.Ceil(math.Sqrt(float64(len(videos)))))
+		rows := (len(videos) + cols - 1) / cols
+		w, h := rtmpWidth/cols/2*2, rtmpHeight/rows/2*2
+		labels := ""
+		layout := make([]string, 0, len(videos))
+		for n, i := range videos {
+			filters = append(filters, fmt.Sprintf("[%d:v]scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2[v%d]", i, w, h, w, h, n))
+			labels += fmt.Sprintf("[v%d]", n)
+			layout = append(layout, fmt.Sprintf("%d_%d", n%cols*w, n/cols*h))
+		}
+		if len(videos) == 1 {
+			filters = append(filters, "[v0]null[vout]")
+		} else {
+			filters = append(filters, fmt.Sprintf("%sxstack=inputs=%d:layout=%s:fill=black[vout]", labels, len(videos), strings.Join(layout, "|")))
+		}
+		args = append(args, "-map", "[vout]",
+			"-c:v", "libx264", "-preset", "veryfast", "-tune", "zerolatency", "-pix_fmt", "yuv420p",
+			"-b:v", "2500k", "-maxrate", "2500k", "-bufsize", "5000k", "-g", "60", "-r", "30")
+	}
+	if len(audios) > 0 {
+		labels := ""
+		for _, i := range audios {
+			labels += fmt.Sprintf("[%d:a]", i)
+		}
+		filters = append(filters, fmt.Sprintf("%samix=inputs=%d:dropout_transition=0[aout]", labels, len(audios)))
+		args = append(args, "-map", "[aout]", "-c:a", "aac", "-ar", "44100", "-b:a", "128k")
+	}
+	return append([]string{"-filter_complex", strings.Join(filters, ";")}, append(args, "-f", "flv", url)...)
+}
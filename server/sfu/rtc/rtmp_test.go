@@ -0,0 +1,76 @@
+package rtc
+
+import (
+	"goRTCServer/pkg/proto"
+	"goRTCServer/server/sfu/conf"
+	"strings"
+	"testing"
+)
+
+func TestValidRTMPURL(t *testing.T) {
+	old := conf.RTMP.Allow
+	defer func() { conf.RTMP.Allow = old }()
+	conf.RTMP.Allow = []string{"live.example.com", "127.0.0.1:1935"}
+
+	cases := []struct {
+		url string
+		ok  bool
+	}{
+		{"rtmp://live.example.com/app/key", true},
+		{"rtmps://live.example.com:443/app/key", true},
+		{"rtmp://127.0.0.1:1935/live/test", true},
+		{"rtmp://127.0.0.1:1936/live/test", false},
+		{"rtmp://live.example.com.evil.com/app/key", false},
+		{"rtmp://other.example.com/app/key", false},
+		{"/tmp/out.flv", false},
+		{"/etc/passwd.flv", false},
+		{"file:///tmp/out.flv", false},
+		{"http://live.example.com/app/key", false},
+		{"rtmp:///app/key", false},
+	}
+	for _, c := range cases {
+		if err := validRTMPURL(c.url); (err == nil) != c.ok {
+			t.Errorf("validRTMPURL(%q) err = %v, want ok %v", c.url, err, c.ok)
+		}
+	}
+
+	conf.RTMP.Allow = nil
+	if err := validRTMPURL("rtmp://live.example.com/app/key"); err == nil {
+		t.Fatal("rtmp must be denied without an allow list")
+	}
+	if _, err := StartRTMP("/tmp/out.flv", nil); err == nil {
+		t.Fatal("StartRTMP must reject a local path")
+	}
+}
+
+func TestRTMPArgsLayout(t *testing.T) {
+	inputs := []*ffmpegInput{{hasAudio: true, hasVideo: true}, {hasAudio: true}, {hasVideo: true}}
+	args := rtmpArgs(inputs, "rtmp://live.example.com/app/key")
+	filter := args[1]
+	for _, want := range []string{"[0:v]scale", "[2:v]scale", "xstack=inputs=2", "[0:a][1:a]amix=inputs=2"} {
+		if !strings.Contains(filter, want) {
+			t.Fatalf("filter should contain %q, filter is %s", want, filter)
+		}
+	}
+	if args[len(args)-1] != "rtmp://live.example.com/app/key" || args[len(args)-2] != "flv" {
+		t.Fatalf("output should be flv to the url, args is %v", args)
+	}
+
+	single := rtmpArgs(inputs[2:], "rtmp://live.example.com/app/key")
+	if !strings.Contains(single[1], "[v0]null[vout]") || strings.Contains(single[1], "amix") {
+		t.Fatalf("single video without audio should not stack or mix, filter is %s", single[1])
+	}
+}
+
+func TestHLSURL(t *testing.T) {
+	id := proto.GetMediaPubKey("room", "u1", "u1#ABC")
+	if got := hlsPath(id); got != "room/u1_ABC" {
+		t.Fatalf("hls path should replace # in mid, got %s", got)
+	}
+	url := conf.HLS.URL
+	conf.HLS.URL = "https://cdn.example.com/hls/"
+	defer func() { conf.HLS.URL = url }()
+	if got := HLSURL(id); got != "https://cdn.example.com/hls/room/u1_ABC/index.m3u8" {
+		t.Fatalf("unexpected hls url %s", got)
+	}
+}
@@ -0,0 +1,107 @@
+package rtc
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"goRTCServer/pkg/logger"
+	"goRTCServer/pkg/utils"
+	"goRTCServer/server/sfu/conf"
+	"net"
+
+	"github.com/pion/turn/v2"
+)
+
+var turnServer *turn.Server
+
+// StartTURN 启动内置的TURN/STUN服务(UDP+TCP, 可选TLS), 返回对外的地址列表
+func StartTURN() ([]string, error) {
+	publicIP := conf.TURN.PublicIP
+	if publicIP == "" {
+		publicIP = rtpHost()
+	}
+	relayIP := net.ParseIP(publicIP)
+	if relayIP == nil {
+		return nil, fmt.Errorf("invalid turn public ip %s", publicIP)
+	}
+	host := conf.TURN.Host
+	if host == "" {
+		host = publicIP
+	}
+	_, port, err := net.SplitHostPort(conf.TURN.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	relay := func() turn.RelayAddressGenerator {
+		return &turn.RelayAddressGeneratorStatic{RelayAddress: relayIP, Address: "0.0.0.0"}
+	}
+	udpConn, err := net.ListenPacket("udp4", conf.TURN.Listen)
+	if err != nil {
+		return nil, err
+	}
+	tcpListener, err := net.Listen("tcp4", conf.TURN.Listen)
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+	urls := []string{
+		fmt.Sprintf("stun:%s", net.JoinHostPort(host, port)),
+		fmt.Sprintf("turn:%s?transport=udp", net.JoinHostPort(host, port)),
+		fmt.Sprintf("turn:%s?transport=tcp", net.JoinHostPort(host, port)),
+	}
+	listeners := []turn.ListenerConfig{{Listener: tcpListener, RelayAddressGenerator: relay()}}
+	if conf.TURN.Cert != "" && conf.TURN.Key != "" {
+		cert, err := tls.LoadX509KeyPair(conf.TURN.Cert, conf.TURN.Key)
+		if err != nil {
+			udpConn.Close()
+			tcpListener.Close()
+			return nil, err
+		}
+		tlsListener, err := tls.Listen("tcp4", conf.TURN.TLSListen, &tls.Config{Certificates: []tls.Certificate{cert}})
+		if err != nil {
+			udpConn.Close()
+			tcpListener.Close()
+			return nil, err
+		}
+		_, tlsPort, _ := net.SplitHostPort(conf.TURN.TLSListen)
+		listeners = append(listeners, turn.ListenerConfig{Listener: tlsListener, RelayAddressGenerator: relay()})
+		urls = append(urls, fmt.Sprintf("turns:%s?transport=tcp", net.JoinHostPort(host, tlsPort)))
+	}
+
+	secret := conf.TURN.Secret
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm: conf.TURN.Realm,
+		// 账号由signal用共享密钥签发, 过期后拒绝
+		AuthHandler: func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+			password, ok := utils.CheckTURNCredential(secret, username)
+			if !ok {
+				logger.Debugf("turn auth failed, username is %s, addr is %v", username, srcAddr)
+				return nil, false
+			}
+			return turn.GenerateAuthKey(username, realm, password), true
+		},
+		PacketConnConfigs: []turn.PacketConnConfig{{PacketConn: udpConn, RelayAddressGenerator: relay()}},
+		ListenerConfigs:   listeners,
+	})
+	if err != nil {
+		udpConn.Close()
+		for _, l := range listeners {
+			l.Listener.Close()
+		}
+		return nil, err
+	}
+	turnServer = server
+	logger.Debugf("turn server start, listen is %s, urls is %v", conf.TURN.Listen, urls)
+	return urls, nil
+}
+
+// StopTURN 关闭内置的TURN服务
+func StopTURN() error {
+	if turnServer == nil {
+		return errors.New("turn server not start")
+	}
+	err := turnServer.Close()
+	turnServer = nil
+	return err
+}
@@ -1,62 +1,120 @@
 package src
 
 import (
+	"goRTCServer/pkg/bus"
+	"goRTCServer/pkg/discovery"
 	"goRTCServer/pkg/etcd"
 	"goRTCServer/pkg/logger"
 	"goRTCServer/pkg/proto"
 	"goRTCServer/pkg/utils"
 	"goRTCServer/server/sfu/conf"
 	"goRTCServer/server/sfu/rtc"
+	"log"
 	"net/http"
 	"strings"
 	"time"
-
-	nprotoo "github.com/cloudwebrtc/nats-protoo"
-	"github.com/sirupsen/logrus"
 )
 
 const statCycle = 10 * time.Second
 
 var (
-	sfuNode *etcd.ServiceNode
-	sfuNats *nprotoo.NatsProtoo
-	caster  *nprotoo.Broadcaster
+	sfuNode  discovery.Registrar
+	sfuBus   bus.Bus
+	caster   bus.Broadcaster
+	stopConf func()
 )
 
-func init() {
-	logger.DoInit(conf.Kafka.URL, "dev_rtc_sfu")
-	logger.SetLevel(logrus.DebugLevel)
+// Start 启动服务, 使用nats, 服务注册按配置使用etcd或静态配置
+func Start() {
+	node, err := newRegistrar()
+	if err != nil {
+		log.Fatalf("sfu start err, err is %v", err)
+	}
+	StartWith(bus.NewNats(conf.Nats.URL), node)
 }
 
-// start 启动服务
-func Start() {
+// newRegistrar 根据配置新建服务注册对象
+func newRegistrar() (discovery.Registrar, error) {
+	if conf.Discovery.Type == "static" {
+		return discovery.NewStatic(conf.StaticNodes()).NewNode(conf.Global.NodeDC, conf.Global.NodeID, conf.Global.Name), nil
+	}
+	node, err := etcd.NewServiceNode(conf.Etcd.Adds, conf.Global.NodeDC, conf.Global.NodeID, conf.Global.Name)
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// StartWith 使用指定的消息总线和服务注册启动服务
+func StartWith(b bus.Bus, node discovery.Registrar) {
+	logger.DoInit(conf.Kafka.URL, "dev_rtc_sfu")
+	logger.SetLevel(conf.GetLogLevel())
 	// 服务注册
-	sfuNode = etcd.NewServiceNode(conf.Etcd.Adds, conf.Global.NodeDC, conf.Global.NodeID, conf.Global.Name)
+	sfuNode = node
+	// 启动内置TURN, 地址随节点信息注册, 由signal下发给客户端
+	if conf.TURN.Enable {
+		urls, err := rtc.StartTURN()
+		if err != nil {
+			logger.Errorf("start turn server err, err is %v", err)
+		} else {
+			sfuNode.SetTURN(urls)
+		}
+	}
 	sfuNode.RegisterNode()
 	// 消息注册
-	sfuNats = nprotoo.NewNatsProtoo(conf.Nats.URL)
-	sfuNats.OnRequest(sfuNode.GetRPCChannel(), handleRPCRequest)
+	sfuBus = b
+	sfuBus.OnRequest(sfuNode.GetRPCChannel(), handleRPCRequest)
 	// 消息广播
-	caster = sfuNats.NewBroadcaster(sfuNode.GetEventChannel())
+	caster = sfuBus.NewBroadcaster(sfuNode.GetEventChannel())
 	// 启动RTC
 	rtc.InitRTC()
 	// 启动调试
 	if conf.Global.Pprof != "" {
 		go debug()
 	}
+	// 启动HLS http服务
+	if conf.HLS.HTTP != "" {
+		go rtc.ServeHLS(conf.HLS.HTTP)
+	}
+	// 配置热加载
+	stop, err := conf.Watch(onConfigReload)
+	if err != nil {
+		logger.Errorf("watch config err, err is %v", err)
+	}
+	stopConf = stop
 	// 启动其他
 	go CheckRTC()
 	go UpdatePaylaod()
 }
 
+// onConfigReload 配置重新加载后更新日志级别和ICE服务, 记录变化的配置项
+func onConfigReload(changed, restart []string, err error) {
+	if err != nil {
+		logger.Errorf("config reload failed, keep current config, err is %v", err)
+		return
+	}
+	logger.SetLevel(conf.GetLogLevel())
+	rtc.LoadICEServers()
+	logger.Infof("config reloaded, changed %v", changed)
+	if len(restart) > 0 {
+		logger.Warnf("config changed but need restart to take effect, keys %v", restart)
+	}
+}
+
 // Stop 关闭连接
 func Stop() {
+	if stopConf != nil {
+		stopConf()
+	}
 	rtc.FreeRTC()
-	if sfuNats != nil {
-		sfuNats.Close()
+	if conf.TURN.Enable {
+		rtc.StopTURN()
+	}
+	if sfuBus != nil {
+		sfuBus.Close()
 	}
 	if sfuNode != nil {
-		sfuNats.Close()
+		sfuNode.Close()
 	}
 }
 
@@ -82,5 +140,6 @@ func UpdatePaylaod() {
 
 func debug() {
 	logger.Debugf("start sfu pprof on %s", conf.Global.Pprof)
+	http.HandleFunc(statsPath, handleStats)
 	http.ListenAndServe(conf.Global.Pprof, nil)
 }
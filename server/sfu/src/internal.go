@@ -2,25 +2,25 @@ package src
 
 import (
 	"fmt"
+	"goRTCServer/pkg/bus"
+	"goRTCServer/pkg/logger"
 	"goRTCServer/pkg/proto"
 	"goRTCServer/pkg/utils"
 	"goRTCServer/server/sfu/rtc"
-
-	nprotoo "github.com/cloudwebrtc/nats-protoo"
 )
 
 // 处理sfu RPC请求
-func handleRPCMsg(request nprotoo.Request, accept nprotoo.RespondFunc, reject nprotoo.RejectFunc) {
+func handleRPCMsg(request bus.Request, accept bus.RespondFunc, reject bus.RejectFunc) {
 	go handleRPCRequest(request, accept, reject)
 }
 
-func handleRPCRequest(request nprotoo.Request, accept nprotoo.RespondFunc, reject nprotoo.RejectFunc) {
+func handleRPCRequest(request bus.Request, accept bus.RespondFunc, reject bus.RejectFunc) {
 	defer utils.Recover("sfu.handleRPCRequest")
 	method := request.Method
 	data := utils.Unmarshal(string(request.Data))
 
 	var res map[string]interface{}
-	err := &nprotoo.Error{Code: 400, Reason: fmt.Sprintf("Unknown method [%s]", method)}
+	err := &bus.Error{Code: 400, Reason: fmt.Sprintf("Unknown method [%s]", method)}
 
 	if method != "" {
 		switch method {
@@ -32,6 +32,38 @@ func handleRPCRequest(request nprotoo.Request, accept nprotoo.RespondFunc, rejec
 			res, err = SubScribe(data)
 		case proto.SignalToSfuUnSubscribe:
 			res, err = UnSubscribe(data)
+		case proto.SignalToSfuStartMix:
+			res, err = StartMix(data)
+		case proto.SignalToSfuStopMix:
+			res, err = StopMix(data)
+		case proto.SignalToSfuSubMix:
+			res, err = SubscribeMix(data)
+		case proto.SignalToSfuUnSubMix:
+			res, err = UnSubscribeMix(data)
+		case proto.SignalToSfuRTPPublish:
+			res, err = RTPPublish(data)
+		case proto.SignalToSfuRTPForward:
+			res, err = RTPForward(data)
+		case proto.SignalToSfuRTPUnForward:
+			res, err = RTPUnForward(data)
+		case proto.SignalToSfuStartHLS:
+			res, err = StartHLS(data)
+		case proto.SignalToSfuStopHLS:
+			res, err = StopHLS(data)
+		case proto.SignalToSfuStartRTMP:
+			res, err = StartRTMP(data)
+		case proto.SignalToSfuStopRTMP:
+			res, err = StopRTMP(data)
+		case proto.SignalToSfuRTMPStatus:
+			res, err = RTMPStatus(data)
+		case proto.SignalToSfuRestartICE:
+			res, err = RestartICE(data)
+		case proto.SignalToSfuMute:
+			res, err = Mute(data)
+		case proto.SignalToSfuPauseSub:
+			res, err = PauseSub(data)
+		case proto.AdminToSfuDrain:
+			res, err = Drain(data)
 		}
 	}
 	if err != nil {
@@ -45,14 +77,14 @@ func handleRPCRequest(request nprotoo.Request, accept nprotoo.RespondFunc, rejec
 	"method", proto.BizToSfuPublish, "rid", rid, "uid", uid, "jsep", jsep
 */
 // publish 处理推流
-func Publish(msg map[string]interface{}) (map[string]interface{}, *nprotoo.Error) {
+func Publish(msg map[string]interface{}) (map[string]interface{}, *bus.Error) {
 	// 1. 获取参数
 	if msg["jsep"] == nil {
-		return nil, &nprotoo.Error{Code: 401, Reason: "cann't find jsep"}
+		return nil, &bus.Error{Code: 401, Reason: "cann't find jsep"}
 	}
 	jsep, ok := msg["jsep"].(map[string]interface{})
 	if !ok {
-		return nil, &nprotoo.Error{402, "jsep cannot transform to map"}
+		return nil, &bus.Error{Code: 402, Reason: "jsep cannot transform to map"}
 	}
 	sdp := utils.Val(jsep, "sdp")
 	rid := utils.Val(msg, "rid")
@@ -63,12 +95,12 @@ func Publish(msg map[string]interface{}) (map[string]interface{}, *nprotoo.Error
 	key := proto.GetMediaPubKey(rid, uid, mid)
 	router := rtc.GetNewRouter(key)
 	if router == nil {
-		return nil, &nprotoo.Error{403, fmt.Sprintf("cannot get router: %s", key)}
+		return nil, &bus.Error{Code: 403, Reason: fmt.Sprintf("cannot get router: %s", key)}
 	}
 	// 3.增加推流
 	resp, err := router.AddPub(mid, sdp)
 	if err != nil {
-		return nil, &nprotoo.Error{403, fmt.Sprintf("add pub err, err is :%v", err)}
+		return nil, &bus.Error{Code: 403, Reason: fmt.Sprintf("add pub err, err is :%v", err)}
 	}
 	return utils.Map("mid", mid, "jsep", utils.Map("type", "answer", "sdp", resp)), nil
 }
@@ -77,7 +109,7 @@ func Publish(msg map[string]interface{}) (map[string]interface{}, *nprotoo.Error
 	"method", proto.BizToSfuUnPublish, "rid", rid, "mid", mid
 */
 // unpublish 处理取消发布流
-func UnPublish(msg map[string]interface{}) (map[string]interface{}, *nprotoo.Error) {
+func UnPublish(msg map[string]interface{}) (map[string]interface{}, *bus.Error) {
 	// 1.获取参数
 	rid := utils.Val(msg, "rid")
 	mid := utils.Val(msg, "mid")
@@ -93,14 +125,14 @@ func UnPublish(msg map[string]interface{}) (map[string]interface{}, *nprotoo.Err
 	"method", proto.BizToSfuSubscribe, "rid", rid, "suid", suid, "mid", mid, "jsep", jsep
 */
 // subscribe 处理订阅流
-func SubScribe(msg map[string]interface{}) (map[string]interface{}, *nprotoo.Error) {
+func SubScribe(msg map[string]interface{}) (map[string]interface{}, *bus.Error) {
 	// 1. 获取参数
 	if msg["jsep"] == nil {
-		return nil, &nprotoo.Error{Code: 401, Reason: "cann't find jsep"}
+		return nil, &bus.Error{Code: 401, Reason: "cann't find jsep"}
 	}
 	jsep, ok := msg["jsep"].(map[string]interface{})
 	if !ok {
-		return nil, &nprotoo.Error{402, "jsep cannot transform to map"}
+		return nil, &bus.Error{Code: 402, Reason: "jsep cannot transform to map"}
 	}
 	sdp := utils.Val(jsep, "sdp")
 	rid := utils.Val(msg, "rid")
@@ -114,12 +146,12 @@ func SubScribe(msg map[string]interface{}) (map[string]interface{}, *nprotoo.Err
 	key := proto.GetMediaPubKey(rid, uid, mid)
 	router := rtc.GetRouter(key)
 	if router == nil {
-		return nil, &nprotoo.Error{403, fmt.Sprintf("cannot get router: %s", key)}
+		return nil, &bus.Error{Code: 403, Reason: fmt.Sprintf("cannot get router: %s", key)}
 	}
 	// 3.增加拉流
 	resp, err := router.AddSub(sid, sdp)
 	if err != nil {
-		return nil, &nprotoo.Error{403, fmt.Sprintf("add sub error: %v", err)}
+		return nil, &bus.Error{Code: 403, Reason: fmt.Sprintf("add sub error: %v", err)}
 	}
 	return utils.Map("sid", sid, "jsep", utils.Map("type", "answer", "sdp", resp)), nil
 }
@@ -128,7 +160,7 @@ func SubScribe(msg map[string]interface{}) (map[string]interface{}, *nprotoo.Err
 	"method", proto.BizToSfuUnSubscribe, "rid", rid, "mid", mid, "sid", sid
 */
 // unsubscribe 处理取消订阅流
-func UnSubscribe(msg map[string]interface{}) (map[string]interface{}, *nprotoo.Error) {
+func UnSubscribe(msg map[string]interface{}) (map[string]interface{}, *bus.Error) {
 	// 获取参数
 	rid := utils.Val(msg, "rid")
 	mid := utils.Val(msg, "mid")
@@ -139,10 +171,358 @@ func UnSubscribe(msg map[string]interface{}) (map[string]interface{}, *nprotoo.E
 	key := proto.GetMediaPubKey(rid, uid, mid)
 	router := rtc.GetRouter(key)
 	if router == nil {
-		return nil, &nprotoo.Error{Code: 410, Reason: fmt.Sprintf("can't get router:%s", key)}
+		return nil, &bus.Error{Code: 410, Reason: fmt.Sprintf("can't get router:%s", key)}
 	}
 
 	// 删除拉流
 	router.DelSub(sid)
 	return utils.Map(), nil
 }
+
+/*
+	"method", proto.SignalToSfuStartMix, "rid", rid, "topn", topn
+*/
+// StartMix 开启房间混音
+func StartMix(msg map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	rid := utils.Val(msg, "rid")
+	topN := utils.InterfaceToInt(msg["topn"])
+	if topN <= 0 {
+		topN = rtc.DefaultMixTopN
+	}
+	_, err := rtc.StartMixer(rid, topN)
+	if err != nil {
+		return nil, &bus.Error{Code: 404, Reason: fmt.Sprintf("start mixer err: %v", err)}
+	}
+	return utils.Map("rid", rid, "topn", topN), nil
+}
+
+/*
+	"method", proto.SignalToSfuStopMix, "rid", rid
+*/
+// StopMix 关闭房间混音
+func StopMix(msg map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	rid := utils.Val(msg, "rid")
+	rtc.StopMixer(rid)
+	return utils.Map(), nil
+}
+
+/*
+	"method", proto.SignalToSfuSubMix, "rid", rid, "suid", suid, "jsep", jsep
+*/
+// SubscribeMix 订阅房间混音
+func SubscribeMix(msg map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	jsep, ok := msg["jsep"].(map[string]interface{})
+	if !ok {
+		return nil, &bus.Error{Code: 401, Reason: "cann't find jsep"}
+	}
+	sdp := utils.Val(jsep, "sdp")
+	rid := utils.Val(msg, "rid")
+	suid := utils.Val(msg, "suid")
+	sid := fmt.Sprintf("%s#%s", suid, utils.RandStr(6))
+
+	mixer := rtc.GetMixer(rid)
+	if mixer == nil {
+		return nil, &bus.Error{Code: 403, Reason: fmt.Sprintf("cannot get mixer: %s", rid)}
+	}
+	resp, err := mixer.AddSub(sid, sdp)
+	if err != nil {
+		return nil, &bus.Error{Code: 403, Reason: fmt.Sprintf("add mix sub error: %v", err)}
+	}
+	return utils.Map("sid", sid, "jsep", utils.Map("type", "answer", "sdp", resp)), nil
+}
+
+/*
+	"method", proto.SignalToSfuUnSubMix, "rid", rid, "sid", sid
+*/
+// UnSubscribeMix 取消订阅房间混音
+func UnSubscribeMix(msg map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	rid := utils.Val(msg, "rid")
+	sid := utils.Val(msg, "sid")
+	mixer := rtc.GetMixer(rid)
+	if mixer == nil {
+		return nil, &bus.Error{Code: 410, Reason: fmt.Sprintf("can't get mixer:%s", rid)}
+	}
+	mixer.DelSub(sid)
+	return utils.Map(), nil
+}
+
+/*
+	"method", proto.SignalToSfuRTPPublish, "rid", rid, "uid", uid, "audio", true, "video", true, "audiopt", 111, "videopt", 96
+*/
+// RTPPublish 创建普通RTP推流端口
+func RTPPublish(msg map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	rid := utils.Val(msg, "rid")
+	uid := utils.Val(msg, "uid")
+	audio := utils.InterfaceToBool(msg["audio"])
+	video := utils.InterfaceToBool(msg["video"])
+	if !audio && !video {
+		return nil, &bus.Error{Code: 401, Reason: "rtp publish no audio and video"}
+	}
+	// opus和vp8只能使用动态payload type, 不传时使用默认值
+	audioPT := utils.InterfaceToInt(msg["audiopt"])
+	videoPT := utils.InterfaceToInt(msg["videopt"])
+	for _, pt := range []int{audioPT, videoPT} {
+		if pt != 0 && (pt < 96 || pt > 127) {
+			return nil, &bus.Error{Code: 401, Reason: fmt.Sprintf("rtp publish payload type must be 96-127, got %d", pt)}
+		}
+	}
+	mid := fmt.Sprintf("%s#%s", uid, utils.RandStr(6))
+
+	key := proto.GetMediaPubKey(rid, uid, mid)
+	router := rtc.GetNewRouter(key)
+	if router == nil {
+		return nil, &bus.Error{Code: 403, Reason: fmt.Sprintf("cannot get router: %s", key)}
+	}
+	pub, err := router.AddRTPPub(mid, audio, video, uint8(audioPT), uint8(videoPT))
+	if err != nil {
+		rtc.DelRouter(key)
+		return nil, &bus.Error{Code: 403, Reason: fmt.Sprintf("add rtp pub err, err is :%v", err)}
+	}
+	res := utils.Map("mid", mid)
+	audioAddr, videoAddr := pub.RTPAddrs()
+	if audioAddr != nil {
+		res["audio"] = utils.Map("host", audioAddr.Host, "rtpport", audioAddr.RTPPort, "rtcpport", audioAddr.RTCPPort)
+	}
+	if videoAddr != nil {
+		res["video"] = utils.Map("host", videoAddr.Host, "rtpport", videoAddr.RTPPort, "rtcpport", videoAddr.RTCPPort)
+	}
+	return res, nil
+}
+
+/*
+	"method", proto.SignalToSfuRTPForward, "rid", rid, "mid", mid, "host", host, "port", port
+*/
+// RTPForward 将流转发到普通RTP地址
+func RTPForward(msg map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	rid := utils.Val(msg, "rid")
+	mid := utils.Val(msg, "mid")
+	host := utils.Val(msg, "host")
+	port := utils.InterfaceToInt(msg["port"])
+	uid := proto.GetUIDFromMID(mid)
+	if host == "" || port <= 0 {
+		return nil, &bus.Error{Code: 401, Reason: "rtp forward host or port invalid"}
+	}
+
+	key := proto.GetMediaPubKey(rid, uid, mid)
+	router := rtc.GetRouter(key)
+	if router == nil {
+		return nil, &bus.Error{Code: 403, Reason: fmt.Sprintf("cannot get router: %s", key)}
+	}
+	forward, err := rtc.NewRTPForward(router, host, port)
+	if err != nil {
+		return nil, &bus.Error{Code: 403, Reason: fmt.Sprintf("add rtp forward err, err is :%v", err)}
+	}
+	router.AddSink(forward)
+	return utils.Map("fid", forward.ID()), nil
+}
+
+/*
+	"method", proto.SignalToSfuRTPUnForward, "rid", rid, "mid", mid, "fid", fid
+*/
+// RTPUnForward 停止RTP转发
+func RTPUnForward(msg map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	rid := utils.Val(msg, "rid")
+	mid := utils.Val(msg, "mid")
+	fid := utils.Val(msg, "fid")
+	uid := proto.GetUIDFromMID(mid)
+
+	key := proto.GetMediaPubKey(rid, uid, mid)
+	router := rtc.GetRouter(key)
+	if router == nil {
+		return nil, &bus.Error{Code: 410, Reason: fmt.Sprintf("can't get router:%s", key)}
+	}
+	router.DelSink(fid)
+	return utils.Map(), nil
+}
+
+/*
+	"method", proto.SignalToSfuStartHLS, "rid", rid, "mid", mid, "lowlatency", false
+*/
+// StartHLS 开启HLS直播输出
+func StartHLS(msg map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	rid := utils.Val(msg, "rid")
+	mid := utils.Val(msg, "mid")
+	lowLatency := utils.InterfaceToBool(msg["lowlatency"])
+	uid := proto.GetUIDFromMID(mid)
+
+	key := proto.GetMediaPubKey(rid, uid, mid)
+	router := rtc.GetRouter(key)
+	if router == nil {
+		return nil, &bus.Error{Code: 403, Reason: fmt.Sprintf("cannot get router: %s", key)}
+	}
+	// 已经开启则直接返回播放地址
+	if router.GetSink(rtc.HLSSinkID) != nil {
+		return utils.Map("url", rtc.HLSURL(key)), nil
+	}
+	hls, err := rtc.NewHLSOutput(router, lowLatency)
+	if err != nil {
+		return nil, &bus.Error{Code: 403, Reason: fmt.Sprintf("start hls err, err is :%v", err)}
+	}
+	return utils.Map("url", hls.URL), nil
+}
+
+/*
+	"method", proto.SignalToSfuStopHLS, "rid", rid, "mid", mid
+*/
+// StopHLS 关闭HLS直播输出
+func StopHLS(msg map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	rid := utils.Val(msg, "rid")
+	mid := utils.Val(msg, "mid")
+	uid := proto.GetUIDFromMID(mid)
+
+	key := proto.GetMediaPubKey(rid, uid, mid)
+	router := rtc.GetRouter(key)
+	if router == nil {
+		return nil, &bus.Error{Code: 410, Reason: fmt.Sprintf("can't get router:%s", key)}
+	}
+	router.DelSink(rtc.HLSSinkID)
+	return utils.Map(), nil
+}
+
+/*
+	"method", proto.SignalToSfuStartRTMP, "rid", rid, "mids", mids, "url", url
+*/
+// StartRTMP 开启RTMP推流, 多路流合成一路
+func StartRTMP(msg map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	rid := utils.Val(msg, "rid")
+	url := utils.Val(msg, "url")
+	mids := utils.InterfaceToStringArray(msg["mids"])
+	if url == "" || len(mids) == 0 {
+		return nil, &bus.Error{Code: 401, Reason: "rtmp url or mids invalid"}
+	}
+
+	routers := make([]*rtc.Router, 0, len(mids))
+	for _, mid := range mids {
+		key := proto.GetMediaPubKey(rid, proto.GetUIDFromMID(mid), mid)
+		router := rtc.GetRouter(key)
+		if router == nil {
+			return nil, &bus.Error{Code: 403, Reason: fmt.Sprintf("cannot get router: %s", key)}
+		}
+		routers = append(routers, router)
+	}
+	egress, err := rtc.StartRTMP(url, routers)
+	if err != nil {
+		return nil, &bus.Error{Code: 403, Reason: fmt.Sprintf("start rtmp err, err is :%v", err)}
+	}
+	return utils.Map("eid", egress.Id), nil
+}
+
+/*
+	"method", proto.SignalToSfuStopRTMP, "rid", rid, "eid", eid
+*/
+// StopRTMP 停止RTMP推流
+func StopRTMP(msg map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	rid := utils.Val(msg, "rid")
+	eid := utils.Val(msg, "eid")
+	if !rtc.StopRTMP(rid, eid) {
+		return nil, &bus.Error{Code: 410, Reason: fmt.Sprintf("can't get rtmp:%s", eid)}
+	}
+	return utils.Map(), nil
+}
+
+/*
+	"method", proto.SignalToSfuRTMPStatus, "rid", rid, "eid", eid
+*/
+// RTMPStatus 查询RTMP推流状态
+func RTMPStatus(msg map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	rid := utils.Val(msg, "rid")
+	eid := utils.Val(msg, "eid")
+	egress := rtc.GetRTMP(rid, eid)
+	if egress == nil {
+		return nil, &bus.Error{Code: 410, Reason: fmt.Sprintf("can't get rtmp:%s", eid)}
+	}
+	state, inputs, restarts, lastErr := egress.Status()
+	return utils.Map("eid", eid, "rid", rid, "mids", egress.Mids, "url", egress.URL, "state", state, "inputs", inputs, "restarts", restarts, "error", lastErr), nil
+}
+
+/*
+	"method", proto.SignalToSfuRestartICE, "rid", rid, "mid", mid, "sid", sid, "jsep", jsep
+*/
+// RestartICE 重建推流或拉流的连接, 带sid为拉流, 否则为推流
+func RestartICE(msg map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	if msg["jsep"] == nil {
+		return nil, &bus.Error{Code: 401, Reason: "cann't find jsep"}
+	}
+	jsep, ok := msg["jsep"].(map[string]interface{})
+	if !ok {
+		return nil, &bus.Error{Code: 402, Reason: "jsep cannot transform to map"}
+	}
+	sdp := utils.Val(jsep, "sdp")
+	rid := utils.Val(msg, "rid")
+	mid := utils.Val(msg, "mid")
+	sid := utils.Val(msg, "sid")
+	uid := proto.GetUIDFromMID(mid)
+
+	key := proto.GetMediaPubKey(rid, uid, mid)
+	router := rtc.GetRouter(key)
+	if router == nil {
+		return nil, &bus.Error{Code: 403, Reason: fmt.Sprintf("cannot get router: %s", key)}
+	}
+	var resp string
+	var err error
+	if sid != "" {
+		resp, err = router.ReconnectSub(sid, sdp)
+	} else {
+		resp, err = router.ReconnectPub(sdp)
+	}
+	if err != nil {
+		return nil, &bus.Error{Code: 404, Reason: fmt.Sprintf("reconnect error: %v", err)}
+	}
+	return utils.Map("jsep", utils.Map("type", "answer", "sdp", resp)), nil
+}
+
+/*
+	"method", proto.SignalToSfuMute, "rid", rid, "mid", mid, "kind", kind, "mute", mute
+*/
+// Mute 停止/恢复转发推流的音频或视频, 不删除Router
+func Mute(msg map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	rid := utils.Val(msg, "rid")
+	mid := utils.Val(msg, "mid")
+	kind := utils.Val(msg, "kind")
+	mute := utils.InterfaceToBool(msg["mute"])
+	uid := proto.GetUIDFromMID(mid)
+
+	key := proto.GetMediaPubKey(rid, uid, mid)
+	router := rtc.GetRouter(key)
+	if router == nil {
+		return nil, &bus.Error{Code: 403, Reason: fmt.Sprintf("cannot get router: %s", key)}
+	}
+	if err := router.SetMute(kind, mute); err != nil {
+		return nil, &bus.Error{Code: 405, Reason: fmt.Sprintf("mute error: %v", err)}
+	}
+	return utils.Map(), nil
+}
+
+/*
+	"method", proto.SignalToSfuPauseSub, "rid", rid, "mid", mid, "sid", sid, "audio", audio, "video", video
+*/
+// PauseSub 暂停/恢复向订阅者转发音频和视频
+func PauseSub(msg map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	rid := utils.Val(msg, "rid")
+	mid := utils.Val(msg, "mid")
+	sid := utils.Val(msg, "sid")
+	uid := proto.GetUIDFromMID(mid)
+
+	key := proto.GetMediaPubKey(rid, uid, mid)
+	router := rtc.GetRouter(key)
+	if router == nil {
+		return nil, &bus.Error{Code: 403, Reason: fmt.Sprintf("cannot get router: %s", key)}
+	}
+	if err := router.PauseSub(sid, utils.InterfaceToBool(msg["audio"]), utils.InterfaceToBool(msg["video"])); err != nil {
+		return nil, &bus.Error{Code: 410, Reason: fmt.Sprintf("pause sub error: %v", err)}
+	}
+	return utils.Map(), nil
+}
+
+/*
+	"method", proto.AdminToSfuDrain, "drain", true
+*/
+// Drain 排空/恢复节点, 排空后signal不再把新的流分配到本节点, 已有的流不受影响
+func Drain(msg map[string]interface{}) (map[string]interface{}, *bus.Error) {
+	drain := utils.InterfaceToBool(msg["drain"])
+	if err := sfuNode.SetDrain(drain); err != nil {
+		return nil, &bus.Error{Code: 410, Reason: fmt.Sprintf("drain error: %v", err)}
+	}
+	logger.Infof("sfu drain changed, drain is %v", drain)
+	return utils.Map("nodeid", sfuNode.NodeInfo().NodeID, "drain", drain, "load", rtc.GetRouters()), nil
+}
@@ -0,0 +1,49 @@
+package src
+
+import (
+	"encoding/json"
+	"goRTCServer/server/sfu/conf"
+	"goRTCServer/server/sfu/rtc"
+	"net/http"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// statsPath 节点状态查询地址, 挂在pprof端口上
+const statsPath = "/stats"
+
+// Stats 节点状态, cpu为进程累计占用的CPU秒数, 两次采样的差值除以间隔即为CPU使用率
+type Stats struct {
+	DC         string  `json:"dc"`
+	NodeID     string  `json:"nodeid"`
+	Name       string  `json:"name"`
+	Load       int     `json:"load"`
+	CPU        float64 `json:"cpu"`
+	CPUs       int     `json:"cpus"`
+	Goroutines int     `json:"goroutines"`
+	Time       int64   `json:"time"`
+}
+
+// GetStats 获取节点当前状态
+func GetStats() Stats {
+	var usage syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+	cpu := time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+	return Stats{
+		DC:         conf.Global.NodeDC,
+		NodeID:     conf.Global.NodeID,
+		Name:       conf.Global.Name,
+		Load:       rtc.GetRouters(),
+		CPU:        cpu.Seconds(),
+		CPUs:       runtime.NumCPU(),
+		Goroutines: runtime.NumGoroutine(),
+		Time:       time.Now().UnixNano() / int64(time.Millisecond),
+	}
+}
+
+// handleStats 返回节点状态
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetStats())
+}
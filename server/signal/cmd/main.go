@@ -1,12 +1,24 @@
 package main
 
-import "goRTCServer/server/signal/src"
+import (
+	"goRTCServer/server/signal/conf"
+	"goRTCServer/server/signal/src"
+	"os"
+	"os/signal"
+	"syscall"
+)
 
 func close() {
 	src.Stop()
 }
 func main() {
+	conf.Init()
 	defer close()
 	src.Start()
-	select {}
+	// 收到退出信号后优雅关闭, 再次收到时直接退出
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	<-ch
+	signal.Stop(ch)
+	src.Shutdown()
 }
@@ -1,18 +1,32 @@
 package conf
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"goRTCServer/pkg/confutil"
+	"goRTCServer/pkg/discovery"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
+// hotSections 可以热加载的配置段, 其他配置修改后需要重启
+var hotSections = []string{"log", "ice", "placement"}
+
 var (
 	cfg = config{}
+	// lock 保护可以热加载的配置项
+	lock sync.RWMutex
 	// 全局配置
 	Global = &cfg.Global
+	// Discovery 服务发现设置
+	Discovery = &cfg.Discovery
 	// Etc设置
 	Etcd = &cfg.Etcd
 	// 信令服务设置
@@ -23,13 +37,20 @@ var (
 	Kafka = &cfg.Kafka
 )
 
-func init() {
+// Init 解析命令行参数并加载配置, 失败时退出
+func Init() {
 	if !cfg.parse() {
 		showHelp()
 		os.Exit(-1)
 	}
 }
 
+// Load 加载指定的配置文件, all-in-one模式下各服务分别加载自己的配置
+func Load(file string) bool {
+	cfg.CfgFile = file
+	return cfg.load()
+}
+
 type global struct {
 	Pprof  string `mapstructure:"pprof"`
 	NodeDC string `mapstructure:"dc"`
@@ -42,27 +63,116 @@ type etcd struct {
 }
 
 type nats struct {
-	URL string `mapstructure:"url"`
+	URL     string `mapstructure:"url"`
+	Timeout int    `mapstructure:"timeout"` // RPC请求超时时间, 单位毫秒
 }
 
 type signal struct {
-	Host string `mapstructure:"host"`
-	Port string `mapstructure:"port"`
-	Cert string `mapstructure:"cert"`
-	Key  string `mapstructure:"key"`
+	Host     string   `mapstructure:"host"`
+	Port     string   `mapstructure:"port"`
+	Cert     string   `mapstructure:"cert"` // 证书和私钥都配置时使用WSS, 文件变化时自动重新加载
+	Key      string   `mapstructure:"key"`
+	Redirect string   `mapstructure:"redirect"` // 使用WSS时在该端口把http重定向到https
+	Origins  []string `mapstructure:"origins"`  // 允许的websocket Origin, 为空时只允许同源
+	URL      string   `mapstructure:"url"`      // 客户端连接本节点的地址, 其他节点关闭时推荐给客户端
+	Shutdown int      `mapstructure:"shutdown"` // 关闭时等待客户端重连到其他节点的时间, 单位秒
+}
+
+type iceserver struct {
+	URLS       []string `mapstructure:"urls"`
+	Username   string   `mapstructure:"username"`
+	Credential string   `mapstructure:"credential"`
+	HMAC       bool     `mapstructure:"hmac"` // 使用secret签发TURN REST API格式的临时账号
+}
+
+type icedc struct {
+	Servers []iceserver `mapstructure:"server"`
+}
+
+type ice struct {
+	Secret  string           `mapstructure:"secret"`
+	TTL     int              `mapstructure:"ttl"`
+	Servers []iceserver      `mapstructure:"server"`
+	DC      map[string]icedc `mapstructure:"dc"` // 按区域覆盖Servers
+}
+
+// GetICE 获取ICE服务设置的密钥和有效期(秒)
+func GetICE() (secret string, ttl int) {
+	lock.RLock()
+	defer lock.RUnlock()
+	return cfg.ICE.Secret, cfg.ICE.TTL
+}
+
+// GetICEServers 获取指定区域的ICE服务, 没有区域配置则使用默认配置
+func GetICEServers(dc string) []iceserver {
+	lock.RLock()
+	defer lock.RUnlock()
+	if d, ok := cfg.ICE.DC[strings.ToLower(dc)]; ok {
+		return d.Servers
+	}
+	return cfg.ICE.Servers
+}
+
+type logcfg struct {
+	Level string `mapstructure:"level"` // debug(默认)、info、warn、error
+}
+
+// GetLogLevel 获取日志级别
+func GetLogLevel() logrus.Level {
+	lock.RLock()
+	defer lock.RUnlock()
+	level, _ := logrus.ParseLevel(cfg.Log.Level)
+	return level
+}
+
+type placement struct {
+	Strategy string `mapstructure:"strategy"` // 新的流分配sfu的策略: load(默认, 本区域负载最低)或random(本区域随机)
+}
+
+// GetPlacement 获取sfu分配策略
+func GetPlacement() string {
+	lock.RLock()
+	defer lock.RUnlock()
+	return cfg.Placement.Strategy
 }
 
 type kafka struct {
 	URL string `mapstructure:"url"`
 }
 
+type staticnode struct {
+	NodeDC string   `mapstructure:"dc"`
+	NodeID string   `mapstructure:"id"`
+	Name   string   `mapstructure:"name"`
+	TURN   []string `mapstructure:"turn"`
+	URL    string   `mapstructure:"url"` // signal节点的客户端连接地址
+}
+
+type discoverycfg struct {
+	Type  string       `mapstructure:"type"` // etcd(默认)或static
+	Nodes []staticnode `mapstructure:"node"` // static时所有节点的列表
+}
+
+// StaticNodes 静态配置的所有节点
+func StaticNodes() []discovery.Node {
+	nodes := make([]discovery.Node, 0, len(cfg.Discovery.Nodes))
+	for _, n := range cfg.Discovery.Nodes {
+		nodes = append(nodes, discovery.Node{NodeDC: n.NodeDC, NodeID: n.NodeID, Name: n.Name, TURN: strings.Join(n.TURN, ","), URL: n.URL})
+	}
+	return nodes
+}
+
 type config struct {
-	Global  global `mapstructure:"global"`
-	Etcd    etcd   `mapstructure:"etcd"`
-	Nats    nats   `mapstructure:"nats"`
-	Signal  signal `mapstructure:"signal"`
-	Kafka   kafka  `mapstructure:"kafka"`
-	CfgFile string
+	Global    global       `mapstructure:"global"`
+	Discovery discoverycfg `mapstructure:"discovery"`
+	Etcd      etcd         `mapstructure:"etcd"`
+	Nats      nats         `mapstructure:"nats"`
+	Signal    signal       `mapstructure:"signal"`
+	Kafka     kafka        `mapstructure:"kafka"`
+	ICE       ice          `mapstructure:"ice"`
+	Log       logcfg       `mapstructure:"log"`
+	Placement placement    `mapstructure:"placement"`
+	CfgFile   string
 }
 
 func showHelp() {
@@ -72,26 +182,161 @@ func showHelp() {
 }
 
 func (c *config) load() bool {
-	_, err := os.Stat(c.CfgFile)
+	n, err := read(c.CfgFile)
 	if err != nil {
+		log.Printf("config file %s load failed. %v\n", c.CfgFile, err)
 		return false
 	}
+	lock.Lock()
+	*c = *n
+	lock.Unlock()
+	fmt.Printf("config %s load successed\n", c.CfgFile)
+	return true
+}
 
-	viper.SetConfigFile(c.CfgFile)
-	viper.SetConfigType("toml")
+// read 读取配置文件, 环境变量覆盖文件中的配置, 填充默认值并校验
+func read(file string) (*config, error) {
+	if _, err := os.Stat(file); err != nil {
+		return nil, err
+	}
+	v := viper.New()
+	v.SetConfigFile(file)
+	v.SetConfigType("toml")
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	c := &config{CfgFile: file}
+	confutil.BindEnv(v, "signal", c)
+	if err := v.UnmarshalExact(c); err != nil {
+		return nil, err
+	}
+	if c.ICE.TTL <= 0 {
+		c.ICE.TTL = 86400
+	}
+	if c.Nats.Timeout <= 0 {
+		c.Nats.Timeout = 15000
+	}
+	if c.Signal.Shutdown <= 0 {
+		c.Signal.Shutdown = 30
+	}
+	if c.Discovery.Type == "" {
+		c.Discovery.Type = "etcd"
+	}
+	if c.Log.Level == "" {
+		c.Log.Level = "debug"
+	}
+	if c.Placement.Strategy == "" {
+		c.Placement.Strategy = "load"
+	}
+	if errs := c.validate(); len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "; "))
+	}
+	return c, nil
+}
 
-	err = viper.ReadInConfig()
-	if err != nil {
-		log.Printf("config file %s read failed. err is %v\n", c.CfgFile, err)
-		return false
+// validate 校验配置, 返回所有错误, 每个错误都带配置项名称
+func (c *config) validate() []string {
+	errs := make([]string, 0)
+	if c.Global.NodeDC == "" || c.Global.NodeID == "" || c.Global.Name == "" {
+		errs = append(errs, "global.dc, global.id and global.name must be non empty")
+	}
+	if port, err := strconv.Atoi(c.Signal.Port); err != nil || port <= 0 || port > 65535 {
+		errs = append(errs, fmt.Sprintf("signal.port must be a port number, got %q", c.Signal.Port))
+	}
+	if (c.Signal.Cert == "") != (c.Signal.Key == "") {
+		errs = append(errs, "signal.cert and signal.key must be set together")
+	}
+	for key, file := range map[string]string{"signal.cert": c.Signal.Cert, "signal.key": c.Signal.Key} {
+		if _, err := os.Stat(file); file != "" && err != nil {
+			errs = append(errs, fmt.Sprintf("%s %v", key, err))
+		}
+	}
+	if c.Signal.Redirect != "" {
+		if port, err := strconv.Atoi(c.Signal.Redirect); err != nil || port <= 0 || port > 65535 {
+			errs = append(errs, fmt.Sprintf("signal.redirect must be a port number, got %q", c.Signal.Redirect))
+		}
+		if c.Signal.Cert == "" {
+			errs = append(errs, "signal.redirect needs signal.cert and signal.key")
+		}
+	}
+	for i, origin := range c.Signal.Origins {
+		if origin != "*" && !strings.HasPrefix(origin, "*.") && !strings.Contains(origin, "://") {
+			errs = append(errs, fmt.Sprintf("signal.origins[%d] must be *, *.domain or scheme://host[:port], got %q", i, origin))
+		}
+	}
+	if c.Nats.URL == "" {
+		errs = append(errs, "nats.url must be non empty")
 	}
-	err = viper.GetViper().UnmarshalExact(c)
+	switch c.Discovery.Type {
+	case "etcd":
+		if len(c.Etcd.Adds) == 0 {
+			errs = append(errs, "etcd.addrs must be non empty when discovery.type is etcd")
+		}
+	case "static":
+		for i, n := range c.Discovery.Nodes {
+			if n.NodeDC == "" || n.NodeID == "" || n.Name == "" {
+				errs = append(errs, fmt.Sprintf("discovery.node[%d] dc, id and name must be non empty", i))
+			}
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("discovery.type must be etcd or static, got %q", c.Discovery.Type))
+	}
+	for i, server := range c.ICE.Servers {
+		errs = append(errs, checkICEServer(fmt.Sprintf("ice.server[%d]", i), server, c.ICE.Secret)...)
+	}
+	for dc, d := range c.ICE.DC {
+		for i, server := range d.Servers {
+			errs = append(errs, checkICEServer(fmt.Sprintf("ice.dc.%s.server[%d]", dc, i), server, c.ICE.Secret)...)
+		}
+	}
+	if _, err := logrus.ParseLevel(c.Log.Level); err != nil {
+		errs = append(errs, fmt.Sprintf("log.level must be debug, info, warn or error, got %q", c.Log.Level))
+	}
+	if c.Placement.Strategy != "load" && c.Placement.Strategy != "random" {
+		errs = append(errs, fmt.Sprintf("placement.strategy must be load or random, got %q", c.Placement.Strategy))
+	}
+	return errs
+}
+
+// checkICEServer 校验一个ICE服务
+func checkICEServer(key string, server iceserver, secret string) []string {
+	errs := make([]string, 0)
+	if len(server.URLS) == 0 {
+		errs = append(errs, key+".urls must be non empty")
+	}
+	if server.HMAC && secret == "" {
+		errs = append(errs, key+".hmac needs ice.secret")
+	}
+	return errs
+}
+
+// Reload 重新读取配置文件, 只更新可以热加载的配置项(日志级别、ICE服务、sfu分配策略),
+// 返回更新了的配置项和修改了但需要重启才能生效的配置项, 配置错误时保持原来的配置
+func Reload() (changed, restart []string, err error) {
+	n, err := read(cfg.CfgFile)
 	if err != nil {
-		log.Printf("config file %s load failed. err is %v\n", c.CfgFile, err)
-		return false
+		return nil, nil, err
 	}
-	fmt.Printf("config %s load successed\n", c.CfgFile)
-	return true
+	lock.Lock()
+	defer lock.Unlock()
+	for _, key := range confutil.Diff(&cfg, n) {
+		if confutil.Section(key, hotSections...) {
+			changed = append(changed, key)
+		} else {
+			restart = append(restart, key)
+		}
+	}
+	cfg.Log = n.Log
+	cfg.ICE = n.ICE
+	cfg.Placement = n.Placement
+	return changed, restart, nil
+}
+
+// Watch 配置文件变化或收到SIGHUP时重新加载, 结果通过onReload通知, 返回停止监控的函数
+func Watch(onReload func(changed, restart []string, err error)) (func(), error) {
+	return confutil.Watch(cfg.CfgFile, func() {
+		onReload(Reload())
+	})
 }
 
 func (c *config) parse() bool {
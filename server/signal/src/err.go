@@ -21,6 +21,9 @@ const (
 	codeSfuRPCErr
 	codeRegisterRPCErr
 	codeUnknownErr
+	codeMixSfuErr
+	codeForbiddenErr
+	codeHostErr
 )
 
 var codeErr = map[int]string{
@@ -39,6 +42,9 @@ var codeErr = map[int]string{
 	codeSfuRPCErr:      "sfu rpc not found",
 	codeRegisterRPCErr: "register rpc not found",
 	codeUnknownErr:     "unknown error",
+	codeMixSfuErr:      "room pubs are on different sfus",
+	codeForbiddenErr:   "only stream owner or room host allowed",
+	codeHostErr:        "only room host allowed",
 }
 
 func codeStr(code int) string {
@@ -1,12 +1,10 @@
 package src
 
 import (
-	"goRTCServer/pkg/logger"
+	"goRTCServer/pkg/bus"
 	"goRTCServer/pkg/proto"
 	"goRTCServer/pkg/utils"
 	"goRTCServer/server/signal/ws"
-
-	nprotoo "github.com/cloudwebrtc/nats-protoo"
 )
 
 // handlerWebSocket 信令处理
@@ -32,6 +30,56 @@ func handlerWebSocket(method string, peer *ws.Peer, msg map[string]interface{},
 		getusers(peer, msg, accept, reject)
 	case proto.ClientToSignalGetRoomPubs:
 		getpubs(peer, msg, accept, reject)
+	case proto.ClientToSignalStartMix:
+		startmix(peer, msg, accept, reject)
+	case proto.ClientToSignalStopMix:
+		stopmix(peer, msg, accept, reject)
+	case proto.ClientToSignalSubMix:
+		submix(peer, msg, accept, reject)
+	case proto.ClientToSignalUnSubMix:
+		unsubmix(peer, msg, accept, reject)
+	case proto.ClientToSignalRTPPublish:
+		rtppublish(peer, msg, accept, reject)
+	case proto.ClientToSignalRTPForward:
+		rtpforward(peer, msg, accept, reject)
+	case proto.ClientToSignalRTPUnForward:
+		rtpunforward(peer, msg, accept, reject)
+	case proto.ClientToSignalStartHLS:
+		starthls(peer, msg, accept, reject)
+	case proto.ClientToSignalStopHLS:
+		stophls(peer, msg, accept, reject)
+	case proto.ClientToSignalStartRTMP:
+		startrtmp(peer, msg, accept, reject)
+	case proto.ClientToSignalStopRTMP:
+		stoprtmp(peer, msg, accept, reject)
+	case proto.ClientToSignalRTMPStatus:
+		rtmpstatus(peer, msg, accept, reject)
+	case proto.ClientToSignalRestartICE, proto.ClientToSignalReconnectPC:
+		restartice(peer, msg, accept, reject)
+	case proto.ClientToSignalSetRoom:
+		setroom(peer, msg, accept, reject)
+	case proto.ClientToSignalAdmit:
+		admit(peer, msg, accept, reject)
+	case proto.ClientToSignalDeny:
+		deny(peer, msg, accept, reject)
+	case proto.ClientToSignalSetRoomMeta:
+		setroommeta(peer, msg, accept, reject)
+	case proto.ClientToSignalSetUserMeta:
+		setusermeta(peer, msg, accept, reject)
+	case proto.ClientToSignalGetRoomMeta:
+		getroommeta(peer, msg, accept, reject)
+	case proto.ClientToSignalChat:
+		chat(peer, msg, accept, reject)
+	case proto.ClientToSignalChatHistory:
+		chathistory(peer, msg, accept, reject)
+	case proto.ClientToSignalMute:
+		mute(peer, msg, accept, reject, true)
+	case proto.ClientToSignalUnMute:
+		mute(peer, msg, accept, reject, false)
+	case proto.ClientToSignalPauseSub:
+		pausesub(peer, msg, accept, reject, true)
+	case proto.ClientToSignalResumeSub:
+		pausesub(peer, msg, accept, reject, false)
 	default:
 		ws.DefaultReject(codeUnknownErr, codeStr(codeUnknownErr))
 	}
@@ -42,7 +90,8 @@ func handlerWebSocket(method string, peer *ws.Peer, msg map[string]interface{},
   "id":3764139
   "method":"join"
   "data":{
-    "rid":"room"
+    "rid":"room",
+    "password":"123456", (可选)
   }
 */
 // 用户加入房间
@@ -51,6 +100,7 @@ func join(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, rejec
 		return
 	}
 	uid := peer.ID()
+	session := peer.Session()
 	rid := utils.Val(msg, "rid")
 
 	// 获取register服务器的RPC句柄
@@ -59,64 +109,53 @@ func join(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, rejec
 		reject(codeRegisterRPCErr, codeStr(codeRegisterRPCErr))
 		return
 	}
-	// 1. 查询uid是否在房间内
-	resp, err := registerRPC.SyncRequest(proto.SignalToRegisterGetSignalInfo, utils.Map("rid", rid, "uid", uid))
+	// 1. 查询同一会话是否在房间内, 在则关闭旧的连接
+	resp, err := registerRPC.SyncRequest(proto.SignalToRegisterGetSignalInfo, utils.Map("rid", rid, "uid", uid, "session", session))
 	rmp := utils.Unmarshal(string(resp))
 	if err == nil {
-		signalId := rmp["signalid"].(string)
-		if signalId != signalNode.NodeInfo().NodeID {
-			// 1.1 不在当前节点 通知其他节点关闭
-			rpcSignal := rpcs[signalId]
-			if rpcSignal != nil {
-				rpcSignal.SyncRequest(proto.SignalToSignalOnKick, utils.Map("rid", rid, "uid", uid))
-			}
-		} else {
-			// 1.2 user 在当前节点
-			// 删除数据库流信息
-			resp, err := registerRPC.SyncRequest(proto.SignalToRegisterOnStreamRemove, utils.Map("rid", rid, "uid", uid, "mid", ""))
-			rmp = utils.Unmarshal(string(resp))
-			if err != nil {
-				rmPubs, ok := rmp["rmPubs"].([]interface{})
-				if ok {
-					SendNotifyByUids(rid, uid, proto.SignalToSignalOnStreamRemove, rmPubs)
-				}
-			} else {
-				logger.Errorf("signal.join request register streamRemove err, err is %v", err.Reason)
-			}
-			// 删除数据库用户信息
-			_, err = registerRPC.SyncRequest(proto.SignalToRegisterOnLeave, utils.Map("rid", rid, "uid", uid))
-			if err != nil {
-				logger.Errorf("signal.join request register userLeave err:%s", err.Reason)
-			}
-
-			// 发送广播给所有人
-			SendNotifyByUids(rid, uid, proto.SignalToClientOnLeave, rmp["rmPubs"].([]interface{}))
-			// 通知本地对象
-			SendNotifyByUid(rid, uid, proto.SignalToClientOnLeave, map[string]interface{}{"rid": rid, "uid": uid})
-			// 删除本地对象
-			room := rooms.GetRoom(rid)
-			if room != nil {
-				room.DelPeer(uid)
-			}
-		}
-
+		kickSession(rid, uid, session, utils.Val(rmp, "signalid"), peer)
 	}
-	// 2.重新进房
-	room := rooms.GetRoom(rid)
-	room.AddPeer(peer)
-	// 3.写数据库
-	resp, err = registerRPC.SyncRequest(proto.SignalToRegisterOnJoin, utils.Map("rid", rid, "uid", uid, "signalId", signalNode.NodeInfo().NodeID))
-
+	// 2.写数据库, register检查房间人数、密码、等候室和多会话策略
+	resp, err = registerRPC.SyncRequest(proto.SignalToRegisterOnJoin, utils.Map("rid", rid, "uid", uid, "session", session, "signalId", signalNode.NodeInfo().NodeID, "password", utils.Val(msg, "password")))
 	if err != nil {
 		reject(err.Code, err.Reason)
 		return
 	}
-	// 4.广播通知房间内其他人
-	SendNotifyByUids(rid, uid, proto.SignalToSignalOnJoin, []interface{}{utils.Unmarshal(string(resp))})
+	rmp = utils.Unmarshal(string(resp))
+	if lobby, _ := rmp["lobby"].(bool); lobby {
+		// 2.1 进入等候室, 通知主持人
+		lobbies.AddRoom(rid).AddPeer(peer)
+		data := utils.Map("rid", rid, "uid", uid, "host", rmp["host"])
+		NotifyPeerWithId(rid, utils.Val(rmp, "host"), proto.SignalToClientOnLobbyJoin, data)
+		caster.Say(proto.SignalToSignalOnLobbyJoin, data)
+		accept([]byte(utils.Marshal(utils.Map("lobby", true))))
+		return
+	}
+	if room := lobbies.GetRoom(rid); room != nil {
+		room.RemovePeer(uid, session)
+	}
+	// 2.2 房间策略为replace时踢出同一用户的其他会话
+	if replaced, ok := rmp["replaced"].([]interface{}); ok {
+		for _, v := range replaced {
+			if old, ok := v.(map[string]interface{}); ok {
+				kickSession(rid, uid, utils.Val(old, "session"), utils.Val(old, "signalid"), peer)
+			}
+		}
+	}
+	// 3.重新进房
+	rooms.AddRoom(rid).AddPeer(peer)
+	// 4.广播通知房间内其他人, 包括同一用户的其他会话
+	delete(rmp, "waiting")
+	delete(rmp, "replaced")
+	SendNotifyByUids(rid, uid, proto.SignalToSignalOnJoin, []interface{}{rmp})
 
-	_, users := FindRoomUsers(rid, uid)
-	_, pubs := FindRoomPubs(rid, uid)
-	res := utils.Map("users", users, "pubs", pubs)
+	_, users := FindRoomUsers(rid, uid, session)
+	_, pubs := FindRoomPubs(rid, uid, session)
+	res := utils.Map("users", users, "pubs", pubs, "meta", FindRoomMeta(rid), "chat", FindChatHistory(rid, uid), "iceServers", GetICEServers(uid))
+	// 主持人返回等候室中的用户
+	if waiting := utils.Unmarshal(string(resp))["waiting"]; waiting != nil {
+		res["waiting"] = waiting
+	}
 	accept([]byte(utils.Marshal(res)))
 }
 
@@ -135,38 +174,16 @@ func leave(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, reje
 	}
 	uid := peer.ID()
 	rid := utils.Val(msg, "rid")
-	// 获取register RPC句柄
-	regiserRPC := GetRPCHandlerByServiceName("register")
-	if regiserRPC == nil {
-		reject(codeRegisterRPCErr, codeStr(codeRegisterRPCErr))
+	if err := removePeer(rid, uid, peer.Session()); err != nil {
+		reject(err.Code, err.Reason)
 		return
 	}
-
-	// 删除数据库中的流信息
-	resp, err := regiserRPC.SyncRequest(proto.SignalToRegisterOnStreamRemove, utils.Map("rid", rid, "uid", uid, "mid", ""))
-	rmp := utils.Unmarshal(string(resp))
-	if err == nil {
-		rePubs, ok := rmp["rmPubs"].([]interface{})
-		if ok {
-			SendNotifyByUids(rid, uid, proto.SignalToSignalOnLeave, rePubs)
-		}
-	} else {
-		logger.Errorf("singal.leave request register streamRemove err:%s", err.Reason)
-	}
-
-	// 删除数据库的用户信息
-	_, err = regiserRPC.SyncRequest(proto.SignalToRegisterOnLeave, utils.Map("rid", rid, "uid", uid))
-	if err != nil {
-		logger.Errorf("signal.join request register userLeave err:%s", err.Reason)
-	}
-
-	// 发送广播给所有人
-	SendNotifyByUids(rid, uid, proto.SignalToClientOnLeave, rmp["rmPubs"].([]interface{}))
-	// 删除本地对象
+	// 移出房间, 连接保持, 可以继续加入其他房间
 	room := rooms.GetRoom(rid)
 	if room != nil {
-		room.DelPeer(uid)
+		room.RemovePeer(uid, peer.Session())
 	}
+	accept([]byte(utils.Marshal(emptyMap)))
 }
 
 /*
@@ -199,9 +216,9 @@ func keepalive(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc,
 	}
 
 	// 更新数据库
-	_, err := regiserRPC.SyncRequest(proto.SignalToRegisterKeepAlive, utils.Map("rid", rid, "uid", uid))
+	_, err := regiserRPC.SyncRequest(proto.SignalToRegisterKeepAlive, utils.Map("rid", rid, "uid", uid, "session", peer.Session()))
 
-	if err == nil {
+	if err != nil {
 		reject(err.Code, err.Reason)
 		return
 	}
@@ -249,8 +266,11 @@ func publish(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, re
 		reject(codeRIDErr, codeStr(codeRIDErr))
 		return
 	}
-	// 获取sfu节点
-	sfuRPC, sfuid := GetRPCHandlerByPayload("sfu")
+	// 获取sfu节点, 房间开启了混音则推流到混音所在的sfu
+	sfuRPC, sfuid := GetMixSFU(rid)
+	if sfuRPC == nil {
+		sfuRPC, sfuid = GetRPCHandlerByPayload("sfu")
+	}
 	if sfuRPC == nil {
 		reject(codeSfuRPCErr, codeStr(codeSfuRPCErr))
 		return
@@ -270,18 +290,20 @@ func publish(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, re
 	// 写数据库
 	rmp := utils.Unmarshal(string(resp))
 	mid := utils.Val(rmp, "mid")
-	stream, err := regiserRPC.SyncRequest(proto.SignalToRegisterOnStreamAdd, utils.Map("rid", rid, "uid", uid, "mid", mid, "sfuid", sfuid, "minfo", minfo))
+	stream, err := regiserRPC.SyncRequest(proto.SignalToRegisterOnStreamAdd, utils.Map("rid", rid, "uid", uid, "session", peer.Session(), "mid", mid, "sfuid", sfuid, "minfo", minfo))
 	if err != nil {
+		// 超过发布人数等原因写入失败, 删除sfu上的流
+		sfuRPC.SyncRequest(proto.SignalToSfuUnPublish, utils.Map("rid", rid, "mid", mid))
 		reject(err.Code, err.Reason)
 		return
 	}
 	// 广播给其他人
-	SendNotifyByUids(rid, uid, proto.SignalToSignalOnStreamAdd, []interface{}{stream})
+	SendNotifyByUids(rid, uid, proto.SignalToSignalOnStreamAdd, []interface{}{utils.Unmarshal(string(stream))})
 
 	resp1 := make(map[string]interface{})
 	resp1["mid"] = mid
 	resp1["sfuid"] = sfuid
-	resp1["jesp"] = rmp["jesp"]
+	resp1["jsep"] = rmp["jsep"]
 	accept([]byte(utils.Marshal(resp1)))
 }
 
@@ -305,7 +327,7 @@ func unpublish(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc,
 	mid := utils.Val(msg, "mid")
 	sfuid := utils.Val(msg, "sfuid")
 
-	var sfuRPC *nprotoo.Requestor
+	var sfuRPC bus.Requestor
 	if sfuid != "" {
 		sfuRPC = GetRPCHandlerByNodeId(sfuid)
 	} else {
@@ -379,7 +401,7 @@ func subscribe(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc,
 
 	// 2.获取sfu RPC句柄
 	sfuid := utils.Val(msg, "sfuid")
-	var sfuRPC *nprotoo.Requestor
+	var sfuRPC bus.Requestor
 	if sfuid != "" {
 		sfuRPC = GetRPCHandlerByNodeId(sfuid)
 	} else {
@@ -391,7 +413,6 @@ func subscribe(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc,
 	}
 	// 3. 获取sfu节点的resp
 	resp, err := sfuRPC.SyncRequest(proto.SignalToSfuSubscribe, utils.Map("rid", rid, "suid", uid, "mid", mid, "jsep", jsep))
-	rmp := utils.Unmarshal(string(resp))
 	if err != nil {
 		if err.Code == 403 {
 			// 3.1 流不存在
@@ -403,21 +424,21 @@ func subscribe(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc,
 			}
 			// 3.1.1 删除数据库中的流
 			id := proto.GetUIDFromMID(mid)
-			resp, err = regiserRPC.SyncRequest(proto.SignalToRegisterOnStreamRemove, utils.Map("rid", rid, "uid", id, "mid", mid))
-			if err != nil {
-				reject(err.Code, err.Reason)
+			resp, rmErr := regiserRPC.SyncRequest(proto.SignalToRegisterOnStreamRemove, utils.Map("rid", rid, "uid", id, "mid", mid))
+			if rmErr != nil {
+				reject(rmErr.Code, rmErr.Reason)
 				return
 			}
 			// 3.1.2 通知其他人
-			rmp = utils.Unmarshal(string(resp))
+			rmp := utils.Unmarshal(string(resp))
 			if rmPubs, ok := rmp["rmPubs"]; ok {
 				SendNotifyByUids(rid, id, proto.SignalToClientOnStreamRemove, []interface{}{rmPubs})
 			}
-			reject(err.Code, err.Reason)
-		} else {
-			accept([]byte(utils.Marshal(rmp)))
 		}
+		reject(err.Code, err.Reason)
+		return
 	}
+	accept([]byte(resp))
 }
 
 /*
@@ -441,7 +462,7 @@ func unsubscribe(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc
 	mid := utils.Val(msg, "mid")
 	// 1.获取sfu RPC句柄
 	sfuid := utils.Val(msg, "sfuid")
-	var sfuRPC *nprotoo.Requestor
+	var sfuRPC bus.Requestor
 	if sfuid != "" {
 		sfuRPC = GetRPCHandlerByNodeId(sfuid)
 	} else {
@@ -478,6 +499,7 @@ func broadcast(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc,
 	rid := utils.Val(msg, "rid")
 	data := utils.Map("rid", rid, "uid", uid, "data", msg["data"])
 	SendNotifyByUid(rid, uid, proto.SignalToClientBroadcast, data)
+	accept([]byte(utils.Marshal(emptyMap)))
 }
 
 /*
@@ -496,7 +518,7 @@ func getusers(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, r
 	uid := peer.ID()
 	rid := utils.Val(msg, "rid")
 	// 查询房间内用户信息
-	_, users := FindRoomUsers(rid, uid)
+	_, users := FindRoomUsers(rid, uid, peer.Session())
 	res := utils.Map("users", users)
 	accept([]byte(utils.Marshal(res)))
 }
@@ -516,7 +538,1012 @@ func getpubs(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, re
 	}
 	uid := peer.ID()
 	rid := utils.Val(msg, "rid")
-	_, pubs := FindRoomPubs(rid, uid)
+	_, pubs := FindRoomPubs(rid, uid, peer.Session())
 	res := utils.Map("pubs", pubs)
 	accept([]byte(utils.Marshal(res)))
 }
+
+/*
+	"request":true
+	"id":3764139
+	"method":"startmix"
+	"data":{
+		"rid": "room",
+		"topn": 3, (可选)
+	}
+*/
+// startmix 开启房间混音
+func startmix(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, reject ws.RejectFunc) {
+	if invalid(msg, "rid", reject) {
+		return
+	}
+	uid := peer.ID()
+	rid := utils.Val(msg, "rid")
+	room := rooms.GetRoom(rid)
+	if room == nil {
+		reject(codeRIDErr, codeStr(codeRIDErr))
+		return
+	}
+	// 混音影响整个房间, 只有主持人可以开启
+	if !IsRoomHost(rid, uid) {
+		reject(codeHostErr, codeStr(codeHostErr))
+		return
+	}
+
+	// 1.已开启混音的房间用原来的sfu, 否则使用房间内已有流所在的sfu
+	// 混音只能拿到本sfu上的流, 已有的流分布在多个sfu上时拒绝开启
+	sfuRPC, sfuid := GetMixSFU(rid)
+	if sfuRPC == nil {
+		sfuid = ""
+		_, pubs := FindRoomPubs(rid, "", "")
+		for _, pub := range pubs {
+			id := utils.Val(pub.(map[string]interface{}), "sfuid")
+			if sfuid != "" && id != sfuid {
+				reject(codeMixSfuErr, codeStr(codeMixSfuErr))
+				return
+			}
+			sfuid = id
+		}
+		if sfuid != "" {
+			if sfuRPC = GetRPCHandlerByNodeId(sfuid); sfuRPC == nil {
+				reject(codeSfuRPCErr, codeStr(codeSfuRPCErr))
+				return
+			}
+		}
+	}
+	if sfuRPC == nil {
+		sfuRPC, sfuid = GetRPCHandlerByPayload("sfu")
+	}
+	if sfuRPC == nil {
+		reject(codeSfuRPCErr, codeStr(codeSfuRPCErr))
+		return
+	}
+	resp, err := sfuRPC.SyncRequest(proto.SignalToSfuStartMix, utils.Map("rid", rid, "topn", msg["topn"]))
+	if err != nil {
+		reject(err.Code, err.Reason)
+		return
+	}
+
+	// 2.写数据库
+	regiserRPC := GetRPCHandlerByServiceName("register")
+	if regiserRPC == nil {
+		reject(codeRegisterRPCErr, codeStr(codeRegisterRPCErr))
+		return
+	}
+	_, err = regiserRPC.SyncRequest(proto.SignalToRegisterOnMixAdd, utils.Map("rid", rid, "sfuid", sfuid))
+	if err != nil {
+		reject(err.Code, err.Reason)
+		return
+	}
+
+	// 3.通知房间内其他人
+	rmp := utils.Unmarshal(string(resp))
+	data := utils.Map("rid", rid, "uid", uid, "sfuid", sfuid, "topn", rmp["topn"])
+	SendNotifyByUid(rid, uid, proto.SignalToSignalOnMixStart, data)
+	accept([]byte(utils.Marshal(data)))
+}
+
+/*
+	"request":true
+	"id":3764139
+	"method":"stopmix"
+	"data":{
+		"rid": "room",
+	}
+*/
+// stopmix 关闭房间混音
+func stopmix(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, reject ws.RejectFunc) {
+	if invalid(msg, "rid", reject) {
+		return
+	}
+	uid := peer.ID()
+	rid := utils.Val(msg, "rid")
+	if rooms.GetRoom(rid) == nil {
+		reject(codeRIDErr, codeStr(codeRIDErr))
+		return
+	}
+	if !IsRoomHost(rid, uid) {
+		reject(codeHostErr, codeStr(codeHostErr))
+		return
+	}
+	sfuRPC, _ := GetMixSFU(rid)
+	if sfuRPC == nil {
+		reject(codeSfuRPCErr, codeStr(codeSfuRPCErr))
+		return
+	}
+	_, err := sfuRPC.SyncRequest(proto.SignalToSfuStopMix, utils.Map("rid", rid))
+	if err != nil {
+		reject(err.Code, err.Reason)
+		return
+	}
+
+	regiserRPC := GetRPCHandlerByServiceName("register")
+	if regiserRPC == nil {
+		reject(codeRegisterRPCErr, codeStr(codeRegisterRPCErr))
+		return
+	}
+	_, err = regiserRPC.SyncRequest(proto.SignalToRegisterOnMixRemove, utils.Map("rid", rid))
+	if err != nil {
+		reject(err.Code, err.Reason)
+		return
+	}
+	SendNotifyByUid(rid, uid, proto.SignalToSignalOnMixStop, utils.Map("rid", rid, "uid", uid))
+	accept([]byte(utils.Marshal(emptyMap)))
+}
+
+/*
+	"request":true
+	"id":3764139
+	"method":"submix"
+	"data":{
+		"rid": "room",
+		"jsep": {
+			"type": "offer",
+			"sdp":"..."
+		}
+	}
+*/
+// submix 订阅房间混音
+func submix(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, reject ws.RejectFunc) {
+	if invalid(msg, "rid", reject) || invalid(msg, "jsep", reject) {
+		return
+	}
+	jsep := msg["jsep"].(map[string]interface{})
+	if invalid(jsep, "sdp", reject) {
+		return
+	}
+	uid := peer.ID()
+	rid := utils.Val(msg, "rid")
+	room := rooms.GetRoom(rid)
+	if room == nil {
+		reject(codeRIDErr, codeStr(codeRIDErr))
+		return
+	}
+	sfuRPC, sfuid := GetMixSFU(rid)
+	if sfuRPC == nil {
+		reject(codeSfuRPCErr, codeStr(codeSfuRPCErr))
+		return
+	}
+	resp, err := sfuRPC.SyncRequest(proto.SignalToSfuSubMix, utils.Map("rid", rid, "suid", uid, "jsep", jsep))
+	if err != nil {
+		reject(err.Code, err.Reason)
+		return
+	}
+	rmp := utils.Unmarshal(string(resp))
+	rmp["sfuid"] = sfuid
+	accept([]byte(utils.Marshal(rmp)))
+}
+
+/*
+	"request":true
+	"id":3764139
+	"method":"unsubmix"
+	"data":{
+		"rid": "room",
+		"sid": "64236c21-21e8-4a3d-9f80-c767d1e1d67f#ABCDEF"
+	}
+*/
+// unsubmix 取消订阅房间混音
+func unsubmix(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, reject ws.RejectFunc) {
+	if invalid(msg, "rid", reject) || invalid(msg, "sid", reject) {
+		return
+	}
+	rid := utils.Val(msg, "rid")
+	sid := utils.Val(msg, "sid")
+	sfuRPC, _ := GetMixSFU(rid)
+	if sfuRPC == nil {
+		reject(codeSfuRPCErr, codeStr(codeSfuRPCErr))
+		return
+	}
+	_, err := sfuRPC.SyncRequest(proto.SignalToSfuUnSubMix, utils.Map("rid", rid, "sid", sid))
+	if err != nil {
+		reject(err.Code, err.Reason)
+		return
+	}
+	accept([]byte(utils.Marshal(emptyMap)))
+}
+
+/*
+  "request":true
+  "id":3764139
+  "method":"rtp_publish"
+  "data":{
+	"rid":"room",
+	"minfo": {
+		"audio": true,
+		"video": true,
+		"audiotype": 0,
+		"videotype": 0,
+	},
+	"audiopt": 111, (可选)
+	"videopt": 96, (可选)
+  }
+*/
+// rtppublish 创建普通RTP推流端口, 供SIP网关、GStreamer等推流
+func rtppublish(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, reject ws.RejectFunc) {
+	if invalid(msg, "rid", reject) {
+		return
+	}
+	uid := peer.ID()
+	rid := utils.Val(msg, "rid")
+
+	minfo, ok := msg["minfo"].(map[string]interface{})
+	if minfo == nil || !ok {
+		reject(codeMinfoErr, codeStr(codeMinfoErr))
+		return
+	}
+
+	// 判断是否在房间内
+	room := rooms.GetRoom(rid)
+	if room == nil {
+		reject(codeRIDErr, codeStr(codeRIDErr))
+		return
+	}
+	sfuRPC, sfuid := GetMixSFU(rid)
+	if sfuRPC == nil {
+		sfuRPC, sfuid = GetRPCHandlerByPayload("sfu")
+	}
+	if sfuRPC == nil {
+		reject(codeSfuRPCErr, codeStr(codeSfuRPCErr))
+		return
+	}
+	resp, err := sfuRPC.SyncRequest(proto.SignalToSfuRTPPublish, utils.Map("rid", rid, "uid", uid, "audio", minfo["audio"], "video", minfo["video"], "audiopt", msg["audiopt"], "videopt", msg["videopt"]))
+	if err != nil {
+		reject(err.Code, err.Reason)
+		return
+	}
+
+	// 获取register RPC句柄
+	regiserRPC := GetRPCHandlerByServiceName("register")
+	if regiserRPC == nil {
+		reject(codeRegisterRPCErr, codeStr(codeRegisterRPCErr))
+		return
+	}
+	// 写数据库
+	rmp := utils.Unmarshal(string(resp))
+	mid := utils.Val(rmp, "mid")
+	stream, err := regiserRPC.SyncRequest(proto.SignalToRegisterOnStreamAdd, utils.Map("rid", rid, "uid", uid, "session", peer.Session(), "mid", mid, "sfuid", sfuid, "minfo", minfo))
+	if err != nil {
+		// 超过发布人数等原因写入失败, 删除sfu上的流
+		sfuRPC.SyncRequest(proto.SignalToSfuUnPublish, utils.Map("rid", rid, "mid", mid))
+		reject(err.Code, err.Reason)
+		return
+	}
+	// 广播给其他人
+	SendNotifyByUids(rid, uid, proto.SignalToSignalOnStreamAdd, []interface{}{utils.Unmarshal(string(stream))})
+
+	rmp["sfuid"] = sfuid
+	accept([]byte(utils.Marshal(rmp)))
+}
+
+/*
+  "request":true
+  "id":3764139
+  "method":"rtp_forward"
+  "data":{
+	"rid":"room",
+	"mid": "64236c21-21e8-4a3d-9f80-c767d1e1d67f#ABCDEF",
+	"host": "192.168.1.10",
+	"port": 5004,
+	"sfuid":"shenzhen-sfu-1", (可选)
+  }
+*/
+// rtpforward 将流转发到普通RTP地址, 只有流的发布者和房间主持人可以转发
+func rtpforward(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, reject ws.RejectFunc) {
+	if invalid(msg, "rid", reject) || invalid(msg, "mid", reject) {
+		return
+	}
+	rid := utils.Val(msg, "rid")
+	mid := utils.Val(msg, "mid")
+	sfuid := utils.Val(msg, "sfuid")
+	room := rooms.GetRoom(rid)
+	if room == nil {
+		reject(codeRIDErr, codeStr(codeRIDErr))
+		return
+	}
+	if !ownerOrHost(rid, peer.ID(), mid) {
+		reject(codeForbiddenErr, codeStr(codeForbiddenErr))
+		return
+	}
+
+	var sfuRPC bus.Requestor
+	if sfuid != "" {
+		sfuRPC = GetRPCHandlerByNodeId(sfuid)
+	} else {
+		sfuRPC = GetSFURPCHandlerByMID(rid, mid)
+	}
+	if sfuRPC == nil {
+		reject(codeSfuRPCErr, codeStr(codeSfuRPCErr))
+		return
+	}
+	resp, err := sfuRPC.SyncRequest(proto.SignalToSfuRTPForward, utils.Map("rid", rid, "mid", mid, "host", msg["host"], "port", msg["port"]))
+	if err != nil {
+		reject(err.Code, err.Reason)
+		return
+	}
+	accept([]byte(resp))
+}
+
+/*
+  "request":true
+  "id":3764139
+  "method":"rtp_unforward"
+  "data":{
+	"rid":"room",
+	"mid": "64236c21-21e8-4a3d-9f80-c767d1e1d67f#ABCDEF",
+	"fid": "rtp_192.168.1.10:5004",
+	"sfuid":"shenzhen-sfu-1", (可选)
+  }
+*/
+// rtpunforward 停止RTP转发, 只有流的发布者和房间主持人可以停止
+func rtpunforward(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, reject ws.RejectFunc) {
+	if invalid(msg, "rid", reject) || invalid(msg, "mid", reject) {
+		return
+	}
+	rid := utils.Val(msg, "rid")
+	mid := utils.Val(msg, "mid")
+	sfuid := utils.Val(msg, "sfuid")
+	if !ownerOrHost(rid, peer.ID(), mid) {
+		reject(codeForbiddenErr, codeStr(codeForbiddenErr))
+		return
+	}
+
+	var sfuRPC bus.Requestor
+	if sfuid != "" {
+		sfuRPC = GetRPCHandlerByNodeId(sfuid)
+	} else {
+		sfuRPC = GetSFURPCHandlerByMID(rid, mid)
+	}
+	if sfuRPC == nil {
+		reject(codeSfuRPCErr, codeStr(codeSfuRPCErr))
+		return
+	}
+	_, err := sfuRPC.SyncRequest(proto.SignalToSfuRTPUnForward, utils.Map("rid", rid, "mid", mid, "fid", msg["fid"]))
+	if err != nil {
+		reject(err.Code, err.Reason)
+		return
+	}
+	accept([]byte(utils.Marshal(emptyMap)))
+}
+
+/*
+  "request":true
+  "id":3764139
+  "method":"starthls"
+  "data":{
+	"rid":"room",
+	"mid": "64236c21-21e8-4a3d-9f80-c767d1e1d67f#ABCDEF",
+	"lowlatency": false, (可选)
+	"sfuid":"shenzhen-sfu-1", (可选)
+  }
+*/
+// starthls 开启HLS直播输出, 只有流的发布者和房间主持人可以开启
+func starthls(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, reject ws.RejectFunc) {
+	if invalid(msg, "rid", reject) || invalid(msg, "mid", reject) {
+		return
+	}
+	rid := utils.Val(msg, "rid")
+	mid := utils.Val(msg, "mid")
+	sfuid := utils.Val(msg, "sfuid")
+	room := rooms.GetRoom(rid)
+	if room == nil {
+		reject(codeRIDErr, codeStr(codeRIDErr))
+		return
+	}
+	if !ownerOrHost(rid, peer.ID(), mid) {
+		reject(codeForbiddenErr, codeStr(codeForbiddenErr))
+		return
+	}
+
+	var sfuRPC bus.Requestor
+	if sfuid != "" {
+		sfuRPC = GetRPCHandlerByNodeId(sfuid)
+	} else {
+		sfuRPC = GetSFURPCHandlerByMID(rid, mid)
+	}
+	if sfuRPC == nil {
+		reject(codeSfuRPCErr, codeStr(codeSfuRPCErr))
+		return
+	}
+	resp, err := sfuRPC.SyncRequest(proto.SignalToSfuStartHLS, utils.Map("rid", rid, "mid", mid, "lowlatency", msg["lowlatency"]))
+	if err != nil {
+		reject(err.Code, err.Reason)
+		return
+	}
+	accept([]byte(resp))
+}
+
+/*
+  "request":true
+  "id":3764139
+  "method":"stophls"
+  "data":{
+	"rid":"room",
+	"mid": "64236c21-21e8-4a3d-9f80-c767d1e1d67f#ABCDEF",
+	"sfuid":"shenzhen-sfu-1", (可选)
+  }
+*/
+// stophls 关闭HLS直播输出, 只有流的发布者和房间主持人可以关闭
+func stophls(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, reject ws.RejectFunc) {
+	if invalid(msg, "rid", reject) || invalid(msg, "mid", reject) {
+		return
+	}
+	rid := utils.Val(msg, "rid")
+	mid := utils.Val(msg, "mid")
+	sfuid := utils.Val(msg, "sfuid")
+	room := rooms.GetRoom(rid)
+	if room == nil {
+		reject(codeRIDErr, codeStr(codeRIDErr))
+		return
+	}
+	if !ownerOrHost(rid, peer.ID(), mid) {
+		reject(codeForbiddenErr, codeStr(codeForbiddenErr))
+		return
+	}
+
+	var sfuRPC bus.Requestor
+	if sfuid != "" {
+		sfuRPC = GetRPCHandlerByNodeId(sfuid)
+	} else {
+		sfuRPC = GetSFURPCHandlerByMID(rid, mid)
+	}
+	if sfuRPC == nil {
+		reject(codeSfuRPCErr, codeStr(codeSfuRPCErr))
+		return
+	}
+	_, err := sfuRPC.SyncRequest(proto.SignalToSfuStopHLS, utils.Map("rid", rid, "mid", mid))
+	if err != nil {
+		reject(err.Code, err.Reason)
+		return
+	}
+	accept([]byte(utils.Marshal(emptyMap)))
+}
+
+/*
+  "request":true
+  "id":3764139
+  "method":"startrtmp"
+  "data":{
+	"rid":"room",
+	"mids": ["64236c21-21e8-4a3d-9f80-c767d1e1d67f#ABCDEF"],
+	"url": "rtmp://live.example.com/app/key",
+	"sfuid":"shenzhen-sfu-1", (可选)
+  }
+*/
+// startrtmp 开启RTMP推流, 多路流需要在同一个sfu上, 只有所有流的发布者或房间主持人可以开启
+func startrtmp(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, reject ws.RejectFunc) {
+	if invalid(msg, "rid", reject) {
+		return
+	}
+	rid := utils.Val(msg, "rid")
+	sfuid := utils.Val(msg, "sfuid")
+	mids := utils.InterfaceToStringArray(msg["mids"])
+	if len(mids) == 0 {
+		reject(codeMIDErr, codeStr(codeMIDErr))
+		return
+	}
+	room := rooms.GetRoom(rid)
+	if room == nil {
+		reject(codeRIDErr, codeStr(codeRIDErr))
+		return
+	}
+	if !ownerOrHostAll(rid, peer.ID(), mids) {
+		reject(codeForbiddenErr, codeStr(codeForbiddenErr))
+		return
+	}
+
+	if sfuid == "" {
+		sfuid = GetSFUIDByMID(rid, mids[0])
+	}
+	sfuRPC := GetRPCHandlerByNodeId(sfuid)
+	if sfuRPC == nil {
+		reject(codeSfuRPCErr, codeStr(codeSfuRPCErr))
+		return
+	}
+	resp, err := sfuRPC.SyncRequest(proto.SignalToSfuStartRTMP, utils.Map("rid", rid, "mids", mids, "url", msg["url"]))
+	if err != nil {
+		reject(err.Code, err.Reason)
+		return
+	}
+	rmp := utils.Unmarshal(string(resp))
+	rmp["sfuid"] = sfuid
+	accept([]byte(utils.Marshal(rmp)))
+}
+
+/*
+  "request":true
+  "id":3764139
+  "method":"stoprtmp"
+  "data":{
+	"rid":"room",
+	"eid": "rtmp_ABCDEFGH",
+	"sfuid":"shenzhen-sfu-1",
+  }
+*/
+// stoprtmp 停止RTMP推流, 和开启一样只有所有流的发布者或房间主持人可以停止
+func stoprtmp(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, reject ws.RejectFunc) {
+	sfuRPC, ok := rtmpAuth(peer, msg, reject)
+	if !ok {
+		return
+	}
+	_, err := sfuRPC.SyncRequest(proto.SignalToSfuStopRTMP, utils.Map("rid", msg["rid"], "eid", msg["eid"]))
+	if err != nil {
+		reject(err.Code, err.Reason)
+		return
+	}
+	accept([]byte(utils.Marshal(emptyMap)))
+}
+
+/*
+  "request":true
+  "id":3764139
+  "method":"rtmpstatus"
+  "data":{
+	"rid":"room",
+	"eid": "rtmp_ABCDEFGH",
+	"sfuid":"shenzhen-sfu-1",
+  }
+*/
+// rtmpstatus 查询RTMP推流状态, 权限和停止一致
+func rtmpstatus(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, reject ws.RejectFunc) {
+	sfuRPC, ok := rtmpAuth(peer, msg, reject)
+	if !ok {
+		return
+	}
+	resp, err := sfuRPC.SyncRequest(proto.SignalToSfuRTMPStatus, utils.Map("rid", msg["rid"], "eid", msg["eid"]))
+	if err != nil {
+		reject(err.Code, err.Reason)
+		return
+	}
+	accept([]byte(resp))
+}
+
+// rtmpAuth 检查房间并通过sfu查询推流合成的流, 只有所有流的发布者或房间主持人可以操作
+func rtmpAuth(peer *ws.Peer, msg map[string]interface{}, reject ws.RejectFunc) (bus.Requestor, bool) {
+	if invalid(msg, "rid", reject) || invalid(msg, "eid", reject) {
+		return nil, false
+	}
+	rid := utils.Val(msg, "rid")
+	room := rooms.GetRoom(rid)
+	if room == nil {
+		reject(codeRIDErr, codeStr(codeRIDErr))
+		return nil, false
+	}
+	sfuRPC := GetRPCHandlerByNodeId(utils.Val(msg, "sfuid"))
+	if sfuRPC == nil {
+		reject(codeSfuRPCErr, codeStr(codeSfuRPCErr))
+		return nil, false
+	}
+	resp, err := sfuRPC.SyncRequest(proto.SignalToSfuRTMPStatus, utils.Map("rid", rid, "eid", msg["eid"]))
+	if err != nil {
+		reject(err.Code, err.Reason)
+		return nil, false
+	}
+	mids := utils.InterfaceToStringArray(utils.Unmarshal(string(resp))["mids"])
+	if !ownerOrHostAll(rid, peer.ID(), mids) {
+		reject(codeForbiddenErr, codeStr(codeForbiddenErr))
+		return nil, false
+	}
+	return sfuRPC, true
+}
+
+/*
+  "request":true
+  "id":3764139
+  "method":"restart_ice" (旧名称reconnect_pc)
+  "data":{
+	"rid": "room",
+	"mid": "64236c21-21e8-4a3d-9f80-c767d1e1d67f#ABCDEF",
+	"sid": "64236c21-21e8-4a3d-9f80-c767d1e1d67f#ABCDEF", (可选, 带sid为重建拉流连接)
+	"jsep": {
+		"type": "offer",
+		"sdp":"..."
+	},
+	"sfuid":"shenzhen-sfu-1", (可选)
+  }
+*/
+// restartice 网络切换后重建推流或拉流连接, mid和sid保持不变
+func restartice(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, reject ws.RejectFunc) {
+	if invalid(msg, "rid", reject) || invalid(msg, "mid", reject) {
+		return
+	}
+	jsep, ok := msg["jsep"].(map[string]interface{})
+	if !ok {
+		reject(codeJsepErr, codeStr(codeJsepErr))
+		return
+	}
+	if invalid(jsep, "sdp", reject) {
+		return
+	}
+	rid := utils.Val(msg, "rid")
+	mid := utils.Val(msg, "mid")
+	sid := utils.Val(msg, "sid")
+	if sid == "" && proto.GetUIDFromMID(mid) != peer.ID() {
+		reject(codePubErr, codeStr(codePubErr))
+		return
+	}
+	if sid != "" && proto.GetUIDFromMID(sid) != peer.ID() {
+		reject(codeSubErr, codeStr(codeSubErr))
+		return
+	}
+
+	sfuid := utils.Val(msg, "sfuid")
+	var sfuRPC bus.Requestor
+	if sfuid != "" {
+		sfuRPC = GetRPCHandlerByNodeId(sfuid)
+	} else {
+		sfuRPC = GetSFURPCHandlerByMID(rid, mid)
+	}
+	if sfuRPC == nil {
+		reject(codeSfuRPCErr, codeStr(codeSfuRPCErr))
+		return
+	}
+	resp, err := sfuRPC.SyncRequest(proto.SignalToSfuRestartICE, utils.Map("rid", rid, "mid", mid, "sid", sid, "jsep", jsep))
+	if err != nil {
+		reject(err.Code, err.Reason)
+		return
+	}
+	accept([]byte(resp))
+}
+
+/*
+  "request":true
+  "id":3764139
+  "method":"set_room"
+  "data":{
+	"rid": "room",
+	"maxusers": 10, (可选, 0为不限制)
+	"maxpubs": 4, (可选, 0为不限制)
+	"password": "123456", (可选, 空字符串为取消密码)
+	"lobby": true, (可选)
+	"sessions": "multi", (可选, multi/replace/reject)
+  }
+*/
+// setroom 设置房间, 只有主持人(第一个加入房间的人)可以修改
+func setroom(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, reject ws.RejectFunc) {
+	if invalid(msg, "rid", reject) {
+		return
+	}
+	registerRPC := GetRPCHandlerByServiceName("register")
+	if registerRPC == nil {
+		reject(codeRegisterRPCErr, codeStr(codeRegisterRPCErr))
+		return
+	}
+	data := utils.Map("rid", utils.Val(msg, "rid"), "uid", peer.ID())
+	for _, key := range []string{"maxusers", "maxpubs", "password", "lobby", "sessions"} {
+		if msg[key] != nil {
+			data[key] = msg[key]
+		}
+	}
+	resp, err := registerRPC.SyncRequest(proto.SignalToRegisterSetRoom, data)
+	if err != nil {
+		reject(err.Code, err.Reason)
+		return
+	}
+	accept([]byte(resp))
+}
+
+/*
+  "request":true
+  "id":3764139
+  "method":"admit"
+  "data":{
+	"rid": "room",
+	"uid": "64236c21-21e8-4a3d-9f80-c767d1e1d67f",
+  }
+*/
+// admit 主持人允许等候室中的用户进入
+func admit(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, reject ws.RejectFunc) {
+	lobbyReply(peer, msg, accept, reject, proto.SignalToRegisterLobbyAdmit, proto.SignalToSignalOnLobbyAdmit)
+}
+
+/*
+  "request":true
+  "id":3764139
+  "method":"deny"
+  "data":{
+	"rid": "room",
+	"uid": "64236c21-21e8-4a3d-9f80-c767d1e1d67f",
+  }
+*/
+// deny 主持人拒绝等候室中的用户进入
+func deny(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, reject ws.RejectFunc) {
+	lobbyReply(peer, msg, accept, reject, proto.SignalToRegisterLobbyDeny, proto.SignalToSignalOnLobbyDeny)
+}
+
+// lobbyReply 处理主持人的允许/拒绝, 写register后通知等候室中的用户
+func lobbyReply(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, reject ws.RejectFunc, regMethod, notifyMethod string) {
+	if invalid(msg, "rid", reject) || invalid(msg, "uid", reject) {
+		return
+	}
+	rid := utils.Val(msg, "rid")
+	target := utils.Val(msg, "uid")
+	registerRPC := GetRPCHandlerByServiceName("register")
+	if registerRPC == nil {
+		reject(codeRegisterRPCErr, codeStr(codeRegisterRPCErr))
+		return
+	}
+	_, err := registerRPC.SyncRequest(regMethod, utils.Map("rid", rid, "uid", peer.ID(), "target", target))
+	if err != nil {
+		reject(err.Code, err.Reason)
+		return
+	}
+	data := utils.Map("rid", rid, "uid", target)
+	lobbyNotify(rid, target, notifyMethod, data)
+	caster.Say(notifyMethod, data)
+	accept([]byte(utils.Marshal(emptyMap)))
+}
+
+/*
+  "request":true
+  "id":3764139
+  "method":"set_room_meta"
+  "data":{
+	"rid": "room",
+	"data": {"title": "周会", "pinned": "64236c21-21e8-4a3d-9f80-c767d1e1d67f"},
+	"version": 3, (可选, 带版本号时版本不一致返回错误)
+  }
+*/
+// setroommeta 设置房间元数据, 合并到已有数据, 值为null的字段删除
+func setroommeta(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, reject ws.RejectFunc) {
+	setmeta(peer, msg, accept, reject, proto.SignalToRegisterSetRoomMeta, proto.SignalToSignalOnRoomMeta)
+}
+
+/*
+  "request":true
+  "id":3764139
+  "method":"set_user_meta"
+  "data":{
+	"rid": "room",
+	"data": {"name": "张三", "hand": true},
+	"version": 3, (可选, 带版本号时版本不一致返回错误)
+  }
+*/
+// setusermeta 设置自己的用户元数据, 合并到已有数据, 值为null的字段删除
+func setusermeta(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, reject ws.RejectFunc) {
+	setmeta(peer, msg, accept, reject, proto.SignalToRegisterSetUserMeta, proto.SignalToSignalOnUserMeta)
+}
+
+// setmeta 写register后通知房间内其他人
+func setmeta(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, reject ws.RejectFunc, regMethod, notifyMethod string) {
+	if invalid(msg, "rid", reject) {
+		return
+	}
+	uid := peer.ID()
+	rid := utils.Val(msg, "rid")
+	data, ok := msg["data"].(map[string]interface{})
+	if !ok {
+		reject(codeUnknownErr, "meta data must be object")
+		return
+	}
+	room := rooms.GetRoom(rid)
+	if room == nil || room.GetPeer(uid, peer.Session()) == nil {
+		reject(codeRIDErr, codeStr(codeRIDErr))
+		return
+	}
+	registerRPC := GetRPCHandlerByServiceName("register")
+	if registerRPC == nil {
+		reject(codeRegisterRPCErr, codeStr(codeRegisterRPCErr))
+		return
+	}
+	req := utils.Map("rid", rid, "uid", uid, "data", data)
+	if msg["version"] != nil {
+		req["version"] = msg["version"]
+	}
+	resp, err := registerRPC.SyncRequest(regMethod, req)
+	if err != nil {
+		reject(err.Code, err.Reason)
+		return
+	}
+	SendNotifyByUid(rid, uid, notifyMethod, utils.Unmarshal(string(resp)))
+	accept([]byte(resp))
+}
+
+/*
+  "request":true
+  "id":3764139
+  "method":"get_room_meta"
+  "data":{
+	"rid": "room",
+  }
+*/
+// getroommeta 获取房间和用户的元数据
+func getroommeta(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, reject ws.RejectFunc) {
+	if invalid(msg, "rid", reject) {
+		return
+	}
+	registerRPC := GetRPCHandlerByServiceName("register")
+	if registerRPC == nil {
+		reject(codeRegisterRPCErr, codeStr(codeRegisterRPCErr))
+		return
+	}
+	resp, err := registerRPC.SyncRequest(proto.SignalToRegisterGetRoomMeta, utils.Map("rid", utils.Val(msg, "rid")))
+	if err != nil {
+		reject(err.Code, err.Reason)
+		return
+	}
+	accept([]byte(resp))
+}
+
+/*
+  "request":true
+  "id":3764139
+  "method":"chat"
+  "data":{
+	"rid": "room",
+	"text": "大家好",
+	"data": {}, (可选, 自定义数据)
+	"to": ["64236c21-21e8-4a3d-9f80-c767d1e1d67f"], (可选, 私聊的接收者)
+  }
+*/
+// chat 发送聊天消息, register保存后通知接收者, 发送者收到带id和时间戳的消息作为确认
+func chat(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, reject ws.RejectFunc) {
+	if invalid(msg, "rid", reject) {
+		return
+	}
+	uid := peer.ID()
+	rid := utils.Val(msg, "rid")
+	if msg["text"] == nil && msg["data"] == nil {
+		reject(codeUnknownErr, "chat text or data must be set")
+		return
+	}
+	room := rooms.GetRoom(rid)
+	if room == nil || room.GetPeer(uid, peer.Session()) == nil {
+		reject(codeRIDErr, codeStr(codeRIDErr))
+		return
+	}
+	registerRPC := GetRPCHandlerByServiceName("register")
+	if registerRPC == nil {
+		reject(codeRegisterRPCErr, codeStr(codeRegisterRPCErr))
+		return
+	}
+	resp, err := registerRPC.SyncRequest(proto.SignalToRegisterChat, utils.Map("rid", rid, "uid", uid, "to", msg["to"], "text", msg["text"], "data", msg["data"]))
+	if err != nil {
+		reject(err.Code, err.Reason)
+		return
+	}
+	data := utils.Unmarshal(string(resp))
+	chatNotify(rid, uid, data)
+	caster.Say(proto.SignalToSignalOnChat, data)
+	accept([]byte(resp))
+}
+
+/*
+  "request":true
+  "id":3764139
+  "method":"chat_history"
+  "data":{
+	"rid": "room",
+	"before": 120, (可选, 获取id小于before的消息, 不带时从最新开始)
+	"limit": 50, (可选, 默认50, 超过register的[chat] maxlimit时拒绝)
+  }
+*/
+// chathistory 分页获取聊天记录
+func chathistory(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, reject ws.RejectFunc) {
+	if invalid(msg, "rid", reject) {
+		return
+	}
+	rid := utils.Val(msg, "rid")
+	room := rooms.GetRoom(rid)
+	if room == nil || room.GetPeer(peer.ID(), peer.Session()) == nil {
+		reject(codeRIDErr, codeStr(codeRIDErr))
+		return
+	}
+	registerRPC := GetRPCHandlerByServiceName("register")
+	if registerRPC == nil {
+		reject(codeRegisterRPCErr, codeStr(codeRegisterRPCErr))
+		return
+	}
+	resp, err := registerRPC.SyncRequest(proto.SignalToRegisterChatHistory, utils.Map("rid", rid, "uid", peer.ID(),
+		"before", msg["before"], "limit", msg["limit"]))
+	if err != nil {
+		reject(err.Code, err.Reason)
+		return
+	}
+	accept([]byte(resp))
+}
+
+/*
+  "request":true
+  "id":3764139
+  "method":"mute"
+  "data":{
+	"rid": "room",
+	"mid": "64236c21-21e8-4a3d-9f80-c767d1e1d67f#ABCDEF",
+	"kind": "audio", (audio或video)
+	"sfuid":"shenzhen-sfu-1", (可选)
+  }
+*/
+// mute 静音/取消静音自己发布的流, sfu停止转发但保留流, 通知其他人stream_update
+func mute(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, reject ws.RejectFunc, muted bool) {
+	if invalid(msg, "rid", reject) || invalid(msg, "mid", reject) || invalid(msg, "kind", reject) {
+		return
+	}
+	uid := peer.ID()
+	rid := utils.Val(msg, "rid")
+	mid := utils.Val(msg, "mid")
+	kind := utils.Val(msg, "kind")
+	if kind != "audio" && kind != "video" {
+		reject(codeUnknownErr, "kind must be audio or video")
+		return
+	}
+	if proto.GetUIDFromMID(mid) != uid {
+		reject(codePubErr, codeStr(codePubErr))
+		return
+	}
+
+	sfuid := utils.Val(msg, "sfuid")
+	var sfuRPC bus.Requestor
+	if sfuid != "" {
+		sfuRPC = GetRPCHandlerByNodeId(sfuid)
+	} else {
+		sfuRPC = GetSFURPCHandlerByMID(rid, mid)
+	}
+	if sfuRPC == nil {
+		reject(codeSfuRPCErr, codeStr(codeSfuRPCErr))
+		return
+	}
+	_, err := sfuRPC.SyncRequest(proto.SignalToSfuMute, utils.Map("rid", rid, "mid", mid, "kind", kind, "mute", muted))
+	if err != nil {
+		reject(err.Code, err.Reason)
+		return
+	}
+
+	registerRPC := GetRPCHandlerByServiceName("register")
+	if registerRPC == nil {
+		reject(codeRegisterRPCErr, codeStr(codeRegisterRPCErr))
+		return
+	}
+	stream, err := registerRPC.SyncRequest(proto.SignalToRegisterOnStreamUpdate, utils.Map("rid", rid, "uid", uid, "mid", mid, "kind", kind, "mute", muted))
+	if err != nil {
+		reject(err.Code, err.Reason)
+		return
+	}
+	SendNotifyByUid(rid, uid, proto.SignalToSignalOnStreamUpdate, utils.Unmarshal(string(stream)))
+	accept([]byte(stream))
+}
+
+/*
+  "request":true
+  "id":3764139
+  "method":"pause_sub"
+  "data":{
+	"rid": "room",
+	"mid": "64236c21-21e8-4a3d-9f80-c767d1e1d67f#ABCDEF",
+	"sid": "64236c21-21e8-4a3d-9f80-c767d1e1d67f#ABCDEF",
+	"audioOnly": true, (可选, 只暂停视频)
+	"sfuid":"shenzhen-sfu-1", (可选)
+  }
+*/
+// pausesub 暂停/恢复接收订阅的流, resume_sub恢复音频和视频
+func pausesub(peer *ws.Peer, msg map[string]interface{}, accept ws.AcceptFunc, reject ws.RejectFunc, pause bool) {
+	if invalid(msg, "rid", reject) || invalid(msg, "mid", reject) || invalid(msg, "sid", reject) {
+		return
+	}
+	rid := utils.Val(msg, "rid")
+	mid := utils.Val(msg, "mid")
+	sid := utils.Val(msg, "sid")
+	if proto.GetUIDFromMID(sid) != peer.ID() {
+		reject(codeSubErr, codeStr(codeSubErr))
+		return
+	}
+
+	sfuid := utils.Val(msg, "sfuid")
+	var sfuRPC bus.Requestor
+	if sfuid != "" {
+		sfuRPC = GetRPCHandlerByNodeId(sfuid)
+	} else {
+		sfuRPC = GetSFURPCHandlerByMID(rid, mid)
+	}
+	if sfuRPC == nil {
+		reject(codeSfuRPCErr, codeStr(codeSfuRPCErr))
+		return
+	}
+	audio := pause && !utils.InterfaceToBool(msg["audioOnly"])
+	_, err := sfuRPC.SyncRequest(proto.SignalToSfuPauseSub, utils.Map("rid", rid, "mid", mid, "sid", sid, "audio", audio, "video", pause))
+	if err != nil {
+		reject(err.Code, err.Reason)
+		return
+	}
+	accept([]byte(utils.Marshal(emptyMap)))
+}
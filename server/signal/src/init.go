@@ -1,17 +1,20 @@
 package src
 
 import (
+	"goRTCServer/pkg/bus"
+	"goRTCServer/pkg/discovery"
 	"goRTCServer/pkg/etcd"
 	"goRTCServer/pkg/logger"
 	"goRTCServer/pkg/proto"
 	"goRTCServer/pkg/utils"
 	"goRTCServer/server/signal/conf"
 	"goRTCServer/server/signal/ws"
+	"log"
+	"math/rand"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
-
-	nprotoo "github.com/cloudwebrtc/nats-protoo"
-	"github.com/sirupsen/logrus"
 )
 
 const (
@@ -20,46 +23,100 @@ const (
 
 var (
 	rooms      *ws.Rooms
-	signalNode *etcd.ServiceNode
-	watch      *etcd.ServiceWatcher
-	signalNats *nprotoo.NatsProtoo
-	caster     *nprotoo.Broadcaster
-	rpcs       = make(map[string]*nprotoo.Requestor)
+	lobbies    *ws.Rooms // 等候室中等待主持人允许的用户
+	signalNode discovery.Registrar
+	watch      discovery.Discovery
+	signalBus  bus.Bus
+	caster     bus.Broadcaster
+	rpcs       = make(map[string]bus.Requestor)
+	rpcsLock   sync.RWMutex // rpcs由服务发现回调写入, 由请求处理读取
+	stopConf   func()
 )
 
-func init() {
-	logger.DoInit(conf.Kafka.URL, "rtc_signal")
-	logger.LogKf.SetLevel(logrus.DebugLevel)
+// Start 启动服务, 使用nats, 服务注册和发现按配置使用etcd或静态配置
+func Start() {
+	node, watcher, err := newDiscovery()
+	if err != nil {
+		log.Fatalf("signal start err, err is %v", err)
+	}
+	StartWith(bus.NewNats(conf.Nats.URL), node, watcher)
 }
 
-// 启动服务
-func Start() {
+// newDiscovery 根据配置新建服务注册和服务发现对象
+func newDiscovery() (discovery.Registrar, discovery.Discovery, error) {
+	if conf.Discovery.Type == "static" {
+		static := discovery.NewStatic(conf.StaticNodes())
+		return static.NewNode(conf.Global.NodeDC, conf.Global.NodeID, conf.Global.Name), static.NewWatcher(), nil
+	}
+	node, err := etcd.NewServiceNode(conf.Etcd.Adds, conf.Global.NodeDC, conf.Global.NodeID, conf.Global.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	watcher, err := etcd.NewServiceWatcher(conf.Etcd.Adds)
+	if err != nil {
+		node.Close()
+		return nil, nil, err
+	}
+	return node, watcher, nil
+}
+
+// StartWith 使用指定的消息总线、服务注册和服务发现启动服务
+func StartWith(b bus.Bus, node discovery.Registrar, watcher discovery.Discovery) {
+	logger.DoInit(conf.Kafka.URL, "rtc_signal")
+	logger.SetLevel(conf.GetLogLevel())
 	rooms = ws.NewRooms()
+	lobbies = ws.NewRooms()
+	// 消息总线, 服务发现的回调中会用到, 需要先设置
+	signalBus = b
 	// 服务注册
-	signalNode = etcd.NewServiceNode(conf.Etcd.Adds, conf.Global.NodeDC, conf.Global.NodeID, conf.Global.Name)
+	signalNode = node
+	signalNode.SetURL(conf.Signal.URL)
 	signalNode.RegisterNode()
 	// 服务发现
-	watch = etcd.NewServiceWatcher(conf.Etcd.Adds)
+	watch = watcher
 	go watch.WatchServiceNode("", watchServiceCallBack)
 	// 消息注册
-	signalNats = nprotoo.NewNatsProtoo(conf.Nats.URL)
-	signalNats.OnRequest(signalNode.GetRPCChannel(), handleRPCMsg)
+	signalBus.OnRequest(signalNode.GetRPCChannel(), handleRPCMsg)
 	// 消息广播
-	caster = signalNats.NewBroadcaster(signalNode.GetEventChannel())
+	caster = signalBus.NewBroadcaster(signalNode.GetEventChannel())
 	// 启动websocket
-	InitSignalServer(conf.Signal.Host, conf.Signal.Port, conf.Signal.Cert, conf.Signal.Key)
+	InitSignalServer(conf.Signal.Host, conf.Signal.Port, conf.Signal.Cert, conf.Signal.Key, conf.Signal.Redirect, conf.Signal.Origins)
 	// 启动房间资源回收
 	go CheckRoom()
 	// 启动调试
 	if conf.Global.Pprof != "" {
 		go debug()
 	}
+	// 配置热加载
+	stop, err := conf.Watch(onConfigReload)
+	if err != nil {
+		logger.Errorf("watch config err, err is %v", err)
+	}
+	stopConf = stop
+}
 
+// onConfigReload 配置重新加载后更新日志级别, 记录变化的配置项
+func onConfigReload(changed, restart []string, err error) {
+	if err != nil {
+		logger.Errorf("config reload failed, keep current config, err is %v", err)
+		return
+	}
+	logger.SetLevel(conf.GetLogLevel())
+	logger.Infof("config reloaded, changed %v", changed)
+	if len(restart) > 0 {
+		logger.Warnf("config changed but need restart to take effect, keys %v", restart)
+	}
 }
 
 func Stop() {
-	if signalNats != nil {
-		signalNats.Close()
+	if stopConf != nil {
+		stopConf()
+	}
+	if wsServer != nil {
+		wsServer.Close()
+	}
+	if signalBus != nil {
+		signalBus.Close()
 	}
 	if signalNode != nil {
 		signalNode.Close()
@@ -75,36 +132,50 @@ func debug() {
 }
 
 // watchServiceCallBack 查看所有的Node节点
-func watchServiceCallBack(state int32, n etcd.Node) {
-	if state == etcd.ServerUp {
+func watchServiceCallBack(state int32, n discovery.Node) {
+	if state == discovery.ServerUp {
 		// 新增节点
 		// 判断是否为广播节点
 		if n.Name == "signal" {
 			if n.NodeID != signalNode.NodeInfo().NodeID {
-				eventID := etcd.GetEventChannel(n)
-				signalNats.OnBroadcast(eventID, handleBroadcast)
+				eventID := discovery.GetEventChannel(n)
+				signalBus.OnBroadcast(eventID, handleBroadcast)
 			}
 		}
-		if n.Name == "sdu" {
-			eventId := etcd.GetEventChannel(n)
-			signalNats.OnBroadcast(eventId, handleBroadcast)
+		if n.Name == "sfu" {
+			eventId := discovery.GetEventChannel(n)
+			signalBus.OnBroadcast(eventId, handleBroadcast)
 		}
 		id := n.NodeID
+		rpcsLock.Lock()
 		_, found := rpcs[id]
 		if !found {
-			rpcID := etcd.GetPRCChannel(n)
-			rpcs[id] = signalNats.NewRequestor(rpcID)
+			rpcID := discovery.GetPRCChannel(n)
+			rpc := signalBus.NewRequestor(rpcID)
+			rpc.SetRequestTimeout(time.Duration(conf.Nats.Timeout) * time.Millisecond)
+			rpcs[id] = rpc
 		}
-	} else if state == etcd.ServerDown {
+		rpcsLock.Unlock()
+	} else if state == discovery.ServerDown {
+		rpcsLock.Lock()
 		delete(rpcs, n.NodeID)
+		rpcsLock.Unlock()
 	} else {
 
 	}
 }
 
+// getRPC 获取指定节点的RPC handler
+func getRPC(nid string) (bus.Requestor, bool) {
+	rpcsLock.RLock()
+	defer rpcsLock.RUnlock()
+	rpc, find := rpcs[nid]
+	return rpc, find
+}
+
 // GetRPCHandlerByServiceName 通过服务名获取RPC handler
-func GetRPCHandlerByServiceName(name string) *nprotoo.Requestor {
-	var node *etcd.Node
+func GetRPCHandlerByServiceName(name string) bus.Requestor {
+	var node *discovery.Node
 	services, find := watch.GetNodes(name)
 	if find {
 		for _, server := range services {
@@ -113,7 +184,7 @@ func GetRPCHandlerByServiceName(name string) *nprotoo.Requestor {
 		}
 	}
 	if node != nil {
-		rpc, find := rpcs[node.NodeID]
+		rpc, find := getRPC(node.NodeID)
 		if find {
 			return rpc
 		}
@@ -122,13 +193,13 @@ func GetRPCHandlerByServiceName(name string) *nprotoo.Requestor {
 }
 
 // GetRPCHandlerByNodeID 获取指定id的RPC Handler
-func GetRPCHandlerByNodeId(nid string) *nprotoo.Requestor {
+func GetRPCHandlerByNodeId(nid string) bus.Requestor {
 	node, find := watch.GetNodeByID(nid)
 	if !find {
 		return nil
 	}
 	if node != nil {
-		rpc, ok := rpcs[node.NodeID]
+		rpc, ok := getRPC(node.NodeID)
 		if ok {
 			return rpc
 		}
@@ -136,27 +207,50 @@ func GetRPCHandlerByNodeId(nid string) *nprotoo.Requestor {
 	return nil
 }
 
-// GetRPCHandlerByPayload 获取负载最低的RPC handler
-func GetRPCHandlerByPayload(name string) (*nprotoo.Requestor, string) {
-	node, ok := watch.GetNodeByPayload(signalNode.NodeInfo().NodeDC, name)
+// GetRPCHandlerByPayload 按配置的分配策略获取本区域节点的RPC handler, 跳过排空中的节点
+func GetRPCHandlerByPayload(name string) (bus.Requestor, string) {
+	var node *discovery.Node
+	var ok bool
+	dc := signalNode.NodeInfo().NodeDC
+	if conf.GetPlacement() == "random" {
+		node, ok = randomNode(dc, name)
+	} else {
+		node, ok = watch.GetNodeByPayload(dc, name)
+	}
 	if !ok {
 		return nil, ""
 	}
-	rpc, find := rpcs[node.NodeID]
+	rpc, find := getRPC(node.NodeID)
 	if find {
 		return rpc, node.NodeID
 	}
 	return nil, ""
 }
 
-// GetExistByUid 根据rid uid判断人是否在线,
-func GetExistByUid(rid, uid string) bool {
+// randomNode 随机获取指定区域内指定服务的一个节点
+func randomNode(dc, name string) (*discovery.Node, bool) {
+	nodes, _ := watch.GetNodes(name)
+	list := make([]discovery.Node, 0, len(nodes))
+	for _, node := range nodes {
+		if node.NodeDC == dc && !node.Drain {
+			list = append(list, node)
+		}
+	}
+	if len(list) == 0 {
+		return nil, false
+	}
+	node := list[rand.Intn(len(list))]
+	return &node, true
+}
+
+// GetExistByUid 根据rid uid session判断用户的会话是否在线,
+func GetExistByUid(rid, uid, session string) bool {
 	registerRPC := GetRPCHandlerByServiceName("register")
 	if registerRPC == nil {
 		logger.Errorf("GetExistByUid cannot  get available register node")
 		return false
 	}
-	resp, err := registerRPC.SyncRequest(proto.SignalToRegisterGetSignalInfo, utils.Map("rid", rid, "uid", uid))
+	resp, err := registerRPC.SyncRequest(proto.SignalToRegisterGetSignalInfo, utils.Map("rid", rid, "uid", uid, "session", session))
 	if err != nil {
 		logger.Errorf(err.Reason)
 		return false
@@ -174,37 +268,42 @@ func GetExistByUid(rid, uid string) bool {
 }
 
 // GetSFURPCHandlerByMID 根据rid mid获取sfu节点的rpc句柄
-func GetSFURPCHandlerByMID(rid, mid string) *nprotoo.Requestor {
+func GetSFURPCHandlerByMID(rid, mid string) bus.Requestor {
+	var sfu bus.Requestor
+	sfuid := GetSFUIDByMID(rid, mid)
+	if sfuid != "" {
+		sfu = GetRPCHandlerByNodeId(sfuid)
+	}
+	return sfu
+}
+
+// GetSFUIDByMID 根据rid mid获取流所在的sfu节点id
+func GetSFUIDByMID(rid, mid string) string {
 	registerRPC := GetRPCHandlerByServiceName("register")
 	if registerRPC == nil {
-		logger.Errorf("GetSFURPCHandlerByMid cannot get available register node")
-		return nil
+		logger.Errorf("GetSFUIDByMID cannot get available register node")
+		return ""
 	}
 	resp, err := registerRPC.SyncRequest(proto.SignalToRegisterGetSfuInfo, utils.Map("rid", rid, "mid", mid))
 	if err != nil {
 		logger.Errorf(err.Reason)
-		return nil
+		return ""
 	}
-	logger.Infof("GetSFURPCHandlerByMID success, resp is %v", resp)
-	var sfu *nprotoo.Requestor
-	sfuid := utils.Val(utils.Unmarshal(string(resp)), "sfuid")
-	if sfuid != "" {
-		sfu = GetRPCHandlerByNodeId(sfuid)
-	}
-	return sfu
+	logger.Infof("GetSFUIDByMID success, resp is %v", resp)
+	return utils.Val(utils.Unmarshal(string(resp)), "sfuid")
 }
 
 /*
-	"method" proto. "rid" rid "uid" uid
+	"method" proto. "rid" rid "uid" uid "session" session
 */
-// 获取房间内其他用户的数据
-func FindRoomUsers(rid, uid string) (bool, interface{}) {
+// 获取房间内其他用户的数据, 包括uid的其他会话
+func FindRoomUsers(rid, uid, session string) (bool, interface{}) {
 	registerRPC := GetRPCHandlerByServiceName("register")
 	if registerRPC == nil {
 		logger.Errorf("FindRoomUsers cannot get available register node")
 		return false, nil
 	}
-	resp, err := registerRPC.SyncRequest(proto.SignalToRegisterGetRoomUsers, utils.Map("rid", rid, "uid", uid))
+	resp, err := registerRPC.SyncRequest(proto.SignalToRegisterGetRoomUsers, utils.Map("rid", rid, "uid", uid, "session", session))
 	if err != nil {
 		logger.Errorf(err.Reason)
 		return false, nil
@@ -219,14 +318,14 @@ func FindRoomUsers(rid, uid string) (bool, interface{}) {
 	return true, users
 }
 
-// FindRoomPubs 获取房间内其他用户流信息
-func FindRoomPubs(rid, uid string) (bool, []interface{}) {
+// FindRoomPubs 获取房间内其他用户流信息, 包括uid其他会话发布的流
+func FindRoomPubs(rid, uid, session string) (bool, []interface{}) {
 	registerRPC := GetRPCHandlerByServiceName("register")
 	if registerRPC == nil {
 		logger.Errorf("FindRoomPubs cannot get available register node")
 		return false, nil
 	}
-	resp, err := registerRPC.SyncRequest(proto.SignalToRegisterGetRoomPubs, utils.Map("rid", rid, "uid", uid))
+	resp, err := registerRPC.SyncRequest(proto.SignalToRegisterGetRoomPubs, utils.Map("rid", rid, "uid", uid, "session", session))
 	if err != nil {
 		logger.Errorf(err.Reason)
 		return false, nil
@@ -241,43 +340,137 @@ func FindRoomPubs(rid, uid string) (bool, []interface{}) {
 	return true, pubs
 }
 
+// FindRoomMeta 获取房间和用户的元数据
+func FindRoomMeta(rid string) map[string]interface{} {
+	registerRPC := GetRPCHandlerByServiceName("register")
+	if registerRPC == nil {
+		logger.Errorf("FindRoomMeta cannot get available register node")
+		return nil
+	}
+	resp, err := registerRPC.SyncRequest(proto.SignalToRegisterGetRoomMeta, utils.Map("rid", rid))
+	if err != nil {
+		logger.Errorf(err.Reason)
+		return nil
+	}
+	return utils.Unmarshal(string(resp))
+}
+
+// FindChatHistory 获取uid可见的最近聊天消息
+func FindChatHistory(rid, uid string) []interface{} {
+	registerRPC := GetRPCHandlerByServiceName("register")
+	if registerRPC == nil {
+		logger.Errorf("FindChatHistory cannot get available register node")
+		return nil
+	}
+	resp, err := registerRPC.SyncRequest(proto.SignalToRegisterChatHistory, utils.Map("rid", rid, "uid", uid))
+	if err != nil {
+		logger.Errorf(err.Reason)
+		return nil
+	}
+	msgs, _ := utils.Unmarshal(string(resp))["messages"].([]interface{})
+	return msgs
+}
+
+// IsRoomHost 判断uid是否为房间主持人
+func IsRoomHost(rid, uid string) bool {
+	registerRPC := GetRPCHandlerByServiceName("register")
+	if registerRPC == nil {
+		logger.Errorf("IsRoomHost cannot get available register node")
+		return false
+	}
+	resp, err := registerRPC.SyncRequest(proto.SignalToRegisterGetRoomHost, utils.Map("rid", rid))
+	if err != nil {
+		logger.Errorf(err.Reason)
+		return false
+	}
+	host := utils.Val(utils.Unmarshal(string(resp)), "host")
+	return host != "" && host == uid
+}
+
+// GetMixSFU 获取房间混音所在sfu的RPC handler, 房间未开启混音返回nil
+func GetMixSFU(rid string) (bus.Requestor, string) {
+	registerRPC := GetRPCHandlerByServiceName("register")
+	if registerRPC == nil {
+		logger.Errorf("GetMixSFU cannot get available register node")
+		return nil, ""
+	}
+	resp, err := registerRPC.SyncRequest(proto.SignalToRegisterGetMixInfo, utils.Map("rid", rid))
+	if err != nil {
+		return nil, ""
+	}
+	sfuid := utils.Val(utils.Unmarshal(string(resp)), "sfuid")
+	if sfuid == "" {
+		return nil, ""
+	}
+	return GetRPCHandlerByNodeId(sfuid), sfuid
+}
+
+// GetICEServers 获取下发给客户端的iceServers, 由[ice]配置(按区域覆盖)和同区域sfu的内置TURN组成, 临时账号按uid签发
+func GetICEServers(uid string) []interface{} {
+	servers := make([]interface{}, 0)
+	secret, seconds := conf.GetICE()
+	ttl := time.Duration(seconds) * time.Second
+	for _, server := range conf.GetICEServers(conf.Global.NodeDC) {
+		username, credential := server.Username, server.Credential
+		if server.HMAC {
+			username, credential = utils.TURNCredential(secret, uid, ttl)
+		}
+		item := utils.Map("urls", server.URLS)
+		if username != "" {
+			item["username"] = username
+			item["credential"] = credential
+		}
+		servers = append(servers, item)
+	}
+	if secret == "" {
+		return servers
+	}
+	nodes, find := watch.GetNodes("sfu")
+	if !find {
+		return servers
+	}
+	local, other := make([]discovery.Node, 0), make([]discovery.Node, 0)
+	for _, node := range nodes {
+		if node.TURN == "" {
+			continue
+		}
+		if node.NodeDC == signalNode.NodeInfo().NodeDC {
+			local = append(local, node)
+		} else {
+			other = append(other, node)
+		}
+	}
+	if len(local) == 0 {
+		local = other
+	}
+	for _, node := range local {
+		username, credential := utils.TURNCredential(secret, uid, ttl)
+		servers = append(servers, utils.Map("urls", strings.Split(node.TURN, ","), "username", username, "credential", credential))
+	}
+	return servers
+}
+
 // CheckRoom 检查所有的房间
 func CheckRoom() {
 	t := time.NewTicker(statCycle)
 	defer t.Stop()
 	for range t.C {
+		// 关闭过程中由Shutdown清理
+		if isShuttingDown() {
+			return
+		}
 		for rid, room := range rooms.GetRooms() {
-			for uid := range room.GetPeers() {
-				exist := GetExistByUid(rid, uid)
+			for _, peer := range room.GetPeers() {
+				uid, session := peer.ID(), peer.Session()
+				exist := GetExistByUid(rid, uid, session)
 				if !exist {
-					// 获取register RPC句柄
-					regigstRPC := GetRPCHandlerByServiceName("register")
-					if regigstRPC == nil {
+					// 删除数据库信息并通知其他人
+					if err := removePeer(rid, uid, session); err != nil {
 						continue
 					}
-					// 删除数据库流
-					resp, err := regigstRPC.SyncRequest(proto.SignalToRegisterOnStreamRemove, utils.Map("rid", rid, "uid", uid, "mid", ""))
-					rmp := utils.Unmarshal(string(resp))
-					if err == nil {
-						rmPubs, ok := rmp["rmPubs"].(map[string]interface{})
-						if ok {
-							SendNotifyByUid(rid, uid, proto.SignalToClientOnStreamRemove, rmPubs)
-						}
-					} else {
-						logger.Errorf("signal.checkRoom request register streamRemove err, err is %v", err.Reason)
-					}
-					// 删除数据库中用户
-					resp, err = regigstRPC.SyncRequest(proto.SignalToRegisterOnLeave, utils.Map("rid", rid, "uid", uid))
-					rmp = utils.Unmarshal(string(resp))
-					if err != nil {
-
-						SendNotifyByUid(rid, uid, proto.SignalToClientOnLeave, rmp)
-					} else {
-						logger.Errorf("signal.checkRoom request register UserRemove err, err is %v", err.Reason)
-					}
 					// 删除本地对象
-					room.DelPeer(uid)
-					logger.Debugf("room = %s, del peer uid = %s", rid, uid)
+					room.DelPeer(uid, session)
+					logger.Debugf("room = %s, del peer uid = %s, session = %s", rid, uid, session)
 				}
 			}
 			if len(room.GetPeers()) == 0 {
@@ -2,25 +2,25 @@ package src
 
 import (
 	"fmt"
+	"goRTCServer/pkg/bus"
 	"goRTCServer/pkg/logger"
 	"goRTCServer/pkg/proto"
 	"goRTCServer/pkg/utils"
-
-	nprotoo "github.com/cloudwebrtc/nats-protoo"
+	"goRTCServer/server/signal/ws"
 )
 
 // 处理RPC请求 ->reigster
-func handleRPCMsg(request nprotoo.Request, accept nprotoo.RespondFunc, reject nprotoo.RejectFunc) {
+func handleRPCMsg(request bus.Request, accept bus.RespondFunc, reject bus.RejectFunc) {
 	go handleRPCRequest(request, accept, reject)
 }
 
-func handleRPCRequest(req nprotoo.Request, accept nprotoo.RespondFunc, reject nprotoo.RejectFunc) {
+func handleRPCRequest(req bus.Request, accept bus.RespondFunc, reject bus.RejectFunc) {
 	defer utils.Recover("signal.handleRPCRequest")
 	method := req.Method
 	data := utils.Unmarshal(string(req.Data))
 
 	var res map[string]interface{}
-	err := &nprotoo.Error{Code: 400, Reason: fmt.Sprintf("Unknown method [%s]", method)}
+	err := &bus.Error{Code: 400, Reason: fmt.Sprintf("Unknown method [%s]", method)}
 
 	switch method {
 	// 处理和register服务器之间的通信
@@ -29,12 +29,13 @@ func handleRPCRequest(req nprotoo.Request, accept nprotoo.RespondFunc, reject np
 	}
 	if err != nil {
 		reject(err.Code, err.Reason)
+		return
 	}
 	accept(res)
 }
 
 // handleBroadcastMsgs 处理广播消息
-func handleBroadcast(msg nprotoo.Notification, subj string) {
+func handleBroadcast(msg bus.Notification, subj string) {
 	defer utils.Recover("biz.handleBroadcast")
 	logger.Debugf("signal.handleBroadcast msg, msg = %v", msg)
 
@@ -55,6 +56,24 @@ func handleBroadcast(msg nprotoo.Notification, subj string) {
 		NotifyPeersWithoutID(rid, uid, proto.SignalToClientOnStreamRemove, data)
 	case proto.SignalToSignalBroadcast:
 		NotifyPeersWithoutID(rid, uid, proto.SignalToClientBroadcast, data)
+	case proto.SignalToSignalOnMixStart:
+		NotifyPeersWithoutID(rid, uid, proto.SignalToClientOnMixStart, data)
+	case proto.SignalToSignalOnMixStop:
+		NotifyPeersWithoutID(rid, uid, proto.SignalToClientOnMixStop, data)
+	case proto.SignalToSignalOnLobbyJoin:
+		NotifyPeerWithId(rid, utils.Val(data, "host"), proto.SignalToClientOnLobbyJoin, data)
+	case proto.SignalToSignalOnLobbyAdmit:
+		lobbyNotify(rid, uid, proto.SignalToClientOnLobbyAdmit, data)
+	case proto.SignalToSignalOnLobbyDeny:
+		lobbyNotify(rid, uid, proto.SignalToClientOnLobbyDeny, data)
+	case proto.SignalToSignalOnRoomMeta:
+		NotifyPeersWithoutID(rid, uid, proto.SignalToClientOnRoomMeta, data)
+	case proto.SignalToSignalOnUserMeta:
+		NotifyPeersWithoutID(rid, uid, proto.SignalToClientOnUserMeta, data)
+	case proto.SignalToSignalOnStreamUpdate:
+		NotifyPeersWithoutID(rid, uid, proto.SignalToClientOnStreamUpdate, data)
+	case proto.SignalToSignalOnChat:
+		chatNotify(rid, uid, data)
 	case proto.SfuToSignalOnStreamRemove:
 		mid := utils.Val(data, "mid")
 		sfuRemoveStream(rid, uid, mid)
@@ -62,47 +81,103 @@ func handleBroadcast(msg nprotoo.Notification, subj string) {
 }
 
 /*
-	“method” proto.SignalToSignalOnKick "rid" rid "uid" uid
+	“method” proto.SignalToSignalOnKick "rid" rid "uid" uid "session" session
 */
-// 踢出房间
-func peerKick(data map[string]interface{}) (map[string]interface{}, *nprotoo.Error) {
+// 踢出房间, session为空时踢出用户在本节点的所有会话
+func peerKick(data map[string]interface{}) (map[string]interface{}, *bus.Error) {
 	rid := utils.Val(data, "rid")
 	uid := utils.Val(data, "uid")
+	session := utils.Val(data, "session")
+	room := rooms.GetRoom(rid)
 
-	// 获取register句柄
+	// 关闭过程中用户重连到其他节点, 只关闭本地连接, 保留用户的流
+	if isShuttingDown() {
+		if room != nil {
+			room.DelPeer(uid, session)
+		}
+		return utils.Map(), nil
+	}
+	sessions := []string{session}
+	if session == "" {
+		sessions = []string{proto.DefaultSession}
+		if room != nil && len(room.GetSessions(uid)) > 0 {
+			sessions = room.GetSessions(uid)
+		}
+	}
+	for _, s := range sessions {
+		if err := removePeer(rid, uid, s); err != nil {
+			return nil, err
+		}
+		// 删除本地对象
+		if room != nil {
+			room.DelPeer(uid, s)
+		}
+	}
+	return utils.Map(), nil
+}
+
+// kickSession 关闭用户的指定会话, 会话在其他节点时通知该节点踢出
+func kickSession(rid, uid, session, signalId string, peer *ws.Peer) {
+	if signalId != signalNode.NodeInfo().NodeID {
+		if rpcSignal, _ := getRPC(signalId); rpcSignal != nil {
+			rpcSignal.SyncRequest(proto.SignalToSignalOnKick, utils.Map("rid", rid, "uid", uid, "session", session))
+		}
+		return
+	}
+	// 会话在当前节点, 删除数据库信息并关闭旧的连接
+	removePeer(rid, uid, session)
+	room := rooms.GetRoom(rid)
+	if room != nil && room.GetPeer(uid, session) != peer {
+		room.DelPeer(uid, session)
+	}
+}
+
+// removePeer 删除数据库中用户会话的流和会话信息, 通知房间内其他人, last表示用户的最后一个会话已经离开
+func removePeer(rid, uid, session string) *bus.Error {
 	registerRPC := GetRPCHandlerByServiceName("register")
 	if registerRPC == nil {
-		return nil, &nprotoo.Error{Code: -1, Reason: "can't get available register rpc node"}
+		return &bus.Error{Code: codeRegisterRPCErr, Reason: codeStr(codeRegisterRPCErr)}
 	}
-
-	// 删除数据库数据
-	resp, err := registerRPC.SyncRequest(proto.SignalToRegisterOnStreamRemove, utils.Map("rid", rid, "uid", uid, "mid", ""))
-	rmp := utils.Unmarshal(string(resp))
-	if err != nil {
-		rmPubs, ok := rmp["rmPubs"].([]interface{})
-		if ok {
+	// 删除数据库流
+	resp, err := registerRPC.SyncRequest(proto.SignalToRegisterOnStreamRemove, utils.Map("rid", rid, "uid", uid, "session", session, "mid", ""))
+	if err == nil {
+		rmp := utils.Unmarshal(string(resp))
+		if rmPubs, ok := rmp["rmPubs"].([]interface{}); ok {
+			unpublishPubs(rmPubs)
 			SendNotifyByUids(rid, uid, proto.SignalToSignalOnStreamRemove, rmPubs)
 		}
 	} else {
-		logger.Errorf("signal.peerKick request register streamRemove err, err is %v", err.Reason)
+		logger.Errorf("signal.removePeer request register streamRemove err, err is %v", err.Reason)
 	}
 	// 删除数据库的用户
-	resp, err = registerRPC.SyncRequest(proto.SignalToRegisterOnLeave, utils.Map("rid", rid, "uid", uid))
-	rmp = utils.Unmarshal(string(resp))
+	data := utils.Map("rid", rid, "uid", uid, "session", session, "last", true)
+	resp, err = registerRPC.SyncRequest(proto.SignalToRegisterOnLeave, utils.Map("rid", rid, "uid", uid, "session", session))
 	if err != nil {
-		logger.Errorf("signal.peerKick request register UserRemove err, err is %v", err.Reason)
+		logger.Errorf("signal.removePeer request register userLeave err, err is %v", err.Reason)
+	} else {
+		data["last"] = utils.Unmarshal(string(resp))["last"]
 	}
 	// 通知所有人
-	SendNotifyByUids(rid, uid, proto.SignalToSignalOnStreamRemove, rmp["rmPubs"].([]interface{}))
-	// 通知客户端
-	SendNotifyByUid(rid, uid, proto.SignalToRegisterOnLeave, rmp)
+	SendNotifyByUid(rid, uid, proto.SignalToSignalOnLeave, data)
+	return nil
+}
 
-	// 删除本地对象
-	room := rooms.GetRoom(rid)
-	if room != nil {
-		room.DelPeer(uid)
+// unpublishPubs 通知sfu删除已经从register中移除的流, 否则被踢出或超时的会话的流会一直留在sfu上
+func unpublishPubs(rmPubs []interface{}) {
+	for _, v := range rmPubs {
+		pub, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		sfuRPC := GetRPCHandlerByNodeId(utils.Val(pub, "sfuid"))
+		if sfuRPC == nil {
+			continue
+		}
+		_, err := sfuRPC.SyncRequest(proto.SignalToSfuUnPublish, utils.Map("rid", pub["rid"], "mid", pub["mid"]))
+		if err != nil {
+			logger.Errorf("signal.unpublishPubs request sfu unpublish err, err is %v, pub is %v", err.Reason, pub)
+		}
 	}
-	return utils.Map(), nil
 }
 
 // handleBroadCastMsgs 处理广播消息
@@ -128,9 +203,36 @@ func sfuRemoveStream(rid, uid, mid string) {
 	return
 }
 
-// NotifyPeersWithoutID 通知房间内的其他
+// NotifyPeersWithoutID 通知房间内的其他, msg中带session时同一用户的其他会话也会收到
 func NotifyPeersWithoutID(rid, uid, method string, msg map[string]interface{}) {
-	rooms.NotifyWithoutUid(rid, uid, method, msg)
+	rooms.NotifyWithoutUid(rid, uid, utils.Val(msg, "session"), method, msg)
+}
+
+// lobbyNotify 通知等候室中的用户并移出等候室, 用户收到允许后重新join
+func lobbyNotify(rid, uid, method string, msg map[string]interface{}) {
+	room := lobbies.GetRoom(rid)
+	if room == nil {
+		return
+	}
+	room.NotifyWithUid(uid, method, msg)
+	room.RemovePeer(uid, "")
+	if len(room.GetPeers()) == 0 {
+		lobbies.DelRoom(rid)
+	}
+}
+
+// chatNotify 通知本节点的聊天消息接收者, 私聊只通知to中的用户
+func chatNotify(rid, uid string, msg map[string]interface{}) {
+	to, ok := msg["to"].([]interface{})
+	if !ok || len(to) == 0 {
+		NotifyPeersWithoutID(rid, uid, proto.SignalToClientOnChat, msg)
+		return
+	}
+	for _, v := range to {
+		if target := fmt.Sprint(v); target != uid {
+			NotifyPeerWithId(rid, target, proto.SignalToClientOnChat, msg)
+		}
+	}
 }
 
 // NotifyPeerWithID 通知房间内的指定人
@@ -0,0 +1,146 @@
+package src
+
+import (
+	"goRTCServer/pkg/discovery"
+	"goRTCServer/pkg/logger"
+	"goRTCServer/pkg/proto"
+	"goRTCServer/pkg/utils"
+	"goRTCServer/server/signal/conf"
+	"goRTCServer/server/signal/ws"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// shuttingDown 节点正在关闭
+var shuttingDown int32
+
+// isShuttingDown 节点是否正在关闭
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// Shutdown 优雅关闭: 停止接受新的websocket连接, 通知所有用户重连到其他signal节点,
+// 等待用户断开或超时后, 清理register中仍指向本节点的用户. 用户的流保留在sfu和register中, 重连后继续使用
+func Shutdown() {
+	if !atomic.CompareAndSwapInt32(&shuttingDown, 0, 1) {
+		return
+	}
+	timeout := time.Duration(conf.Signal.Shutdown) * time.Second
+	logger.Infof("signal shutting down, wait peers to reconnect for %v", timeout)
+	if wsServer != nil {
+		wsServer.Close()
+	}
+	signalNode.SetDrain(true)
+
+	// 通知重连, 记录需要清理的用户
+	type member struct{ rid, uid, session string }
+	members := make([]member, 0)
+	notify := func(rid string, room *ws.Room, lobby bool) {
+		room.MapPeers(func(uid string, peer *ws.Peer) {
+			if !lobby {
+				members = append(members, member{rid, uid, peer.Session()})
+			}
+			if !peer.Closed() {
+				peer.Notify(proto.SignalToClientReconnect, reconnectInfo(rid, timeout))
+			}
+		})
+	}
+	rooms.MapRooms(func(rid string, room *ws.Room) { notify(rid, room, false) })
+	lobbies.MapRooms(func(rid string, room *ws.Room) { notify(rid, room, true) })
+
+	// 等待用户断开
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) && peerCount() > 0 {
+		time.Sleep(200 * time.Millisecond)
+	}
+	logger.Infof("signal shutdown, %d peers notified, %d peers not moved", len(members), peerCount())
+
+	// 清理仍指向本节点的用户, 已经重连到其他节点的用户不处理
+	for _, m := range members {
+		cleanupPeer(m.rid, m.uid, m.session)
+	}
+	rooms.MapRooms(func(rid string, room *ws.Room) { rooms.DelRoom(rid) })
+	lobbies.MapRooms(func(rid string, room *ws.Room) { lobbies.DelRoom(rid) })
+}
+
+// reconnectInfo 重连通知, 每个用户随机推荐一个其他的signal节点, 没有可用节点时客户端使用原来的地址重连
+func reconnectInfo(rid string, timeout time.Duration) map[string]interface{} {
+	data := utils.Map("rid", rid, "timeout", int(timeout.Seconds()))
+	if node, ok := suggestSignal(); ok {
+		data["signalid"] = node.NodeID
+		data["url"] = node.URL
+	}
+	return data
+}
+
+// suggestSignal 随机获取一个其他的signal节点, 优先本区域
+func suggestSignal() (*discovery.Node, bool) {
+	self := signalNode.NodeInfo()
+	nodes, _ := watch.GetNodes("signal")
+	local := make([]discovery.Node, 0)
+	other := make([]discovery.Node, 0)
+	for _, node := range nodes {
+		if node.NodeID == self.NodeID || node.Drain {
+			continue
+		}
+		if node.NodeDC == self.NodeDC {
+			local = append(local, node)
+		} else {
+			other = append(other, node)
+		}
+	}
+	if len(local) == 0 {
+		local = other
+	}
+	if len(local) == 0 {
+		return nil, false
+	}
+	node := local[rand.Intn(len(local))]
+	return &node, true
+}
+
+// peerCount 本节点上还没有断开的用户数
+func peerCount() int {
+	count := 0
+	for _, list := range []*ws.Rooms{rooms, lobbies} {
+		list.MapRooms(func(rid string, room *ws.Room) {
+			room.MapPeers(func(uid string, peer *ws.Peer) {
+				if !peer.Closed() {
+					count++
+				}
+			})
+		})
+	}
+	return count
+}
+
+// dropPeer 从本地房间和等候室中移除断开的连接, 不修改register
+func dropPeer(peer *ws.Peer) {
+	uid, session := peer.ID(), peer.Session()
+	for _, list := range []*ws.Rooms{rooms, lobbies} {
+		list.MapRooms(func(rid string, room *ws.Room) {
+			if room.GetPeer(uid, session) == peer {
+				room.RemovePeer(uid, session)
+			}
+		})
+	}
+}
+
+// cleanupPeer 用户会话没有重连到其他节点时删除register中的会话并通知房间内其他人, 保留用户的流
+func cleanupPeer(rid, uid, session string) {
+	registerRPC := GetRPCHandlerByServiceName("register")
+	if registerRPC == nil {
+		return
+	}
+	resp, err := registerRPC.SyncRequest(proto.SignalToRegisterGetSignalInfo, utils.Map("rid", rid, "uid", uid, "session", session))
+	if err != nil || utils.Val(utils.Unmarshal(string(resp)), "signalid") != signalNode.NodeInfo().NodeID {
+		return
+	}
+	resp, err = registerRPC.SyncRequest(proto.SignalToRegisterOnLeave, utils.Map("rid", rid, "uid", uid, "session", session))
+	if err != nil {
+		logger.Errorf("signal.cleanupPeer request register userLeave err, err is %v", err.Reason)
+		return
+	}
+	SendNotifyByUid(rid, uid, proto.SignalToSignalOnLeave, utils.Map("rid", rid, "uid", uid, "session", session, "last", utils.Unmarshal(string(resp))["last"]))
+}
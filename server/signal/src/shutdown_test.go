@@ -0,0 +1,54 @@
+package src
+
+import (
+	"goRTCServer/pkg/discovery"
+	"testing"
+	"time"
+)
+
+// addSignal 注册一个signal节点
+func addSignal(t *testing.T, registry *discovery.Memory, dc, nid string, drain bool) {
+	t.Helper()
+	node := registry.NewNode(dc, nid, "signal")
+	node.SetURL("wss://" + nid + "/ws")
+	if err := node.RegisterNode(); err != nil {
+		t.Fatalf("register node err, err is %v", err)
+	}
+	if drain {
+		node.SetDrain(true)
+	}
+	t.Cleanup(node.Close)
+}
+
+func TestReconnectInfoSuggestsOtherSignal(t *testing.T) {
+	registry := discovery.NewMemory()
+	oldNode, oldWatch := signalNode, watch
+	t.Cleanup(func() { signalNode, watch = oldNode, oldWatch })
+	signalNode = registry.NewNode("dc1", "signal_self", "signal")
+	signalNode.RegisterNode()
+	t.Cleanup(signalNode.Close)
+	watch = registry.NewWatcher()
+	t.Cleanup(watch.Close)
+
+	// 没有其他节点时不推荐, 客户端使用原地址重连
+	info := reconnectInfo("room", 30*time.Second)
+	if info["url"] != nil || info["timeout"] != 30 || info["rid"] != "room" {
+		t.Fatalf("reconnect info without other signal is %v", info)
+	}
+
+	// 排空中的节点不推荐, 本区域没有时推荐其他区域
+	addSignal(t, registry, "dc1", "signal_drain", true)
+	addSignal(t, registry, "dc2", "signal_remote", false)
+	info = reconnectInfo("room", 30*time.Second)
+	if info["signalid"] != "signal_remote" || info["url"] != "wss://signal_remote/ws" {
+		t.Fatalf("reconnect info should suggest signal_remote, info is %v", info)
+	}
+
+	// 优先本区域
+	addSignal(t, registry, "dc1", "signal_local", false)
+	for i := 0; i < 10; i++ {
+		if info = reconnectInfo("room", 30*time.Second); info["signalid"] != "signal_local" {
+			t.Fatalf("reconnect info should suggest signal_local, info is %v", info)
+		}
+	}
+}
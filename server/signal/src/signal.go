@@ -2,6 +2,7 @@ package src
 
 import (
 	"goRTCServer/pkg/logger"
+	"goRTCServer/pkg/proto"
 	"goRTCServer/pkg/utils"
 	"goRTCServer/server/signal/ws"
 	"net/http"
@@ -9,14 +10,22 @@ import (
 	"github.com/cloudwebrtc/go-protoo/transport"
 )
 
-// InitSignalServer 初始化ws
-func InitSignalServer(host string, port string, cert, key string) {
+// wsServer websocket服务, 关闭时停止接受新连接
+var wsServer *ws.WebSocketServer
+
+// InitSignalServer 初始化ws, 配置了证书时使用WSS
+func InitSignalServer(host string, port string, cert, key string, redirect string, origins []string) {
 	config := ws.DefaultConfig()
 	config.Host = host
 	config.Port = port
 	config.CertFile = cert
 	config.KeyFile = key
-	wsServer := ws.NewWebSocketServer(handler)
+	config.RedirectPort = redirect
+	config.AllowOrigins = origins
+	if len(origins) == 0 {
+		logger.Warnf("signal.origins is empty, websocket only accepts same-origin and non-browser clients, set origins to allow other web origins")
+	}
+	wsServer = ws.NewWebSocketServer(handler)
 	go wsServer.Bind(config)
 }
 
@@ -28,7 +37,16 @@ func handler(transport *transport.WebSocketTransport, request *http.Request) {
 		return
 	}
 	id := peerID[0]
-	peer := ws.NewPeer(id, transport)
+	// 同一用户的多个连接(多标签页、多设备)通过session区分
+	session := vars.Get("session")
+	if session == "" {
+		session = proto.DefaultSession
+	}
+	if !validSession(session) {
+		logger.Warnf("invalid session %q, peer is %s", session, id)
+		return
+	}
+	peer := ws.NewPeer(id, session, transport)
 
 	handleRequest := func(req map[string]interface{}, accept ws.AcceptFunc, reject ws.RejectFunc) {
 		defer utils.Recover("signal handleRequest")
@@ -64,6 +82,10 @@ func handler(transport *transport.WebSocketTransport, request *http.Request) {
 		handlerWebSocket(method, peer, msg, ws.DefaultAccept, ws.DefaultReject)
 	}
 	handleClose := func(codoe int, err string) {
+		// 关闭过程中用户断开即认为已经重连到其他节点
+		if isShuttingDown() {
+			dropPeer(peer)
+		}
 		peer.Close()
 	}
 	peer.On("req", handleRequest)
@@ -71,3 +93,31 @@ func handler(transport *transport.WebSocketTransport, request *http.Request) {
 	peer.On("close", handleClose)
 	peer.On("error", handleClose)
 }
+
+// validSession session只能包含字母、数字和"_.-", 最长64个字符
+func validSession(session string) bool {
+	if len(session) > 64 {
+		return false
+	}
+	for _, c := range session {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// ownerOrHost 判断uid是否为流的发布者或房间主持人
+func ownerOrHost(rid, uid, mid string) bool {
+	return proto.GetUIDFromMID(mid) == uid || IsRoomHost(rid, uid)
+}
+
+// ownerOrHostAll 是否是所有流的发布者或者房间主持人
+func ownerOrHostAll(rid, uid string, mids []string) bool {
+	for _, mid := range mids {
+		if proto.GetUIDFromMID(mid) != uid {
+			return IsRoomHost(rid, uid)
+		}
+	}
+	return true
+}
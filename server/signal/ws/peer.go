@@ -1,7 +1,9 @@
 package ws
 
 import (
+	"encoding/json"
 	"goRTCServer/pkg/logger"
+	"sync/atomic"
 
 	peer "github.com/cloudwebrtc/go-protoo/peer"
 	"github.com/cloudwebrtc/go-protoo/transport"
@@ -10,22 +12,75 @@ import (
 // peer 对象
 type Peer struct {
 	peer.Peer
+	session string
+	closed  int32
 }
 
-// 新建peer对象
-func NewPeer(uid string, t *transport.WebSocketTransport) *Peer {
+// 新建peer对象, 同一用户的多个连接通过session区分
+func NewPeer(uid, session string, t *transport.WebSocketTransport) *Peer {
 	return &Peer{
-		*peer.NewPeer(uid, t),
+		Peer:    *peer.NewPeer(uid, t),
+		session: session,
 	}
 }
 
-// On 事件处理
+// Session 连接的会话
+func (p *Peer) Session() string {
+	return p.session
+}
+
+// On 事件处理, 在单独的goroutine中读取peer的事件通道并按顺序回调
+// req: func(map[string]interface{}, AcceptFunc, RejectFunc)
+// notification: func(map[string]interface{})
+// close: func(int, string)
 func (p *Peer) On(event, listener interface{}) {
-	p.On(event, listener)
+	switch event {
+	case "req":
+		if fn, ok := listener.(func(map[string]interface{}, AcceptFunc, RejectFunc)); ok {
+			go func() {
+				for req := range p.OnRequest {
+					respond := req.Accept
+					fn(message(req.Request.Method, req.Request.Data), func(data json.RawMessage) { respond(data) }, RejectFunc(req.Reject))
+				}
+			}()
+		}
+	case "notification":
+		if fn, ok := listener.(func(map[string]interface{})); ok {
+			go func() {
+				for n := range p.OnNotification {
+					fn(message(n.Method, n.Data))
+				}
+			}()
+		}
+	case "close":
+		if fn, ok := listener.(func(int, string)); ok {
+			go func() {
+				err := <-p.OnClose
+				atomic.StoreInt32(&p.closed, 1)
+				fn(err.Code, err.Text)
+			}()
+		}
+	}
+}
+
+// message 转换为method和data组成的map
+func message(method string, data json.RawMessage) map[string]interface{} {
+	msg := map[string]interface{}{"method": method}
+	var mp map[string]interface{}
+	if err := json.Unmarshal(data, &mp); err == nil && mp != nil {
+		msg["data"] = mp
+	}
+	return msg
 }
 
 // Close peer关闭
 func (p *Peer) Close() {
 	logger.LogKf.Debugf("Close Room Peer is %s", p.ID())
+	atomic.StoreInt32(&p.closed, 1)
 	p.Peer.Close()
 }
+
+// Closed 连接是否已经关闭
+func (p *Peer) Closed() bool {
+	return atomic.LoadInt32(&p.closed) == 1
+}
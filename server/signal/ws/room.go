@@ -25,73 +25,117 @@ func (r *Room) ID() string {
 	return r.id
 }
 
+// peerKey 房间内peer的key, 同一用户的每个会话单独保存
+func peerKey(uid, session string) string {
+	return uid + "/" + session
+}
+
 // AddPeer 新增peer
 func (r *Room) AddPeer(peer *Peer) {
-	uid := peer.ID()
-	r.DelPeer(uid)
+	uid, session := peer.ID(), peer.Session()
+	// 同一个连接重复加入不关闭
+	if r.GetPeer(uid, session) != peer {
+		r.DelPeer(uid, session)
+	}
 	r.peersMutex.Lock()
 	defer r.peersMutex.Unlock()
-	r.peers[uid] = peer
+	r.peers[peerKey(uid, session)] = peer
 	//
 }
 
-// DelPeer 删除peer
-func (r *Room) DelPeer(uid string) {
+// DelPeer 删除peer, session为空时删除用户所有的会话
+func (r *Room) DelPeer(uid, session string) {
 	r.peersMutex.Lock()
 	defer r.peersMutex.Unlock()
-	if r.peers[uid] != nil {
-		r.peers[uid].Close()
-		delete(r.peers, uid)
+	for key, peer := range r.peers {
+		if match(peer, uid, session) {
+			peer.Close()
+			delete(r.peers, key)
+		}
+	}
+}
+
+// RemovePeer 移除peer, 不关闭连接, session为空时移除用户所有的会话
+func (r *Room) RemovePeer(uid, session string) {
+	r.peersMutex.Lock()
+	defer r.peersMutex.Unlock()
+	for key, peer := range r.peers {
+		if match(peer, uid, session) {
+			delete(r.peers, key)
+		}
 	}
 }
 
 // GetPeer 获取Peer
-func (r *Room) GetPeer(uid string) *Peer {
+func (r *Room) GetPeer(uid, session string) *Peer {
 	r.peersMutex.Lock()
 	defer r.peersMutex.Unlock()
-	if peer, ok := r.peers[uid]; ok {
+	if peer, ok := r.peers[peerKey(uid, session)]; ok {
 		return peer
 	}
 	return nil
 }
 
-// GetPeers 获取peers
+// GetSessions 获取用户在本房间的所有会话
+func (r *Room) GetSessions(uid string) []string {
+	r.peersMutex.Lock()
+	defer r.peersMutex.Unlock()
+	sessions := make([]string, 0)
+	for _, peer := range r.peers {
+		if peer.ID() == uid {
+			sessions = append(sessions, peer.Session())
+		}
+	}
+	return sessions
+}
+
+// GetPeers 获取peers的副本, 遍历时不受并发加入和离开的影响
 func (r *Room) GetPeers() map[string]*Peer {
-	return r.peers
+	r.peersMutex.Lock()
+	defer r.peersMutex.Unlock()
+	peers := make(map[string]*Peer, len(r.peers))
+	for key, peer := range r.peers {
+		peers[key] = peer
+	}
+	return peers
 }
 
-// MapPeers 遍历所有的peer
+// MapPeers 遍历所有的peer, 回调参数为uid
 func (r *Room) MapPeers(fn func(string, *Peer)) {
 	r.peersMutex.Lock()
 	defer r.peersMutex.Unlock()
-	for uid, peer := range r.peers {
-		fn(uid, peer)
+	for _, peer := range r.peers {
+		fn(peer.ID(), peer)
 	}
 }
 
-// NotifyWithUid 通知房间内的指定人
+// NotifyWithUid 通知房间内的指定人, 用户的所有会话都会收到
 func (r *Room) NotifyWithUid(uid, method string, data map[string]interface{}) {
 	r.peersMutex.Lock()
 	defer r.peersMutex.Unlock()
-	for id, peer := range r.peers {
-		if uid == id {
+	for _, peer := range r.peers {
+		if peer.ID() == uid {
 			peer.Notify(method, data)
-			break
 		}
 	}
 }
 
-// NotifyWithoutUid 通知房间里面其他人
-func (r *Room) NotifyWithoutUid(fuid, method string, data map[string]interface{}) {
+// NotifyWithoutUid 通知房间里面其他人, fsession为空时不通知fuid所有的会话, 否则只跳过该会话
+func (r *Room) NotifyWithoutUid(fuid, fsession, method string, data map[string]interface{}) {
 	r.peersMutex.Lock()
 	defer r.peersMutex.Unlock()
-	for uid, peer := range r.peers {
-		if uid != fuid {
+	for _, peer := range r.peers {
+		if !match(peer, fuid, fsession) {
 			peer.Notify(method, data)
 		}
 	}
 }
 
+// match peer是否是uid的指定会话, session为空时匹配uid所有的会话
+func match(peer *Peer, uid, session string) bool {
+	return peer.ID() == uid && (session == "" || peer.Session() == session)
+}
+
 // NotifyAll 通知房间里面所有人
 func (r *Room) NotifyAll(method string, data map[string]interface{}) {
 	r.peersMutex.Lock()
@@ -17,12 +17,12 @@ func NewRooms() *Rooms {
 
 // AddRoom 新增room
 func (r *Rooms) AddRoom(rid string) *Room {
-	room := r.GetRoom(rid)
+	r.Lock()
+	defer r.Unlock()
+	room := r.roomMap[rid]
 	if room == nil {
 		room = NewRoom(rid)
-		r.Lock()
 		r.roomMap[rid] = room
-		r.Unlock()
 	}
 	return room
 }
@@ -47,25 +47,44 @@ func (r *Rooms) GetRoom(rid string) *Room {
 	return nil
 }
 
-// GetRoom 获取rooms
+// MapRooms 遍历所有的room, 回调中可以增删room
+func (r *Rooms) MapRooms(fn func(string, *Room)) {
+	r.Lock()
+	list := make(map[string]*Room, len(r.roomMap))
+	for rid, room := range r.roomMap {
+		list[rid] = room
+	}
+	r.Unlock()
+	for rid, room := range list {
+		fn(rid, room)
+	}
+}
+
+// GetRooms 获取rooms的副本, 遍历时不受并发创建和删除的影响
 func (r *Rooms) GetRooms() map[string]*Room {
-	return r.roomMap
+	r.Lock()
+	defer r.Unlock()
+	rooms := make(map[string]*Room, len(r.roomMap))
+	for rid, room := range r.roomMap {
+		rooms[rid] = room
+	}
+	return rooms
 }
 
 // NotifyWithUid 通知房间指定人
 func (r *Rooms) NotifyWithUid(rid, uid, method string, data map[string]interface{}) {
-	room := r.roomMap[rid]
+	room := r.GetRoom(rid)
 	if room != nil {
 		room.NotifyWithUid(uid, method, data)
 	}
 	return
 }
 
-// NotifyWithoutUid 通知房间里面其他人
-func (r *Rooms) NotifyWithoutUid(rid, fuid, method string, data map[string]interface{}) {
+// NotifyWithoutUid 通知房间里面其他人, fsession为空时不通知fuid所有的会话
+func (r *Rooms) NotifyWithoutUid(rid, fuid, fsession, method string, data map[string]interface{}) {
 	room := r.GetRoom(rid)
 	if room != nil {
-		room.NotifyWithoutUid(fuid, method, data)
+		room.NotifyWithoutUid(fuid, fsession, method, data)
 	}
 }
 
@@ -0,0 +1,121 @@
+package ws
+
+import (
+	"crypto/tls"
+	"goRTCServer/pkg/confutil"
+	"goRTCServer/pkg/logger"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// certLoader 加载TLS证书, 证书或私钥文件变化(如证书续期)时重新加载, 加载失败时继续使用原来的证书
+type certLoader struct {
+	certFile string
+	keyFile  string
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+	stops    []func()
+}
+
+// newCertLoader 加载证书并监控证书文件
+func newCertLoader(certFile, keyFile string) (*certLoader, error) {
+	c := &certLoader{certFile: certFile, keyFile: keyFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	for _, file := range []string{certFile, keyFile} {
+		stop, err := confutil.Watch(file, c.reload)
+		if err != nil {
+			logger.Errorf("watch cert file %s err, err is %v", file, err)
+			continue
+		}
+		c.stops = append(c.stops, stop)
+	}
+	return c, nil
+}
+
+func (c *certLoader) load() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	c.cert = &cert
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *certLoader) reload() {
+	if err := c.load(); err != nil {
+		logger.Errorf("reload cert %s err, keep current cert, err is %v", c.certFile, err)
+		return
+	}
+	logger.Infof("cert %s reloaded", c.certFile)
+}
+
+// getCertificate tls.Config.GetCertificate, 每次握手使用最新的证书
+func (c *certLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cert, nil
+}
+
+// close 停止监控证书文件
+func (c *certLoader) close() {
+	for _, stop := range c.stops {
+		stop()
+	}
+}
+
+// redirectHandler 把http请求重定向到https端口
+func redirectHandler(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// checkOrigin 按白名单检查websocket请求的Origin, 支持"*"(所有)、完整的origin(https://example.com)
+// 和子域名通配(*.example.com, 不限协议和端口). 没有Origin的请求(非浏览器客户端)和同源请求总是允许
+func checkOrigin(origins []string) func(req *http.Request) bool {
+	return func(req *http.Request) bool {
+		origin := req.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		if strings.EqualFold(u.Host, req.Host) {
+			return true
+		}
+		host := strings.ToLower(u.Hostname())
+		for _, allow := range origins {
+			allow = strings.ToLower(strings.TrimSuffix(allow, "/"))
+			switch {
+			case allow == "*":
+				return true
+			case strings.HasPrefix(allow, "*."):
+				if strings.HasSuffix(host, allow[1:]) {
+					return true
+				}
+			case strings.EqualFold(origin, allow):
+				return true
+			}
+		}
+		logger.Warnf("websocket origin %s not allowed", origin)
+		return false
+	}
+}
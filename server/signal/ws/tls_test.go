@@ -0,0 +1,77 @@
+package ws
+
+import (
+	"goRTCServer/pkg/logger"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	logger.DoInit("", "ws_test")
+	os.Exit(m.Run())
+}
+
+func TestCheckOrigin(t *testing.T) {
+	cases := []struct {
+		name    string
+		origins []string
+		host    string
+		origin  string
+		allow   bool
+	}{
+		{"no origin", nil, "signal.example.com:8443", "", true},
+		{"same origin", nil, "signal.example.com:8443", "https://signal.example.com:8443", true},
+		{"same host other port", nil, "signal.example.com:8443", "https://signal.example.com", false},
+		{"empty list", nil, "signal.example.com:8443", "https://app.example.com", false},
+		{"invalid origin", []string{"*"}, "signal.example.com", "://bad", false},
+		{"all", []string{"*"}, "signal.example.com", "https://evil.com", true},
+		{"exact", []string{"https://app.example.com"}, "signal.example.com", "https://app.example.com", true},
+		{"exact trailing slash and case", []string{"HTTPS://App.Example.com/"}, "signal.example.com", "https://app.example.com", true},
+		{"exact other scheme", []string{"https://app.example.com"}, "signal.example.com", "http://app.example.com", false},
+		{"exact other port", []string{"https://app.example.com"}, "signal.example.com", "https://app.example.com:8443", false},
+		{"wildcard subdomain", []string{"*.example.com"}, "signal.other.com", "https://app.example.com", true},
+		{"wildcard deep subdomain any scheme and port", []string{"*.example.com"}, "signal.other.com", "http://a.b.example.com:3000", true},
+		{"wildcard not apex", []string{"*.example.com"}, "signal.other.com", "https://example.com", false},
+		{"wildcard not suffix match", []string{"*.example.com"}, "signal.other.com", "https://evilexample.com", false},
+		{"wildcard not prefix match", []string{"*.example.com"}, "signal.other.com", "https://example.com.evil.com", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://"+c.host+"/ws", nil)
+			if c.origin != "" {
+				req.Header.Set("Origin", c.origin)
+			}
+			if got := checkOrigin(c.origins)(req); got != c.allow {
+				t.Fatalf("checkOrigin(%v) origin %q host %q is %v, want %v", c.origins, c.origin, c.host, got, c.allow)
+			}
+		})
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	cases := []struct {
+		name   string
+		port   string
+		target string
+		want   string
+	}{
+		{"default port", "443", "http://example.com/ws?peer=a", "https://example.com/ws?peer=a"},
+		{"drop http port", "443", "http://example.com:80/ws", "https://example.com/ws"},
+		{"custom port", "8443", "http://example.com/ws", "https://example.com:8443/ws"},
+		{"custom port replaces http port", "8443", "http://example.com:8080/", "https://example.com:8443/"},
+		{"ipv4", "8443", "http://10.0.0.1:80/ws", "https://10.0.0.1:8443/ws"},
+		{"ipv6 default port", "443", "http://[::1]:80/ws", "https://[::1]/ws"},
+		{"ipv6 custom port", "8443", "http://[::1]:80/ws", "https://[::1]:8443/ws"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			redirectHandler(c.port).ServeHTTP(w, httptest.NewRequest(http.MethodGet, c.target, nil))
+			if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != c.want {
+				t.Fatalf("redirect %s is %d %s, want %s", c.target, w.Code, w.Header().Get("Location"), c.want)
+			}
+		})
+	}
+}
@@ -1,9 +1,11 @@
 package ws
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"goRTCServer/pkg/logger"
 	"net/http"
+	"sync"
 
 	"github.com/cloudwebrtc/go-protoo/peer"
 	"github.com/cloudwebrtc/go-protoo/transport"
@@ -41,6 +43,8 @@ type WebSocketServerConfig struct {
 	KeyFile       string
 	HTMLRoot      string
 	WebsocketPath string
+	RedirectPort  string   // 配置证书时在该端口把http重定向到https, 为空不启用
+	AllowOrigins  []string // 允许的Origin, 为空时只允许同源和非浏览器客户端
 }
 
 func DefaultConfig() WebSocketServerConfig {
@@ -56,6 +60,10 @@ func DefaultConfig() WebSocketServerConfig {
 type WebSocketServer struct {
 	handleWebSocket func(ws *transport.WebSocketTransport, req *http.Request)
 	upgrader        websocket.Upgrader
+	certs           *certLoader
+	lock            sync.Mutex
+	servers         []*http.Server
+	closed          bool
 }
 
 // 新建一个websocket对象
@@ -63,27 +71,96 @@ func NewWebSocketServer(handler func(ws *transport.WebSocketTransport, req *http
 	var server = &WebSocketServer{
 		handleWebSocket: handler,
 	}
-	server.upgrader = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
-	}
 	return server
 }
 
 func (w *WebSocketServer) handleWebSocketRequest(writer http.ResponseWriter, req *http.Request) {
+	if w.isClosed() {
+		http.Error(writer, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
 	respHeader := http.Header{}
 	socket, err := w.upgrader.Upgrade(writer, req, respHeader)
 	if err != nil {
-		panic(err)
+		logger.Debugf("websocket upgrade err, err is %v", err)
+		return
 	}
 	wsTransPort := transport.NewWebSocketTransport(socket)
 	w.handleWebSocket(wsTransPort, req)
+	go wsTransPort.WriteLoop()
 	wsTransPort.ReadLoop()
 }
 
+// Bind 监听websocket, 配置了证书和私钥时使用WSS
 func (w *WebSocketServer) Bind(cfg WebSocketServerConfig) {
+	w.upgrader = websocket.Upgrader{CheckOrigin: checkOrigin(cfg.AllowOrigins)}
 	http.HandleFunc(cfg.WebsocketPath, w.handleWebSocketRequest)
-	logger.LogKf.Debugf("non-TLS websocketserver listening on : %d, %d", cfg.Host, cfg.Port)
-	panic(http.ListenAndServe(cfg.Host+":"+cfg.Port, nil))
+	addr := cfg.Host + ":" + cfg.Port
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		server := w.addServer(&http.Server{Addr: addr})
+		logger.LogKf.Debugf("non-TLS websocketserver listening on %s", addr)
+		serve(server.ListenAndServe())
+		return
+	}
+
+	certs, err := newCertLoader(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		panic(err)
+	}
+	w.lock.Lock()
+	w.certs = certs
+	w.lock.Unlock()
+	if cfg.RedirectPort != "" {
+		redirect := w.addServer(&http.Server{Addr: cfg.Host + ":" + cfg.RedirectPort, Handler: redirectHandler(cfg.Port)})
+		go func() {
+			logger.LogKf.Debugf("http redirect listening on %s", redirect.Addr)
+			serve(redirect.ListenAndServe())
+		}()
+	}
+	server := w.addServer(&http.Server{
+		Addr:      addr,
+		TLSConfig: &tls.Config{GetCertificate: certs.getCertificate, MinVersion: tls.VersionTLS12},
+	})
+	logger.LogKf.Debugf("TLS websocketserver listening on %s", addr)
+	serve(server.ListenAndServeTLS("", ""))
+}
+
+// addServer 记录监听的server, 用于关闭, 已经关闭时不再监听
+func (w *WebSocketServer) addServer(server *http.Server) *http.Server {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.servers = append(w.servers, server)
+	if w.closed {
+		server.Close()
+	}
+	return server
+}
+
+// serve 监听失败时退出, 正常关闭时返回
+func serve(err error) {
+	if err != http.ErrServerClosed {
+		panic(err)
+	}
+}
+
+func (w *WebSocketServer) isClosed() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.closed
+}
+
+// Close 停止接受新的websocket连接, 已经建立的连接不受影响
+func (w *WebSocketServer) Close() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return
+	}
+	w.closed = true
+	for _, server := range w.servers {
+		server.Close()
+	}
+	if w.certs != nil {
+		w.certs.close()
+	}
 }
@@ -0,0 +1,42 @@
+package e2e
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestChatLimits(t *testing.T) {
+	a := dial(t, "chatlim_a")
+	a.join("room_chatlim")
+
+	// 超过[chat] maxbytes
+	_, err := a.request("chat", map[string]interface{}{"rid": "room_chatlim", "text": strings.Repeat("a", 5000)})
+	var rerr *requestError
+	if !errors.As(err, &rerr) || rerr.Code != 421 {
+		t.Fatalf("oversized chat should be rejected with 421, err is %v", err)
+	}
+
+	// 超过[chat] maxlimit
+	_, err = a.request("chat_history", map[string]interface{}{"rid": "room_chatlim", "limit": 1000})
+	if !errors.As(err, &rerr) || rerr.Code != 422 {
+		t.Fatalf("chat history over the limit should be rejected with 422, err is %v", err)
+	}
+	a.mustRequest("chat_history", map[string]interface{}{"rid": "room_chatlim", "limit": 100})
+
+	// 每秒最多5条, 11条跨过一秒边界也至少有一条被拒绝
+	limited := false
+	for i := 0; i < 11; i++ {
+		_, err = a.request("chat", map[string]interface{}{"rid": "room_chatlim", "text": "hi"})
+		if errors.As(err, &rerr) && rerr.Code == 423 {
+			limited = true
+			break
+		}
+		if err != nil {
+			t.Fatalf("chat err, err is %v", err)
+		}
+	}
+	if !limited {
+		t.Fatalf("chat should be rate limited")
+	}
+}
@@ -0,0 +1,53 @@
+package e2e
+
+import (
+	"goRTCServer/pkg/proto"
+	"testing"
+)
+
+func TestMuteStopsForwarding(t *testing.T) {
+	a := dial(t, "mute_a")
+	b := dial(t, "mute_b")
+	a.join("room_mute")
+	b.join("room_mute")
+
+	p := a.publish("room_mute")
+	s := b.subscribe(p)
+	s.waitMedia(t)
+
+	a.mustRequest("mute", map[string]interface{}{"rid": "room_mute", "mid": p.mid, "kind": "video"})
+	b.waitNotify(proto.SignalToClientOnStreamUpdate, field("mid", p.mid))
+	waitFlow(t, &s.video, false, "video stop after mute")
+	waitFlow(t, &s.audio, true, "audio keep after mute")
+
+	a.mustRequest("unmute", map[string]interface{}{"rid": "room_mute", "mid": p.mid, "kind": "video"})
+	waitFlow(t, &s.video, true, "video resume after unmute")
+
+	// 只能静音自己发布的流
+	if _, err := b.request("mute", map[string]interface{}{"rid": "room_mute", "mid": p.mid, "kind": "audio"}); err == nil {
+		t.Fatalf("mute others stream should be rejected")
+	}
+}
+
+func TestPauseSub(t *testing.T) {
+	a := dial(t, "pause_a")
+	b := dial(t, "pause_b")
+	a.join("room_pause")
+	b.join("room_pause")
+
+	p := a.publish("room_pause")
+	s := b.subscribe(p)
+	s.waitMedia(t)
+
+	// audioOnly只暂停视频, 继续接收音频
+	b.mustRequest("pause_sub", map[string]interface{}{"rid": "room_pause", "mid": p.mid, "sid": s.sid, "audioOnly": true})
+	waitFlow(t, &s.video, false, "video stop after pause")
+	waitFlow(t, &s.audio, true, "audio keep after audioOnly pause")
+
+	b.mustRequest("pause_sub", map[string]interface{}{"rid": "room_pause", "mid": p.mid, "sid": s.sid})
+	waitFlow(t, &s.audio, false, "audio stop after pause")
+
+	b.mustRequest("resume_sub", map[string]interface{}{"rid": "room_pause", "mid": p.mid, "sid": s.sid})
+	waitFlow(t, &s.audio, true, "audio resume")
+	waitFlow(t, &s.video, true, "video resume")
+}
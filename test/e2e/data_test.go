@@ -0,0 +1,89 @@
+package e2e
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// dataReceiver 订阅端在offer中带上数据通道, 接收sfu创建的可靠通道上的消息
+type dataReceiver struct {
+	open chan struct{}
+	msgs chan string
+}
+
+func newDataReceiver() *dataReceiver {
+	return &dataReceiver{open: make(chan struct{}), msgs: make(chan string, 16)}
+}
+
+// setup 添加探测通道使offer带有m=application, 并接收sfu的reliable通道
+func (r *dataReceiver) setup(t *testing.T) func(pc *webrtc.PeerConnection) {
+	return func(pc *webrtc.PeerConnection) {
+		if _, err := pc.CreateDataChannel("probe", nil); err != nil {
+			t.Fatalf("create data channel err, err is %v", err)
+		}
+		pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+			if dc.Label() != "reliable" {
+				return
+			}
+			dc.OnOpen(func() { close(r.open) })
+			dc.OnMessage(func(msg webrtc.DataChannelMessage) { r.msgs <- string(msg.Data) })
+		})
+	}
+}
+
+// next 等待下一条消息
+func (r *dataReceiver) next(t *testing.T) string {
+	t.Helper()
+	select {
+	case msg := <-r.msgs:
+		return msg
+	case <-time.After(mediaTimeout):
+		t.Fatalf("wait data message timeout")
+	}
+	return ""
+}
+
+func TestDataChannelForward(t *testing.T) {
+	a := dial(t, "data_a")
+	b := dial(t, "data_b")
+	c := dial(t, "data_c")
+	for _, cl := range []*client{a, b, c} {
+		cl.join("room_data")
+	}
+
+	var dc *webrtc.DataChannel
+	dcOpen := make(chan struct{})
+	p := a.publishWith("room_data", func(pc *webrtc.PeerConnection) {
+		var err error
+		if dc, err = pc.CreateDataChannel("reliable", nil); err != nil {
+			t.Fatalf("create data channel err, err is %v", err)
+		}
+		dc.OnOpen(func() { close(dcOpen) })
+	})
+	rb, rc := newDataReceiver(), newDataReceiver()
+	b.subscribeWith(p, rb.setup(t))
+	c.subscribeWith(p, rc.setup(t))
+	for _, ch := range []chan struct{}{dcOpen, rb.open, rc.open} {
+		waitConnected(t, ch)
+	}
+
+	// 指定接收者的消息只转发给data_b, 并去掉外层的to
+	if err := dc.SendText(`{"to":["data_b"],"data":{"n":1}}`); err != nil {
+		t.Fatalf("send text err, err is %v", err)
+	}
+	if err := dc.SendText(`{"n":2}`); err != nil {
+		t.Fatalf("send text err, err is %v", err)
+	}
+	if msg := rb.next(t); msg != `{"n":1}` {
+		t.Fatalf("data_b first message should be the directed one, msg is %s", msg)
+	}
+	if msg := rb.next(t); msg != `{"n":2}` {
+		t.Fatalf("data_b second message should be the broadcast, msg is %s", msg)
+	}
+	// 通道有序, data_c收到的第一条消息就是广播
+	if msg := rc.next(t); msg != `{"n":2}` {
+		t.Fatalf("data_c should only receive the broadcast, msg is %s", msg)
+	}
+}
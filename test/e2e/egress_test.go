@@ -0,0 +1,202 @@
+package e2e
+
+import (
+	"bytes"
+	"errors"
+	sfuConf "goRTCServer/server/sfu/conf"
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartRTMPRejectsUnlistedURL(t *testing.T) {
+	a := dial(t, "rtmp_a")
+	a.join("room_rtmp")
+	p := a.publish("room_rtmp")
+
+	// 本地文件和不在[rtmp] allow中的服务器都不允许
+	for _, url := range []string{"/tmp/out.flv", "file:///tmp/out.flv", "rtmp://evil.example.com/app/key"} {
+		_, err := a.request("startrtmp", map[string]interface{}{"rid": "room_rtmp", "mids": []string{p.mid}, "url": url})
+		var rerr *requestError
+		if !errors.As(err, &rerr) || !strings.Contains(rerr.Reason, "rtmp") {
+			t.Fatalf("startrtmp %s should be rejected, err is %v", url, err)
+		}
+	}
+}
+
+func TestStartHLS(t *testing.T) {
+	a := dial(t, "hls_a")
+	a.join("room_hls")
+	p := a.publish("room_hls")
+
+	req := map[string]interface{}{"rid": "room_hls", "mid": p.mid, "sfuid": p.sfuid}
+	if _, err := exec.LookPath(sfuConf.FFmpeg.Path); err != nil {
+		// 没有ffmpeg时开启失败
+		if _, err := a.request("starthls", req); err == nil {
+			t.Fatalf("starthls without ffmpeg should fail")
+		}
+		return
+	}
+	sfuConf.HLS.Dir = t.TempDir()
+	res := a.mustRequest("starthls", req)
+	if url, _ := res["url"].(string); !strings.HasSuffix(url, ".m3u8") {
+		t.Fatalf("starthls should return a playlist url, res is %v", res)
+	}
+	// 重复开启返回同一个地址
+	if again := a.mustRequest("starthls", req); again["url"] != res["url"] {
+		t.Fatalf("starthls again should return the same url, res is %v", again)
+	}
+	a.mustRequest("stophls", req)
+}
+
+func TestHLSNeedsOwnerOrHost(t *testing.T) {
+	a := dial(t, "hls_auth_a")
+	b := dial(t, "hls_auth_b")
+	a.join("room_hls_auth")
+	b.join("room_hls_auth")
+	p := a.publish("room_hls_auth")
+
+	// 不是发布者也不是主持人, 开启和关闭都不允许
+	req := map[string]interface{}{"rid": "room_hls_auth", "mid": p.mid, "sfuid": p.sfuid}
+	for _, method := range []string{"starthls", "stophls"} {
+		_, err := b.request(method, req)
+		var rerr *requestError
+		if !errors.As(err, &rerr) || rerr.Reason != "only stream owner or room host allowed" {
+			t.Fatalf("%s by another user should be rejected, err is %v", method, err)
+		}
+	}
+	// 不在房间中不能关闭
+	_, err := a.request("stophls", map[string]interface{}{"rid": "room_hls_other", "mid": p.mid, "sfuid": p.sfuid})
+	var rerr *requestError
+	if !errors.As(err, &rerr) || rerr.Reason != "rid not found" {
+		t.Fatalf("stophls outside the room should be rejected, err is %v", err)
+	}
+}
+
+func TestRTMPNeedsOwnerOrHost(t *testing.T) {
+	a := dial(t, "rtmp_auth_a")
+	b := dial(t, "rtmp_auth_b")
+	a.join("room_rtmp_auth")
+	b.join("room_rtmp_auth")
+	p := a.publish("room_rtmp_auth")
+
+	// 不是发布者也不是主持人, 在检查地址之前就拒绝
+	_, err := b.request("startrtmp", map[string]interface{}{"rid": "room_rtmp_auth", "mids": []string{p.mid}, "url": "rtmp://live.example.com/app/key"})
+	var rerr *requestError
+	if !errors.As(err, &rerr) || rerr.Reason != "only stream owner or room host allowed" {
+		t.Fatalf("startrtmp by another user should be rejected, err is %v", err)
+	}
+	// 停止和查询需要房间, 其他房间的推流查不到
+	for _, method := range []string{"stoprtmp", "rtmpstatus"} {
+		if _, err := a.request(method, map[string]interface{}{"eid": "rtmp_unknown", "sfuid": p.sfuid}); !errors.As(err, &rerr) || rerr.Reason != "rid not found" {
+			t.Fatalf("%s without rid should be rejected, err is %v", method, err)
+		}
+		if _, err := a.request(method, map[string]interface{}{"rid": "room_rtmp_auth", "eid": "rtmp_unknown", "sfuid": p.sfuid}); !errors.As(err, &rerr) || rerr.Code != 410 {
+			t.Fatalf("%s of an unknown eid should return 410, err is %v", method, err)
+		}
+	}
+}
+
+// rtmpListener 本地的RTMP服务, 完成握手后把收到的数据写到data
+type rtmpListener struct {
+	ln   net.Listener
+	data chan []byte
+}
+
+func newRTMPListener(t *testing.T) *rtmpListener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen rtmp err, err is %v", err)
+	}
+	l := &rtmpListener{ln: ln, data: make(chan []byte, 64)}
+	t.Cleanup(func() { ln.Close() })
+	go l.serve()
+	return l
+}
+
+// serve 接受连接并完成RTMP简单握手: 读C0C1, 回S0S1S2, 读C2
+func (l *rtmpListener) serve() {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			c0c1 := make([]byte, 1+1536)
+			if _, err := io.ReadFull(conn, c0c1); err != nil || c0c1[0] != 3 {
+				return
+			}
+			s := append([]byte{3}, make([]byte, 1536)...)
+			s = append(s, c0c1[1:]...)
+			if _, err := conn.Write(s); err != nil {
+				return
+			}
+			if _, err := io.ReadFull(conn, make([]byte, 1536)); err != nil {
+				return
+			}
+			buf := make([]byte, 4096)
+			for {
+				n, err := conn.Read(buf)
+				if n > 0 {
+					l.data <- append([]byte{}, buf[:n]...)
+				}
+				if err != nil {
+					return
+				}
+			}
+		}(conn)
+	}
+}
+
+func TestRTMPPushToLocalListener(t *testing.T) {
+	if _, err := exec.LookPath(sfuConf.FFmpeg.Path); err != nil {
+		t.Skip("ffmpeg not found")
+	}
+	l := newRTMPListener(t)
+	addr := l.ln.Addr().String()
+	allow := sfuConf.RTMP.Allow
+	sfuConf.RTMP.Allow = []string{addr}
+	t.Cleanup(func() { sfuConf.RTMP.Allow = allow })
+
+	a := dial(t, "rtmp_push_a")
+	b := dial(t, "rtmp_push_b")
+	a.join("room_rtmp_push")
+	b.join("room_rtmp_push")
+	p := a.publish("room_rtmp_push")
+
+	res := a.mustRequest("startrtmp", map[string]interface{}{"rid": "room_rtmp_push", "mids": []string{p.mid}, "url": "rtmp://" + addr + "/live/test"})
+	eid, _ := res["eid"].(string)
+	req := map[string]interface{}{"rid": "room_rtmp_push", "eid": eid, "sfuid": res["sfuid"]}
+	t.Cleanup(func() { a.request("stoprtmp", req) })
+
+	// 握手后ffmpeg发送connect命令, 说明推流连到了本地服务
+	var got []byte
+	deadline := time.After(mediaTimeout)
+	for !bytes.Contains(got, []byte("connect")) {
+		select {
+		case data := <-l.data:
+			got = append(got, data...)
+		case <-deadline:
+			t.Fatalf("rtmp listener got no connect command, got %d bytes", len(got))
+		}
+	}
+
+	if status := a.mustRequest("rtmpstatus", req); status["state"] != "running" || status["rid"] != "room_rtmp_push" {
+		t.Fatalf("rtmp should be running in the room, status is %v", status)
+	}
+	var rerr *requestError
+	for _, method := range []string{"rtmpstatus", "stoprtmp"} {
+		if _, err := b.request(method, req); !errors.As(err, &rerr) || rerr.Reason != "only stream owner or room host allowed" {
+			t.Fatalf("%s by another user should be rejected, err is %v", method, err)
+		}
+	}
+	a.mustRequest("stoprtmp", req)
+	if _, err := a.request("rtmpstatus", req); !errors.As(err, &rerr) || rerr.Code != 410 {
+		t.Fatalf("rtmp should be gone after stop, err is %v", err)
+	}
+}
@@ -0,0 +1,394 @@
+// e2e 端到端测试: 一个进程内启动register、sfu和signal, 依赖全部使用进程内实现,
+// 由脚本化的websocket客户端和pion客户端驱动, 不需要网络
+package e2e
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goRTCServer/pkg/bus"
+	"goRTCServer/pkg/discovery"
+	regConf "goRTCServer/server/register/conf"
+	regSrc "goRTCServer/server/register/src"
+	sfuConf "goRTCServer/server/sfu/conf"
+	"goRTCServer/server/sfu/rtc"
+	sfuSrc "goRTCServer/server/sfu/src"
+	signalConf "goRTCServer/server/signal/conf"
+	signalSrc "goRTCServer/server/signal/src"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+	"github.com/pion/logging"
+	"github.com/pion/transport/v2/vnet"
+)
+
+const (
+	requestTimeout = 20 * time.Second
+	notifyTimeout  = 10 * time.Second
+)
+
+var (
+	memBus    *bus.Memory
+	sfuNode   discovery.Registrar
+	signalRPC string
+	regRPC    string
+	wsURL     string
+	clientNet *vnet.Net
+)
+
+// TestMain 启动整个服务栈, 所有测试共用
+func TestMain(m *testing.M) {
+	os.Exit(run(m))
+}
+
+func run(m *testing.M) int {
+	if !regConf.Load("../../cfg/register.toml") || !sfuConf.Load("../../cfg/sfu.toml") || !signalConf.Load("../../cfg/signal.toml") {
+		fmt.Println("load config failed")
+		return 1
+	}
+	// 关闭需要监听端口的附加服务
+	regConf.Global.Pprof = ""
+	sfuConf.Global.Pprof = ""
+	signalConf.Global.Pprof = ""
+	sfuConf.TURN.Enable = false
+	sfuConf.HLS.HTTP = ""
+
+	// 存储使用进程内的redis
+	store, err := miniredis.Run()
+	if err != nil {
+		fmt.Printf("start memory redis err, err is %v\n", err)
+		return 1
+	}
+	defer store.Close()
+	regConf.Redis.Addrs = []string{store.Addr()}
+	regConf.Redis.Pwd = ""
+	regConf.Redis.DB = 0
+
+	// 媒体走pion虚拟网络, sfu和客户端各一个地址
+	wan, err := vnet.NewRouter(&vnet.RouterConfig{
+		CIDR:          "10.0.0.0/24",
+		MinDelay:      5 * time.Millisecond,
+		LoggerFactory: logging.NewDefaultLoggerFactory(),
+	})
+	if err != nil {
+		fmt.Printf("new virtual router err, err is %v\n", err)
+		return 1
+	}
+	sfuNet, err := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{"10.0.0.1"}})
+	if err == nil {
+		clientNet, err = vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{"10.0.0.2"}})
+	}
+	if err == nil {
+		err = wan.AddNet(sfuNet)
+	}
+	if err == nil {
+		err = wan.AddNet(clientNet)
+	}
+	if err == nil {
+		err = wan.Start()
+	}
+	if err != nil {
+		fmt.Printf("start virtual network err, err is %v\n", err)
+		return 1
+	}
+	defer wan.Stop()
+	rtc.SetVNet(sfuNet)
+
+	// 信令监听本机的空闲端口
+	port, err := freePort()
+	if err != nil {
+		fmt.Printf("get free port err, err is %v\n", err)
+		return 1
+	}
+	signalConf.Signal.Host = "127.0.0.1"
+	signalConf.Signal.Port = port
+	wsURL = "ws://127.0.0.1:" + port + "/ws"
+
+	memBus = bus.NewMemory()
+	defer memBus.Shutdown()
+	registry := discovery.NewMemory()
+	sfuNode = registry.NewNode(sfuConf.Global.NodeDC, sfuConf.Global.NodeID, sfuConf.Global.Name)
+	signalNode := registry.NewNode(signalConf.Global.NodeDC, signalConf.Global.NodeID, signalConf.Global.Name)
+	signalRPC = signalNode.GetRPCChannel()
+	regNode := registry.NewNode(regConf.Global.NodeDC, regConf.Global.NodeID, regConf.Global.Name)
+	regRPC = regNode.GetRPCChannel()
+	regSrc.StartWith(memBus, regNode)
+	sfuSrc.StartWith(memBus, sfuNode)
+	signalSrc.StartWith(memBus, signalNode, registry.NewWatcher())
+	defer func() {
+		signalSrc.Stop()
+		sfuSrc.Stop()
+		regSrc.Stop()
+	}()
+	if err := waitListen("127.0.0.1:"+port, 5*time.Second); err != nil {
+		fmt.Printf("signal not ready, err is %v\n", err)
+		return 1
+	}
+	return m.Run()
+}
+
+// freePort 获取本机一个空闲的TCP端口
+func freePort() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	return port, err
+}
+
+// waitListen 等待地址可以连接
+func waitListen(addr string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// message protoo消息, 请求、应答和通知共用
+type message struct {
+	Request      bool            `json:"request,omitempty"`
+	Response     bool            `json:"response,omitempty"`
+	Notification bool            `json:"notification,omitempty"`
+	ID           int             `json:"id,omitempty"`
+	Method       string          `json:"method,omitempty"`
+	OK           bool            `json:"ok,omitempty"`
+	Data         json.RawMessage `json:"data,omitempty"`
+	ErrorCode    int             `json:"errorCode,omitempty"`
+	ErrorReason  string          `json:"errorReason,omitempty"`
+}
+
+// requestError 信令拒绝请求
+type requestError struct {
+	Code   int
+	Reason string
+}
+
+func (e *requestError) Error() string {
+	return fmt.Sprintf("request rejected, code is %d, reason is %s", e.Code, e.Reason)
+}
+
+// client 脚本化的信令客户端
+type client struct {
+	t      *testing.T
+	uid    string
+	conn   *websocket.Conn
+	lock   sync.Mutex
+	nextID int
+	waits  map[int]chan message
+	notes  []message
+	poke   chan struct{}
+	closed chan struct{}
+}
+
+// dial 以uid连接信令, 测试结束时关闭
+func dial(t *testing.T, uid string) *client {
+	t.Helper()
+	return dialSession(t, uid, "")
+}
+
+// dialSession 以uid和session连接信令, session为空时使用默认会话
+func dialSession(t *testing.T, uid, session string) *client {
+	t.Helper()
+	url := wsURL + "?peer=" + uid
+	if session != "" {
+		url += "&session=" + session
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial signal err, err is %v, uid is %s", err, uid)
+	}
+	c := &client{
+		t:      t,
+		uid:    uid,
+		conn:   conn,
+		waits:  make(map[int]chan message),
+		poke:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	go c.readLoop()
+	t.Cleanup(func() { conn.Close() })
+	return c
+}
+
+// readLoop 读取应答和通知, 连接关闭后结束
+func (c *client) readLoop() {
+	defer close(c.closed)
+	for {
+		var msg message
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		c.lock.Lock()
+		if msg.Response {
+			if ch, ok := c.waits[msg.ID]; ok {
+				ch <- msg
+				delete(c.waits, msg.ID)
+			}
+		} else if msg.Notification {
+			c.notes = append(c.notes, msg)
+			select {
+			case c.poke <- struct{}{}:
+			default:
+			}
+		}
+		c.lock.Unlock()
+	}
+}
+
+// request 发送请求并等待应答
+func (c *client) request(method string, data map[string]interface{}) (map[string]interface{}, error) {
+	c.lock.Lock()
+	c.nextID++
+	id := c.nextID
+	ch := make(chan message, 1)
+	c.waits[id] = ch
+	err := c.conn.WriteJSON(map[string]interface{}{"request": true, "id": id, "method": method, "data": data})
+	c.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case msg := <-ch:
+		if !msg.OK {
+			return nil, &requestError{Code: msg.ErrorCode, Reason: msg.ErrorReason}
+		}
+		res := make(map[string]interface{})
+		if len(msg.Data) > 0 {
+			json.Unmarshal(msg.Data, &res)
+		}
+		return res, nil
+	case <-c.closed:
+		return nil, errors.New("connection closed")
+	case <-time.After(requestTimeout):
+		return nil, fmt.Errorf("request %s timeout", method)
+	}
+}
+
+// mustRequest 发送请求, 失败时结束测试
+func (c *client) mustRequest(method string, data map[string]interface{}) map[string]interface{} {
+	c.t.Helper()
+	res, err := c.request(method, data)
+	if err != nil {
+		c.t.Fatalf("%s %s err, err is %v", c.uid, method, err)
+	}
+	return res
+}
+
+// waitNotify 等待满足条件的通知, 不满足的通知保留给之后的等待
+func (c *client) waitNotify(method string, match func(map[string]interface{}) bool) map[string]interface{} {
+	c.t.Helper()
+	return c.waitNotifyFor(notifyTimeout, method, match)
+}
+
+// waitNotifyFor 在指定时间内等待满足条件的通知
+func (c *client) waitNotifyFor(timeout time.Duration, method string, match func(map[string]interface{}) bool) map[string]interface{} {
+	c.t.Helper()
+	deadline := time.After(timeout)
+	for {
+		c.lock.Lock()
+		for i, msg := range c.notes {
+			if msg.Method != method {
+				continue
+			}
+			data := make(map[string]interface{})
+			json.Unmarshal(msg.Data, &data)
+			if match == nil || match(data) {
+				c.notes = append(c.notes[:i], c.notes[i+1:]...)
+				c.lock.Unlock()
+				return data
+			}
+		}
+		c.lock.Unlock()
+		select {
+		case <-c.poke:
+		case <-deadline:
+			c.t.Fatalf("%s wait notification %s timeout", c.uid, method)
+		}
+	}
+}
+
+// waitClosed 等待服务端关闭连接
+func (c *client) waitClosed() {
+	c.t.Helper()
+	select {
+	case <-c.closed:
+	case <-time.After(notifyTimeout):
+		c.t.Fatalf("%s wait connection closed timeout", c.uid)
+	}
+}
+
+// join 加入房间
+func (c *client) join(rid string) map[string]interface{} {
+	c.t.Helper()
+	return c.mustRequest("join", map[string]interface{}{"rid": rid})
+}
+
+// users 房间内其他用户的uid
+func (c *client) users(rid string) []string {
+	c.t.Helper()
+	res := c.mustRequest("getusers", map[string]interface{}{"rid": rid})
+	return fieldList(res["users"], "uid")
+}
+
+// pubs 房间内其他用户发布的流的mid
+func (c *client) pubs(rid string) []string {
+	c.t.Helper()
+	res := c.mustRequest("getpubs", map[string]interface{}{"rid": rid})
+	return fieldList(res["pubs"], "mid")
+}
+
+// fieldList 获取对象列表中指定字段的值
+func fieldList(v interface{}, key string) []string {
+	list, _ := v.([]interface{})
+	res := make([]string, 0, len(list))
+	for _, item := range list {
+		if mp, ok := item.(map[string]interface{}); ok {
+			res = append(res, fmt.Sprint(mp[key]))
+		}
+	}
+	return res
+}
+
+// contains 判断列表中是否有指定的值
+func contains(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+// field 匹配通知中指定字段的值
+func field(key, value string) func(map[string]interface{}) bool {
+	return func(data map[string]interface{}) bool {
+		return fmt.Sprint(data[key]) == value
+	}
+}
+
+// eventually 在超时时间内等待条件成立
+func eventually(t *testing.T, timeout time.Duration, desc string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("wait %s timeout", desc)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,251 @@
+package e2e
+
+import (
+	"fmt"
+	"goRTCServer/pkg/proto"
+	"goRTCServer/server/sfu/rtc"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+const (
+	connectTimeout = 15 * time.Second
+	mediaTimeout   = 15 * time.Second
+	frameInterval  = 20 * time.Millisecond
+)
+
+// newAPI 新建使用虚拟网络的pion API
+func newAPI() *webrtc.API {
+	engine := &webrtc.MediaEngine{}
+	engine.RegisterDefaultCodecs()
+	setting := webrtc.SettingEngine{}
+	setting.SetVNet(clientNet)
+	return webrtc.NewAPI(webrtc.WithMediaEngine(engine), webrtc.WithSettingEngine(setting))
+}
+
+// offer 创建offer, 没有开启trickle, 等候选地址收集完再返回
+func offer(t *testing.T, pc *webrtc.PeerConnection) map[string]interface{} {
+	t.Helper()
+	desc, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("create offer err, err is %v", err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err = pc.SetLocalDescription(desc); err != nil {
+		t.Fatalf("set local description err, err is %v", err)
+	}
+	<-gathered
+	return map[string]interface{}{"type": "offer", "sdp": pc.LocalDescription().SDP}
+}
+
+// answer 设置信令返回的answer
+func answer(t *testing.T, pc *webrtc.PeerConnection, res map[string]interface{}) {
+	t.Helper()
+	jsep, _ := res["jsep"].(map[string]interface{})
+	sdp, _ := jsep["sdp"].(string)
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sdp}); err != nil {
+		t.Fatalf("set remote description err, err is %v", err)
+	}
+}
+
+// connected 连接建立后关闭的通道
+func connected(pc *webrtc.PeerConnection) chan struct{} {
+	ch := make(chan struct{})
+	var once sync.Once
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			once.Do(func() { close(ch) })
+		}
+	})
+	return ch
+}
+
+// waitConnected 等待连接建立
+func waitConnected(t *testing.T, ch chan struct{}) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(connectTimeout):
+		t.Fatalf("peer connection timeout")
+	}
+}
+
+// publisher 推送合成的Opus和VP8数据的推流端
+type publisher struct {
+	rid   string
+	uid   string
+	mid   string
+	sfuid string
+	pc    *webrtc.PeerConnection
+	stop  chan struct{}
+	once  sync.Once
+}
+
+// publish 发布一路音视频流, 连接建立后开始发送数据
+func (c *client) publish(rid string) *publisher {
+	c.t.Helper()
+	return c.publishWith(rid, nil)
+}
+
+// publishWith 发布一路音视频流, setup在创建offer之前调用, 可以添加数据通道
+func (c *client) publishWith(rid string, setup func(pc *webrtc.PeerConnection)) *publisher {
+	c.t.Helper()
+	pc, err := newAPI().NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		c.t.Fatalf("new peer connection err, err is %v", err)
+	}
+	c.t.Cleanup(func() { pc.Close() })
+	if setup != nil {
+		setup(pc)
+	}
+	audio, video := addTracks(c.t, pc, c.uid)
+	up := connected(pc)
+	res := c.mustRequest("publish", map[string]interface{}{
+		"rid":   rid,
+		"jsep":  offer(c.t, pc),
+		"minfo": map[string]interface{}{"audio": true, "video": true},
+	})
+	answer(c.t, pc, res)
+	waitConnected(c.t, up)
+
+	p := &publisher{
+		rid:   rid,
+		uid:   c.uid,
+		mid:   fmt.Sprint(res["mid"]),
+		sfuid: fmt.Sprint(res["sfuid"]),
+		pc:    pc,
+		stop:  make(chan struct{}),
+	}
+	c.t.Cleanup(p.stopMedia)
+	go p.send(audio, video)
+	// sfu收到数据后才有track, 之后才能订阅
+	eventually(c.t, mediaTimeout, "sfu receive tracks", func() bool {
+		router := rtc.GetRouter(proto.GetMediaPubKey(rid, c.uid, p.mid))
+		if router == nil {
+			return false
+		}
+		pub := router.GetPub()
+		return pub != nil && pub.AudioTrack() != nil && pub.VideoTrack() != nil
+	})
+	return p
+}
+
+// addTracks 添加一路Opus和一路VP8的track
+func addTracks(t *testing.T, pc *webrtc.PeerConnection, uid string) (audio, video *webrtc.TrackLocalStaticSample) {
+	t.Helper()
+	audio, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", uid)
+	if err != nil {
+		t.Fatalf("new audio track err, err is %v", err)
+	}
+	video, err = webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", uid)
+	if err != nil {
+		t.Fatalf("new video track err, err is %v", err)
+	}
+	for _, track := range []*webrtc.TrackLocalStaticSample{audio, video} {
+		if _, err = pc.AddTrack(track); err != nil {
+			t.Fatalf("add track err, err is %v", err)
+		}
+	}
+	return audio, video
+}
+
+// send 按帧间隔发送数据, 每个视频帧都是关键帧
+func (p *publisher) send(audio, video *webrtc.TrackLocalStaticSample) {
+	t := time.NewTicker(frameInterval)
+	defer t.Stop()
+	frame := make([]byte, 200)
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-t.C:
+			audio.WriteSample(media.Sample{Data: []byte{0xfc, 0xff, 0xfe}, Duration: frameInterval})
+			video.WriteSample(media.Sample{Data: frame, Duration: frameInterval})
+		}
+	}
+}
+
+// stopMedia 停止发送数据, 连接保持
+func (p *publisher) stopMedia() {
+	p.once.Do(func() { close(p.stop) })
+}
+
+// subscriber 统计收到的RTP包的拉流端
+type subscriber struct {
+	sid   string
+	pc    *webrtc.PeerConnection
+	audio int64
+	video int64
+}
+
+// subscribe 订阅流并等待连接建立
+func (c *client) subscribe(p *publisher) *subscriber {
+	c.t.Helper()
+	return c.subscribeWith(p, nil)
+}
+
+// subscribeWith 订阅流并等待连接建立, setup在创建offer之前调用, 可以添加数据通道
+func (c *client) subscribeWith(p *publisher, setup func(pc *webrtc.PeerConnection)) *subscriber {
+	c.t.Helper()
+	pc, err := newAPI().NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		c.t.Fatalf("new peer connection err, err is %v", err)
+	}
+	c.t.Cleanup(func() { pc.Close() })
+	if setup != nil {
+		setup(pc)
+	}
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		_, err = pc.AddTransceiverFromKind(kind, webrtc.RtpTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+		if err != nil {
+			c.t.Fatalf("add transceiver err, err is %v", err)
+		}
+	}
+	s := &subscriber{pc: pc}
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		counter := &s.audio
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			counter = &s.video
+		}
+		for {
+			if _, _, err := track.ReadRTP(); err != nil {
+				return
+			}
+			atomic.AddInt64(counter, 1)
+		}
+	})
+	up := connected(pc)
+	res := c.mustRequest("subscribe", map[string]interface{}{
+		"rid":   p.rid,
+		"mid":   p.mid,
+		"sfuid": p.sfuid,
+		"jsep":  offer(c.t, pc),
+	})
+	s.sid = fmt.Sprint(res["sid"])
+	answer(c.t, pc, res)
+	waitConnected(c.t, up)
+	return s
+}
+
+// waitMedia 等待音频和视频都收到RTP包
+func (s *subscriber) waitMedia(t *testing.T) {
+	t.Helper()
+	eventually(t, mediaTimeout, "rtp arrive", func() bool {
+		return atomic.LoadInt64(&s.audio) > 0 && atomic.LoadInt64(&s.video) > 0
+	})
+}
+
+// waitFlow 等待计数器的增长状态符合预期, flow为false时等待不再收到数据
+func waitFlow(t *testing.T, counter *int64, flow bool, desc string) {
+	t.Helper()
+	eventually(t, mediaTimeout, desc, func() bool {
+		before := atomic.LoadInt64(counter)
+		time.Sleep(10 * frameInterval)
+		return (atomic.LoadInt64(counter) > before) == flow
+	})
+}
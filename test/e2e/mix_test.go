@@ -0,0 +1,103 @@
+package e2e
+
+import (
+	"errors"
+	"fmt"
+	"goRTCServer/pkg/proto"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestStartMixRejectsPubsOnDifferentSfus(t *testing.T) {
+	a := dial(t, "mixsfu_a")
+	a.join("room_mixsfu")
+
+	// 房间内两路流分别在本sfu和另一个sfu上, 混音拿不到另一个sfu的流
+	reg := memBus.NewRequestor(regRPC)
+	for uid, sfuid := range map[string]string{"mixsfu_a": sfuNode.NodeInfo().NodeID, "mixsfu_b": "other_sfu"} {
+		_, err := reg.SyncRequest(proto.SignalToRegisterOnStreamAdd, map[string]interface{}{
+			"rid": "room_mixsfu", "uid": uid, "mid": uid + "#mixsfu", "sfuid": sfuid, "minfo": map[string]interface{}{"audio": true},
+		})
+		if err != nil {
+			t.Fatalf("stream add err, err is %v", err.Reason)
+		}
+	}
+
+	_, err := a.request("startmix", map[string]interface{}{"rid": "room_mixsfu"})
+	var rerr *requestError
+	if !errors.As(err, &rerr) || rerr.Reason != "room pubs are on different sfus" {
+		t.Fatalf("startmix should be rejected, err is %v", err)
+	}
+}
+
+func TestMixNeedsHost(t *testing.T) {
+	a := dial(t, "mixhost_a")
+	b := dial(t, "mixhost_b")
+	a.join("room_mixhost")
+	b.join("room_mixhost")
+
+	for _, method := range []string{"startmix", "stopmix"} {
+		_, err := b.request(method, map[string]interface{}{"rid": "room_mixhost"})
+		var rerr *requestError
+		if !errors.As(err, &rerr) || rerr.Reason != "only room host allowed" {
+			t.Fatalf("%s by non host should be rejected, err is %v", method, err)
+		}
+	}
+}
+
+func TestMixedAudio(t *testing.T) {
+	a := dial(t, "mixaudio_a")
+	b := dial(t, "mixaudio_b")
+	c := dial(t, "mixaudio_c")
+	a.join("room_mixaudio")
+	b.join("room_mixaudio")
+	c.join("room_mixaudio")
+	a.publish("room_mixaudio")
+	b.publish("room_mixaudio")
+
+	_, err := a.request("startmix", map[string]interface{}{"rid": "room_mixaudio", "topn": 2})
+	var rerr *requestError
+	if errors.As(err, &rerr) && strings.Contains(rerr.Reason, "without opus") {
+		t.Skip("sfu built without opus codec, run with -tags opus")
+	}
+	if err != nil {
+		t.Fatalf("startmix err, err is %v", err)
+	}
+	t.Cleanup(func() { a.request("stopmix", map[string]interface{}{"rid": "room_mixaudio"}) })
+
+	// 不发布的听众订阅一路混音, 应该收到sfu重新编码的opus
+	pc, err := newAPI().NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("new peer connection err, err is %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RtpTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	if err != nil {
+		t.Fatalf("add transceiver err, err is %v", err)
+	}
+	var packets int64
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		for {
+			pkt, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			if len(pkt.Payload) > 0 {
+				atomic.AddInt64(&packets, 1)
+			}
+		}
+	})
+	up := connected(pc)
+	res := c.mustRequest("submix", map[string]interface{}{"rid": "room_mixaudio", "jsep": offer(t, pc)})
+	if fmt.Sprint(res["sid"]) == "" {
+		t.Fatalf("submix should return sid, res is %v", res)
+	}
+	answer(t, pc, res)
+	waitConnected(t, up)
+	eventually(t, mediaTimeout, "mixed audio arrive", func() bool {
+		return atomic.LoadInt64(&packets) > 0
+	})
+}
@@ -0,0 +1,133 @@
+package e2e
+
+import (
+	"goRTCServer/pkg/proto"
+	"goRTCServer/server/sfu/rtc"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// disconnect 模拟推流端网络断开: 停止发送数据, sfu上的pub进入宽限期
+func disconnect(t *testing.T, p *publisher) *rtc.Router {
+	t.Helper()
+	router := rtc.GetRouter(proto.GetMediaPubKey(p.rid, p.uid, p.mid))
+	if router == nil || router.GetPub() == nil {
+		t.Fatalf("router not found, mid is %s", p.mid)
+	}
+	p.stopMedia()
+	p.pc.Close()
+	router.GetPub().OnPeerConnect(webrtc.PeerConnectionStateDisconnected)
+	return router
+}
+
+// reconnect 新建连接替换原来的推流连接, mid保持不变
+func (c *client) reconnect(p *publisher) (*publisher, error) {
+	c.t.Helper()
+	return c.reconnectWith(p, proto.ClientToSignalRestartICE)
+}
+
+// reconnectWith 使用指定的method重建推流连接
+func (c *client) reconnectWith(p *publisher, method string) (*publisher, error) {
+	c.t.Helper()
+	pc, err := newAPI().NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		c.t.Fatalf("new peer connection err, err is %v", err)
+	}
+	c.t.Cleanup(func() { pc.Close() })
+	audio, video := addTracks(c.t, pc, c.uid)
+	up := connected(pc)
+	res, err := c.request(method, map[string]interface{}{
+		"rid":   p.rid,
+		"mid":   p.mid,
+		"sfuid": p.sfuid,
+		"jsep":  offer(c.t, pc),
+	})
+	if err != nil {
+		return nil, err
+	}
+	answer(c.t, pc, res)
+	waitConnected(c.t, up)
+	np := &publisher{rid: p.rid, uid: p.uid, mid: p.mid, sfuid: p.sfuid, pc: pc, stop: make(chan struct{})}
+	c.t.Cleanup(np.stopMedia)
+	go np.send(audio, video)
+	return np, nil
+}
+
+func (s *subscriber) packets() int64 {
+	return atomic.LoadInt64(&s.audio) + atomic.LoadInt64(&s.video)
+}
+
+func TestReconnectWithinGrace(t *testing.T) {
+	a := dial(t, "reconn_a")
+	b := dial(t, "reconn_b")
+	a.join("room_reconn")
+	b.join("room_reconn")
+	p := a.publish("room_reconn")
+	s := b.subscribe(p)
+	s.waitMedia(t)
+
+	// 宽限期内保留Router和房间内的流信息
+	router := disconnect(t, p)
+	if !router.Alive() {
+		t.Fatal("router should be kept within the grace period")
+	}
+	if pubs := b.pubs("room_reconn"); !contains(pubs, p.mid) {
+		t.Fatalf("pubs should contain %s within the grace period, pubs is %v", p.mid, pubs)
+	}
+
+	// 新连接替换原来的连接, mid和Router不变, 订阅者继续收到数据
+	if _, err := a.reconnect(p); err != nil {
+		t.Fatalf("reconnect err, err is %v", err)
+	}
+	if rtc.GetRouter(proto.GetMediaPubKey(p.rid, p.uid, p.mid)) != router {
+		t.Fatal("router should be kept after reconnect")
+	}
+	before := s.packets()
+	eventually(t, mediaTimeout, "rtp arrive after reconnect", func() bool {
+		return s.packets() > before+10
+	})
+}
+
+func TestReconnectPCAlias(t *testing.T) {
+	a := dial(t, "reconn_alias_a")
+	b := dial(t, "reconn_alias_b")
+	a.join("room_reconn_alias")
+	b.join("room_reconn_alias")
+	p := a.publish("room_reconn_alias")
+	s := b.subscribe(p)
+	s.waitMedia(t)
+
+	// 旧名称reconnect_pc和restart_ice一样重建连接
+	disconnect(t, p)
+	if _, err := a.reconnectWith(p, proto.ClientToSignalReconnectPC); err != nil {
+		t.Fatalf("reconnect_pc err, err is %v", err)
+	}
+	before := s.packets()
+	eventually(t, mediaTimeout, "rtp arrive after reconnect_pc", func() bool {
+		return s.packets() > before+10
+	})
+}
+
+func TestReconnectAfterGrace(t *testing.T) {
+	if testing.Short() {
+		t.Skip("grace period takes more than 10 seconds")
+	}
+	a := dial(t, "regrace_a")
+	b := dial(t, "regrace_b")
+	a.join("room_regrace")
+	b.join("room_regrace")
+	p := a.publish("room_regrace")
+
+	// 宽限期内没有重建连接, sfu删除Router并通知房间内其他人
+	disconnect(t, p)
+	b.waitNotifyFor(20*time.Second, proto.SignalToClientOnStreamRemove, field("mid", p.mid))
+	if !routerGone(p)() {
+		t.Fatal("router should be removed after the grace period")
+	}
+	if _, err := a.reconnect(p); err == nil {
+		t.Fatalf("reconnect after the grace period should fail, mid is %s", p.mid)
+	}
+}
@@ -0,0 +1,156 @@
+package e2e
+
+import (
+	"goRTCServer/pkg/proto"
+	"goRTCServer/server/sfu/rtc"
+	"testing"
+	"time"
+)
+
+// routerGone 判断sfu上的Router已经被删除
+func routerGone(p *publisher) func() bool {
+	return func() bool {
+		return rtc.GetRouter(proto.GetMediaPubKey(p.rid, p.uid, p.mid)) == nil
+	}
+}
+
+func TestJoin(t *testing.T) {
+	a := dial(t, "join_a")
+	b := dial(t, "join_b")
+	a.join("room_join")
+	b.join("room_join")
+
+	a.waitNotify(proto.SignalToClientOnJoin, field("uid", "join_b"))
+	if users := a.users("room_join"); !contains(users, "join_b") {
+		t.Fatalf("users should contain join_b, users is %v", users)
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	a := dial(t, "media_a")
+	b := dial(t, "media_b")
+	a.join("room_media")
+	b.join("room_media")
+
+	p := a.publish("room_media")
+	b.waitNotify(proto.SignalToClientOnStreamAdd, field("mid", p.mid))
+	if pubs := b.pubs("room_media"); !contains(pubs, p.mid) {
+		t.Fatalf("pubs should contain %s, pubs is %v", p.mid, pubs)
+	}
+	s := b.subscribe(p)
+	s.waitMedia(t)
+	b.mustRequest("unsubscribe", map[string]interface{}{"rid": "room_media", "mid": p.mid, "sid": s.sid})
+}
+
+func TestUnpublish(t *testing.T) {
+	a := dial(t, "unpub_a")
+	b := dial(t, "unpub_b")
+	a.join("room_unpub")
+	b.join("room_unpub")
+
+	p := a.publish("room_unpub")
+	b.subscribe(p).waitMedia(t)
+	a.mustRequest("unpublish", map[string]interface{}{"rid": "room_unpub", "mid": p.mid, "sfuid": p.sfuid})
+
+	b.waitNotify(proto.SignalToClientOnStreamRemove, field("mid", p.mid))
+	if pubs := b.pubs("room_unpub"); contains(pubs, p.mid) {
+		t.Fatalf("pubs should not contain %s, pubs is %v", p.mid, pubs)
+	}
+	eventually(t, time.Second, "router removed", routerGone(p))
+}
+
+func TestLeave(t *testing.T) {
+	a := dial(t, "leave_a")
+	b := dial(t, "leave_b")
+	a.join("room_leave")
+	b.join("room_leave")
+
+	p := a.publish("room_leave")
+	a.mustRequest("leave", map[string]interface{}{"rid": "room_leave"})
+
+	b.waitNotify(proto.SignalToClientOnStreamRemove, field("mid", p.mid))
+	b.waitNotify(proto.SignalToClientOnLeave, field("uid", "leave_a"))
+	if users := b.users("room_leave"); contains(users, "leave_a") {
+		t.Fatalf("users should not contain leave_a, users is %v", users)
+	}
+	if pubs := b.pubs("room_leave"); contains(pubs, p.mid) {
+		t.Fatalf("pubs should not contain %s, pubs is %v", p.mid, pubs)
+	}
+
+	// 离开房间后连接保持, 可以重新加入
+	a.join("room_leave")
+	b.waitNotify(proto.SignalToClientOnJoin, field("uid", "leave_a"))
+}
+
+func TestKick(t *testing.T) {
+	a := dial(t, "kick_a")
+	b := dial(t, "kick_b")
+	a.join("room_kick")
+	b.join("room_kick")
+
+	// 用户在其他signal节点登录时, 由该节点通过RPC踢出
+	p := a.publish("room_kick")
+	_, err := memBus.NewRequestor(signalRPC).SyncRequest(proto.SignalToSignalOnKick, map[string]interface{}{"rid": "room_kick", "uid": "kick_a"})
+	if err != nil {
+		t.Fatalf("kick err, err is %v", err.Reason)
+	}
+
+	a.waitClosed()
+	b.waitNotify(proto.SignalToClientOnStreamRemove, field("mid", p.mid))
+	b.waitNotify(proto.SignalToClientOnLeave, field("uid", "kick_a"))
+	// 推流连接还在, sfu上的流也要删除
+	eventually(t, time.Second, "router removed", routerGone(p))
+	if users := b.users("room_kick"); contains(users, "kick_a") {
+		t.Fatalf("users should not contain kick_a, users is %v", users)
+	}
+}
+
+func TestRejoinKicksOldConnection(t *testing.T) {
+	old := dial(t, "rejoin_a")
+	old.join("room_rejoin")
+
+	c := dial(t, "rejoin_a")
+	c.join("room_rejoin")
+	old.waitClosed()
+	if _, err := c.request("keepalive", map[string]interface{}{"rid": "room_rejoin"}); err != nil {
+		t.Fatalf("keepalive after rejoin err, err is %v", err)
+	}
+}
+
+func TestSFUStreamRemove(t *testing.T) {
+	a := dial(t, "sfurm_a")
+	b := dial(t, "sfurm_b")
+	a.join("room_sfurm")
+	b.join("room_sfurm")
+
+	// sfu通知流被移除, signal清理数据库并通知房间内其他人
+	p := a.publish("room_sfurm")
+	memBus.NewBroadcaster(sfuNode.GetEventChannel()).Say(proto.SfuToSignalOnStreamRemove, map[string]interface{}{"rid": "room_sfurm", "uid": "sfurm_a", "mid": p.mid})
+
+	b.waitNotify(proto.SignalToClientOnStreamRemove, field("mid", p.mid))
+	if pubs := b.pubs("room_sfurm"); contains(pubs, p.mid) {
+		t.Fatalf("pubs should not contain %s, pubs is %v", p.mid, pubs)
+	}
+}
+
+func TestRouterTimeout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("router timeout takes more than 10 seconds")
+	}
+	a := dial(t, "timeout_a")
+	b := dial(t, "timeout_b")
+	a.join("room_timeout")
+	b.join("room_timeout")
+
+	// 推流端停止发送数据, sfu超时删除Router并通过sfu_stream_remove清理
+	p := a.publish("room_timeout")
+	p.stopMedia()
+
+	b.waitNotifyFor(20*time.Second, proto.SignalToClientOnStreamRemove, field("mid", p.mid))
+	if !routerGone(p)() {
+		t.Fatalf("router should be removed after timeout")
+	}
+	if pubs := b.pubs("room_timeout"); contains(pubs, p.mid) {
+		t.Fatalf("pubs should not contain %s, pubs is %v", p.mid, pubs)
+	}
+}
@@ -0,0 +1,99 @@
+package e2e
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func TestRTPForwardNeedsOwnerAndAllowList(t *testing.T) {
+	a := dial(t, "rtpfwd_a")
+	b := dial(t, "rtpfwd_b")
+	a.join("room_rtpfwd")
+	b.join("room_rtpfwd")
+	p := a.publish("room_rtpfwd")
+
+	// 不是发布者也不是主持人
+	_, err := b.request("rtp_forward", map[string]interface{}{"rid": "room_rtpfwd", "mid": p.mid, "host": "127.0.0.1", "port": 5004})
+	var rerr *requestError
+	if !errors.As(err, &rerr) || rerr.Reason != "only stream owner or room host allowed" {
+		t.Fatalf("rtp_forward by another user should be rejected, err is %v", err)
+	}
+
+	// 发布者转发, 但目标不在sfu的[rtp] forwardallow中
+	_, err = a.request("rtp_forward", map[string]interface{}{"rid": "room_rtpfwd", "mid": p.mid, "host": "127.0.0.1", "port": 5004})
+	if !errors.As(err, &rerr) || !strings.Contains(rerr.Reason, "not allowed") {
+		t.Fatalf("rtp_forward outside the allow list should be rejected, err is %v", err)
+	}
+}
+
+// sendRTP 按帧间隔向rtp_publish返回的端口发送opus和vp8关键帧
+func sendRTP(t *testing.T, res map[string]interface{}, stop chan struct{}) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen udp err, err is %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	port := func(kind string) *net.UDPAddr {
+		addr, _ := res[kind].(map[string]interface{})
+		return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(addr["rtpport"].(float64))}
+	}
+	audio, video := port("audio"), port("video")
+	go func() {
+		tick := time.NewTicker(frameInterval)
+		defer tick.Stop()
+		for seq := uint16(1); ; seq++ {
+			select {
+			case <-stop:
+				return
+			case <-tick.C:
+			}
+			ts := uint32(seq) * 960
+			pkt := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 111, SequenceNumber: seq, Timestamp: ts, SSRC: 1111}, Payload: []byte{0xfc, 0xff, 0xfe}}
+			data, _ := pkt.Marshal()
+			conn.WriteToUDP(data, audio)
+			// VP8描述符S=1, 帧头P位为0表示关键帧
+			pkt = &rtp.Packet{Header: rtp.Header{Version: 2, Marker: true, PayloadType: 96, SequenceNumber: seq, Timestamp: ts * 1800 / 960, SSRC: 2222}, Payload: []byte{0x10, 0x00, 0x00, 0x00}}
+			data, _ = pkt.Marshal()
+			conn.WriteToUDP(data, video)
+		}
+	}()
+}
+
+func TestRTPPublishReachesSubscriber(t *testing.T) {
+	a := dial(t, "rtppub_a")
+	b := dial(t, "rtppub_b")
+	a.join("room_rtppub")
+	b.join("room_rtppub")
+	res := a.mustRequest("rtp_publish", map[string]interface{}{
+		"rid":   "room_rtppub",
+		"minfo": map[string]interface{}{"audio": true, "video": true},
+	})
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	sendRTP(t, res, stop)
+
+	p := &publisher{rid: "room_rtppub", uid: a.uid, mid: fmt.Sprint(res["mid"]), sfuid: fmt.Sprint(res["sfuid"])}
+	s := b.subscribe(p)
+	s.waitMedia(t)
+}
+
+func TestRTPPublishRejectsStaticPayloadType(t *testing.T) {
+	a := dial(t, "rtppt_a")
+	a.join("room_rtppt")
+	_, err := a.request("rtp_publish", map[string]interface{}{
+		"rid":     "room_rtppt",
+		"minfo":   map[string]interface{}{"audio": true},
+		"audiopt": 0x08,
+	})
+	var rerr *requestError
+	if !errors.As(err, &rerr) || !strings.Contains(rerr.Reason, "payload type") {
+		t.Fatalf("rtp_publish with a static payload type should be rejected, err is %v", err)
+	}
+}
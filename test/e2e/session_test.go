@@ -0,0 +1,96 @@
+package e2e
+
+import (
+	"errors"
+	"fmt"
+	"goRTCServer/pkg/proto"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionReplaceUnpublishes(t *testing.T) {
+	old := dialSession(t, "replace_a", "s1")
+	b := dial(t, "replace_b")
+	old.join("room_replace")
+	b.join("room_replace")
+	p := old.publish("room_replace")
+
+	// 默认策略replace, 新会话加入后踢出旧会话, 旧会话的流从register和sfu上删除
+	c := dialSession(t, "replace_a", "s2")
+	c.join("room_replace")
+	old.waitClosed()
+	b.waitNotify(proto.SignalToClientOnStreamRemove, field("mid", p.mid))
+	eventually(t, time.Second, "router removed", routerGone(p))
+	if pubs := b.pubs("room_replace"); contains(pubs, p.mid) {
+		t.Fatalf("pubs should not contain %s, pubs is %v", p.mid, pubs)
+	}
+	if users := b.users("room_replace"); !contains(users, "replace_a") {
+		t.Fatalf("users should contain replace_a, users is %v", users)
+	}
+}
+
+func TestSessionMulti(t *testing.T) {
+	s1 := dialSession(t, "multi_a", "s1")
+	b := dial(t, "multi_b")
+	s1.join("room_multi")
+	s1.mustRequest("set_room", map[string]interface{}{"rid": "room_multi", "sessions": "multi"})
+	b.join("room_multi")
+
+	s2 := dialSession(t, "multi_a", "s2")
+	s2.join("room_multi")
+	// 同一用户的其他会话也会收到加入通知
+	s1.waitNotify(proto.SignalToClientOnJoin, field("session", "s2"))
+
+	// 不是最后一个会话离开时, 用户仍在房间内
+	s2.mustRequest("leave", map[string]interface{}{"rid": "room_multi"})
+	b.waitNotify(proto.SignalToClientOnLeave, field("session", "s2"))
+	if users := b.users("room_multi"); !contains(users, "multi_a") {
+		t.Fatalf("users should contain multi_a, users is %v", users)
+	}
+	if _, err := s1.request("keepalive", map[string]interface{}{"rid": "room_multi"}); err != nil {
+		t.Fatalf("keepalive of s1 err, err is %v", err)
+	}
+}
+
+func TestSessionReject(t *testing.T) {
+	s1 := dialSession(t, "reject_a", "s1")
+	s1.join("room_reject")
+	s1.mustRequest("set_room", map[string]interface{}{"rid": "room_reject", "sessions": "reject"})
+
+	// 已经有在线会话时拒绝, 同时加入的多个会话也只有一个成功
+	s1.mustRequest("leave", map[string]interface{}{"rid": "room_reject"})
+	clients := make([]*client, 4)
+	for i := range clients {
+		clients[i] = dialSession(t, "reject_a", fmt.Sprintf("c%d", i))
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(clients))
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, c *client) {
+			defer wg.Done()
+			_, errs[i] = c.request("join", map[string]interface{}{"rid": "room_reject"})
+		}(i, c)
+	}
+	wg.Wait()
+	joined := -1
+	for i, err := range errs {
+		var rerr *requestError
+		switch {
+		case err == nil && joined < 0:
+			joined = i
+		case err == nil:
+			t.Fatalf("only one session should join, %d and %d joined", joined, i)
+		case !errors.As(err, &rerr) || rerr.Code != 420:
+			t.Fatalf("join should be rejected with 420, err is %v", err)
+		}
+	}
+	if joined < 0 {
+		t.Fatalf("one session should join, errs is %v", errs)
+	}
+
+	// 在线的会话离开后其他会话可以加入
+	clients[joined].mustRequest("leave", map[string]interface{}{"rid": "room_reject"})
+	s1.join("room_reject")
+}
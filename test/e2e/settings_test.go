@@ -0,0 +1,36 @@
+package e2e
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSetRoomOnlyHost(t *testing.T) {
+	a := dial(t, "host_a")
+	b := dial(t, "host_b")
+
+	// 房间还没有人加入, 没有主持人, 不能抢先设置房间
+	_, err := b.request("set_room", map[string]interface{}{"rid": "room_host", "maxusers": 1})
+	var rerr *requestError
+	if !errors.As(err, &rerr) || rerr.Code != 413 {
+		t.Fatalf("set room before join should be rejected with 413, err is %v", err)
+	}
+
+	// 第一个加入的人成为主持人
+	a.join("room_host")
+	b.join("room_host")
+	_, err = b.request("set_room", map[string]interface{}{"rid": "room_host", "maxusers": 1})
+	if !errors.As(err, &rerr) || rerr.Code != 413 {
+		t.Fatalf("set room by non host should be rejected with 413, err is %v", err)
+	}
+
+	res := a.mustRequest("set_room", map[string]interface{}{"rid": "room_host", "maxusers": 5})
+	if !field("host", "host_a")(res) {
+		t.Fatalf("host should be host_a, res is %v", res)
+	}
+
+	// 主持人离开后重新加入仍然是主持人
+	a.mustRequest("leave", map[string]interface{}{"rid": "room_host"})
+	a.join("room_host")
+	a.mustRequest("set_room", map[string]interface{}{"rid": "room_host", "maxusers": 10})
+}